@@ -9,38 +9,56 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/liang/mqtt-app/backend/database"
 	"github.com/liang/mqtt-app/backend/models"
+	"gorm.io/gorm"
 )
 
+// GetAlerts 查询告警，查询条件见 alertQuery。
+// 传 limit 或 cursor 时使用游标分页，返回 next_cursor(没有下一页时为空)；
+// 传 page 或 page_size 时按页分页；都不传时返回最多 alertListMaxRows 条告警的数组
 func GetAlerts(c *gin.Context) {
 	userID := c.MustGet("userID").(uint)
 
+	q, err := parseAlertQuery(c.Request.URL.Query(), userID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	query := q.scope(database.DB.Model(&models.Alert{}))
+
+	// 游标分页
+	if q.paginating {
+		var alerts []models.Alert
+		if err := query.Scopes(q.order, q.page).Find(&alerts).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query alerts"})
+			return
+		}
+		nextCursor := ""
+		if len(alerts) > q.limit {
+			alerts = alerts[:q.limit]
+			nextCursor = q.encodeCursor(&alerts[len(alerts)-1])
+		}
+		c.JSON(http.StatusOK, gin.H{"data": alerts, "next_cursor": nextCursor})
+		return
+	}
+
 	// 获取查询参数
 	page := c.DefaultQuery("page", "0")
 	pageSize := c.DefaultQuery("page_size", "0")
-	typeParam := c.Query("type")
 
 	var pageNum, pageSizeNum int
 
 	// 如果提供了分页参数，进行分页查询
 	if page != "0" || pageSize != "0" {
 		// 解析页码
-		if page != "0" {
-			if p, err := strconv.Atoi(page); err == nil && p > 0 {
-				pageNum = p
-			} else {
-				pageNum = 1
-			}
+		if p, err := strconv.Atoi(page); err == nil && p > 0 {
+			pageNum = p
 		} else {
 			pageNum = 1
 		}
 
 		// 解析每页大小
-		if pageSize != "0" {
-			if ps, err := strconv.Atoi(pageSize); err == nil && ps > 0 {
-				pageSizeNum = ps
-			} else {
-				pageSizeNum = 10
-			}
+		if ps, err := strconv.Atoi(pageSize); err == nil && ps > 0 {
+			pageSizeNum = ps
 		} else {
 			pageSizeNum = 10
 		}
@@ -50,29 +68,11 @@ func GetAlerts(c *gin.Context) {
 		var alerts []models.Alert
 		var total int64
 
-		// 构建查询条件
-		query := database.DB.Model(&models.Alert{}).
-			Joins("JOIN devices ON devices.id = alerts.device_id").
-			Where("devices.user_id = ?", userID)
-
-		// 添加类型过滤条件
-		if typeParam != "" {
-			query = query.Where("alerts.type = ?", typeParam)
-		}
-
 		// 获取总数
-		query.Count(&total)
+		query.Session(&gorm.Session{}).Count(&total)
 
 		// 获取分页数据
-		dataQuery := database.DB.Joins("JOIN devices ON devices.id = alerts.device_id").
-			Where("devices.user_id = ?", userID)
-
-		// 添加类型过滤条件
-		if typeParam != "" {
-			dataQuery = dataQuery.Where("alerts.type = ?", typeParam)
-		}
-
-		dataQuery.Order("alerts.created_at DESC").
+		query.Scopes(q.order).
 			Offset(offset).
 			Limit(pageSizeNum).
 			Find(&alerts)
@@ -89,17 +89,9 @@ func GetAlerts(c *gin.Context) {
 		return
 	}
 
-	// 如果没有分页参数，返回全部数据
+	// 如果没有分页参数，返回最新的告警
 	var alerts []models.Alert
-	query := database.DB.Joins("JOIN devices ON devices.id = alerts.device_id").
-		Where("devices.user_id = ?", userID)
-
-	// 添加类型过滤条件
-	if typeParam != "" {
-		query = query.Where("alerts.type = ?", typeParam)
-	}
-
-	query.Order("alerts.created_at DESC").Find(&alerts)
+	query.Scopes(q.order).Limit(alertListMaxRows).Find(&alerts)
 
 	c.JSON(http.StatusOK, alerts)
 }
@@ -110,7 +102,7 @@ func GetUnreadAlerts(c *gin.Context) {
 	var count int64
 	database.DB.Model(&models.Alert{}).
 		Joins("JOIN devices ON devices.id = alerts.device_id").
-		Where("devices.user_id = ? AND alerts.read = ?", userID, false).
+		Where("devices.user_id = ? AND alerts.read = ? AND alerts.silenced = ?", userID, false, false).
 		Count(&count)
 
 	c.JSON(http.StatusOK, gin.H{"count": count})
@@ -135,29 +127,43 @@ func MarkAlertAsRead(c *gin.Context) {
 }
 
 func CreateAlert(c *gin.Context) {
-	var input models.Alert
+	var input struct {
+		models.Alert
+		ConfigID *uint `json:"config_id"` // 指定解析配置，为空时按设备绑定选择
+	}
 
 	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	alert := input.Alert
 
 	// Verify device belongs to user
 	userID := c.MustGet("userID").(uint)
 	var device models.Device
-	if err := database.DB.Where("id = ? AND user_id = ?", input.DeviceID, userID).First(&device).Error; err != nil {
+	if err := database.DB.Where("id = ? AND user_id = ?", alert.DeviceID, userID).First(&device).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
 		return
 	}
-	// 获取配置
-	var config models.MessageTypeConfig
-	if err := database.DB.Where("id = ? AND user_id = ?", input.Type, userID).First(&config).Error; err != nil {
+	// 获取配置: 指定的配置 > 设备/主题/设备组绑定 > 用户默认配置
+	var config *models.MessageTypeConfig
+	var err error
+	if input.ConfigID != nil {
+		config, err = userConfigByID(userID, *input.ConfigID)
+	} else {
+		config, _, err = resolveMessageConfig(&device, device.Topic)
+	}
+	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Message type config not found"})
 		return
 	}
+	if err := ensureConfigVersioned(config); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record config version"})
+		return
+	}
 
 	// 解析消息数据
-	parseData, err := parseMessageData(config.Format, input.RawData)
+	parseData, err := parseWithConfig(*config, alert.RawData)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -170,16 +176,18 @@ func CreateAlert(c *gin.Context) {
 		return
 	}
 
-	input.Timestamp = time.Now().Unix()
-	input.ParsedData = string(parsedDataJSON)
+	alert.Timestamp = time.Now().Unix()
+	alert.ParsedData = string(parsedDataJSON)
+	alert.ConfigID = config.ID
+	alert.ConfigVersion = config.Version
 
-	result := database.DB.Create(&input)
-	if result.Error != nil {
+	// 与设备上报的告警相同，经过去重、限流和静默后保存并发送通知
+	if _, err := saveAlert(&alert); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create alert"})
 		return
 	}
 
-	c.JSON(http.StatusOK, input)
+	c.JSON(http.StatusOK, alert)
 }
 
 func MarkAlertsAsRead(c *gin.Context) {
@@ -264,6 +272,9 @@ func DeleteAlert(c *gin.Context) {
 	}
 
 	database.DB.Delete(&alert)
+	database.DB.Where("alert_id = ?", alert.ID).Delete(&models.AlertComment{})
+	database.DB.Where("alert_id = ?", alert.ID).Delete(&models.AlertEvent{})
+	database.DB.Where("alert_id = ?", alert.ID).Delete(&models.AlertEscalation{})
 
 	c.JSON(http.StatusOK, gin.H{"message": "Alert deleted successfully"})
 }
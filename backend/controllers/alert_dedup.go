@@ -0,0 +1,181 @@
+package controllers
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+	"gorm.io/gorm"
+)
+
+const (
+	// alertDedupWindow 相同指纹的告警在该时长内重复发生时合并，超过后重新生成
+	alertDedupWindow = 24 * time.Hour
+	// alertRateWindow 设备告警限流的时间窗口
+	alertRateWindow = time.Minute
+	// alertRateLimit 每个设备在一个窗口内最多新建的告警数，合并到已有告警的不计入
+	alertRateLimit = 30
+)
+
+// alertSaveResult 保存告警的结果
+type alertSaveResult int
+
+const (
+	alertCreated      alertSaveResult = iota // 新建告警
+	alertDeduplicated                        // 合并到相同指纹的告警
+	alertSuppressed                          // 超出限流被抑制，计入告警风暴汇总
+)
+
+// alertFingerprint 告警指纹: 设备 + 规则(非规则告警为类型) + 级别
+func alertFingerprint(alert *models.Alert) string {
+	key := "type:" + alert.Type
+	if alert.RuleID != 0 {
+		key = fmt.Sprintf("rule:%d", alert.RuleID)
+	}
+	sum := sha1.Sum([]byte(fmt.Sprintf("%d|%s|%s", alert.DeviceID, key, alert.Level)))
+	return hex.EncodeToString(sum[:])
+}
+
+// alertRateState 设备当前限流窗口的计数
+type alertRateState struct {
+	start      time.Time
+	created    int
+	suppressed int
+}
+
+// alertSaver 串行化告警保存，保证去重查找与新建之间没有并发插入
+var alertSaver = struct {
+	sync.Mutex
+	rates map[uint]*alertRateState // device ID -> 限流窗口
+}{rates: make(map[uint]*alertRateState)}
+
+// saveAlert 保存告警: 存在相同指纹且未处理的告警时累加次数并更新最近发生时间和数据，
+// 否则按设备限流后新建，超出限制的告警不保存，计入设备的告警风暴汇总告警，alert 指向相同指纹的未处理告警。
+// 新建的告警(包括风暴汇总告警)发送通知并开始升级，匹配静默的告警标记为静默后照常保存，不发送通知
+func saveAlert(alert *models.Alert) (alertSaveResult, error) {
+	result, created, err := storeAlert(alert)
+	if created != nil && !created.Silenced {
+		notifyAlert(created)
+		startAlertEscalation(created)
+	}
+	return result, err
+}
+
+// storeAlert 去重、限流并保存告警，返回新建的告警
+func storeAlert(alert *models.Alert) (alertSaveResult, *models.Alert, error) {
+	if alert.Timestamp == 0 {
+		alert.Timestamp = time.Now().Unix()
+	}
+	alert.Fingerprint = alertFingerprint(alert)
+	alert.LastSeen = alert.Timestamp
+	if silence := matchSilence(alert); silence != nil {
+		alert.Silenced = true
+		alert.SilenceID = silence.ID
+	}
+
+	alertSaver.Lock()
+	defer alertSaver.Unlock()
+
+	merged, err := mergeDuplicateAlert(alert)
+	if err != nil || merged {
+		return alertDeduplicated, nil, err
+	}
+
+	rate := alertSaver.rates[alert.DeviceID]
+	now := time.Now()
+	if rate == nil || now.Sub(rate.start) >= alertRateWindow {
+		rate = &alertRateState{start: now}
+		alertSaver.rates[alert.DeviceID] = rate
+	}
+	if rate.created >= alertRateLimit {
+		rate.suppressed++
+		storm, err := recordAlertStorm(alert, rate)
+		if err != nil {
+			return alertSuppressed, nil, err
+		}
+		// 被抑制的告警不保存，alert 替换为相同指纹的最近一条未处理告警(如有)，
+		// 规则状态据此关联到已有告警而不是 ID 0
+		var existing models.Alert
+		err = database.DB.Where("fingerprint = ? AND state IN ?", alert.Fingerprint,
+			[]string{models.AlertStateOpen, models.AlertStateAcknowledged, ""}).
+			Order("id DESC").First(&existing).Error
+		switch {
+		case err == nil:
+			*alert = existing
+		case !errors.Is(err, gorm.ErrRecordNotFound):
+			return alertSuppressed, storm, err
+		}
+		return alertSuppressed, storm, nil
+	}
+
+	if err := database.DB.Create(alert).Error; err != nil {
+		return alertCreated, nil, err
+	}
+	rate.created++
+	return alertCreated, alert, nil
+}
+
+// mergeDuplicateAlert 查找相同指纹的未处理告警，找到时累加发生次数并用新告警的内容更新，
+// alert 被替换为合并后的告警。静默期间的告警与未静默的告警互不合并，静默结束后重新产生的告警照常通知
+func mergeDuplicateAlert(alert *models.Alert) (bool, error) {
+	var existing models.Alert
+	err := database.DB.Where("fingerprint = ? AND silenced = ? AND state IN ? AND last_seen >= ?", alert.Fingerprint, alert.Silenced,
+		[]string{models.AlertStateOpen, models.AlertStateAcknowledged, ""},
+		alert.LastSeen-int64(alertDedupWindow/time.Second)).
+		Order("id DESC").First(&existing).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := database.DB.Model(&existing).Updates(map[string]interface{}{
+		"occurrences":    gorm.Expr("occurrences + 1"),
+		"last_seen":      alert.LastSeen,
+		"message":        alert.Message,
+		"raw_data":       alert.RawData,
+		"parsed_data":    alert.ParsedData,
+		"config_id":      alert.ConfigID,
+		"config_version": alert.ConfigVersion,
+		"read":           false,
+	}).Error; err != nil {
+		return false, err
+	}
+	return true, database.DB.First(alert, existing.ID).Error
+}
+
+// recordAlertStorm 记录设备被抑制的告警: 每个设备保持一条未处理的风暴汇总告警，
+// 发生次数为累计抑制的告警数，新建汇总告警时返回该告警。被抑制的告警已静默时汇总告警也静默
+func recordAlertStorm(suppressed *models.Alert, rate *alertRateState) (*models.Alert, error) {
+	storm := models.Alert{
+		DeviceID: suppressed.DeviceID,
+		Type:     models.AlertTypeStorm,
+		Level:    models.AlertLevelHigh,
+		Message: fmt.Sprintf("Alert storm on device %d: more than %d alerts within %v, %d suppressed in current window",
+			suppressed.DeviceID, alertRateLimit, alertRateWindow, rate.suppressed),
+		Timestamp:     suppressed.Timestamp,
+		LastSeen:      suppressed.Timestamp,
+		RawData:       suppressed.RawData,
+		ParsedData:    suppressed.ParsedData,
+		ConfigID:      suppressed.ConfigID,
+		ConfigVersion: suppressed.ConfigVersion,
+		Silenced:      suppressed.Silenced,
+		SilenceID:     suppressed.SilenceID,
+	}
+	storm.Fingerprint = alertFingerprint(&storm)
+
+	merged, err := mergeDuplicateAlert(&storm)
+	if err != nil || merged {
+		return nil, err
+	}
+	if err := database.DB.Create(&storm).Error; err != nil {
+		return nil, err
+	}
+	return &storm, nil
+}
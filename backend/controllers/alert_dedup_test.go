@@ -0,0 +1,167 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+func TestSaveAlertDeduplication(t *testing.T) {
+	useTestDatabase(t)
+	alertSaver.rates = make(map[uint]*alertRateState)
+
+	newAlert := func(ts int64, raw string) *models.Alert {
+		return &models.Alert{DeviceID: 7, Type: "99", Level: "low", Timestamp: ts, RawData: raw}
+	}
+	for i, want := range []alertSaveResult{alertCreated, alertDeduplicated, alertDeduplicated} {
+		if got, err := saveAlert(newAlert(int64(1000+i), fmt.Sprint(i))); err != nil || got != want {
+			t.Fatalf("Save %d: got %v %v, want %v", i, got, err, want)
+		}
+	}
+
+	var alerts []models.Alert
+	database.DB.Find(&alerts)
+	if len(alerts) != 1 || alerts[0].Occurrences != 3 || alerts[0].Timestamp != 1000 || alerts[0].LastSeen != 1002 || alerts[0].RawData != "2" {
+		t.Fatalf("Expected one merged alert, got %+v", alerts)
+	}
+
+	// 不同级别的告警指纹不同
+	other := newAlert(1003, "")
+	other.Level = "high"
+	if got, _ := saveAlert(other); got != alertCreated {
+		t.Errorf("Expected alert with different level to be created, got %v", got)
+	}
+
+	// 已解决的告警不再合并
+	if err := transitionAlert(database.DB, &alerts[0], models.AlertActionResolve, 0, ""); err != nil {
+		t.Fatalf("Failed to resolve alert: %v", err)
+	}
+	if got, _ := saveAlert(newAlert(1004, "")); got != alertCreated {
+		t.Errorf("Expected new alert after resolve, got %v", got)
+	}
+
+	// 超出 24 小时的重复告警重新生成
+	if got, _ := saveAlert(newAlert(1004+int64(alertDedupWindow.Seconds())+1, "")); got != alertCreated {
+		t.Errorf("Expected new alert outside the dedup window, got %v", got)
+	}
+}
+
+func TestSaveAlertStorm(t *testing.T) {
+	useTestDatabase(t)
+	alertSaver.rates = make(map[uint]*alertRateState)
+
+	// 每条告警类型不同，无法合并，超出限流的部分被抑制
+	for i := 0; i < alertRateLimit+5; i++ {
+		want := alertCreated
+		if i >= alertRateLimit {
+			want = alertSuppressed
+		}
+		alert := &models.Alert{DeviceID: 3, Type: fmt.Sprintf("t%d", i), Level: "low", Timestamp: 2000}
+		if got, err := saveAlert(alert); err != nil || got != want {
+			t.Fatalf("Save %d: got %v %v, want %v", i, got, err, want)
+		}
+	}
+	// 其他设备不受影响
+	if got, _ := saveAlert(&models.Alert{DeviceID: 4, Type: "t", Level: "low"}); got != alertCreated {
+		t.Errorf("Expected alert for another device to be created, got %v", got)
+	}
+
+	var count int64
+	database.DB.Model(&models.Alert{}).Where("device_id = ? AND type <> ?", 3, models.AlertTypeStorm).Count(&count)
+	if count != alertRateLimit {
+		t.Errorf("Expected %d stored alerts, got %d", alertRateLimit, count)
+	}
+	var storm models.Alert
+	if err := database.DB.Where("device_id = ? AND type = ?", 3, models.AlertTypeStorm).First(&storm).Error; err != nil {
+		t.Fatalf("Expected storm alert: %v", err)
+	}
+	if storm.Occurrences != 5 || storm.Level != models.AlertLevelHigh {
+		t.Errorf("Unexpected storm alert: %+v", storm)
+	}
+}
+
+func TestSuppressedAlertID(t *testing.T) {
+	useTestDatabase(t)
+	alertSaver.rates = make(map[uint]*alertRateState)
+
+	// 超出合并窗口但仍未处理的规则告警
+	stale := &models.Alert{DeviceID: 5, Type: "rule", Level: "high", RuleID: 9, Timestamp: 1000}
+	if got, _ := saveAlert(stale); got != alertCreated {
+		t.Fatalf("Expected alert to be created, got %v", got)
+	}
+	now := 1000 + int64(alertDedupWindow.Seconds()) + 1
+	for i := 1; i < alertRateLimit; i++ {
+		saveAlert(&models.Alert{DeviceID: 5, Type: fmt.Sprintf("t%d", i), Level: "low", Timestamp: now})
+	}
+
+	suppressed := &models.Alert{DeviceID: 5, Type: "rule", Level: "high", RuleID: 9, Timestamp: now}
+	if got, err := saveAlert(suppressed); err != nil || got != alertSuppressed {
+		t.Fatalf("Expected alert to be suppressed, got %v %v", got, err)
+	}
+	if suppressed.ID != stale.ID {
+		t.Errorf("Expected suppressed alert to refer to alert %d, got %d", stale.ID, suppressed.ID)
+	}
+
+	// 没有相同指纹的未处理告警时不关联任何告警
+	other := &models.Alert{DeviceID: 5, Type: "rule", Level: "high", RuleID: 10, Timestamp: now}
+	if got, _ := saveAlert(other); got != alertSuppressed || other.ID != 0 {
+		t.Errorf("Expected suppressed alert without match to have no ID, got %v %d", got, other.ID)
+	}
+}
+
+func TestCreateAlertDeduplication(t *testing.T) {
+	useTestDatabase(t)
+	gin.SetMode(gin.TestMode)
+	alertSaver.rates = make(map[uint]*alertRateState)
+
+	device := models.Device{Name: "pump", Topic: "pump", UserID: 1}
+	database.DB.Create(&device)
+	config := models.MessageTypeConfig{UserID: 1, Name: "pump", Protocol: "mqtt", Format: mustFormatJSON(t, geoTestFormat)}
+	database.DB.Create(&config)
+
+	create := func() models.Alert {
+		t.Helper()
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		body := fmt.Sprintf(`{"device_id":%d,"config_id":%d,"type":"99","level":"high","message":"overheat","raw_data":"%s"}`,
+			device.ID, config.ID, geoTestPayload)
+		c.Request = httptest.NewRequest(http.MethodPost, "/api/alerts", strings.NewReader(body))
+		c.Request.Header.Set("Content-Type", "application/json")
+		c.Set("userID", uint(1))
+		CreateAlert(c)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected alert to be created, got %d: %s", w.Code, w.Body.String())
+		}
+		var alert models.Alert
+		json.Unmarshal(w.Body.Bytes(), &alert)
+		return alert
+	}
+
+	first, second := create(), create()
+	if first.ID == 0 || second.ID != first.ID || second.Occurrences != 2 {
+		t.Errorf("Expected repeated alert to be merged, got %+v and %+v", first, second)
+	}
+}
+
+func TestMergeDuplicateAlertError(t *testing.T) {
+	useTestDatabase(t)
+
+	alert := &models.Alert{DeviceID: 1, Type: "overheat", Level: models.AlertLevelHigh, Timestamp: 1000, LastSeen: 1000}
+	alert.Fingerprint = alertFingerprint(alert)
+	if merged, err := mergeDuplicateAlert(alert); merged || err != nil {
+		t.Fatalf("Expected no duplicate without error, got %v %v", merged, err)
+	}
+
+	// 查询失败不能当作没有重复告警，否则会再生成一条未处理告警
+	database.DB.Migrator().DropTable(&models.Alert{})
+	if merged, err := mergeDuplicateAlert(alert); merged || err == nil {
+		t.Errorf("Expected lookup error to be returned, got %v %v", merged, err)
+	}
+}
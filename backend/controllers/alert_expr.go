@@ -0,0 +1,630 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// 告警规则表达式:
+//   比较   temperature > 60、status == "fault"、voltage <= 3.3
+//   逻辑   &&、||、!(也可写作 and、or、not)，支持括号
+//   运算   + - * / %
+//   函数   abs(x)、has(field)、changed(field)、delta(field)
+// 字段名可使用 a.b 访问嵌套字段。表达式末尾的 "for 5m" 表示条件需持续成立的时长。
+
+// errFieldMissing 消息中没有表达式引用的字段，本条消息不参与该规则的计算
+var errFieldMissing = errors.New("field missing")
+
+// ruleExprMaxLength 表达式长度上限
+const ruleExprMaxLength = 1024
+
+// ruleExpr 已编译的规则表达式
+type ruleExpr struct {
+	source  string
+	root    exprNode
+	fields  []string      // 引用的字段，用于生成告警消息
+	history []string      // changed/delta 引用的字段，需要保存上一条消息中的值
+	hold    time.Duration // for 子句指定的持续时长
+}
+
+// exprEnv 表达式计算环境
+type exprEnv struct {
+	fields   map[string]interface{}
+	previous map[string]interface{} // 上一条消息中的字段值，没有历史时为空
+}
+
+type exprNode interface {
+	eval(env *exprEnv) (interface{}, error)
+}
+
+var ruleHoldPattern = regexp.MustCompile(`(?i)\s+for\s+(\S+)\s*$`)
+
+// compileRuleExpr 编译规则表达式，末尾可带 for <时长>
+func compileRuleExpr(source string) (*ruleExpr, error) {
+	source = strings.TrimSpace(source)
+	if source == "" {
+		return nil, errors.New("expression is empty")
+	}
+	if len(source) > ruleExprMaxLength {
+		return nil, fmt.Errorf("expression exceeds %d characters", ruleExprMaxLength)
+	}
+
+	expr := &ruleExpr{source: source}
+	body := source
+	if m := ruleHoldPattern.FindStringSubmatchIndex(source); m != nil {
+		hold, err := time.ParseDuration(source[m[2]:m[3]])
+		if err != nil || hold <= 0 {
+			return nil, fmt.Errorf("invalid duration %q in for clause", source[m[2]:m[3]])
+		}
+		expr.hold = hold
+		body = source[:m[0]]
+	}
+
+	tokens, err := tokenizeExpr(body)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens, expr: expr}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+	}
+	expr.root = root
+	return expr, nil
+}
+
+// eval 计算表达式的布尔结果
+func (e *ruleExpr) eval(env *exprEnv) (bool, error) {
+	value, err := e.root.eval(env)
+	if err != nil {
+		return false, err
+	}
+	result, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression must evaluate to a boolean, got %v", value)
+	}
+	return result, nil
+}
+
+// --- 词法分析 ---
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNumber
+	tokenString
+	tokenIdent
+	tokenOp
+)
+
+type exprToken struct {
+	kind tokenKind
+	text string
+	num  float64
+	pos  int
+}
+
+func tokenizeExpr(src string) ([]exprToken, error) {
+	var tokens []exprToken
+	for i := 0; i < len(src); {
+		ch := rune(src[i])
+		switch {
+		case unicode.IsSpace(ch):
+			i++
+		case ch >= '0' && ch <= '9' || ch == '.' && i+1 < len(src) && src[i+1] >= '0' && src[i+1] <= '9':
+			start := i
+			for i < len(src) && (src[i] >= '0' && src[i] <= '9' || src[i] == '.' || src[i] == 'e' || src[i] == 'E' ||
+				(src[i] == '+' || src[i] == '-') && (src[i-1] == 'e' || src[i-1] == 'E')) {
+				i++
+			}
+			num, err := strconv.ParseFloat(src[start:i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q at position %d", src[start:i], start)
+			}
+			tokens = append(tokens, exprToken{kind: tokenNumber, text: src[start:i], num: num, pos: start})
+		case ch == '"' || ch == '\'':
+			start := i
+			i++
+			var sb strings.Builder
+			for i < len(src) && rune(src[i]) != ch {
+				if src[i] == '\\' && i+1 < len(src) {
+					i++
+				}
+				sb.WriteByte(src[i])
+				i++
+			}
+			if i >= len(src) {
+				return nil, fmt.Errorf("unterminated string at position %d", start)
+			}
+			i++
+			tokens = append(tokens, exprToken{kind: tokenString, text: sb.String(), pos: start})
+		case ch == '_' || ch >= 0x80 || unicode.IsLetter(ch):
+			start := i
+			for i < len(src) && (src[i] == '_' || src[i] == '.' || src[i] >= 0x80 ||
+				unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i]))) {
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: tokenIdent, text: src[start:i], pos: start})
+		default:
+			op := src[i : i+1]
+			if i+1 < len(src) {
+				switch two := src[i : i+2]; two {
+				case ">=", "<=", "==", "!=", "&&", "||":
+					op = two
+				}
+			}
+			if !strings.Contains("><=!&|+-*/%(),", op[:1]) || op == "=" || op == "&" || op == "|" {
+				return nil, fmt.Errorf("unexpected %q at position %d", op, i)
+			}
+			tokens = append(tokens, exprToken{kind: tokenOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(tokens, exprToken{kind: tokenEOF, text: "end of expression", pos: len(src)}), nil
+}
+
+// --- 语法分析 ---
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+	expr   *ruleExpr
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// accept 当前记号是指定运算符或关键字之一时读取并返回
+func (p *exprParser) accept(ops ...string) (string, bool) {
+	tok := p.peek()
+	if tok.kind != tokenOp && tok.kind != tokenIdent {
+		return "", false
+	}
+	for _, op := range ops {
+		if tok.text == op || tok.kind == tokenIdent && strings.EqualFold(tok.text, op) {
+			p.next()
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("||", "or"); !ok {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicNode{or: true, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("&&", "and"); !ok {
+			return left, nil
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicNode{left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseNot() (exprNode, error) {
+	if _, ok := p.accept("!", "not"); ok {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand: operand}, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *exprParser) parseCompare() (exprNode, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	if op, ok := p.accept(">=", "<=", "==", "!=", ">", "<"); ok {
+		right, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		return &compareNode{op: op, left: left, right: right}, nil
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAdditive() (exprNode, error) {
+	left, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept("+", "-")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		left = &arithNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseMultiplicative() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept("*", "/", "%")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &arithNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if _, ok := p.accept("-"); ok {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &arithNode{op: "-", left: literalNode{value: 0.0}, right: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokenNumber:
+		return literalNode{value: tok.num}, nil
+	case tokenString:
+		return literalNode{value: tok.text}, nil
+	case tokenIdent:
+		switch strings.ToLower(tok.text) {
+		case "true":
+			return literalNode{value: true}, nil
+		case "false":
+			return literalNode{value: false}, nil
+		}
+		if _, ok := p.accept("("); ok {
+			return p.parseCall(tok)
+		}
+		p.expr.addField(tok.text)
+		return fieldNode{name: tok.text}, nil
+	case tokenOp:
+		if tok.text == "(" {
+			node, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := p.accept(")"); !ok {
+				return nil, fmt.Errorf("missing ')' at position %d", p.peek().pos)
+			}
+			return node, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+}
+
+// parseCall 解析函数调用，changed/delta/has 的参数必须是字段名
+func (p *exprParser) parseCall(name exprToken) (exprNode, error) {
+	fn := strings.ToLower(name.text)
+	switch fn {
+	case "changed", "delta", "has":
+		arg := p.next()
+		if arg.kind != tokenIdent {
+			return nil, fmt.Errorf("%s() expects a field name at position %d", fn, arg.pos)
+		}
+		if _, ok := p.accept(")"); !ok {
+			return nil, fmt.Errorf("missing ')' at position %d", p.peek().pos)
+		}
+		p.expr.addField(arg.text)
+		if fn != "has" {
+			p.expr.addHistory(arg.text)
+		}
+		return fieldFuncNode{fn: fn, field: arg.text}, nil
+	case "abs":
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.accept(")"); !ok {
+			return nil, fmt.Errorf("missing ')' at position %d", p.peek().pos)
+		}
+		return &absNode{operand: arg}, nil
+	}
+	return nil, fmt.Errorf("unknown function %s() at position %d", name.text, name.pos)
+}
+
+func (e *ruleExpr) addField(name string) {
+	for _, f := range e.fields {
+		if f == name {
+			return
+		}
+	}
+	e.fields = append(e.fields, name)
+}
+
+func (e *ruleExpr) addHistory(name string) {
+	for _, f := range e.history {
+		if f == name {
+			return
+		}
+	}
+	e.history = append(e.history, name)
+}
+
+// --- 计算 ---
+
+// lookupField 按字段名读取值，名称不存在时按 . 分隔访问嵌套对象
+func lookupField(fields map[string]interface{}, name string) (interface{}, bool) {
+	if value, ok := fields[name]; ok {
+		return value, value != nil
+	}
+	var current interface{} = fields
+	for _, part := range strings.Split(name, ".") {
+		obj, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = obj[part]; !ok {
+			return nil, false
+		}
+	}
+	return current, current != nil
+}
+
+// exprValue 将字段值转换为表达式值: 数值为 float64，其余为 bool 或 string
+func exprValue(value interface{}) interface{} {
+	if f, ok := numericFloat(value); ok {
+		return f
+	}
+	switch v := value.(type) {
+	case bool, string:
+		return v
+	case uint:
+		return float64(v)
+	}
+	return fmt.Sprint(value)
+}
+
+type literalNode struct{ value interface{} }
+
+func (n literalNode) eval(*exprEnv) (interface{}, error) { return n.value, nil }
+
+type fieldNode struct{ name string }
+
+func (n fieldNode) eval(env *exprEnv) (interface{}, error) {
+	value, ok := lookupField(env.fields, n.name)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errFieldMissing, n.name)
+	}
+	return exprValue(value), nil
+}
+
+type fieldFuncNode struct{ fn, field string }
+
+func (n fieldFuncNode) eval(env *exprEnv) (interface{}, error) {
+	current, ok := lookupField(env.fields, n.field)
+	if n.fn == "has" {
+		return ok, nil
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errFieldMissing, n.field)
+	}
+	previous, hasPrevious := env.previous[n.field]
+	switch n.fn {
+	case "changed":
+		// 第一条消息没有历史值，不视为变化
+		return hasPrevious && exprValue(previous) != exprValue(current), nil
+	default:
+		cur, ok := exprValue(current).(float64)
+		if !ok {
+			return nil, fmt.Errorf("delta(%s): field is not numeric", n.field)
+		}
+		prev, ok := exprValue(previous).(float64)
+		if !hasPrevious || !ok {
+			return 0.0, nil
+		}
+		return cur - prev, nil
+	}
+}
+
+type notNode struct{ operand exprNode }
+
+func (n *notNode) eval(env *exprEnv) (interface{}, error) {
+	value, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return nil, fmt.Errorf("'!' expects a boolean, got %v", value)
+	}
+	return !b, nil
+}
+
+type logicNode struct {
+	or          bool
+	left, right exprNode
+}
+
+func (n *logicNode) eval(env *exprEnv) (interface{}, error) {
+	operand := func(node exprNode) (bool, error) {
+		value, err := node.eval(env)
+		if err != nil {
+			return false, err
+		}
+		b, ok := value.(bool)
+		if !ok {
+			return false, fmt.Errorf("logical operator expects a boolean, got %v", value)
+		}
+		return b, nil
+	}
+
+	left, err := operand(n.left)
+	if err != nil {
+		return nil, err
+	}
+	if left == n.or {
+		return left, nil
+	}
+	return operand(n.right)
+}
+
+type compareNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n *compareNode) eval(env *exprEnv) (interface{}, error) {
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	var cmp int
+	switch l := left.(type) {
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare number %v with %v", l, right)
+		}
+		switch {
+		case l < r:
+			cmp = -1
+		case l > r:
+			cmp = 1
+		}
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare string %q with %v", l, right)
+		}
+		cmp = strings.Compare(l, r)
+	case bool:
+		r, ok := right.(bool)
+		if !ok || n.op != "==" && n.op != "!=" {
+			return nil, fmt.Errorf("booleans only support == and !=")
+		}
+		if l != r {
+			cmp = 1
+		}
+	}
+
+	switch n.op {
+	case ">":
+		return cmp > 0, nil
+	case ">=":
+		return cmp >= 0, nil
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case "==":
+		return cmp == 0, nil
+	default:
+		return cmp != 0, nil
+	}
+}
+
+type arithNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n *arithNode) eval(env *exprEnv) (interface{}, error) {
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	l, lok := left.(float64)
+	r, rok := right.(float64)
+	if !lok || !rok {
+		return nil, fmt.Errorf("'%s' expects numbers, got %v and %v", n.op, left, right)
+	}
+
+	switch n.op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		if r == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return l / r, nil
+	default:
+		if r == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return math.Mod(l, r), nil
+	}
+}
+
+type absNode struct{ operand exprNode }
+
+func (n *absNode) eval(env *exprEnv) (interface{}, error) {
+	value, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := value.(float64)
+	if !ok {
+		return nil, fmt.Errorf("abs() expects a number, got %v", value)
+	}
+	return math.Abs(f), nil
+}
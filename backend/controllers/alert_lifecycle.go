@@ -0,0 +1,323 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+	"gorm.io/gorm"
+)
+
+// alertTransition 告警状态转换: 允许的起始状态及目标状态
+type alertTransition struct {
+	from []string
+	to   string
+}
+
+// alertTransitions 各操作对应的状态转换: open → acknowledged → resolved，
+// 规则恢复时 open/acknowledged 自动转为 cleared，resolved/cleared 可重新打开
+var alertTransitions = map[string]alertTransition{
+	models.AlertActionAcknowledge: {from: []string{models.AlertStateOpen}, to: models.AlertStateAcknowledged},
+	models.AlertActionResolve:     {from: []string{models.AlertStateOpen, models.AlertStateAcknowledged}, to: models.AlertStateResolved},
+	models.AlertActionClear:       {from: []string{models.AlertStateOpen, models.AlertStateAcknowledged}, to: models.AlertStateCleared},
+	models.AlertActionReopen:      {from: []string{models.AlertStateResolved, models.AlertStateCleared}, to: models.AlertStateOpen},
+}
+
+// errInvalidAlertTransition 告警当前状态不允许该操作
+var errInvalidAlertTransition = errors.New("invalid alert state transition")
+
+// alertState 告警的处理状态，引入状态之前的告警视为 open
+func alertState(alert *models.Alert) string {
+	if alert.State == "" {
+		return models.AlertStateOpen
+	}
+	return alert.State
+}
+
+// recordAlertEvent 保存告警处理记录，userID 为 0 表示系统操作
+func recordAlertEvent(tx *gorm.DB, alertID, userID uint, action, fromState, toState, detail string) error {
+	event := models.AlertEvent{
+		AlertID:   alertID,
+		UserID:    userID,
+		Action:    action,
+		FromState: fromState,
+		ToState:   toState,
+		Detail:    detail,
+	}
+	if userID != 0 {
+		var user models.User
+		tx.Select("username").First(&user, userID)
+		event.Username = user.Username
+	}
+	if len(event.Detail) > 255 {
+		event.Detail = event.Detail[:255]
+	}
+	return tx.Create(&event).Error
+}
+
+// transitionAlert 执行状态转换并记录处理记录，告警状态已被其他请求修改时返回 errInvalidAlertTransition
+func transitionAlert(tx *gorm.DB, alert *models.Alert, action string, userID uint, detail string) error {
+	transition, ok := alertTransitions[action]
+	if !ok {
+		return fmt.Errorf("unknown alert action %q", action)
+	}
+	from := alertState(alert)
+	allowed := false
+	for _, state := range transition.from {
+		if state == from {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("%w: cannot %s an alert in state %s", errInvalidAlertTransition, action, from)
+	}
+
+	now := time.Now().Unix()
+	updates := map[string]interface{}{"state": transition.to}
+	switch action {
+	case models.AlertActionAcknowledge:
+		updates["acknowledged_at"] = now
+		updates["acknowledged_by"] = userID
+		updates["read"] = true
+	case models.AlertActionResolve, models.AlertActionClear:
+		updates["resolved_at"] = now
+		updates["resolved_by"] = userID
+		if action == models.AlertActionResolve {
+			updates["read"] = true
+		}
+	case models.AlertActionReopen:
+		updates["acknowledged_at"] = 0
+		updates["acknowledged_by"] = 0
+		updates["resolved_at"] = 0
+		updates["resolved_by"] = 0
+	}
+
+	err := tx.Transaction(func(tx *gorm.DB) error {
+		// 仅在状态仍为读取时的状态时更新，并发的相同操作只有一个成功并记录处理记录
+		result := tx.Model(alert).Where("COALESCE(state, '') = ?", alert.State).Updates(updates)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("%w: alert state was changed by another request", errInvalidAlertTransition)
+		}
+		if err := updateAlertEscalation(tx, alert.ID, action); err != nil {
+			return err
+		}
+		return recordAlertEvent(tx, alert.ID, userID, action, from, transition.to, detail)
+	})
+	if err == nil && action == models.AlertActionReopen {
+		wakeEscalations()
+	}
+	return err
+}
+
+// clearRuleAlert 规则恢复后自动清除其生成的告警，告警已被处理时不变
+func clearRuleAlert(alertID uint, detail string) {
+	var alert models.Alert
+	if err := database.DB.First(&alert, alertID).Error; err != nil {
+		return
+	}
+	err := transitionAlert(database.DB, &alert, models.AlertActionClear, 0, detail)
+	if err != nil && !errors.Is(err, errInvalidAlertTransition) {
+		log.Printf("Failed to clear alert %d: %v", alertID, err)
+	}
+}
+
+// userAlert 获取属于当前用户设备的告警，不存在时返回 404
+func userAlert(c *gin.Context) (*models.Alert, bool) {
+	userID := c.MustGet("userID").(uint)
+
+	var alert models.Alert
+	if err := database.DB.Joins("JOIN devices ON devices.id = alerts.device_id").
+		Where("alerts.id = ? AND devices.user_id = ?", c.Param("id"), userID).
+		First(&alert).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Alert not found"})
+		return nil, false
+	}
+	return &alert, true
+}
+
+// addAlertComment 保存评论并记录处理记录
+func addAlertComment(tx *gorm.DB, alert *models.Alert, userID uint, body string) (*models.AlertComment, error) {
+	comment := models.AlertComment{AlertID: alert.ID, UserID: userID, Body: body}
+	var user models.User
+	tx.Select("username").First(&user, userID)
+	comment.Username = user.Username
+
+	err := tx.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&comment).Error; err != nil {
+			return err
+		}
+		state := alertState(alert)
+		return recordAlertEvent(tx, alert.ID, userID, models.AlertActionComment, state, state, body)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &comment, nil
+}
+
+// handleAlertTransition 执行告警操作，请求体可带 comment 同时添加评论
+func handleAlertTransition(c *gin.Context, action string) {
+	userID := c.MustGet("userID").(uint)
+	alert, ok := userAlert(c)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Comment string `json:"comment"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	comment := strings.TrimSpace(input.Comment)
+
+	if err := transitionAlert(database.DB, alert, action, userID, comment); err != nil {
+		if errors.Is(err, errInvalidAlertTransition) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update alert"})
+		return
+	}
+	if comment != "" {
+		if _, err := addAlertComment(database.DB, alert, userID, comment); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add comment"})
+			return
+		}
+	}
+
+	database.DB.First(alert, alert.ID)
+	c.JSON(http.StatusOK, gin.H{"data": alert})
+}
+
+// AcknowledgeAlert 确认告警
+func AcknowledgeAlert(c *gin.Context) {
+	handleAlertTransition(c, models.AlertActionAcknowledge)
+}
+
+// ResolveAlert 解决告警
+func ResolveAlert(c *gin.Context) {
+	handleAlertTransition(c, models.AlertActionResolve)
+}
+
+// ReopenAlert 重新打开已解决或已清除的告警
+func ReopenAlert(c *gin.Context) {
+	handleAlertTransition(c, models.AlertActionReopen)
+}
+
+// AssignAlert 指定告警处理人，assignee_id 为空时取消指派
+func AssignAlert(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	alert, ok := userAlert(c)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		AssigneeID *uint `json:"assignee_id"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	detail := "unassigned"
+	if input.AssigneeID != nil {
+		var assignee models.User
+		if err := database.DB.Select("id, username").First(&assignee, *input.AssigneeID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Assignee not found"})
+			return
+		}
+		detail = "assigned to " + assignee.Username
+	}
+
+	state := alertState(alert)
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(alert).Update("assignee_id", input.AssigneeID).Error; err != nil {
+			return err
+		}
+		return recordAlertEvent(tx, alert.ID, userID, models.AlertActionAssign, state, state, detail)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to assign alert"})
+		return
+	}
+	alert.AssigneeID = input.AssigneeID
+
+	c.JSON(http.StatusOK, gin.H{"data": alert})
+}
+
+// GetAlertComments 获取告警评论
+func GetAlertComments(c *gin.Context) {
+	alert, ok := userAlert(c)
+	if !ok {
+		return
+	}
+
+	var comments []models.AlertComment
+	if err := database.DB.Where("alert_id = ?", alert.ID).Order("id").Find(&comments).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get comments"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": comments})
+}
+
+// AddAlertComment 添加告警评论
+func AddAlertComment(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	alert, ok := userAlert(c)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Body string `json:"body" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	body := strings.TrimSpace(input.Body)
+	if body == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Comment body is required"})
+		return
+	}
+
+	comment, err := addAlertComment(database.DB, alert, userID, body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add comment"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": comment})
+}
+
+// GetAlertEvents 获取告警处理记录
+func GetAlertEvents(c *gin.Context) {
+	alert, ok := userAlert(c)
+	if !ok {
+		return
+	}
+
+	var events []models.AlertEvent
+	if err := database.DB.Where("alert_id = ?", alert.ID).Order("id").Find(&events).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get alert events"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": events})
+}
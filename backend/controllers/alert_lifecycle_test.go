@@ -0,0 +1,134 @@
+package controllers
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+// useTestDatabase 使用临时数据库，测试结束后恢复原连接
+func useTestDatabase(t *testing.T) {
+	t.Helper()
+	previous := database.DB
+	database.ConnectDatabaseAt(filepath.Join(t.TempDir(), "test.db"))
+	t.Cleanup(func() {
+		if db, err := database.DB.DB(); err == nil {
+			db.Close()
+		}
+		database.DB = previous
+	})
+}
+
+func TestAlertLifecycle(t *testing.T) {
+	useTestDatabase(t)
+
+	user := models.User{Username: "oncall", Password: "x"}
+	database.DB.Create(&user)
+	device := models.Device{Name: "sensor", Topic: "sensors/1", UserID: user.ID}
+	database.DB.Create(&device)
+	alert := models.Alert{DeviceID: device.ID, Type: "warning", Level: "high"}
+	database.DB.Create(&alert)
+	if alert.State != models.AlertStateOpen {
+		t.Fatalf("Expected new alert to be open, got %q", alert.State)
+	}
+
+	steps := []struct {
+		action string
+		state  string
+		err    error
+	}{
+		{models.AlertActionAcknowledge, models.AlertStateAcknowledged, nil},
+		{models.AlertActionAcknowledge, "", errInvalidAlertTransition},
+		{models.AlertActionResolve, models.AlertStateResolved, nil},
+		{models.AlertActionClear, "", errInvalidAlertTransition},
+		{models.AlertActionReopen, models.AlertStateOpen, nil},
+	}
+	for _, step := range steps {
+		err := transitionAlert(database.DB, &alert, step.action, user.ID, "")
+		if !errors.Is(err, step.err) {
+			t.Fatalf("%s: got error %v, want %v", step.action, err, step.err)
+		}
+		database.DB.First(&alert, alert.ID)
+		if step.err == nil && alert.State != step.state {
+			t.Errorf("%s: got state %q, want %q", step.action, alert.State, step.state)
+		}
+	}
+	if alert.AcknowledgedAt != 0 || alert.ResolvedAt != 0 {
+		t.Errorf("Expected reopen to reset transition times, got %+v", alert)
+	}
+
+	var events []models.AlertEvent
+	database.DB.Where("alert_id = ?", alert.ID).Order("id").Find(&events)
+	if len(events) != 3 || events[1].FromState != models.AlertStateAcknowledged || events[1].Username != "oncall" {
+		t.Errorf("Unexpected events: %+v", events)
+	}
+}
+
+func TestAlertTransitionConflict(t *testing.T) {
+	useTestDatabase(t)
+
+	device := models.Device{Name: "sensor", Topic: "sensors/1", UserID: 1}
+	database.DB.Create(&device)
+	alert := models.Alert{DeviceID: device.ID, Type: "warning", Level: "high"}
+	database.DB.Create(&alert)
+
+	// 两个请求读取到相同的 open 状态，只有先提交的确认生效
+	first, second := alert, alert
+	if err := transitionAlert(database.DB, &first, models.AlertActionAcknowledge, 1, ""); err != nil {
+		t.Fatalf("Failed to acknowledge alert: %v", err)
+	}
+	if err := transitionAlert(database.DB, &second, models.AlertActionResolve, 2, ""); !errors.Is(err, errInvalidAlertTransition) {
+		t.Errorf("Expected stale transition to conflict, got %v", err)
+	}
+
+	var events []models.AlertEvent
+	database.DB.Where("alert_id = ?", alert.ID).Find(&events)
+	if len(events) != 1 || events[0].Action != models.AlertActionAcknowledge {
+		t.Errorf("Expected a single acknowledge event, got %+v", events)
+	}
+	database.DB.First(&alert, alert.ID)
+	if alert.State != models.AlertStateAcknowledged || alert.ResolvedBy != 0 {
+		t.Errorf("Unexpected alert after conflict: %+v", alert)
+	}
+}
+
+func TestAlertRuleAutoClear(t *testing.T) {
+	useTestDatabase(t)
+
+	device := models.Device{Name: "boiler", Topic: "boiler/1", UserID: 1}
+	database.DB.Create(&device)
+	rule := models.AlertRule{UserID: 1, Name: "过温", Enabled: true, Condition: "temperature > 60", Level: models.AlertLevelCritical}
+	database.DB.Create(&rule)
+	// 其他设备的规则不作用于该设备
+	other := device.ID + 1
+	database.DB.Create(&models.AlertRule{UserID: 1, Name: "other", Enabled: true, DeviceID: &other, Condition: "temperature > 0"})
+
+	record := func(temperature float64) {
+		telemetry := models.Telemetry{DeviceID: device.ID, Source: "test", RawData: "00"}
+		if err := recordTelemetry(&telemetry, map[string]interface{}{"temperature": temperature}); err != nil {
+			t.Fatalf("Failed to record telemetry: %v", err)
+		}
+	}
+
+	record(50)
+	record(65)
+	record(70)
+	var alerts []models.Alert
+	database.DB.Where("device_id = ?", device.ID).Find(&alerts)
+	if len(alerts) != 1 {
+		t.Fatalf("Expected one alert, got %d", len(alerts))
+	}
+	alert := alerts[0]
+	if alert.RuleID != rule.ID || alert.Level != models.AlertLevelCritical || alert.Type != "emergency" || alert.State != models.AlertStateOpen {
+		t.Errorf("Unexpected alert: %+v", alert)
+	}
+
+	record(40)
+	database.DB.First(&alert, alert.ID)
+	if alert.State != models.AlertStateCleared || alert.ResolvedBy != 0 || alert.ResolvedAt == 0 {
+		t.Errorf("Expected alert to be cleared, got %+v", alert)
+	}
+}
@@ -0,0 +1,313 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/liang/mqtt-app/backend/models"
+	"gorm.io/gorm"
+)
+
+const (
+	// alertQueryDefaultLimit 游标分页默认每页条数
+	alertQueryDefaultLimit = 50
+	// alertQueryMaxLimit 游标分页每页最多条数
+	alertQueryMaxLimit = 500
+	// alertListMaxRows 不分页时最多返回的告警数
+	alertListMaxRows = 1000
+)
+
+// alertSortKey 告警排序方式: 排序表达式及告警对应的排序值，相同值按 ID 排序
+type alertSortKey struct {
+	expr  string
+	value func(*models.Alert) int64
+}
+
+// alertLevelRank 按严重程度排序告警级别
+const alertLevelRank = "CASE alerts.level WHEN 'critical' THEN 4 WHEN 'high' THEN 3 WHEN 'medium' THEN 2 WHEN 'low' THEN 1 ELSE 0 END"
+
+// alertSortKeys 支持的排序方式，created_at 按 ID 排序(ID 随创建时间递增)
+var alertSortKeys = map[string]alertSortKey{
+	"created_at":  {expr: "alerts.id", value: func(a *models.Alert) int64 { return int64(a.ID) }},
+	"timestamp":   {expr: "alerts.timestamp", value: func(a *models.Alert) int64 { return a.Timestamp }},
+	"last_seen":   {expr: "alerts.last_seen", value: func(a *models.Alert) int64 { return a.LastSeen }},
+	"occurrences": {expr: "alerts.occurrences", value: func(a *models.Alert) int64 { return int64(a.Occurrences) }},
+	"level": {expr: alertLevelRank, value: func(a *models.Alert) int64 {
+		return map[string]int64{models.AlertLevelCritical: 4, models.AlertLevelHigh: 3, models.AlertLevelMedium: 2, models.AlertLevelLow: 1}[a.Level]
+	}},
+}
+
+// alertQuery 告警查询条件，由请求参数解析:
+//   - type、level、state: 可逗号分隔多个，state=open 包含引入状态之前的告警
+//   - from、to: 告警发生时间(Timestamp)范围，Unix 秒或 RFC3339，包含两端
+//   - device_id(可逗号分隔多个)、group_id、read(true/false)、silenced(true/false)
+//   - assignee_id: 数字，me 表示当前用户，none 表示未指派
+//   - q: 全文搜索消息和解析数据，空白分隔的词都须出现(按词前缀匹配)
+//   - sort: created_at(默认)、timestamp、last_seen、level、occurrences；order: desc(默认)、asc
+//   - cursor、limit: 游标分页，cursor 为上一页返回的 next_cursor
+type alertQuery struct {
+	userID     uint
+	types      []string
+	levels     []string
+	states     []string
+	deviceIDs  []uint
+	groupID    uint
+	from, to   int64
+	read       *bool
+	silenced   *bool
+	assignee   string
+	search     string
+	sort       string
+	desc       bool
+	cursor     *alertCursor
+	limit      int
+	paginating bool // 请求了游标分页
+}
+
+// alertCursor 游标: 上一页最后一条告警的排序值和 ID
+type alertCursor struct {
+	value int64
+	id    uint
+}
+
+// splitList 拆分逗号分隔的参数，忽略空项
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseQueryTime 解析 Unix 秒或 RFC3339 时间
+func parseQueryTime(s string) (int64, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return t.Unix(), nil
+}
+
+// parseQueryBool 解析 true/false 参数，为空时返回 nil
+func parseQueryBool(values url.Values, name string) (*bool, error) {
+	value := values.Get(name)
+	if value == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return &b, nil
+}
+
+// queryDefault 获取参数，为空时返回默认值
+func queryDefault(values url.Values, name, defaultValue string) string {
+	if value := values.Get(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// parseAlertQuery 解析告警查询参数，导出任务保存请求参数后在后台解析
+func parseAlertQuery(values url.Values, userID uint) (*alertQuery, error) {
+	q := &alertQuery{
+		userID:   userID,
+		types:    splitList(values.Get("type")),
+		levels:   splitList(values.Get("level")),
+		states:   splitList(values.Get("state")),
+		assignee: values.Get("assignee_id"),
+		search:   strings.TrimSpace(values.Get("q")),
+		sort:     queryDefault(values, "sort", "created_at"),
+		desc:     true,
+	}
+
+	var err error
+	if q.deviceIDs, err = parseIDList(values.Get("device_id")); err != nil {
+		return nil, fmt.Errorf("invalid device_id: %v", err)
+	}
+	if value := values.Get("group_id"); value != "" {
+		id, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid group_id %q", value)
+		}
+		q.groupID = uint(id)
+	}
+	if value := values.Get("from"); value != "" {
+		if q.from, err = parseQueryTime(value); err != nil {
+			return nil, err
+		}
+	}
+	if value := values.Get("to"); value != "" {
+		if q.to, err = parseQueryTime(value); err != nil {
+			return nil, err
+		}
+	}
+	if q.read, err = parseQueryBool(values, "read"); err != nil {
+		return nil, err
+	}
+	if q.silenced, err = parseQueryBool(values, "silenced"); err != nil {
+		return nil, err
+	}
+
+	if _, ok := alertSortKeys[q.sort]; !ok {
+		return nil, fmt.Errorf("invalid sort %q", q.sort)
+	}
+	switch order := queryDefault(values, "order", "desc"); order {
+	case "desc":
+	case "asc":
+		q.desc = false
+	default:
+		return nil, fmt.Errorf("invalid order %q", order)
+	}
+
+	q.limit = alertQueryDefaultLimit
+	if value := values.Get("limit"); value != "" {
+		q.paginating = true
+		if q.limit, err = strconv.Atoi(value); err != nil || q.limit <= 0 {
+			return nil, fmt.Errorf("invalid limit %q", value)
+		}
+		if q.limit > alertQueryMaxLimit {
+			q.limit = alertQueryMaxLimit
+		}
+	}
+	if value := values.Get("cursor"); value != "" {
+		q.paginating = true
+		if q.cursor, err = q.decodeCursor(value); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+// ftsMatchExpression 将搜索词转换为 FTS 查询: 每个词按前缀匹配，所有词都须出现
+func ftsMatchExpression(search string) string {
+	var terms []string
+	for _, term := range strings.Fields(search) {
+		term = strings.ReplaceAll(term, `"`, "")
+		if term != "" {
+			terms = append(terms, `"`+term+`*"`)
+		}
+	}
+	return strings.Join(terms, " ")
+}
+
+// scope 查询当前用户设备的告警并应用过滤条件，不含排序和分页
+func (q *alertQuery) scope(db *gorm.DB) *gorm.DB {
+	query := db.Joins("JOIN devices ON devices.id = alerts.device_id").
+		Where("devices.user_id = ?", q.userID)
+
+	if len(q.types) > 0 {
+		query = query.Where("alerts.type IN ?", q.types)
+	}
+	if len(q.levels) > 0 {
+		query = query.Where("alerts.level IN ?", q.levels)
+	}
+	if len(q.states) > 0 {
+		states := q.states
+		for _, state := range states {
+			// 引入状态之前的告警状态为空，视为 open
+			if state == models.AlertStateOpen {
+				states = append(states, "")
+				break
+			}
+		}
+		query = query.Where("alerts.state IN ?", states)
+	}
+	if len(q.deviceIDs) > 0 {
+		query = query.Where("alerts.device_id IN ?", q.deviceIDs)
+	}
+	if q.groupID != 0 {
+		query = query.Where("devices.group_id = ?", q.groupID)
+	}
+	if q.from != 0 {
+		query = query.Where("alerts.timestamp >= ?", q.from)
+	}
+	if q.to != 0 {
+		query = query.Where("alerts.timestamp <= ?", q.to)
+	}
+	if q.read != nil {
+		query = query.Where("alerts.read = ?", *q.read)
+	}
+	if q.silenced != nil {
+		query = query.Where("alerts.silenced = ?", *q.silenced)
+	}
+	switch q.assignee {
+	case "":
+	case "none":
+		query = query.Where("alerts.assignee_id IS NULL")
+	case "me":
+		query = query.Where("alerts.assignee_id = ?", q.userID)
+	default:
+		query = query.Where("alerts.assignee_id = ?", q.assignee)
+	}
+	if match := ftsMatchExpression(q.search); match != "" {
+		query = query.Where("alerts.id IN (SELECT docid FROM alerts_fts WHERE alerts_fts MATCH ?)", match)
+	}
+	return query
+}
+
+// order 按排序方式排序，相同排序值按 ID 排序保证顺序稳定
+func (q *alertQuery) order(db *gorm.DB) *gorm.DB {
+	key := alertSortKeys[q.sort]
+	direction := "DESC"
+	if !q.desc {
+		direction = "ASC"
+	}
+	if key.expr == "alerts.id" {
+		return db.Order("alerts.id " + direction)
+	}
+	return db.Order(key.expr + " " + direction).Order("alerts.id " + direction)
+}
+
+// page 应用游标条件和每页条数，多取一条用于判断是否还有下一页
+func (q *alertQuery) page(db *gorm.DB) *gorm.DB {
+	if q.cursor != nil {
+		key := alertSortKeys[q.sort]
+		op := "<"
+		if !q.desc {
+			op = ">"
+		}
+		if key.expr == "alerts.id" {
+			db = db.Where("alerts.id "+op+" ?", q.cursor.id)
+		} else {
+			db = db.Where("("+key.expr+" "+op+" ?) OR ("+key.expr+" = ? AND alerts.id "+op+" ?)",
+				q.cursor.value, q.cursor.value, q.cursor.id)
+		}
+	}
+	return db.Limit(q.limit + 1)
+}
+
+// encodeCursor 根据一页的最后一条告警生成下一页的游标，游标包含排序方式，换了排序方式的游标无效
+func (q *alertQuery) encodeCursor(alert *models.Alert) string {
+	raw := fmt.Sprintf("%s,%t,%d,%d", q.sort, q.desc, alertSortKeys[q.sort].value(alert), alert.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func (q *alertQuery) decodeCursor(s string) (*alertCursor, error) {
+	errCursor := errors.New("invalid cursor")
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errCursor
+	}
+	parts := strings.Split(string(raw), ",")
+	if len(parts) != 4 || parts[0] != q.sort || parts[1] != strconv.FormatBool(q.desc) {
+		return nil, errCursor
+	}
+	value, err1 := strconv.ParseInt(parts[2], 10, 64)
+	id, err2 := strconv.ParseUint(parts[3], 10, 64)
+	if err1 != nil || err2 != nil {
+		return nil, errCursor
+	}
+	return &alertCursor{value: value, id: uint(id)}, nil
+}
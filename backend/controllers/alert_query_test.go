@@ -0,0 +1,134 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+// queryAlerts 以 userID 调用 GetAlerts，返回状态码和响应
+func queryAlerts(t *testing.T, userID uint, params url.Values) (int, map[string]json.RawMessage) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/alerts?"+params.Encode(), nil)
+	c.Set("userID", userID)
+	GetAlerts(c)
+
+	var body map[string]json.RawMessage
+	json.Unmarshal(w.Body.Bytes(), &body)
+	return w.Code, body
+}
+
+func alertIDs(t *testing.T, raw json.RawMessage) []uint {
+	t.Helper()
+	var alerts []models.Alert
+	if err := json.Unmarshal(raw, &alerts); err != nil {
+		t.Fatalf("Invalid alerts %s: %v", raw, err)
+	}
+	ids := make([]uint, len(alerts))
+	for i := range alerts {
+		ids[i] = alerts[i].ID
+	}
+	return ids
+}
+
+func TestAlertQuery(t *testing.T) {
+	useTestDatabase(t)
+
+	group := models.DeviceGroup{Name: "north"}
+	database.DB.Create(&group)
+	owner := models.Device{Name: "a", Topic: "a", UserID: 1, GroupID: &group.ID}
+	other := models.Device{Name: "b", Topic: "b", UserID: 1}
+	stranger := models.Device{Name: "c", Topic: "c", UserID: 2}
+	database.DB.Create(&owner)
+	database.DB.Create(&other)
+	database.DB.Create(&stranger)
+
+	levels := []string{"low", "critical", "medium", "high"}
+	for i := 0; i < 8; i++ {
+		device := owner
+		if i%2 == 1 {
+			device = other
+		}
+		alert := models.Alert{
+			DeviceID:   device.ID,
+			Type:       "offline",
+			Level:      levels[i%4],
+			Timestamp:  int64(1000 + i*100),
+			Message:    fmt.Sprintf("设备%d 温度过高 pump-%d", i, i),
+			ParsedData: fmt.Sprintf(`{"temperature":%d}`, 60+i),
+			Read:       i < 3,
+		}
+		database.DB.Create(&alert)
+	}
+	database.DB.Create(&models.Alert{DeviceID: stranger.ID, Level: "low", Timestamp: 1000, Message: "pump-0"})
+	// 修改消息后全文索引同步更新
+	database.DB.Model(&models.Alert{}).Where("id = ?", 8).Update("message", "voltage drop")
+
+	cases := []struct {
+		params string
+		want   []uint
+	}{
+		{"", []uint{8, 7, 6, 5, 4, 3, 2, 1}},
+		{"from=1200&to=1500", []uint{6, 5, 4, 3}},
+		{"from=1970-01-01T00:26:40Z", []uint{8, 7}},
+		{"device_id=" + fmt.Sprint(other.ID), []uint{8, 6, 4, 2}},
+		{"group_id=" + fmt.Sprint(group.ID) + "&read=false", []uint{7, 5}},
+		{"level=critical,high&sort=timestamp&order=asc", []uint{2, 4, 6, 8}},
+		{"sort=level", []uint{6, 2, 8, 4, 7, 3, 5, 1}},
+		{"q=pump-3", []uint{4}},
+		{"q=temperature 65", []uint{6}},
+		{"q=voltage", []uint{8}},
+		{"q=pump-7", nil},
+	}
+	for _, tc := range cases {
+		params, _ := url.ParseQuery(tc.params)
+		code, body := queryAlerts(t, 1, params)
+		if code != http.StatusOK {
+			t.Fatalf("%s: status %d", tc.params, code)
+		}
+		params.Set("limit", "100")
+		_, body = queryAlerts(t, 1, params)
+		if got := alertIDs(t, body["data"]); fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.params, got, tc.want)
+		}
+	}
+
+	// 游标分页按级别排序遍历全部告警
+	var all []uint
+	params := url.Values{"sort": {"level"}, "limit": {"3"}}
+	for page := 0; ; page++ {
+		if page > 5 {
+			t.Fatal("Too many pages")
+		}
+		_, body := queryAlerts(t, 1, params)
+		all = append(all, alertIDs(t, body["data"])...)
+		var next string
+		json.Unmarshal(body["next_cursor"], &next)
+		if next == "" {
+			break
+		}
+		params.Set("cursor", next)
+	}
+	if fmt.Sprint(all) != fmt.Sprint([]uint{6, 2, 8, 4, 7, 3, 5, 1}) {
+		t.Errorf("Cursor pages: got %v", all)
+	}
+
+	// 换了排序方式的游标无效
+	params.Set("sort", "timestamp")
+	if code, _ := queryAlerts(t, 1, params); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for cursor of another sort, got %d", code)
+	}
+	if code, _ := queryAlerts(t, 1, url.Values{"from": {"yesterday"}}); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid from, got %d", code)
+	}
+}
@@ -0,0 +1,592 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+// compiledAlertRule 已编译的告警规则
+type compiledAlertRule struct {
+	rule      models.AlertRule
+	condition *ruleExpr
+	clear     *ruleExpr // 为空时触发条件不成立即恢复
+}
+
+// ruleTransition 一条消息引起的规则状态变化
+type ruleTransition int
+
+const (
+	ruleUnchanged ruleTransition = iota
+	ruleFired
+	ruleCleared
+)
+
+// compileAlertRule 编译规则的触发条件和恢复条件
+func compileAlertRule(rule models.AlertRule) (*compiledAlertRule, error) {
+	condition, err := compileRuleExpr(rule.Condition)
+	if err != nil {
+		return nil, fmt.Errorf("condition: %v", err)
+	}
+	compiled := &compiledAlertRule{rule: rule, condition: condition}
+	if strings.TrimSpace(rule.ClearCondition) != "" {
+		if compiled.clear, err = compileRuleExpr(rule.ClearCondition); err != nil {
+			return nil, fmt.Errorf("clear_condition: %v", err)
+		}
+	}
+	return compiled, nil
+}
+
+// alertRuleCache 已编译规则的缓存，规则修改后 UpdatedAt 变化时重新编译
+var alertRuleCache = struct {
+	sync.RWMutex
+	rules map[uint]*compiledAlertRule
+}{rules: make(map[uint]*compiledAlertRule)}
+
+// cachedAlertRule 获取规则的编译结果，未缓存或已修改时编译并缓存
+func cachedAlertRule(rule models.AlertRule) (*compiledAlertRule, error) {
+	alertRuleCache.RLock()
+	compiled, ok := alertRuleCache.rules[rule.ID]
+	alertRuleCache.RUnlock()
+	if ok && compiled.rule.UpdatedAt.Equal(rule.UpdatedAt) {
+		return compiled, nil
+	}
+
+	compiled, err := compileAlertRule(rule)
+	if err != nil {
+		return nil, err
+	}
+	alertRuleCache.Lock()
+	alertRuleCache.rules[rule.ID] = compiled
+	alertRuleCache.Unlock()
+	return compiled, nil
+}
+
+// invalidateAlertRule 规则删除后移除编译结果
+func invalidateAlertRule(id uint) {
+	alertRuleCache.Lock()
+	delete(alertRuleCache.rules, id)
+	alertRuleCache.Unlock()
+}
+
+// holdSeconds for 子句要求的持续秒数
+func holdSeconds(expr *ruleExpr) int64 {
+	if expr == nil {
+		return 0
+	}
+	return int64(expr.hold / time.Second)
+}
+
+// step 使用一条消息推进规则状态: 未触发时触发条件持续成立满 for 时长后触发，
+// 已触发时恢复条件(未设置时为触发条件不成立)持续成立满时长后恢复。
+// 引用的字段不在消息中时返回 errFieldMissing，状态不变
+func (r *compiledAlertRule) step(state *models.AlertRuleState, env *exprEnv, now int64) (ruleTransition, error) {
+	if !state.Firing {
+		matched, err := r.condition.eval(env)
+		if err != nil {
+			return ruleUnchanged, err
+		}
+		if !matched {
+			state.PendingSince = 0
+			return ruleUnchanged, nil
+		}
+		if state.PendingSince == 0 {
+			state.PendingSince = now
+		}
+		if now-state.PendingSince < holdSeconds(r.condition) {
+			return ruleUnchanged, nil
+		}
+		state.Firing = true
+		state.PendingSince = 0
+		state.ClearPendingSince = 0
+		state.FiredAt = now
+		return ruleFired, nil
+	}
+
+	var cleared bool
+	var err error
+	if r.clear != nil {
+		cleared, err = r.clear.eval(env)
+	} else {
+		var matched bool
+		matched, err = r.condition.eval(env)
+		cleared = !matched
+	}
+	if err != nil {
+		return ruleUnchanged, err
+	}
+	if !cleared {
+		state.ClearPendingSince = 0
+		return ruleUnchanged, nil
+	}
+	if state.ClearPendingSince == 0 {
+		state.ClearPendingSince = now
+	}
+	if now-state.ClearPendingSince < holdSeconds(r.clear) {
+		return ruleUnchanged, nil
+	}
+	state.Firing = false
+	state.ClearPendingSince = 0
+	state.ClearedAt = now
+	return ruleCleared, nil
+}
+
+// alertTypeForLevel 规则告警的类型: critical 为 emergency，low 为 info，其余为 warning
+func alertTypeForLevel(level string) string {
+	switch level {
+	case models.AlertLevelCritical:
+		return "emergency"
+	case models.AlertLevelLow:
+		return "info"
+	default:
+		return "warning"
+	}
+}
+
+var ruleMessagePlaceholder = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// formatRuleValue 格式化告警消息中的字段值
+func formatRuleValue(value interface{}) string {
+	if f, ok := value.(float64); ok {
+		return fmt.Sprintf("%g", f)
+	}
+	return fmt.Sprint(value)
+}
+
+// message 生成告警消息: 模板中的 {device}、{rule} 替换为设备名和规则名，{字段名} 替换为字段值；
+// 未设置模板时列出规则名、条件及引用字段的当前值
+func (r *compiledAlertRule) message(device *models.Device, fields map[string]interface{}) string {
+	if r.rule.Message != "" {
+		return ruleMessagePlaceholder.ReplaceAllStringFunc(r.rule.Message, func(match string) string {
+			name := match[1 : len(match)-1]
+			switch name {
+			case "device":
+				return device.Name
+			case "rule":
+				return r.rule.Name
+			}
+			if value, ok := lookupField(fields, name); ok {
+				return formatRuleValue(exprValue(value))
+			}
+			return match
+		})
+	}
+
+	values := make([]string, 0, len(r.condition.fields))
+	for _, name := range r.condition.fields {
+		if value, ok := lookupField(fields, name); ok {
+			values = append(values, name+"="+formatRuleValue(exprValue(value)))
+		}
+	}
+	return fmt.Sprintf("%s: %s (%s)", r.rule.Name, r.rule.Condition, strings.Join(values, ", "))
+}
+
+// historyFields 规则需要保存历史值的字段
+func (r *compiledAlertRule) historyFields() []string {
+	history := append([]string{}, r.condition.history...)
+	if r.clear != nil {
+		history = append(history, r.clear.history...)
+	}
+	return history
+}
+
+// deviceRuleLocks 按设备串行化规则计算，避免并发消息读写同一状态
+var deviceRuleLocks sync.Map // device ID -> *sync.Mutex
+
+// deviceAlertRules 获取作用于设备的已启用规则: 指定该设备、设备所在组或未限定范围的规则
+func deviceAlertRules(device *models.Device) ([]models.AlertRule, error) {
+	query := database.DB.Where("user_id = ? AND enabled = ?", device.UserID, true).
+		Where("device_id IS NULL OR device_id = ?", device.ID)
+	if device.GroupID != nil {
+		query = query.Where("group_id IS NULL OR group_id = ?", *device.GroupID)
+	} else {
+		query = query.Where("group_id IS NULL")
+	}
+
+	var rules []models.AlertRule
+	err := query.Order("id").Find(&rules).Error
+	return rules, err
+}
+
+// evaluateAlertRules 对设备的一条解析后的消息计算告警规则，telemetry 提供设备、时间及原始数据
+func evaluateAlertRules(telemetry *models.Telemetry, fields map[string]interface{}) {
+	if len(fields) == 0 || telemetry.DeviceID == 0 {
+		return
+	}
+
+	var device models.Device
+	if err := database.DB.First(&device, telemetry.DeviceID).Error; err != nil {
+		return
+	}
+	rules, err := deviceAlertRules(&device)
+	if err != nil {
+		log.Printf("Failed to load alert rules for device %d: %v", device.ID, err)
+		return
+	}
+	if len(rules) == 0 {
+		return
+	}
+
+	lock, _ := deviceRuleLocks.LoadOrStore(device.ID, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	now := telemetry.Timestamp
+	if now == 0 {
+		now = time.Now().Unix()
+	}
+	for _, rule := range rules {
+		compiled, err := cachedAlertRule(rule)
+		if err != nil {
+			log.Printf("Alert rule %d is invalid: %v", rule.ID, err)
+			continue
+		}
+		if err := compiled.apply(&device, telemetry, fields, now); err != nil {
+			log.Printf("Failed to evaluate alert rule %d for device %d: %v", rule.ID, device.ID, err)
+		}
+	}
+}
+
+// apply 计算规则并保存状态，触发时生成告警
+func (r *compiledAlertRule) apply(device *models.Device, telemetry *models.Telemetry, fields map[string]interface{}, now int64) error {
+	var state models.AlertRuleState
+	if err := database.DB.Where("rule_id = ? AND device_id = ?", r.rule.ID, device.ID).
+		FirstOrInit(&state, models.AlertRuleState{RuleID: r.rule.ID, DeviceID: device.ID}).Error; err != nil {
+		return err
+	}
+	previous := map[string]interface{}{}
+	if state.Previous != "" {
+		json.Unmarshal([]byte(state.Previous), &previous)
+	}
+
+	before := state
+	transition, err := r.step(&state, &exprEnv{fields: fields, previous: previous}, now)
+	if errors.Is(err, errFieldMissing) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if history := r.historyFields(); len(history) > 0 {
+		for _, name := range history {
+			if value, ok := lookupField(fields, name); ok {
+				previous[name] = value
+			}
+		}
+		data, err := json.Marshal(previous)
+		if err != nil {
+			return err
+		}
+		state.Previous = string(data)
+	}
+
+	switch transition {
+	case ruleFired:
+		alert, err := r.createAlert(device, telemetry, fields, now)
+		if err != nil {
+			return err
+		}
+		state.AlertID = alert.ID
+	case ruleCleared:
+		if state.AlertID != 0 {
+			clearRuleAlert(state.AlertID, "rule clear condition met")
+		}
+	}
+
+	if state == before && state.ID != 0 {
+		return nil
+	}
+	return database.DB.Save(&state).Error
+}
+
+// createAlert 生成规则告警，记录规则ID及解析所用的配置版本
+func (r *compiledAlertRule) createAlert(device *models.Device, telemetry *models.Telemetry, fields map[string]interface{}, now int64) (*models.Alert, error) {
+	parsedData, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	alert := models.Alert{
+		DeviceID:      device.ID,
+		Type:          alertTypeForLevel(r.rule.Level),
+		Message:       r.message(device, fields),
+		Level:         r.rule.Level,
+		Timestamp:     now,
+		RawData:       telemetry.RawData,
+		ParsedData:    string(parsedData),
+		ConfigID:      telemetry.ConfigID,
+		ConfigVersion: telemetry.ConfigVersion,
+		RuleID:        r.rule.ID,
+	}
+	if _, err := saveAlert(&alert); err != nil {
+		return nil, err
+	}
+	return &alert, nil
+}
+
+// alertRuleInput 创建或修改规则的请求
+type alertRuleInput struct {
+	Name           string `json:"name" binding:"required"`
+	Description    string `json:"description"`
+	Enabled        *bool  `json:"enabled"`
+	DeviceID       *uint  `json:"device_id"`
+	GroupID        *uint  `json:"group_id"`
+	Condition      string `json:"condition" binding:"required"`
+	ClearCondition string `json:"clear_condition"`
+	Level          string `json:"level"`
+	Message        string `json:"message"`
+}
+
+// validateAlertRuleInput 校验规则的范围、级别及表达式，返回错误时对应的 HTTP 状态码
+func validateAlertRuleInput(userID uint, input *alertRuleInput) (int, error) {
+	if input.DeviceID != nil && input.GroupID != nil {
+		return http.StatusBadRequest, errors.New("device_id and group_id cannot both be set")
+	}
+	if input.DeviceID != nil {
+		var device models.Device
+		if err := database.DB.Where("id = ? AND user_id = ?", *input.DeviceID, userID).First(&device).Error; err != nil {
+			return http.StatusNotFound, errors.New("Device not found")
+		}
+	}
+	if input.GroupID != nil {
+		var group models.DeviceGroup
+		if err := database.DB.First(&group, *input.GroupID).Error; err != nil {
+			return http.StatusNotFound, errors.New("Device group not found")
+		}
+	}
+
+	switch input.Level {
+	case "":
+		input.Level = models.AlertLevelMedium
+	case models.AlertLevelCritical, models.AlertLevelHigh, models.AlertLevelMedium, models.AlertLevelLow:
+	default:
+		return http.StatusBadRequest, fmt.Errorf("invalid level %q", input.Level)
+	}
+
+	if _, err := compileAlertRule(models.AlertRule{Condition: input.Condition, ClearCondition: input.ClearCondition}); err != nil {
+		return http.StatusBadRequest, err
+	}
+	return http.StatusOK, nil
+}
+
+// apply 将请求写入规则
+func (input *alertRuleInput) apply(rule *models.AlertRule) {
+	rule.Name = input.Name
+	rule.Description = input.Description
+	if input.Enabled != nil {
+		rule.Enabled = *input.Enabled
+	}
+	rule.DeviceID = input.DeviceID
+	rule.GroupID = input.GroupID
+	rule.Condition = strings.TrimSpace(input.Condition)
+	rule.ClearCondition = strings.TrimSpace(input.ClearCondition)
+	rule.Level = input.Level
+	rule.Message = input.Message
+}
+
+// GetAlertRules 获取告警规则列表
+func GetAlertRules(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	var rules []models.AlertRule
+	if err := database.DB.Where("user_id = ?", userID).Order("id").Find(&rules).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get alert rules"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": rules})
+}
+
+// CreateAlertRule 创建告警规则
+func CreateAlertRule(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	var input alertRuleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if status, err := validateAlertRuleInput(userID, &input); err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	rule := models.AlertRule{UserID: userID, Enabled: true}
+	input.apply(&rule)
+	if err := database.DB.Create(&rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create alert rule"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": rule})
+}
+
+// UpdateAlertRule 修改告警规则，条件修改后规则在各设备上的状态重新计算
+func UpdateAlertRule(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	id := c.Param("id")
+
+	var rule models.AlertRule
+	if err := database.DB.Where("id = ? AND user_id = ?", id, userID).First(&rule).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Alert rule not found"})
+		return
+	}
+
+	var input alertRuleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if status, err := validateAlertRuleInput(userID, &input); err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	conditionChanged := strings.TrimSpace(input.Condition) != rule.Condition ||
+		strings.TrimSpace(input.ClearCondition) != rule.ClearCondition
+	input.apply(&rule)
+	if err := database.DB.Save(&rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update alert rule"})
+		return
+	}
+	if conditionChanged {
+		database.DB.Unscoped().Where("rule_id = ?", rule.ID).Delete(&models.AlertRuleState{})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": rule})
+}
+
+// DeleteAlertRule 删除告警规则及其状态，已生成的告警保留
+func DeleteAlertRule(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	id := c.Param("id")
+
+	var rule models.AlertRule
+	if err := database.DB.Where("id = ? AND user_id = ?", id, userID).First(&rule).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Alert rule not found"})
+		return
+	}
+
+	if err := database.DB.Delete(&rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete alert rule"})
+		return
+	}
+	database.DB.Unscoped().Where("rule_id = ?", rule.ID).Delete(&models.AlertRuleState{})
+	invalidateAlertRule(rule.ID)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Alert rule deleted successfully"})
+}
+
+// GetAlertRuleStates 获取规则在各设备上的状态
+func GetAlertRuleStates(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	id := c.Param("id")
+
+	var rule models.AlertRule
+	if err := database.DB.Where("id = ? AND user_id = ?", id, userID).First(&rule).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Alert rule not found"})
+		return
+	}
+
+	var states []models.AlertRuleState
+	if err := database.DB.Where("rule_id = ?", rule.ID).Order("device_id").Find(&states).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get alert rule states"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": states})
+}
+
+// AlertRuleTestStep 规则测试的一条消息
+type AlertRuleTestStep struct {
+	Timestamp int64                  `json:"timestamp"` // Unix 秒，为 0 时按序号递增
+	Fields    map[string]interface{} `json:"fields"`
+}
+
+// AlertRuleTestResult 规则测试中一条消息的计算结果
+type AlertRuleTestResult struct {
+	Timestamp int64  `json:"timestamp"`
+	Firing    bool   `json:"firing"`
+	Event     string `json:"event,omitempty"` // fired, cleared
+	Message   string `json:"message,omitempty"`
+	Skipped   string `json:"skipped,omitempty"` // 引用字段缺失时跳过的原因
+	Error     string `json:"error,omitempty"`
+}
+
+// runAlertRuleTest 按顺序使用消息推进规则状态，不读写数据库
+func runAlertRuleTest(compiled *compiledAlertRule, steps []AlertRuleTestStep) []AlertRuleTestResult {
+	device := &models.Device{Name: "test"}
+	state := models.AlertRuleState{}
+	previous := map[string]interface{}{}
+	results := make([]AlertRuleTestResult, 0, len(steps))
+
+	sort.SliceStable(steps, func(i, j int) bool { return steps[i].Timestamp < steps[j].Timestamp })
+	for i, step := range steps {
+		now := step.Timestamp
+		if now == 0 {
+			now = int64(i)
+		}
+		result := AlertRuleTestResult{Timestamp: now}
+		transition, err := compiled.step(&state, &exprEnv{fields: step.Fields, previous: previous}, now)
+		switch {
+		case errors.Is(err, errFieldMissing):
+			result.Skipped = err.Error()
+		case err != nil:
+			result.Error = err.Error()
+		case transition == ruleFired:
+			result.Event = "fired"
+			result.Message = compiled.message(device, step.Fields)
+		case transition == ruleCleared:
+			result.Event = "cleared"
+		}
+		if err == nil {
+			for _, name := range compiled.historyFields() {
+				if value, ok := lookupField(step.Fields, name); ok {
+					previous[name] = value
+				}
+			}
+		}
+		result.Firing = state.Firing
+		results = append(results, result)
+	}
+	return results
+}
+
+// TestAlertRule 使用一组消息测试规则的触发与恢复，不生成告警
+func TestAlertRule(c *gin.Context) {
+	var input struct {
+		Condition      string              `json:"condition" binding:"required"`
+		ClearCondition string              `json:"clear_condition"`
+		Message        string              `json:"message"`
+		Name           string              `json:"name"`
+		Steps          []AlertRuleTestStep `json:"steps"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	compiled, err := compileAlertRule(models.AlertRule{
+		Name:           input.Name,
+		Condition:      strings.TrimSpace(input.Condition),
+		ClearCondition: input.ClearCondition,
+		Message:        input.Message,
+	})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": runAlertRuleTest(compiled, input.Steps)})
+}
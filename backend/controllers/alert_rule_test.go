@@ -0,0 +1,178 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+func TestRuleExpr(t *testing.T) {
+	fields := map[string]interface{}{
+		"temperature": float32(65.5),
+		"voltage":     3.1,
+		"speed":       uint16(130),
+		"status":      "fault",
+		"gps":         map[string]interface{}{"fix": true, "sats": int64(7)},
+	}
+
+	tests := []struct {
+		expr    string
+		want    bool
+		errMsg  string
+		missing bool
+	}{
+		{expr: "temperature > 60", want: true},
+		{expr: "voltage < 3.3 && speed > 120", want: true},
+		{expr: "voltage >= 3.3 or not (speed <= 120)", want: true},
+		{expr: `status == "fault" && gps.fix == true`, want: true},
+		{expr: "gps.sats * 2 - 4 >= 10", want: true},
+		{expr: "abs(-temperature) > 65 && temperature % 2 > 1", want: true},
+		{expr: "has(humidity) || !has(status)", want: false},
+		{expr: "humidity > 80", missing: true},
+		{expr: "speed / 0 > 1", errMsg: "division by zero"},
+		{expr: `status > 1`, errMsg: "cannot compare"},
+		{expr: "temperature + 1", errMsg: "boolean"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			expr, err := compileRuleExpr(tt.expr)
+			if err != nil {
+				t.Fatalf("Failed to compile: %v", err)
+			}
+			got, err := expr.eval(&exprEnv{fields: fields})
+			switch {
+			case tt.missing:
+				if !errors.Is(err, errFieldMissing) {
+					t.Errorf("Expected missing field error, got %v", err)
+				}
+			case tt.errMsg != "":
+				if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+					t.Errorf("Expected error containing %q, got %v", tt.errMsg, err)
+				}
+			case err != nil:
+				t.Errorf("Unexpected error: %v", err)
+			case got != tt.want:
+				t.Errorf("Got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	for _, invalid := range []string{"", "temperature >", "temperature = 1", "(voltage < 3", "foo(x) > 1", `status == "x`, "changed(1)", "voltage < 3 for 5parsecs"} {
+		if _, err := compileRuleExpr(invalid); err == nil {
+			t.Errorf("Expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestAlertRuleHysteresis(t *testing.T) {
+	rule, err := compileAlertRule(models.AlertRule{
+		Name:           "过温",
+		Condition:      "temperature > 60 for 5m",
+		ClearCondition: "temperature < 55 for 1m",
+		Message:        "{device} {rule}: {temperature}℃",
+	})
+	if err != nil {
+		t.Fatalf("Failed to compile rule: %v", err)
+	}
+
+	step := func(ts int64, temperature float64) AlertRuleTestStep {
+		return AlertRuleTestStep{Timestamp: ts, Fields: map[string]interface{}{"temperature": temperature}}
+	}
+	results := runAlertRuleTest(rule, []AlertRuleTestStep{
+		step(0, 61),   // 开始持续
+		step(120, 50), // 未满 5 分钟即恢复正常，重新计时
+		step(180, 62),
+		step(400, 63),
+		step(480, 65), // 持续 300 秒，触发
+		step(500, 58), // 处于迟滞区间，保持触发
+		step(560, 54), // 恢复条件开始成立
+		{Timestamp: 600, Fields: map[string]interface{}{"voltage": 3.3}}, // 缺少字段，跳过
+		step(620, 53), // 恢复条件持续 60 秒，恢复
+	})
+
+	events := make([]string, len(results))
+	for i, result := range results {
+		events[i] = result.Event
+		if result.Skipped != "" {
+			events[i] = "skipped"
+		}
+	}
+	want := []string{"", "", "", "", "fired", "", "", "skipped", "cleared"}
+	if strings.Join(events, ",") != strings.Join(want, ",") {
+		t.Errorf("Unexpected events: got %q, want %q", events, want)
+	}
+	if results[4].Message != "test 过温: 65℃" {
+		t.Errorf("Unexpected message: %q", results[4].Message)
+	}
+	if !results[5].Firing || results[8].Firing {
+		t.Errorf("Unexpected firing state: %+v", results)
+	}
+}
+
+func TestAlertRuleChanged(t *testing.T) {
+	rule, err := compileAlertRule(models.AlertRule{Name: "状态变化", Condition: `changed(status) || delta(count) > 10`})
+	if err != nil {
+		t.Fatalf("Failed to compile rule: %v", err)
+	}
+
+	results := runAlertRuleTest(rule, []AlertRuleTestStep{
+		{Fields: map[string]interface{}{"status": "ok", "count": 1}},
+		{Fields: map[string]interface{}{"status": "ok", "count": 5}},
+		{Fields: map[string]interface{}{"status": "fault", "count": 6}},
+		{Fields: map[string]interface{}{"status": "fault", "count": 7}},
+		{Fields: map[string]interface{}{"status": "fault", "count": 20}},
+	})
+
+	var events []string
+	for _, result := range results {
+		events = append(events, result.Event)
+	}
+	// 状态不再变化时恢复，计数突增时再次触发
+	if got := strings.Join(events, ","); got != ",,fired,cleared,fired" {
+		t.Errorf("Unexpected events: %q", got)
+	}
+	if !strings.Contains(results[2].Message, "status=fault") {
+		t.Errorf("Unexpected default message: %q", results[2].Message)
+	}
+}
+
+func TestCreateAlertRuleEnabled(t *testing.T) {
+	useTestDatabase(t)
+	gin.SetMode(gin.TestMode)
+
+	create := func(body string) models.AlertRule {
+		t.Helper()
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/api/alert-rules", bytes.NewBufferString(body))
+		c.Request.Header.Set("Content-Type", "application/json")
+		c.Set("userID", uint(1))
+		CreateAlertRule(c)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected rule to be created, got %d: %s", w.Code, w.Body.String())
+		}
+		var created struct {
+			Data models.AlertRule `json:"data"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &created)
+		var rule models.AlertRule
+		database.DB.First(&rule, created.Data.ID)
+		return rule
+	}
+
+	if rule := create(`{"name":"过温","condition":"temperature > 60"}`); !rule.Enabled {
+		t.Error("Expected new rule to be enabled by default")
+	}
+	if rule := create(`{"name":"停用","condition":"temperature > 60","enabled":false}`); rule.Enabled {
+		t.Error("Expected rule created with enabled=false to stay disabled")
+	}
+}
@@ -0,0 +1,315 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+	"gorm.io/gorm"
+)
+
+const (
+	// alertStatsCacheTTL 统计结果的缓存时长
+	alertStatsCacheTTL = 30 * time.Second
+	// alertStatsCacheSize 缓存的统计结果数量上限，超出时整体清空
+	alertStatsCacheSize = 256
+	// alertStatsMaxBuckets 一次统计最多的时间桶数
+	alertStatsMaxBuckets = 1000
+	// alertStatsDefaultTop 默认返回的告警最多设备数
+	alertStatsDefaultTop = 10
+)
+
+// alertStatsBucket 时间桶: 长度、默认统计范围及对齐基准(周从周一开始，1970-01-05 为周一)
+type alertStatsBucket struct {
+	size int64
+	span time.Duration
+	base int64
+}
+
+var alertStatsBuckets = map[string]alertStatsBucket{
+	"hour": {size: 3600, span: 24 * time.Hour},
+	"day":  {size: 86400, span: 7 * 24 * time.Hour},
+	"week": {size: 7 * 86400, span: 12 * 7 * 24 * time.Hour, base: 4 * 86400},
+}
+
+// alertStatsDimensions 时间序列可按维度分组: 维度的 SQL 表达式
+var alertStatsDimensions = map[string]string{
+	"level":  "alerts.level",
+	"type":   "alerts.type",
+	"device": "alerts.device_id",
+	"group":  "COALESCE(devices.group_id, 0)",
+}
+
+// AlertStatsCount 按维度统计的告警数
+type AlertStatsCount struct {
+	Key         string `json:"key"`
+	Name        string `json:"name,omitempty"`
+	Count       int64  `json:"count"`
+	Occurrences int64  `json:"occurrences"`
+}
+
+// AlertStatsPoint 时间序列的一个时间桶，Counts 为按维度分组的告警数
+type AlertStatsPoint struct {
+	Bucket int64            `json:"bucket"` // 时间桶开始时间，Unix 秒
+	Total  int64            `json:"total"`
+	Counts map[string]int64 `json:"counts"`
+}
+
+// AlertStatsDuration 处理时长统计，单位秒
+type AlertStatsDuration struct {
+	Count   int64   `json:"count"`
+	Average float64 `json:"average"`
+	Max     int64   `json:"max"`
+}
+
+// AlertStats 告警统计结果
+type AlertStats struct {
+	From        int64              `json:"from"`
+	To          int64              `json:"to"`
+	Bucket      string             `json:"bucket"`
+	GroupBy     string             `json:"group_by"`
+	Total       int64              `json:"total"`
+	Occurrences int64              `json:"occurrences"`
+	Series      []AlertStatsPoint  `json:"series"`
+	ByLevel     []AlertStatsCount  `json:"by_level"`
+	ByType      []AlertStatsCount  `json:"by_type"`
+	ByDevice    []AlertStatsCount  `json:"by_device"`
+	ByGroup     []AlertStatsCount  `json:"by_group"`
+	TopDevices  []AlertStatsCount  `json:"top_devices"` // 按发生次数排序的告警最多的设备
+	MTTA        AlertStatsDuration `json:"mtta"`        // 从发生到确认的平均时长
+	MTTR        AlertStatsDuration `json:"mttr"`        // 从发生到解决或自动清除的平均时长
+	GeneratedAt int64              `json:"generated_at"`
+}
+
+// alertStatsCache 统计结果缓存，以用户和查询参数为键
+var alertStatsCache = struct {
+	sync.RWMutex
+	entries map[string]alertStatsCacheEntry
+}{entries: make(map[string]alertStatsCacheEntry)}
+
+type alertStatsCacheEntry struct {
+	stats   *AlertStats
+	expires time.Time
+}
+
+// GetAlertStats 告警统计: 参数同告警查询的过滤条件(from/to 默认为按时间桶的最近一段时间)，以及
+// bucket(hour、day、week，默认 day)、group_by(时间序列的分组维度: level、type、device、group，默认 level)、
+// tz(时间桶对齐的时区，默认服务器时区)、top(告警最多设备数)、cache=false 不使用缓存
+func GetAlertStats(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	key := fmt.Sprintf("%d?%s", userID, c.Request.URL.RawQuery)
+	if c.Query("cache") != "false" {
+		alertStatsCache.RLock()
+		entry, ok := alertStatsCache.entries[key]
+		alertStatsCache.RUnlock()
+		if ok && time.Now().Before(entry.expires) {
+			c.JSON(http.StatusOK, gin.H{"data": entry.stats})
+			return
+		}
+	}
+
+	q, err := parseAlertQuery(c.Request.URL.Query(), userID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	opts, err := parseAlertStatsOptions(c, q)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	stats, err := computeAlertStats(q, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute alert statistics"})
+		return
+	}
+
+	alertStatsCache.Lock()
+	if len(alertStatsCache.entries) >= alertStatsCacheSize {
+		alertStatsCache.entries = make(map[string]alertStatsCacheEntry)
+	}
+	alertStatsCache.entries[key] = alertStatsCacheEntry{stats: stats, expires: time.Now().Add(alertStatsCacheTTL)}
+	alertStatsCache.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{"data": stats})
+}
+
+// alertStatsOptions 统计选项
+type alertStatsOptions struct {
+	bucketName string
+	bucket     alertStatsBucket
+	groupBy    string
+	top        int
+	offset     int64 // 时区相对 UTC 的偏移秒数
+}
+
+// bucketStart 时间所在时间桶的开始时间: 按时区偏移后对齐到桶长度
+func (opts *alertStatsOptions) bucketStart(ts int64) int64 {
+	size := opts.bucket.size
+	return ts - ((ts+opts.offset-opts.bucket.base)%size+size)%size
+}
+
+// parseAlertStatsOptions 解析统计参数，未指定时间范围时统计按时间桶的最近一段时间
+func parseAlertStatsOptions(c *gin.Context, q *alertQuery) (*alertStatsOptions, error) {
+	opts := &alertStatsOptions{
+		bucketName: c.DefaultQuery("bucket", "day"),
+		groupBy:    c.DefaultQuery("group_by", "level"),
+		top:        alertStatsDefaultTop,
+	}
+	var ok bool
+	if opts.bucket, ok = alertStatsBuckets[opts.bucketName]; !ok {
+		return nil, fmt.Errorf("invalid bucket %q", opts.bucketName)
+	}
+	if _, ok := alertStatsDimensions[opts.groupBy]; !ok {
+		return nil, fmt.Errorf("invalid group_by %q", opts.groupBy)
+	}
+	if value := c.Query("top"); value != "" {
+		if opts.top, _ = strconv.Atoi(value); opts.top <= 0 {
+			return nil, fmt.Errorf("invalid top %q", value)
+		}
+	}
+	loc := time.Local
+	if tz := c.Query("tz"); tz != "" {
+		var err error
+		if loc, err = time.LoadLocation(tz); err != nil {
+			return nil, fmt.Errorf("invalid tz %q", tz)
+		}
+	}
+
+	if q.to == 0 {
+		q.to = time.Now().Unix()
+	}
+	if q.from == 0 {
+		q.from = q.to - int64(opts.bucket.span/time.Second)
+	}
+	if q.to < q.from {
+		return nil, fmt.Errorf("to must not be before from")
+	}
+	_, offset := time.Unix(q.from, 0).In(loc).Zone()
+	opts.offset = int64(offset)
+	if (opts.bucketStart(q.to)-opts.bucketStart(q.from))/opts.bucket.size+1 > alertStatsMaxBuckets {
+		return nil, fmt.Errorf("too many buckets, use a larger bucket or a shorter range")
+	}
+	return opts, nil
+}
+
+// computeAlertStats 在数据库中按条件聚合告警统计
+func computeAlertStats(q *alertQuery, opts *alertStatsOptions) (*AlertStats, error) {
+	base := func() *gorm.DB { return q.scope(database.DB.Model(&models.Alert{})) }
+	stats := &AlertStats{From: q.from, To: q.to, Bucket: opts.bucketName, GroupBy: opts.groupBy, GeneratedAt: time.Now().Unix()}
+	size := opts.bucket.size
+
+	// 时间序列
+	bucketExpr := fmt.Sprintf("alerts.timestamp - (((alerts.timestamp + %d - %d) %% %d) + %d) %% %d",
+		opts.offset, opts.bucket.base, size, size, size)
+	var rows []struct {
+		Bucket int64
+		Key    string
+		Count  int64
+	}
+	if err := base().Select(bucketExpr + " AS bucket, CAST(" + alertStatsDimensions[opts.groupBy] + " AS TEXT) AS key, COUNT(*) AS count").
+		Group("bucket, key").Order("bucket").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	points := make(map[int64]*AlertStatsPoint)
+	for b := opts.bucketStart(q.from); b <= q.to; b += size {
+		stats.Series = append(stats.Series, AlertStatsPoint{Bucket: b, Counts: map[string]int64{}})
+	}
+	for i := range stats.Series {
+		points[stats.Series[i].Bucket] = &stats.Series[i]
+	}
+	for _, row := range rows {
+		if point := points[row.Bucket]; point != nil {
+			point.Total += row.Count
+			point.Counts[row.Key] += row.Count
+		}
+	}
+
+	// 按维度统计
+	countBy := func(expr string, names func([]AlertStatsCount)) ([]AlertStatsCount, error) {
+		var counts []AlertStatsCount
+		err := base().Select("CAST(" + expr + " AS TEXT) AS key, COUNT(*) AS count, SUM(alerts.occurrences) AS occurrences").
+			Group("key").Order("count DESC, key").Scan(&counts).Error
+		if err == nil && names != nil {
+			names(counts)
+		}
+		return counts, err
+	}
+	var err error
+	if stats.ByLevel, err = countBy(alertStatsDimensions["level"], nil); err != nil {
+		return nil, err
+	}
+	if stats.ByType, err = countBy(alertStatsDimensions["type"], nil); err != nil {
+		return nil, err
+	}
+	if stats.ByDevice, err = countBy(alertStatsDimensions["device"], nameDevices); err != nil {
+		return nil, err
+	}
+	if stats.ByGroup, err = countBy(alertStatsDimensions["group"], nameGroups); err != nil {
+		return nil, err
+	}
+	for _, count := range stats.ByLevel {
+		stats.Total += count.Count
+		stats.Occurrences += count.Occurrences
+	}
+
+	// 告警最多的设备
+	if err := base().Select("CAST(alerts.device_id AS TEXT) AS key, COUNT(*) AS count, SUM(alerts.occurrences) AS occurrences").
+		Group("key").Order("occurrences DESC, count DESC, key").Limit(opts.top).Scan(&stats.TopDevices).Error; err != nil {
+		return nil, err
+	}
+	nameDevices(stats.TopDevices)
+
+	// 平均确认和解决时长
+	durationOf := func(column string) (AlertStatsDuration, error) {
+		var d AlertStatsDuration
+		expr := "alerts." + column + " - alerts.timestamp"
+		err := base().Where("alerts." + column + " > 0").
+			Select("COUNT(*) AS count, COALESCE(AVG(" + expr + "), 0) AS average, COALESCE(MAX(" + expr + "), 0) AS max").
+			Scan(&d).Error
+		return d, err
+	}
+	if stats.MTTA, err = durationOf("acknowledged_at"); err != nil {
+		return nil, err
+	}
+	if stats.MTTR, err = durationOf("resolved_at"); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// nameDevices 填充设备统计的设备名称
+func nameDevices(counts []AlertStatsCount) {
+	ids := make([]string, len(counts))
+	for i := range counts {
+		ids[i] = counts[i].Key
+	}
+	var devices []models.Device
+	database.DB.Select("id", "name").Where("id IN ?", ids).Find(&devices)
+	names := make(map[string]string)
+	for _, device := range devices {
+		names[strconv.FormatUint(uint64(device.ID), 10)] = device.Name
+	}
+	for i := range counts {
+		counts[i].Name = names[counts[i].Key]
+	}
+}
+
+// nameGroups 填充设备组统计的组名，未分组的设备键为 0
+func nameGroups(counts []AlertStatsCount) {
+	var groups []models.DeviceGroup
+	database.DB.Select("id", "name").Find(&groups)
+	names := make(map[string]string)
+	for _, group := range groups {
+		names[strconv.FormatUint(uint64(group.ID), 10)] = group.Name
+	}
+	for i := range counts {
+		counts[i].Name = names[counts[i].Key]
+	}
+}
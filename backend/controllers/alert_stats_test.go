@@ -0,0 +1,109 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+func getAlertStats(t *testing.T, userID uint, query string) (int, *AlertStats) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/stats/alerts?"+query, nil)
+	c.Set("userID", userID)
+	GetAlertStats(c)
+
+	var body struct {
+		Data *AlertStats `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	return w.Code, body.Data
+}
+
+func TestAlertStats(t *testing.T) {
+	useTestDatabase(t)
+	alertStatsCache.entries = make(map[string]alertStatsCacheEntry)
+
+	group := models.DeviceGroup{Name: "plant"}
+	database.DB.Create(&group)
+	pump := models.Device{Name: "pump", Topic: "pump", UserID: 1, GroupID: &group.ID}
+	fan := models.Device{Name: "fan", Topic: "fan", UserID: 1}
+	database.DB.Create(&pump)
+	database.DB.Create(&fan)
+
+	const day = int64(86400)
+	start := int64(1700006400) // 2023-11-15 00:00 UTC
+	alerts := []models.Alert{
+		{DeviceID: pump.ID, Type: "overheat", Level: "high", Timestamp: start + 100, Occurrences: 5, AcknowledgedAt: start + 160, ResolvedAt: start + 400},
+		{DeviceID: pump.ID, Type: "overheat", Level: "critical", Timestamp: start + 3600, Occurrences: 1, AcknowledgedAt: start + 3600 + 300},
+		{DeviceID: fan.ID, Type: "offline", Level: "high", Timestamp: start + day + 10, Occurrences: 2},
+		{DeviceID: fan.ID, Type: "offline", Level: "low", Timestamp: start + 2*day + 10, Occurrences: 1, ResolvedAt: start + 2*day + 210},
+		{DeviceID: fan.ID, Type: "offline", Level: "low", Timestamp: start - 10, Occurrences: 1}, // 范围之外
+	}
+	for i := range alerts {
+		database.DB.Create(&alerts[i])
+	}
+
+	query := fmt.Sprintf("from=%d&to=%d&tz=UTC", start, start+3*day-1)
+	code, stats := getAlertStats(t, 1, query)
+	if code != http.StatusOK || stats == nil {
+		t.Fatalf("Unexpected status %d", code)
+	}
+	if stats.Total != 4 || stats.Occurrences != 9 {
+		t.Errorf("Unexpected totals: %d alerts, %d occurrences", stats.Total, stats.Occurrences)
+	}
+	if len(stats.Series) != 3 {
+		t.Fatalf("Expected 3 daily buckets, got %+v", stats.Series)
+	}
+	wantSeries := []string{"map[critical:1 high:1]", "map[high:1]", "map[low:1]"}
+	for i, point := range stats.Series {
+		if point.Bucket != start+int64(i)*day || fmt.Sprint(point.Counts) != wantSeries[i] {
+			t.Errorf("Bucket %d: got %d %v", i, point.Bucket, point.Counts)
+		}
+	}
+	if fmt.Sprint(stats.ByLevel) != fmt.Sprint([]AlertStatsCount{{Key: "high", Count: 2, Occurrences: 7}, {Key: "critical", Count: 1, Occurrences: 1}, {Key: "low", Count: 1, Occurrences: 1}}) {
+		t.Errorf("Unexpected by_level: %+v", stats.ByLevel)
+	}
+	if len(stats.ByGroup) != 2 || (stats.ByGroup[0].Name != "plant" && stats.ByGroup[1].Name != "plant") {
+		t.Errorf("Unexpected by_group: %+v", stats.ByGroup)
+	}
+	if len(stats.TopDevices) != 2 || stats.TopDevices[0].Name != "pump" || stats.TopDevices[0].Occurrences != 6 {
+		t.Errorf("Unexpected top devices: %+v", stats.TopDevices)
+	}
+	if stats.MTTA.Count != 2 || stats.MTTA.Average != 180 || stats.MTTA.Max != 300 {
+		t.Errorf("Unexpected MTTA: %+v", stats.MTTA)
+	}
+	if stats.MTTR.Count != 2 || stats.MTTR.Average != 250 {
+		t.Errorf("Unexpected MTTR: %+v", stats.MTTR)
+	}
+
+	// 按小时、按设备分组
+	_, hourly := getAlertStats(t, 1, fmt.Sprintf("from=%d&to=%d&tz=Asia/Shanghai&bucket=hour&group_by=device", start, start+2*3600-1))
+	if hourly == nil || len(hourly.Series) != 2 || hourly.Series[1].Counts[fmt.Sprint(pump.ID)] != 1 {
+		t.Errorf("Unexpected hourly series: %+v", hourly)
+	}
+
+	// 缓存的结果不包含新告警，cache=false 时重新计算
+	database.DB.Create(&models.Alert{DeviceID: pump.ID, Level: "low", Timestamp: start + 50, Occurrences: 1})
+	if _, cached := getAlertStats(t, 1, query); cached.Total != 4 {
+		t.Errorf("Expected cached total 4, got %d", cached.Total)
+	}
+	if _, fresh := getAlertStats(t, 1, query+"&cache=false"); fresh.Total != 5 {
+		t.Errorf("Expected fresh total 5, got %d", fresh.Total)
+	}
+
+	if code, _ := getAlertStats(t, 1, "bucket=minute"); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid bucket, got %d", code)
+	}
+	if code, _ := getAlertStats(t, 1, "bucket=hour&from=1&to=100000000"); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for too many buckets, got %d", code)
+	}
+}
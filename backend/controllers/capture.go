@@ -0,0 +1,406 @@
+package controllers
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+	"gorm.io/gorm"
+)
+
+// 抓包限制
+const (
+	captureDefaultDuration = time.Hour
+	captureMaxDuration     = 24 * time.Hour
+	captureDefaultFrames   = 1000
+	captureMaxFrames       = 100000
+	captureMaxFrameSize    = 64 * 1024 // 单帧最多保存的字节数
+)
+
+// activeCapture 内存中的抓包会话，接入路径按设备查找，避免每帧查询数据库
+type activeCapture struct {
+	sessionID uint
+	deviceID  uint
+	topic     string
+	expiresAt time.Time
+	maxFrames int
+
+	mu     sync.Mutex
+	frames int
+}
+
+// captureIndex 进行中的抓包会话，按设备ID和设备主题索引
+var captureIndex = struct {
+	sync.RWMutex
+	byDevice map[uint]*activeCapture
+	byTopic  map[string]*activeCapture
+}{byDevice: make(map[uint]*activeCapture), byTopic: make(map[string]*activeCapture)}
+
+func indexCapture(session *models.CaptureSession) {
+	capture := &activeCapture{
+		sessionID: session.ID,
+		deviceID:  session.DeviceID,
+		topic:     session.Topic,
+		expiresAt: session.ExpiresAt,
+		maxFrames: session.MaxFrames,
+		frames:    session.FrameCount,
+	}
+	captureIndex.Lock()
+	captureIndex.byDevice[capture.deviceID] = capture
+	if capture.topic != "" {
+		captureIndex.byTopic[capture.topic] = capture
+	}
+	captureIndex.Unlock()
+}
+
+func unindexCapture(sessionID uint) {
+	captureIndex.Lock()
+	defer captureIndex.Unlock()
+	for deviceID, capture := range captureIndex.byDevice {
+		if capture.sessionID == sessionID {
+			delete(captureIndex.byDevice, deviceID)
+			if captureIndex.byTopic[capture.topic] == capture {
+				delete(captureIndex.byTopic, capture.topic)
+			}
+		}
+	}
+}
+
+// deviceCapture 返回设备进行中的抓包会话，未开启时返回 nil
+func deviceCapture(deviceID uint) *activeCapture {
+	captureIndex.RLock()
+	defer captureIndex.RUnlock()
+	return captureIndex.byDevice[deviceID]
+}
+
+// topicCapture 按设备主题返回进行中的抓包会话，用于尚未识别出设备记录的帧
+func topicCapture(topic string) *activeCapture {
+	captureIndex.RLock()
+	defer captureIndex.RUnlock()
+	return captureIndex.byTopic[topic]
+}
+
+// LoadCaptureSessions 启动时恢复进行中的抓包会话，已过期的会话标记为停止
+func LoadCaptureSessions() {
+	var sessions []models.CaptureSession
+	database.DB.Where("status = ?", models.CaptureStatusActive).Find(&sessions)
+	for i := range sessions {
+		if time.Now().After(sessions[i].ExpiresAt) {
+			stopCaptureSession(sessions[i].ID, "expired")
+			continue
+		}
+		indexCapture(&sessions[i])
+	}
+}
+
+// stopCaptureSession 停止抓包会话并移出内存索引
+func stopCaptureSession(sessionID uint, reason string) {
+	unindexCapture(sessionID)
+	now := time.Now()
+	database.DB.Model(&models.CaptureSession{}).
+		Where("id = ? AND status = ?", sessionID, models.CaptureStatusActive).
+		Updates(map[string]interface{}{"status": models.CaptureStatusStopped, "stop_reason": reason, "stopped_at": &now})
+}
+
+// record 保存一帧，会话到期或达到帧数上限时停止抓包
+func (c *activeCapture) record(transport, direction, peer string, payload []byte, note string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	if time.Now().After(c.expiresAt) {
+		c.mu.Unlock()
+		stopCaptureSession(c.sessionID, "expired")
+		return
+	}
+	if c.frames >= c.maxFrames {
+		c.mu.Unlock()
+		stopCaptureSession(c.sessionID, "max_frames")
+		return
+	}
+	c.frames++
+	full := c.frames >= c.maxFrames
+	c.mu.Unlock()
+
+	frame := models.CapturedFrame{
+		SessionID:  c.sessionID,
+		DeviceID:   c.deviceID,
+		Transport:  transport,
+		Direction:  direction,
+		Peer:       peer,
+		Size:       len(payload),
+		Note:       note,
+		CapturedAt: time.Now(),
+	}
+	if len(payload) > captureMaxFrameSize {
+		payload = payload[:captureMaxFrameSize]
+		frame.Truncated = true
+	}
+	frame.Payload = hex.EncodeToString(payload)
+	if len(frame.Note) > 255 {
+		frame.Note = frame.Note[:255]
+	}
+
+	if err := database.DB.Create(&frame).Error; err != nil {
+		log.Printf("Failed to save captured frame for device %d: %v", c.deviceID, err)
+		return
+	}
+	database.DB.Model(&models.CaptureSession{}).Where("id = ?", c.sessionID).
+		UpdateColumn("frame_count", gorm.Expr("frame_count + 1"))
+	if full {
+		stopCaptureSession(c.sessionID, "max_frames")
+	}
+}
+
+// errorNote 将处理错误转换为帧备注
+func errorNote(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// zyPeerTopics ZY TCP 连接最近一次识别出的设备主题，用于记录无法解析的帧
+var zyPeerTopics sync.Map // remote addr -> topic
+
+// ZyConnectionClosed 连接关闭后清除对应的设备主题
+func ZyConnectionClosed(conn net.Conn) {
+	zyPeerTopics.Delete(conn.RemoteAddr().String())
+}
+
+// CaptureRecord 导出的抓包帧(JSONL 每行一条)，也是 replay 命令的输入
+type CaptureRecord struct {
+	Time      time.Time `json:"ts"`
+	Device    string    `json:"device"`
+	Transport string    `json:"transport"`
+	Direction string    `json:"direction"`
+	Peer      string    `json:"peer,omitempty"`
+	Payload   string    `json:"payload_hex"`
+	Truncated bool      `json:"truncated,omitempty"`
+	Note      string    `json:"note,omitempty"`
+}
+
+// captureRecord 将保存的帧转换为导出格式
+func captureRecord(session *models.CaptureSession, frame *models.CapturedFrame) CaptureRecord {
+	return CaptureRecord{
+		Time:      frame.CapturedAt,
+		Device:    session.Topic,
+		Transport: frame.Transport,
+		Direction: frame.Direction,
+		Peer:      frame.Peer,
+		Payload:   frame.Payload,
+		Truncated: frame.Truncated,
+		Note:      frame.Note,
+	}
+}
+
+// userCaptureSession 获取属于用户的抓包会话
+func userCaptureSession(c *gin.Context) (*models.CaptureSession, bool) {
+	userID := c.MustGet("userID").(uint)
+	var session models.CaptureSession
+	if err := database.DB.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&session).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Capture session not found"})
+		return nil, false
+	}
+	return &session, true
+}
+
+// StartDeviceCapture 开启设备抓包，同一设备同时只有一个进行中的会话
+func StartDeviceCapture(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	var device models.Device
+	if err := database.DB.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&device).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	var input struct {
+		DurationMinutes int `json:"duration_minutes"`
+		MaxFrames       int `json:"max_frames"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	duration := captureDefaultDuration
+	if input.DurationMinutes > 0 {
+		duration = time.Duration(input.DurationMinutes) * time.Minute
+	}
+	if duration > captureMaxDuration {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("duration must not exceed %v", captureMaxDuration)})
+		return
+	}
+	maxFrames := captureDefaultFrames
+	if input.MaxFrames > 0 {
+		maxFrames = input.MaxFrames
+	}
+	if maxFrames > captureMaxFrames {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("max_frames must not exceed %d", captureMaxFrames)})
+		return
+	}
+
+	if existing := deviceCapture(device.ID); existing != nil {
+		stopCaptureSession(existing.sessionID, "restarted")
+	}
+
+	session := models.CaptureSession{
+		UserID:    userID,
+		DeviceID:  device.ID,
+		Topic:     device.Topic,
+		Status:    models.CaptureStatusActive,
+		MaxFrames: maxFrames,
+		ExpiresAt: time.Now().Add(duration),
+	}
+	if err := database.DB.Create(&session).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create capture session"})
+		return
+	}
+	indexCapture(&session)
+
+	c.JSON(http.StatusCreated, gin.H{"data": session})
+}
+
+// StopDeviceCapture 停止设备进行中的抓包
+func StopDeviceCapture(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	var session models.CaptureSession
+	if err := database.DB.Where("device_id = ? AND user_id = ? AND status = ?", c.Param("id"), userID, models.CaptureStatusActive).
+		First(&session).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No active capture for device"})
+		return
+	}
+	stopCaptureSession(session.ID, "manual")
+	database.DB.First(&session, session.ID)
+
+	c.JSON(http.StatusOK, gin.H{"data": session})
+}
+
+// GetCaptureSessions 获取抓包会话列表，可按 device_id 过滤
+func GetCaptureSessions(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	query := database.DB.Where("user_id = ?", userID)
+	if deviceID := c.Query("device_id"); deviceID != "" {
+		query = query.Where("device_id = ?", deviceID)
+	}
+
+	var sessions []models.CaptureSession
+	if err := query.Order("id DESC").Limit(100).Find(&sessions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch capture sessions"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": sessions})
+}
+
+// GetCaptureFrames 分页获取会话记录的帧
+func GetCaptureFrames(c *gin.Context) {
+	session, ok := userCaptureSession(c)
+	if !ok {
+		return
+	}
+
+	pageNum, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || pageNum < 1 {
+		pageNum = 1
+	}
+	pageSizeNum, err := strconv.Atoi(c.DefaultQuery("page_size", "100"))
+	if err != nil || pageSizeNum < 1 || pageSizeNum > 1000 {
+		pageSizeNum = 100
+	}
+
+	query := database.DB.Model(&models.CapturedFrame{}).Where("session_id = ?", session.ID)
+	var total int64
+	query.Count(&total)
+
+	var frames []models.CapturedFrame
+	if err := query.Order("id").Offset((pageNum - 1) * pageSizeNum).Limit(pageSizeNum).Find(&frames).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch frames"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":      frames,
+		"session":   session,
+		"total":     total,
+		"page":      pageNum,
+		"page_size": pageSizeNum,
+	})
+}
+
+// eachCapturedFrame 按记录顺序分批遍历会话的帧
+func eachCapturedFrame(sessionID uint, fn func(frame *models.CapturedFrame) error) error {
+	var frames []models.CapturedFrame
+	var fnErr error
+	err := database.DB.Where("session_id = ?", sessionID).Order("id").FindInBatches(&frames, 500, func(tx *gorm.DB, batch int) error {
+		for i := range frames {
+			if fnErr = fn(&frames[i]); fnErr != nil {
+				return fnErr
+			}
+		}
+		return nil
+	}).Error
+	if fnErr != nil {
+		return fnErr
+	}
+	return err
+}
+
+// ExportCapture 以 JSONL 格式下载会话记录的帧，可作为 replay 命令的输入
+func ExportCapture(c *gin.Context) {
+	session, ok := userCaptureSession(c)
+	if !ok {
+		return
+	}
+
+	filename := fmt.Sprintf("capture-%d-%s.jsonl", session.ID, session.CreatedAt.Format("20060102-150405"))
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Status(http.StatusOK)
+
+	w := bufio.NewWriter(c.Writer)
+	encoder := json.NewEncoder(w)
+	err := eachCapturedFrame(session.ID, func(frame *models.CapturedFrame) error {
+		return encoder.Encode(captureRecord(session, frame))
+	})
+	if err != nil {
+		log.Printf("Failed to export capture %d: %v", session.ID, err)
+	}
+	w.Flush()
+}
+
+// DeleteCaptureSession 删除抓包会话及其记录的帧
+func DeleteCaptureSession(c *gin.Context) {
+	session, ok := userCaptureSession(c)
+	if !ok {
+		return
+	}
+
+	stopCaptureSession(session.ID, "deleted")
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("session_id = ?", session.ID).Delete(&models.CapturedFrame{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(session).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete capture session"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Capture session deleted successfully"})
+}
@@ -0,0 +1,672 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+// CoAP 消息类型
+const (
+	coapConfirmable    = 0
+	coapNonConfirmable = 1
+	coapAcknowledgment = 2
+	coapReset          = 3
+)
+
+// CoAP 方法及响应码 (class<<5 | detail)
+const (
+	coapEmpty            = 0x00
+	coapGET              = 0x01
+	coapPOST             = 0x02
+	coapPUT              = 0x03
+	coapChanged          = 0x44 // 2.04
+	coapContent          = 0x45 // 2.05
+	coapBadRequest       = 0x80 // 4.00
+	coapUnauthorized     = 0x81 // 4.01
+	coapNotFound         = 0x84 // 4.04
+	coapMethodNotAllowed = 0x85 // 4.05
+)
+
+// CoAP 选项编号
+const (
+	coapOptionObserve       = 6
+	coapOptionURIPath       = 11
+	coapOptionContentFormat = 12
+	coapOptionURIQuery      = 15
+)
+
+// coapContentFormatJSON application/json
+const coapContentFormatJSON = 50
+
+// coapExchangeLifetime CON 消息去重缓存时间(RFC 7252 EXCHANGE_LIFETIME)
+const coapExchangeLifetime = 247 * time.Second
+
+// 观察者及去重缓存的限制。UDP 源地址可以伪造，不加限制时内存无限增长，
+// 且服务器会向任意地址持续发送通知
+const (
+	coapMaxObservers       = 1000
+	coapMaxDeviceObservers = 8
+	coapObserverLifetime   = 10 * time.Minute // 观察者需在该时间内重新注册
+	coapMaxDuplicates      = 10000
+	coapCleanupInterval    = 30 * time.Second
+)
+
+// Observe 选项取值
+const (
+	coapObserveRegister   = 0
+	coapObserveDeregister = 1
+)
+
+// coapTokenQuery 携带设备 CoAP 读取凭证的 Uri-Query 参数名
+const coapTokenQuery = "token"
+
+// CoAPOption CoAP 选项
+type CoAPOption struct {
+	Number uint16
+	Value  []byte
+}
+
+// CoAPMessage CoAP 消息
+type CoAPMessage struct {
+	Type      uint8
+	Code      uint8
+	MessageID uint16
+	Token     []byte
+	Options   []CoAPOption
+	Payload   []byte
+}
+
+// Option 返回第一个指定编号的选项值
+func (m *CoAPMessage) Option(number uint16) ([]byte, bool) {
+	for _, opt := range m.Options {
+		if opt.Number == number {
+			return opt.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Query 返回 Uri-Query 中指定参数的值
+func (m *CoAPMessage) Query(name string) string {
+	for _, opt := range m.Options {
+		if opt.Number != coapOptionURIQuery {
+			continue
+		}
+		if key, value, ok := strings.Cut(string(opt.Value), "="); ok && key == name {
+			return value
+		}
+	}
+	return ""
+}
+
+// Path 返回以 / 连接的 Uri-Path
+func (m *CoAPMessage) Path() string {
+	var segments []string
+	for _, opt := range m.Options {
+		if opt.Number == coapOptionURIPath {
+			segments = append(segments, string(opt.Value))
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// parseCoAPMessage 解析 CoAP 消息 (RFC 7252 第3节)
+func parseCoAPMessage(data []byte) (*CoAPMessage, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("message too short: %d bytes", len(data))
+	}
+	if version := data[0] >> 6; version != 1 {
+		return nil, fmt.Errorf("unsupported CoAP version: %d", version)
+	}
+
+	msg := &CoAPMessage{
+		Type:      (data[0] >> 4) & 0x03,
+		Code:      data[1],
+		MessageID: binary.BigEndian.Uint16(data[2:4]),
+	}
+
+	tokenLen := int(data[0] & 0x0f)
+	if tokenLen > 8 || len(data) < 4+tokenLen {
+		return nil, fmt.Errorf("invalid token length: %d", tokenLen)
+	}
+	msg.Token = data[4 : 4+tokenLen]
+
+	rest := data[4+tokenLen:]
+	var number uint16
+	for len(rest) > 0 {
+		if rest[0] == 0xff {
+			if len(rest) == 1 {
+				return nil, fmt.Errorf("payload marker without payload")
+			}
+			msg.Payload = rest[1:]
+			break
+		}
+
+		delta, length := int(rest[0]>>4), int(rest[0]&0x0f)
+		rest = rest[1:]
+
+		var err error
+		if delta, rest, err = readCoAPOptionNibble(delta, rest); err != nil {
+			return nil, err
+		}
+		if length, rest, err = readCoAPOptionNibble(length, rest); err != nil {
+			return nil, err
+		}
+		if len(rest) < length {
+			return nil, fmt.Errorf("option value truncated")
+		}
+
+		if int(number)+delta > 0xffff {
+			return nil, fmt.Errorf("option number overflow")
+		}
+		number += uint16(delta)
+		msg.Options = append(msg.Options, CoAPOption{Number: number, Value: rest[:length]})
+		rest = rest[length:]
+	}
+
+	return msg, nil
+}
+
+// readCoAPOptionNibble 解析选项 delta/length 的扩展字节
+func readCoAPOptionNibble(value int, rest []byte) (int, []byte, error) {
+	switch value {
+	case 13:
+		if len(rest) < 1 {
+			return 0, nil, fmt.Errorf("option header truncated")
+		}
+		return int(rest[0]) + 13, rest[1:], nil
+	case 14:
+		if len(rest) < 2 {
+			return 0, nil, fmt.Errorf("option header truncated")
+		}
+		return int(binary.BigEndian.Uint16(rest[0:2])) + 269, rest[2:], nil
+	case 15:
+		return 0, nil, fmt.Errorf("reserved option nibble")
+	default:
+		return value, rest, nil
+	}
+}
+
+// Marshal 编码 CoAP 消息，选项按编号排序
+func (m *CoAPMessage) Marshal() []byte {
+	data := []byte{0x40 | (m.Type&0x03)<<4 | uint8(len(m.Token)&0x0f), m.Code, 0, 0}
+	binary.BigEndian.PutUint16(data[2:4], m.MessageID)
+	data = append(data, m.Token...)
+
+	options := append([]CoAPOption(nil), m.Options...)
+	sort.SliceStable(options, func(i, j int) bool { return options[i].Number < options[j].Number })
+
+	var number uint16
+	for _, opt := range options {
+		delta := int(opt.Number - number)
+		number = opt.Number
+
+		deltaNibble, deltaExt := encodeCoAPOptionNibble(delta)
+		lengthNibble, lengthExt := encodeCoAPOptionNibble(len(opt.Value))
+		data = append(data, byte(deltaNibble<<4|lengthNibble))
+		data = append(data, deltaExt...)
+		data = append(data, lengthExt...)
+		data = append(data, opt.Value...)
+	}
+
+	if len(m.Payload) > 0 {
+		data = append(data, 0xff)
+		data = append(data, m.Payload...)
+	}
+	return data
+}
+
+// encodeCoAPOptionNibble 编码选项 delta/length 及其扩展字节
+func encodeCoAPOptionNibble(value int) (int, []byte) {
+	switch {
+	case value < 13:
+		return value, nil
+	case value < 269:
+		return 13, []byte{byte(value - 13)}
+	default:
+		ext := make([]byte, 2)
+		binary.BigEndian.PutUint16(ext, uint16(value-269))
+		return 14, ext
+	}
+}
+
+// encodeCoAPUint 以最少字节编码无符号整数选项值
+func encodeCoAPUint(value uint32) []byte {
+	switch {
+	case value == 0:
+		return nil
+	case value < 1<<8:
+		return []byte{byte(value)}
+	case value < 1<<16:
+		return []byte{byte(value >> 8), byte(value)}
+	default:
+		return []byte{byte(value >> 16), byte(value >> 8), byte(value)}
+	}
+}
+
+// decodeCoAPUint 解码无符号整数选项值
+func decodeCoAPUint(value []byte) uint32 {
+	var result uint32
+	for _, b := range value {
+		result = result<<8 | uint32(b)
+	}
+	return result
+}
+
+// coapObserver 观察某设备数据的客户端
+type coapObserver struct {
+	conn      net.PacketConn
+	addr      net.Addr
+	token     []byte
+	deviceID  uint
+	expires   time.Time
+	messageID uint16 // 最近一次通知的消息ID，客户端以 RST 拒绝时按此匹配
+}
+
+// coapDuplicate 已处理的 CON 消息响应缓存
+type coapDuplicate struct {
+	response []byte
+	expires  time.Time
+}
+
+var (
+	coapMutex      sync.Mutex
+	coapObservers  = make(map[string]*coapObserver)
+	coapDuplicates = make(map[string]coapDuplicate)
+	coapMessageID  uint32
+	coapObserveSeq uint32
+)
+
+// HandleCoAPPacket 处理收到的 CoAP 数据报
+func HandleCoAPPacket(conn net.PacketConn, addr net.Addr, data []byte) {
+	msg, err := parseCoAPMessage(data)
+	if err != nil {
+		fmt.Printf("Error parsing CoAP message from %s: %v\n", addr, err)
+		return
+	}
+
+	// 重传的 CON 消息直接返回之前的响应
+	dupKey := fmt.Sprintf("%s/%d", addr, msg.MessageID)
+	if msg.Type == coapConfirmable {
+		if response, ok := lookupCoAPDuplicate(dupKey); ok {
+			conn.WriteTo(response, addr)
+			return
+		}
+	}
+
+	response := handleCoAPMessage(conn, addr, msg)
+	if response == nil {
+		return
+	}
+
+	encoded := response.Marshal()
+	if msg.Type == coapConfirmable {
+		storeCoAPDuplicate(dupKey, encoded)
+	}
+	if _, err := conn.WriteTo(encoded, addr); err != nil {
+		fmt.Printf("Error writing CoAP response to %s: %v\n", addr, err)
+	}
+}
+
+// handleCoAPMessage 处理请求并返回响应，nil 表示无需响应
+func handleCoAPMessage(conn net.PacketConn, addr net.Addr, msg *CoAPMessage) *CoAPMessage {
+	switch msg.Type {
+	case coapReset:
+		// 客户端拒绝通知，取消观察。RST 不带 token，按通知的消息ID匹配
+		removeCoAPObserverByMessage(addr, msg.MessageID)
+		return nil
+	case coapAcknowledgment:
+		return nil
+	}
+
+	// CoAP ping: 空的 CON 消息以 RST 响应
+	if msg.Code == coapEmpty {
+		if msg.Type == coapConfirmable {
+			return &CoAPMessage{Type: coapReset, MessageID: msg.MessageID}
+		}
+		return nil
+	}
+
+	switch msg.Code {
+	case coapPOST, coapPUT:
+		return handleCoAPUplink(msg)
+	case coapGET:
+		return handleCoAPGet(conn, addr, msg)
+	default:
+		return newCoAPResponse(msg, coapMethodNotAllowed, nil)
+	}
+}
+
+// handleCoAPUplink 处理设备上报: 按 Uri-Path 或负载确定设备，解析并保存
+func handleCoAPUplink(msg *CoAPMessage) *CoAPMessage {
+	device, err := resolveIngestDevice(msg.Path(), msg.Payload)
+	if err != nil {
+		return newCoAPResponse(msg, coapNotFound, []byte(err.Error()))
+	}
+
+	if _, err := ingestDevicePayload(device, "coap", msg.Payload); err != nil {
+		fmt.Printf("Error processing CoAP data for device %s: %v\n", device.Topic, err)
+		return newCoAPResponse(msg, coapBadRequest, []byte(err.Error()))
+	}
+
+	notifyCoAPObservers(device.ID)
+	return newCoAPResponse(msg, coapChanged, nil)
+}
+
+// handleCoAPGet 返回设备最新遥测数据，携带 Observe 选项时注册/取消观察。
+// 只有设置了 CoAP 读取凭证的设备可以读取，请求需在 Uri-Query 中携带 token=<凭证>
+func handleCoAPGet(conn net.PacketConn, addr net.Addr, msg *CoAPMessage) *CoAPMessage {
+	device, err := findDeviceByTopic(msg.Path())
+	if err != nil || !coapTokenValid(device, msg.Query(coapTokenQuery)) {
+		// 设备不存在与凭证错误返回相同结果，避免探测设备
+		return newCoAPResponse(msg, coapUnauthorized, nil)
+	}
+
+	payload, err := latestTelemetryJSON(device.ID)
+	if err != nil {
+		return newCoAPResponse(msg, coapNotFound, []byte("no telemetry"))
+	}
+
+	response := newCoAPResponse(msg, coapContent, payload)
+	response.Options = append(response.Options, CoAPOption{Number: coapOptionContentFormat, Value: encodeCoAPUint(coapContentFormatJSON)})
+
+	if observe, ok := msg.Option(coapOptionObserve); ok {
+		switch decodeCoAPUint(observe) {
+		case coapObserveRegister:
+			observer := &coapObserver{conn: conn, addr: addr, token: append([]byte(nil), msg.Token...), deviceID: device.ID}
+			if addCoAPObserver(observer, time.Now()) {
+				seq := atomic.AddUint32(&coapObserveSeq, 1) & 0xffffff
+				response.Options = append(response.Options, CoAPOption{Number: coapOptionObserve, Value: encodeCoAPUint(seq)})
+			}
+		case coapObserveDeregister:
+			removeCoAPObserver(addr, msg.Token)
+		}
+	}
+
+	return response
+}
+
+// newCoAPResponse 构造响应: CON 请求使用捎带 ACK，NON 请求使用 NON 响应
+func newCoAPResponse(request *CoAPMessage, code uint8, payload []byte) *CoAPMessage {
+	response := &CoAPMessage{
+		Type:      coapAcknowledgment,
+		Code:      code,
+		MessageID: request.MessageID,
+		Token:     request.Token,
+		Payload:   payload,
+	}
+	if request.Type == coapNonConfirmable {
+		response.Type = coapNonConfirmable
+		response.MessageID = uint16(atomic.AddUint32(&coapMessageID, 1))
+	}
+	return response
+}
+
+// lookupCoAPDuplicate 查找重复 CON 消息的缓存响应
+func lookupCoAPDuplicate(key string) ([]byte, bool) {
+	coapMutex.Lock()
+	defer coapMutex.Unlock()
+
+	entry, ok := coapDuplicates[key]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.response, true
+}
+
+// storeCoAPDuplicate 缓存 CON 消息的响应，缓存已满时不再缓存，过期项由定时清理删除
+func storeCoAPDuplicate(key string, response []byte) {
+	coapMutex.Lock()
+	defer coapMutex.Unlock()
+
+	if _, exists := coapDuplicates[key]; !exists && len(coapDuplicates) >= coapMaxDuplicates {
+		return
+	}
+	coapDuplicates[key] = coapDuplicate{response: response, expires: time.Now().Add(coapExchangeLifetime)}
+}
+
+// coapTokenValid 校验设备的 CoAP 读取凭证，未设置凭证的设备不允许读取
+func coapTokenValid(device *models.Device, token string) bool {
+	return device.CoAPToken != "" && subtle.ConstantTimeCompare([]byte(device.CoAPToken), []byte(token)) == 1
+}
+
+// coapObserverKey 观察者以客户端地址和 token 区分
+func coapObserverKey(addr net.Addr, token []byte) string {
+	return addr.String() + "/" + string(token)
+}
+
+// addCoAPObserver 注册或续期观察者，超过总数或单个设备的上限时返回 false
+func addCoAPObserver(observer *coapObserver, now time.Time) bool {
+	coapMutex.Lock()
+	defer coapMutex.Unlock()
+
+	key := coapObserverKey(observer.addr, observer.token)
+	if _, exists := coapObservers[key]; !exists {
+		if len(coapObservers) >= coapMaxObservers {
+			return false
+		}
+		count := 0
+		for _, existing := range coapObservers {
+			if existing.deviceID == observer.deviceID {
+				count++
+			}
+		}
+		if count >= coapMaxDeviceObservers {
+			return false
+		}
+	}
+	observer.expires = now.Add(coapObserverLifetime)
+	coapObservers[key] = observer
+	return true
+}
+
+// removeCoAPObserver 取消观察
+func removeCoAPObserver(addr net.Addr, token []byte) {
+	coapMutex.Lock()
+	defer coapMutex.Unlock()
+	delete(coapObservers, coapObserverKey(addr, token))
+}
+
+// removeCoAPObserverByMessage 客户端以 RST 回应通知时取消对应的观察
+func removeCoAPObserverByMessage(addr net.Addr, messageID uint16) {
+	coapMutex.Lock()
+	defer coapMutex.Unlock()
+	for key, observer := range coapObservers {
+		if observer.messageID == messageID && observer.addr.String() == addr.String() {
+			delete(coapObservers, key)
+		}
+	}
+}
+
+// removeDeviceCoAPObservers 取消设备的所有观察
+func removeDeviceCoAPObservers(deviceID uint) {
+	coapMutex.Lock()
+	defer coapMutex.Unlock()
+	for key, observer := range coapObservers {
+		if observer.deviceID == deviceID {
+			delete(coapObservers, key)
+		}
+	}
+}
+
+// cleanupCoAPState 删除过期的去重缓存和观察者
+func cleanupCoAPState(now time.Time) {
+	coapMutex.Lock()
+	defer coapMutex.Unlock()
+	for key, entry := range coapDuplicates {
+		if now.After(entry.expires) {
+			delete(coapDuplicates, key)
+		}
+	}
+	for key, observer := range coapObservers {
+		if now.After(observer.expires) {
+			delete(coapObservers, key)
+		}
+	}
+}
+
+// StartCoAPCleanup 定时清理过期的 CoAP 去重缓存和观察者
+func StartCoAPCleanup() {
+	go func() {
+		ticker := time.NewTicker(coapCleanupInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			cleanupCoAPState(now)
+		}
+	}()
+}
+
+// notifyCoAPObservers 向观察该设备的客户端发送 NON 通知
+func notifyCoAPObservers(deviceID uint) {
+	now := time.Now()
+	coapMutex.Lock()
+	var observers []*coapObserver
+	for _, observer := range coapObservers {
+		if observer.deviceID == deviceID && now.Before(observer.expires) {
+			observers = append(observers, observer)
+		}
+	}
+	coapMutex.Unlock()
+
+	if len(observers) == 0 {
+		return
+	}
+
+	payload, err := latestTelemetryJSON(deviceID)
+	if err != nil {
+		return
+	}
+
+	seq := atomic.AddUint32(&coapObserveSeq, 1) & 0xffffff
+	for _, observer := range observers {
+		messageID := uint16(atomic.AddUint32(&coapMessageID, 1))
+		coapMutex.Lock()
+		observer.messageID = messageID
+		coapMutex.Unlock()
+		notification := &CoAPMessage{
+			Type:      coapNonConfirmable,
+			Code:      coapContent,
+			MessageID: messageID,
+			Token:     observer.token,
+			Options: []CoAPOption{
+				{Number: coapOptionObserve, Value: encodeCoAPUint(seq)},
+				{Number: coapOptionContentFormat, Value: encodeCoAPUint(coapContentFormatJSON)},
+			},
+			Payload: payload,
+		}
+		if _, err := observer.conn.WriteTo(notification.Marshal(), observer.addr); err != nil {
+			removeCoAPObserver(observer.addr, observer.token)
+		}
+	}
+}
+
+// EnableCoAPAccess 为设备生成新的 CoAP 读取凭证，旧凭证及其观察者失效
+func EnableCoAPAccess(c *gin.Context) {
+	device, ok := userCoAPDevice(c)
+	if !ok {
+		return
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	token := hex.EncodeToString(buf)
+	if err := database.DB.Model(device).Update("coap_token", token).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save token"})
+		return
+	}
+	removeDeviceCoAPObservers(device.ID)
+
+	c.JSON(http.StatusOK, gin.H{"data": gin.H{"coap_token": token}})
+}
+
+// DisableCoAPAccess 清除设备的 CoAP 读取凭证，不再允许通过 CoAP 读取
+func DisableCoAPAccess(c *gin.Context) {
+	device, ok := userCoAPDevice(c)
+	if !ok {
+		return
+	}
+
+	if err := database.DB.Model(device).Update("coap_token", "").Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear token"})
+		return
+	}
+	removeDeviceCoAPObservers(device.ID)
+
+	c.JSON(http.StatusOK, gin.H{"message": "CoAP access disabled"})
+}
+
+// userCoAPDevice 查找当前用户的设备，找不到时返回 404
+func userCoAPDevice(c *gin.Context) (*models.Device, bool) {
+	userID := c.MustGet("userID").(uint)
+	var device models.Device
+	if err := database.DB.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&device).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return nil, false
+	}
+	return &device, true
+}
+
+// latestTelemetryJSON 返回设备最新一条遥测数据的 JSON
+func latestTelemetryJSON(deviceID uint) ([]byte, error) {
+	var telemetry models.Telemetry
+	if err := database.DB.Where("device_id = ?", deviceID).Order("timestamp DESC").First(&telemetry).Error; err != nil {
+		return nil, err
+	}
+	return json.Marshal(telemetry)
+}
+
+// findDeviceByTopic 按 topic 查找设备
+func findDeviceByTopic(topic string) (*models.Device, error) {
+	if topic == "" {
+		return nil, fmt.Errorf("empty device topic")
+	}
+	var device models.Device
+	if err := database.DB.Where("topic = ?", topic).First(&device).Error; err != nil {
+		return nil, fmt.Errorf("device %s not found", topic)
+	}
+	return &device, nil
+}
+
+// resolveIngestDevice 优先按地址(topic)查找设备，找不到时从负载中识别
+func resolveIngestDevice(topic string, payload []byte) (*models.Device, error) {
+	if device, err := findDeviceByTopic(topic); err == nil {
+		return device, nil
+	}
+	return resolveDeviceByPayload(payload)
+}
+
+// HandleUDPPacket 处理原始 UDP 数据报: 从负载识别设备并解析，回复 ACK 或错误信息
+func HandleUDPPacket(conn net.PacketConn, addr net.Addr, data []byte) {
+	device, err := resolveDeviceByPayload(data)
+	if err != nil {
+		fmt.Printf("Error resolving UDP device from %s: %v\n", addr, err)
+		conn.WriteTo([]byte("ERROR: "+err.Error()), addr)
+		return
+	}
+
+	if _, err := ingestDevicePayload(device, "udp", data); err != nil {
+		fmt.Printf("Error processing UDP data for device %s: %v\n", device.Topic, err)
+		conn.WriteTo([]byte("ERROR: "+err.Error()), addr)
+		return
+	}
+
+	conn.WriteTo([]byte("ACK"), addr)
+}
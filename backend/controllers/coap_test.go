@@ -0,0 +1,229 @@
+package controllers
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+func TestCoAPMessageRoundTrip(t *testing.T) {
+	msg := &CoAPMessage{
+		Type:      coapConfirmable,
+		Code:      coapPOST,
+		MessageID: 0x1234,
+		Token:     []byte{0xde, 0xad, 0xbe, 0xef},
+		Options: []CoAPOption{
+			{Number: coapOptionContentFormat, Value: encodeCoAPUint(coapContentFormatJSON)},
+			{Number: coapOptionURIPath, Value: []byte("meters")},
+			{Number: coapOptionURIPath, Value: []byte("nb-iot-meter-000123456")},
+			{Number: 2048, Value: []byte{0x01}},
+		},
+		Payload: []byte(`{"reading":12.5}`),
+	}
+
+	parsed, err := parseCoAPMessage(msg.Marshal())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if parsed.Type != msg.Type || parsed.Code != msg.Code || parsed.MessageID != msg.MessageID {
+		t.Errorf("Header mismatch: %+v", parsed)
+	}
+	if !bytes.Equal(parsed.Token, msg.Token) {
+		t.Errorf("Expected token %x, got %x", msg.Token, parsed.Token)
+	}
+	if parsed.Path() != "meters/nb-iot-meter-000123456" {
+		t.Errorf("Expected path 'meters/nb-iot-meter-000123456', got '%s'", parsed.Path())
+	}
+	if value, ok := parsed.Option(coapOptionContentFormat); !ok || decodeCoAPUint(value) != coapContentFormatJSON {
+		t.Errorf("Expected content format 50, got %v", value)
+	}
+	if value, ok := parsed.Option(2048); !ok || !bytes.Equal(value, []byte{0x01}) {
+		t.Errorf("Expected extended option 2048, got %v", value)
+	}
+	if !bytes.Equal(parsed.Payload, msg.Payload) {
+		t.Errorf("Expected payload %s, got %s", msg.Payload, parsed.Payload)
+	}
+}
+
+func TestParseCoAPMessageErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "too short", data: []byte{0x40, 0x01}},
+		{name: "wrong version", data: []byte{0x80, 0x01, 0x00, 0x01}},
+		{name: "token too long", data: []byte{0x49, 0x01, 0x00, 0x01}},
+		{name: "payload marker without payload", data: []byte{0x40, 0x02, 0x00, 0x01, 0xff}},
+		{name: "truncated option", data: []byte{0x40, 0x02, 0x00, 0x01, 0xb5, 'a'}},
+		{name: "reserved nibble", data: []byte{0x40, 0x02, 0x00, 0x01, 0xf1, 0x00}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseCoAPMessage(tt.data); err == nil {
+				t.Error("Expected error, but got none")
+			}
+		})
+	}
+}
+
+func TestHandleCoAPMessage(t *testing.T) {
+	t.Run("Ping is answered with reset", func(t *testing.T) {
+		ping := &CoAPMessage{Type: coapConfirmable, Code: coapEmpty, MessageID: 7}
+		response := handleCoAPMessage(nil, nil, ping)
+		if response == nil || response.Type != coapReset || response.MessageID != 7 {
+			t.Errorf("Expected RST with message ID 7, got %+v", response)
+		}
+	})
+
+	t.Run("Unsupported method on confirmable request", func(t *testing.T) {
+		request := &CoAPMessage{Type: coapConfirmable, Code: 0x04, MessageID: 9, Token: []byte{0x01}}
+		response := handleCoAPMessage(nil, nil, request)
+		if response == nil || response.Type != coapAcknowledgment || response.Code != coapMethodNotAllowed {
+			t.Fatalf("Expected ACK 4.05, got %+v", response)
+		}
+		if response.MessageID != 9 || !bytes.Equal(response.Token, []byte{0x01}) {
+			t.Errorf("Expected piggybacked response to echo message ID and token, got %+v", response)
+		}
+	})
+
+	t.Run("Non-confirmable request gets non-confirmable response", func(t *testing.T) {
+		request := &CoAPMessage{Type: coapNonConfirmable, Code: 0x04, MessageID: 11, Token: []byte{0x02}}
+		response := handleCoAPMessage(nil, nil, request)
+		if response == nil || response.Type != coapNonConfirmable {
+			t.Errorf("Expected NON response, got %+v", response)
+		}
+	})
+}
+
+// useTestCoAPState 使用空的观察者及去重缓存
+func useTestCoAPState(t *testing.T) {
+	t.Helper()
+	coapMutex.Lock()
+	observers, duplicates := coapObservers, coapDuplicates
+	coapObservers = make(map[string]*coapObserver)
+	coapDuplicates = make(map[string]coapDuplicate)
+	coapMutex.Unlock()
+	t.Cleanup(func() {
+		coapMutex.Lock()
+		coapObservers, coapDuplicates = observers, duplicates
+		coapMutex.Unlock()
+	})
+}
+
+// coapGet 构造读取设备数据的 GET 请求
+func coapGet(topic, token string, observe bool) *CoAPMessage {
+	msg := &CoAPMessage{Type: coapConfirmable, Code: coapGET, MessageID: 1, Token: []byte(topic + token)}
+	msg.Options = append(msg.Options, CoAPOption{Number: coapOptionURIPath, Value: []byte(topic)})
+	if token != "" {
+		msg.Options = append(msg.Options, CoAPOption{Number: coapOptionURIQuery, Value: []byte("token=" + token)})
+	}
+	if observe {
+		msg.Options = append(msg.Options, CoAPOption{Number: coapOptionObserve, Value: encodeCoAPUint(coapObserveRegister)})
+	}
+	return msg
+}
+
+func TestCoAPGetRequiresToken(t *testing.T) {
+	useTestDatabase(t)
+	useTestCoAPState(t)
+
+	private := models.Device{Name: "meter", Topic: "860000000000001", UserID: 1}
+	shared := models.Device{Name: "meter", Topic: "860000000000002", UserID: 1, CoAPToken: "secret"}
+	database.DB.Create(&private)
+	database.DB.Create(&shared)
+	database.DB.Create(&models.Telemetry{DeviceID: private.ID, Timestamp: time.Now().Unix()})
+	database.DB.Create(&models.Telemetry{DeviceID: shared.ID, Timestamp: time.Now().Unix()})
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer conn.Close()
+	addr := conn.LocalAddr()
+
+	// 未设置凭证、凭证错误或设备不存在时返回相同结果，不注册观察者
+	for _, msg := range []*CoAPMessage{
+		coapGet(private.Topic, "", true),
+		coapGet(private.Topic, "secret", true),
+		coapGet(shared.Topic, "", true),
+		coapGet(shared.Topic, "wrong", true),
+		coapGet("860000000000999", "secret", true),
+	} {
+		response := handleCoAPMessage(conn, addr, msg)
+		if response == nil || response.Code != coapUnauthorized || len(response.Payload) != 0 {
+			t.Errorf("Expected 4.01 for %s?%s, got %+v", msg.Path(), msg.Query("token"), response)
+		}
+	}
+	if len(coapObservers) != 0 {
+		t.Fatalf("Expected no observers, got %d", len(coapObservers))
+	}
+
+	response := handleCoAPMessage(conn, addr, coapGet(shared.Topic, "secret", true))
+	if response == nil || response.Code != coapContent || len(response.Payload) == 0 {
+		t.Fatalf("Expected 2.05 with telemetry, got %+v", response)
+	}
+	if _, ok := response.Option(coapOptionObserve); !ok || len(coapObservers) != 1 {
+		t.Errorf("Expected observer to be registered, got %d", len(coapObservers))
+	}
+}
+
+func TestCoAPObserverLimits(t *testing.T) {
+	useTestCoAPState(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer conn.Close()
+	now := time.Now()
+	observer := func(port int, deviceID uint) *coapObserver {
+		return &coapObserver{conn: conn, addr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: port}, token: []byte{1}, deviceID: deviceID}
+	}
+
+	// 单个设备及总数的上限
+	for i := 0; i < coapMaxDeviceObservers; i++ {
+		if !addCoAPObserver(observer(1000+i, 1), now) {
+			t.Fatalf("Expected observer %d to be added", i)
+		}
+	}
+	if addCoAPObserver(observer(2000, 1), now) {
+		t.Error("Expected per-device limit to reject observer")
+	}
+	if !addCoAPObserver(observer(1000, 1), now.Add(time.Minute)) {
+		t.Error("Expected re-registration to be accepted")
+	}
+	for i := 0; len(coapObservers) < coapMaxObservers; i++ {
+		addCoAPObserver(observer(3000+i, uint(100+i)), now)
+	}
+	if addCoAPObserver(observer(9999, 9999), now) {
+		t.Error("Expected global limit to reject observer")
+	}
+
+	// 客户端以 RST 回应通知时取消观察
+	coapObservers[coapObserverKey(observer(1001, 1).addr, []byte{1})].messageID = 77
+	handleCoAPMessage(conn, observer(1001, 1).addr, &CoAPMessage{Type: coapReset, MessageID: 77})
+	if _, ok := coapObservers[coapObserverKey(observer(1001, 1).addr, []byte{1})]; ok {
+		t.Error("Expected RST to remove observer")
+	}
+
+	// 过期的观察者及去重缓存被定时清理，重新注册的观察者保留
+	storeCoAPDuplicate("expired", []byte{1})
+	cleanupCoAPState(now.Add(coapObserverLifetime + time.Second))
+	if len(coapObservers) != 1 || len(coapDuplicates) != 0 {
+		t.Errorf("Expected only the re-registered observer to remain, got %d observers, %d duplicates", len(coapObservers), len(coapDuplicates))
+	}
+
+	for i := 0; i < coapMaxDuplicates+10; i++ {
+		storeCoAPDuplicate(fmt.Sprint(i), nil)
+	}
+	if len(coapDuplicates) != coapMaxDuplicates {
+		t.Errorf("Expected duplicate cache to be capped, got %d", len(coapDuplicates))
+	}
+}
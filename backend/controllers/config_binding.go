@@ -0,0 +1,285 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+// 解析配置的来源，按优先级从高到低
+const (
+	ConfigSourceDevice  = "device"  // 设备绑定
+	ConfigSourceTopic   = "topic"   // 主题模式绑定
+	ConfigSourceGroup   = "group"   // 设备组绑定
+	ConfigSourceDefault = "default" // 用户默认配置
+)
+
+// mqttTopicMatch 判断主题是否匹配 MQTT 主题模式(+ 匹配单层，# 匹配剩余所有层)
+func mqttTopicMatch(pattern, topic string) bool {
+	patternLevels := strings.Split(pattern, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, level := range patternLevels {
+		if level == "#" {
+			return i == len(patternLevels)-1
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(patternLevels) == len(topicLevels)
+}
+
+// validateTopicPattern 校验主题模式，# 只能出现在最后一层，通配符必须独占一层
+func validateTopicPattern(pattern string) error {
+	if pattern == "" {
+		return fmt.Errorf("pattern is required")
+	}
+	levels := strings.Split(pattern, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return fmt.Errorf("'#' must be the last level of the pattern")
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return fmt.Errorf("'+' must occupy an entire level")
+		}
+	}
+	return nil
+}
+
+// topicPatternSpecificity 主题模式的精确程度，精确层级越多越优先
+func topicPatternSpecificity(pattern string) int {
+	score := 0
+	for _, level := range strings.Split(pattern, "/") {
+		switch level {
+		case "#":
+		case "+":
+			score++
+		default:
+			score += 2
+		}
+	}
+	return score
+}
+
+// matchTopicBinding 在绑定列表中选择与主题匹配的最佳绑定: 优先级高者优先，其次模式更精确者
+func matchTopicBinding(bindings []models.TopicConfigBinding, topic string) *models.TopicConfigBinding {
+	var matched []models.TopicConfigBinding
+	for _, binding := range bindings {
+		if mqttTopicMatch(binding.Pattern, topic) {
+			matched = append(matched, binding)
+		}
+	}
+	if len(matched) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		if matched[i].Priority != matched[j].Priority {
+			return matched[i].Priority > matched[j].Priority
+		}
+		return topicPatternSpecificity(matched[i].Pattern) > topicPatternSpecificity(matched[j].Pattern)
+	})
+	return &matched[0]
+}
+
+// userConfigByID 获取属于指定用户的消息类型配置
+func userConfigByID(userID, configID uint) (*models.MessageTypeConfig, error) {
+	var config models.MessageTypeConfig
+	if err := database.DB.Where("id = ? AND user_id = ?", configID, userID).First(&config).Error; err != nil {
+		return nil, fmt.Errorf("message type config %d not found", configID)
+	}
+	return &config, nil
+}
+
+// boundMessageConfig 按 设备绑定 > 主题模式绑定 > 设备组绑定 的顺序查找显式绑定的配置，
+// 没有显式绑定时返回 nil
+func boundMessageConfig(device *models.Device, topic string) (*models.MessageTypeConfig, string) {
+	if device.MessageTypeConfigID != nil {
+		if config, err := userConfigByID(device.UserID, *device.MessageTypeConfigID); err == nil {
+			return config, ConfigSourceDevice
+		}
+	}
+
+	if topic == "" {
+		topic = device.Topic
+	}
+	var bindings []models.TopicConfigBinding
+	database.DB.Where("user_id = ?", device.UserID).Order("id").Find(&bindings)
+	if binding := matchTopicBinding(bindings, topic); binding != nil {
+		if config, err := userConfigByID(device.UserID, binding.ConfigID); err == nil {
+			return config, ConfigSourceTopic
+		}
+	}
+
+	if device.GroupID != nil {
+		var group models.DeviceGroup
+		if err := database.DB.First(&group, *device.GroupID).Error; err == nil && group.MessageTypeConfigID != nil {
+			if config, err := userConfigByID(device.UserID, *group.MessageTypeConfigID); err == nil {
+				return config, ConfigSourceGroup
+			}
+		}
+	}
+
+	return nil, ""
+}
+
+// resolveMessageConfig 选择设备在指定主题上使用的解析配置，没有显式绑定时回退到用户默认配置
+func resolveMessageConfig(device *models.Device, topic string) (*models.MessageTypeConfig, string, error) {
+	if config, source := boundMessageConfig(device, topic); config != nil {
+		return config, source, nil
+	}
+
+	config, err := defaultMessageConfig(device.UserID)
+	if err != nil {
+		return nil, "", err
+	}
+	return config, ConfigSourceDefault, nil
+}
+
+// GetDeviceMessageConfig 获取设备当前生效的解析配置及其来源
+func GetDeviceMessageConfig(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	id := c.Param("id")
+
+	var device models.Device
+	if err := database.DB.Where("id = ? AND user_id = ?", id, userID).First(&device).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	config, source, err := resolveMessageConfig(&device, c.Query("topic"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": config, "source": source})
+}
+
+// GetTopicConfigBindings 获取主题绑定列表
+func GetTopicConfigBindings(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	var bindings []models.TopicConfigBinding
+	if err := database.DB.Where("user_id = ?", userID).Order("priority DESC, id").Find(&bindings).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get topic bindings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": bindings})
+}
+
+// CreateTopicConfigBinding 创建主题绑定
+func CreateTopicConfigBinding(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	var input struct {
+		Pattern  string `json:"pattern" binding:"required"`
+		ConfigID uint   `json:"config_id" binding:"required"`
+		Priority int    `json:"priority"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := validateTopicPattern(input.Pattern); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := userConfigByID(userID, input.ConfigID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message type config not found"})
+		return
+	}
+
+	binding := models.TopicConfigBinding{
+		UserID:   userID,
+		Pattern:  input.Pattern,
+		ConfigID: input.ConfigID,
+		Priority: input.Priority,
+	}
+	if err := database.DB.Create(&binding).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create topic binding"})
+		return
+	}
+
+	refreshMQTTIngestion()
+	c.JSON(http.StatusOK, gin.H{"data": binding})
+}
+
+// UpdateTopicConfigBinding 更新主题绑定
+func UpdateTopicConfigBinding(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	id := c.Param("id")
+
+	var binding models.TopicConfigBinding
+	if err := database.DB.Where("id = ? AND user_id = ?", id, userID).First(&binding).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Topic binding not found"})
+		return
+	}
+
+	var input struct {
+		Pattern  string `json:"pattern"`
+		ConfigID uint   `json:"config_id"`
+		Priority *int   `json:"priority"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if input.Pattern != "" {
+		if err := validateTopicPattern(input.Pattern); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		binding.Pattern = input.Pattern
+	}
+	if input.ConfigID != 0 {
+		if _, err := userConfigByID(userID, input.ConfigID); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Message type config not found"})
+			return
+		}
+		binding.ConfigID = input.ConfigID
+	}
+	if input.Priority != nil {
+		binding.Priority = *input.Priority
+	}
+
+	if err := database.DB.Save(&binding).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update topic binding"})
+		return
+	}
+
+	refreshMQTTIngestion()
+	c.JSON(http.StatusOK, gin.H{"data": binding})
+}
+
+// DeleteTopicConfigBinding 删除主题绑定
+func DeleteTopicConfigBinding(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	id := c.Param("id")
+
+	var binding models.TopicConfigBinding
+	if err := database.DB.Where("id = ? AND user_id = ?", id, userID).First(&binding).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Topic binding not found"})
+		return
+	}
+
+	if err := database.DB.Delete(&binding).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete topic binding"})
+		return
+	}
+
+	refreshMQTTIngestion()
+	c.JSON(http.StatusOK, gin.H{"message": "Topic binding deleted successfully"})
+}
@@ -0,0 +1,108 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+func TestMQTTTopicMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		topic   string
+		want    bool
+	}{
+		{pattern: "sensors/room1/temp", topic: "sensors/room1/temp", want: true},
+		{pattern: "sensors/+/temp", topic: "sensors/room1/temp", want: true},
+		{pattern: "sensors/+/temp", topic: "sensors/room1/humidity", want: false},
+		{pattern: "sensors/#", topic: "sensors/room1/temp", want: true},
+		{pattern: "sensors/#", topic: "sensors", want: true},
+		{pattern: "#", topic: "any/topic", want: true},
+		{pattern: "sensors/+", topic: "sensors/room1/temp", want: false},
+		{pattern: "sensors/room1/temp", topic: "sensors/room1", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := mqttTopicMatch(tt.pattern, tt.topic); got != tt.want {
+			t.Errorf("mqttTopicMatch(%q, %q) = %v, want %v", tt.pattern, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestValidateTopicPattern(t *testing.T) {
+	valid := []string{"a/b/c", "a/+/c", "a/#", "#", "+"}
+	for _, pattern := range valid {
+		if err := validateTopicPattern(pattern); err != nil {
+			t.Errorf("Expected %q to be valid, got %v", pattern, err)
+		}
+	}
+
+	invalid := []string{"", "a/#/c", "a/b#", "a/b+/c"}
+	for _, pattern := range invalid {
+		if err := validateTopicPattern(pattern); err == nil {
+			t.Errorf("Expected %q to be invalid", pattern)
+		}
+	}
+}
+
+func TestMatchTopicBinding(t *testing.T) {
+	bindings := []models.TopicConfigBinding{
+		{Pattern: "meters/#", ConfigID: 1},
+		{Pattern: "meters/+/power", ConfigID: 2},
+		{Pattern: "meters/site-a/power", ConfigID: 3},
+		{Pattern: "trackers/#", ConfigID: 4, Priority: 0},
+		{Pattern: "trackers/+/gps", ConfigID: 5, Priority: -1},
+	}
+
+	tests := []struct {
+		name     string
+		topic    string
+		configID uint
+	}{
+		{name: "Most specific pattern wins", topic: "meters/site-a/power", configID: 3},
+		{name: "Single level wildcard beats multi level", topic: "meters/site-b/power", configID: 2},
+		{name: "Multi level wildcard fallback", topic: "meters/site-b/water", configID: 1},
+		{name: "Priority beats specificity", topic: "trackers/t1/gps", configID: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			binding := matchTopicBinding(bindings, tt.topic)
+			if binding == nil || binding.ConfigID != tt.configID {
+				t.Errorf("Expected config %d, got %+v", tt.configID, binding)
+			}
+		})
+	}
+
+	if binding := matchTopicBinding(bindings, "other/topic"); binding != nil {
+		t.Errorf("Expected no binding, got %+v", binding)
+	}
+}
+
+func TestMQTTIngestTopics(t *testing.T) {
+	useTestDatabase(t)
+
+	configID := uint(7)
+	group := models.DeviceGroup{Name: "bound", MessageTypeConfigID: &configID}
+	database.DB.Create(&group)
+	devices := []models.Device{
+		{Name: "mine", Topic: "site1/meter", UserID: 1},
+		{Name: "theirs", Topic: "site2/meter", UserID: 2},
+		{Name: "grouped", Topic: "site2/pump", UserID: 2, GroupID: &group.ID},
+		{Name: "wildcard", Topic: "site1/+", UserID: 1},
+	}
+	for i := range devices {
+		database.DB.Create(&devices[i])
+	}
+	database.DB.Create(&models.TopicConfigBinding{UserID: 1, Pattern: "#", ConfigID: 1})
+
+	topics := mqttIngestTopics()
+	if len(topics) != 2 || !topics["site1/meter"] || !topics["site2/pump"] {
+		t.Errorf("Expected only site1/meter and site2/pump, got %v", topics)
+	}
+
+	if err := ingestMQTTMessage("unknown/device", []byte("{}")); err == nil {
+		t.Error("Expected message from unknown device to be dropped")
+	}
+}
@@ -0,0 +1,395 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+)
+
+// configBundleKind 配置包类型标识，导入时用于识别文件
+const configBundleKind = "message-type-configs"
+
+// 导入时与同名配置冲突的处理方式
+const (
+	ConflictFail      = "fail"      // 存在冲突时不导入任何配置
+	ConflictSkip      = "skip"      // 跳过同名配置
+	ConflictOverwrite = "overwrite" // 覆盖同名配置并生成新版本
+	ConflictRename    = "rename"    // 以新名称创建
+)
+
+// ConfigBundle 可在不同环境间迁移的消息类型配置包
+type ConfigBundle struct {
+	Kind       string         `json:"kind" yaml:"kind"`
+	Version    int            `json:"version" yaml:"version"`
+	ExportedAt int64          `json:"exported_at" yaml:"exported_at"`
+	Configs    []BundleConfig `json:"configs" yaml:"configs"`
+}
+
+// BundleConfig 配置包中的单个配置，Format 以结构化对象保存便于阅读和比对；
+// 默认配置标记与环境相关，不随配置包迁移
+type BundleConfig struct {
+	Name          string      `json:"name" yaml:"name"`
+	Description   string      `json:"description,omitempty" yaml:"description,omitempty"`
+	Protocol      string      `json:"protocol" yaml:"protocol"`
+	FPort         int         `json:"f_port,omitempty" yaml:"f_port,omitempty"`
+	SourceVersion int         `json:"source_version,omitempty" yaml:"source_version,omitempty"` // 导出时的配置版本
+	Format        interface{} `json:"format" yaml:"format"`
+}
+
+// ImportResult 单个配置的导入结果
+type ImportResult struct {
+	Name    string `json:"name"`
+	Action  string `json:"action"` // created, updated, unchanged, skipped, renamed, conflict
+	ID      uint   `json:"id,omitempty"`
+	Version int    `json:"version,omitempty"`
+	NewName string `json:"new_name,omitempty"`
+}
+
+// formatDocument 将保存的 Format 字符串转换为结构化对象，兼容被引号包裹的 JSON 字符串
+func formatDocument(format string) (interface{}, error) {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(format), &doc); err != nil {
+		return nil, err
+	}
+	if inner, ok := doc.(string); ok {
+		if err := json.Unmarshal([]byte(inner), &doc); err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// bundleFormatString 将配置包中的 Format 对象转换为保存用的 JSON 字符串并校验
+func bundleFormatString(doc interface{}) (string, error) {
+	if text, ok := doc.(string); ok {
+		doc = nil
+		if err := json.Unmarshal([]byte(text), &doc); err != nil {
+			return "", fmt.Errorf("invalid format JSON: %v", err)
+		}
+	}
+	if _, ok := doc.(map[string]interface{}); !ok {
+		return "", fmt.Errorf("format must be an object")
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	var format models.MessageFormat
+	if err := json.Unmarshal(data, &format); err != nil {
+		return "", fmt.Errorf("invalid format: %v", err)
+	}
+	return string(data), nil
+}
+
+// newConfigBundle 将配置打包
+func newConfigBundle(configs []models.MessageTypeConfig) (*ConfigBundle, error) {
+	bundle := &ConfigBundle{
+		Kind:       configBundleKind,
+		Version:    1,
+		ExportedAt: time.Now().Unix(),
+		Configs:    make([]BundleConfig, 0, len(configs)),
+	}
+	for _, config := range configs {
+		format, err := formatDocument(config.Format)
+		if err != nil {
+			return nil, fmt.Errorf("config '%s' has invalid format: %v", config.Name, err)
+		}
+		bundle.Configs = append(bundle.Configs, BundleConfig{
+			Name:          config.Name,
+			Description:   config.Description,
+			Protocol:      config.Protocol,
+			FPort:         config.FPort,
+			SourceVersion: config.Version,
+			Format:        format,
+		})
+	}
+	return bundle, nil
+}
+
+// decodeConfigBundle 解析 JSON 或 YAML 配置包(JSON 是 YAML 的子集，按内容自动识别)
+func decodeConfigBundle(data []byte) (*ConfigBundle, error) {
+	var bundle ConfigBundle
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		if err := json.Unmarshal(trimmed, &bundle); err != nil {
+			return nil, fmt.Errorf("invalid bundle JSON: %v", err)
+		}
+	} else if err := yaml.Unmarshal(trimmed, &bundle); err != nil {
+		return nil, fmt.Errorf("invalid bundle YAML: %v", err)
+	}
+
+	if bundle.Kind != "" && bundle.Kind != configBundleKind {
+		return nil, fmt.Errorf("unsupported bundle kind: %s", bundle.Kind)
+	}
+	if len(bundle.Configs) == 0 {
+		return nil, fmt.Errorf("bundle contains no configs")
+	}
+
+	seen := make(map[string]bool)
+	for i, config := range bundle.Configs {
+		if config.Name == "" || config.Protocol == "" {
+			return nil, fmt.Errorf("config %d: name and protocol are required", i)
+		}
+		if seen[config.Name] {
+			return nil, fmt.Errorf("config '%s' appears more than once", config.Name)
+		}
+		seen[config.Name] = true
+	}
+	return &bundle, nil
+}
+
+// uniqueConfigName 为重命名导入生成不与已有配置重复的名称
+func uniqueConfigName(name string, taken map[string]bool) string {
+	for i := 2; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)", name, i)
+		if !taken[candidate] {
+			return candidate
+		}
+	}
+}
+
+// importConfigBundle 按冲突处理方式导入配置包，dryRun 时只返回预期结果
+func importConfigBundle(tx *gorm.DB, userID uint, bundle *ConfigBundle, conflict string, dryRun bool) ([]ImportResult, error) {
+	var existing []models.MessageTypeConfig
+	if err := tx.Where("user_id = ?", userID).Find(&existing).Error; err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*models.MessageTypeConfig)
+	taken := make(map[string]bool)
+	for i := range existing {
+		byName[existing[i].Name] = &existing[i]
+		taken[existing[i].Name] = true
+	}
+
+	results := make([]ImportResult, 0, len(bundle.Configs))
+	for _, item := range bundle.Configs {
+		format, err := bundleFormatString(item.Format)
+		if err != nil {
+			return nil, fmt.Errorf("config '%s': %v", item.Name, err)
+		}
+		validation := validateMessageFormat(item.Protocol, format)
+		if !validation.Valid {
+			issue := validation.Errors[0]
+			return nil, fmt.Errorf("config '%s': format.%s: %s", item.Name, issue.Path, issue.Message)
+		}
+		format = validation.Format
+		result := ImportResult{Name: item.Name}
+		incoming := models.MessageTypeConfig{
+			UserID:      userID,
+			Name:        item.Name,
+			Description: item.Description,
+			Protocol:    item.Protocol,
+			Format:      format,
+			FPort:       item.FPort,
+		}
+
+		current, exists := byName[item.Name]
+		switch {
+		case !exists:
+			result.Action = "created"
+		case conflict == ConflictSkip:
+			result.Action = "skipped"
+			result.ID = current.ID
+			results = append(results, result)
+			continue
+		case conflict == ConflictRename:
+			incoming.Name = uniqueConfigName(item.Name, taken)
+			result.Action = "renamed"
+			result.NewName = incoming.Name
+		case conflict == ConflictOverwrite:
+			result.ID = current.ID
+			// Format 按内容比较，忽略键顺序和空白
+			if current.Description == incoming.Description && current.Protocol == incoming.Protocol &&
+				current.FPort == incoming.FPort && jsonEqual(current.Format, incoming.Format) {
+				result.Action = "unchanged"
+				result.Version = current.Version
+				results = append(results, result)
+				continue
+			}
+			result.Action = "updated"
+		default:
+			result.Action = "conflict"
+			result.ID = current.ID
+			results = append(results, result)
+			continue
+		}
+		taken[incoming.Name] = true
+
+		if dryRun {
+			results = append(results, result)
+			continue
+		}
+
+		comment := "imported"
+		if item.SourceVersion > 0 {
+			comment = fmt.Sprintf("imported from version %d", item.SourceVersion)
+		}
+		if result.Action == "updated" {
+			// 覆盖前确保旧内容已有版本记录，便于回滚
+			if current.Version == 0 {
+				if _, err := recordConfigVersion(tx, current, userID, "initial version", 0); err != nil {
+					return nil, err
+				}
+			}
+			invalidateDecoder(current.Format)
+			current.Description = incoming.Description
+			current.Protocol = incoming.Protocol
+			current.Format = incoming.Format
+			current.FPort = incoming.FPort
+			if err := tx.Save(current).Error; err != nil {
+				return nil, err
+			}
+			if _, err := recordConfigVersion(tx, current, userID, comment, 0); err != nil {
+				return nil, err
+			}
+			result.Version = current.Version
+		} else {
+			if err := tx.Create(&incoming).Error; err != nil {
+				return nil, err
+			}
+			if _, err := recordConfigVersion(tx, &incoming, userID, comment, 0); err != nil {
+				return nil, err
+			}
+			result.ID = incoming.ID
+			result.Version = incoming.Version
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// ExportMessageTypeConfigs 导出消息类型配置包，ids 为逗号分隔的配置ID(为空时导出全部)，
+// format=yaml 时导出 YAML，否则导出 JSON
+func ExportMessageTypeConfigs(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	query := database.DB.Where("user_id = ?", userID)
+	if ids := c.Query("ids"); ids != "" {
+		var configIDs []uint
+		for _, part := range strings.Split(ids, ",") {
+			id, err := strconv.ParseUint(strings.TrimSpace(part), 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid config id: " + part})
+				return
+			}
+			configIDs = append(configIDs, uint(id))
+		}
+		query = query.Where("id IN ?", configIDs)
+	}
+
+	var configs []models.MessageTypeConfig
+	if err := query.Order("id").Find(&configs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get message type configs"})
+		return
+	}
+	if len(configs) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No message type configs to export"})
+		return
+	}
+
+	bundle, err := newConfigBundle(configs)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	filename := fmt.Sprintf("message-types-%s", time.Now().Format("20060102150405"))
+	if c.Query("format") == "yaml" {
+		data, err := yaml.Marshal(bundle)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode bundle"})
+			return
+		}
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s.yaml", filename))
+		c.Data(http.StatusOK, "application/yaml", data)
+		return
+	}
+
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode bundle"})
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s.json", filename))
+	c.Data(http.StatusOK, "application/json", data)
+}
+
+// uploadedContent 读取上传文件(表单字段 file)或请求体内容
+func uploadedContent(c *gin.Context) ([]byte, error) {
+	if file, err := c.FormFile("file"); err == nil {
+		f, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return io.ReadAll(f)
+	}
+	return io.ReadAll(c.Request.Body)
+}
+
+// ImportMessageTypeConfigs 导入消息类型配置包(JSON/YAML)，
+// conflict 指定同名冲突处理方式: fail(默认)、skip、overwrite、rename；dry_run=true 时只预览结果
+func ImportMessageTypeConfigs(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	conflict := c.DefaultQuery("conflict", ConflictFail)
+	switch conflict {
+	case ConflictFail, ConflictSkip, ConflictOverwrite, ConflictRename:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "conflict must be one of fail, skip, overwrite, rename"})
+		return
+	}
+	dryRun := c.Query("dry_run") == "true"
+
+	data, err := uploadedContent(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read bundle"})
+		return
+	}
+	bundle, err := decodeConfigBundle(data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var results []ImportResult
+	var conflicts bool
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		// 冲突模式下先预检，存在冲突时不写入任何配置
+		if results, err = importConfigBundle(tx, userID, bundle, conflict, true); err != nil {
+			return err
+		}
+		for _, result := range results {
+			if result.Action == "conflict" {
+				conflicts = true
+			}
+		}
+		if dryRun || conflicts {
+			return nil
+		}
+		results, err = importConfigBundle(tx, userID, bundle, conflict, false)
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if conflicts {
+		c.JSON(http.StatusConflict, gin.H{"error": "Configs with the same name already exist", "data": results})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": results, "dry_run": dryRun})
+}
@@ -0,0 +1,262 @@
+package controllers
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+	"gopkg.in/yaml.v3"
+)
+
+func TestConfigBundleRoundTrip(t *testing.T) {
+	configs := []models.MessageTypeConfig{
+		{Name: "tracker", Protocol: "mqtt", Version: 3, Format: `{"encoding":"hex","body":[{"name":"battery","type":"uint8","offset":0,"length":1}]}`},
+		{Name: "legacy", Protocol: "tcp", Format: `"{\"encoding\":\"ascii\",\"kind\":\"kv\"}"`},
+	}
+
+	bundle, err := newConfigBundle(configs)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for _, encode := range []func(interface{}) ([]byte, error){json.Marshal, yaml.Marshal} {
+		data, err := encode(bundle)
+		if err != nil {
+			t.Fatalf("Failed to encode bundle: %v", err)
+		}
+		decoded, err := decodeConfigBundle(data)
+		if err != nil {
+			t.Fatalf("Failed to decode bundle: %v\n%s", err, data)
+		}
+		if len(decoded.Configs) != 2 || decoded.Configs[0].SourceVersion != 3 {
+			t.Fatalf("Unexpected decoded bundle: %+v", decoded)
+		}
+
+		format, err := bundleFormatString(decoded.Configs[0].Format)
+		if err != nil || !jsonEqual(format, configs[0].Format) {
+			t.Errorf("Expected format %s, got %s (%v)", configs[0].Format, format, err)
+		}
+		// 被引号包裹的旧格式导出后还原为对象
+		format, err = bundleFormatString(decoded.Configs[1].Format)
+		if err != nil || !jsonEqual(format, `{"encoding":"ascii","kind":"kv"}`) {
+			t.Errorf("Unexpected legacy format %s (%v)", format, err)
+		}
+	}
+}
+
+// testConfigBundle 包含一个与已有配置同名且内容不同的配置和一个新配置
+const testConfigBundle = `{"kind":"message-type-configs","version":1,"configs":[
+	{"name":"tracker","protocol":"mqtt","source_version":5,"format":{"encoding":"hex","body":[{"name":"battery","type":"uint16","offset":0,"length":2,"endian":"big"}]}},
+	{"name":"gateway","protocol":"mqtt","format":{"encoding":"hex","body":[{"name":"rssi","type":"int8","offset":0,"length":1}]}}
+]}`
+
+// importTestBundle 调用导入接口，返回状态码和导入结果
+func importTestBundle(t *testing.T, query, body string) (int, []ImportResult) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/message-types/import?"+query, strings.NewReader(body))
+	c.Set("userID", uint(1))
+	ImportMessageTypeConfigs(c)
+
+	var response struct {
+		Data []ImportResult `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return w.Code, response.Data
+}
+
+// importActions 按配置名称汇总导入结果
+func importActions(results []ImportResult) map[string]string {
+	actions := make(map[string]string)
+	for _, result := range results {
+		actions[result.Name] = result.Action
+	}
+	return actions
+}
+
+// userConfigNames 返回用户的所有配置名称
+func userConfigNames(userID uint) []string {
+	var names []string
+	database.DB.Model(&models.MessageTypeConfig{}).Where("user_id = ?", userID).Order("id").Pluck("name", &names)
+	return names
+}
+
+func TestImportMessageTypeConfigs(t *testing.T) {
+	useTestDatabase(t)
+	gin.SetMode(gin.TestMode)
+
+	tracker := models.MessageTypeConfig{UserID: 1, Name: "tracker", Protocol: "mqtt",
+		Format: `{"encoding":"hex","body":[{"name":"battery","type":"uint8","offset":0,"length":1}]}`}
+	database.DB.Create(&tracker)
+	if err := ensureConfigVersioned(&tracker); err != nil {
+		t.Fatalf("Failed to version config: %v", err)
+	}
+	// 其他用户的同名配置不算冲突
+	database.DB.Create(&models.MessageTypeConfig{UserID: 2, Name: "gateway", Protocol: "mqtt", Format: `{}`})
+
+	// fail: 存在冲突时不写入任何配置，预览同样返回冲突
+	for _, query := range []string{"", "conflict=fail&dry_run=true"} {
+		code, results := importTestBundle(t, query, testConfigBundle)
+		if actions := importActions(results); code != http.StatusConflict || actions["tracker"] != "conflict" || actions["gateway"] != "created" {
+			t.Fatalf("%q: expected conflict, got %d %v", query, code, results)
+		}
+	}
+	if names := userConfigNames(1); len(names) != 1 {
+		t.Fatalf("Expected no config to be imported on conflict, got %v", names)
+	}
+
+	// skip: 预览不写入，导入时跳过同名配置
+	code, results := importTestBundle(t, "conflict=skip&dry_run=true", testConfigBundle)
+	if actions := importActions(results); code != http.StatusOK || actions["tracker"] != "skipped" || actions["gateway"] != "created" {
+		t.Fatalf("Unexpected skip preview %d %v", code, results)
+	}
+	if names := userConfigNames(1); len(names) != 1 {
+		t.Fatalf("Expected dry run not to write, got %v", names)
+	}
+	code, results = importTestBundle(t, "conflict=skip", testConfigBundle)
+	if actions := importActions(results); code != http.StatusOK || actions["tracker"] != "skipped" || actions["gateway"] != "created" || results[1].Version != 1 {
+		t.Fatalf("Unexpected skip import %d %v", code, results)
+	}
+	var current models.MessageTypeConfig
+	database.DB.First(&current, tracker.ID)
+	if current.Format != tracker.Format || current.Version != 1 {
+		t.Errorf("Expected skipped config to be unchanged, got %+v", current)
+	}
+
+	// overwrite: 预览不写入；导入时更新内容并记录新版本，内容相同的配置不变
+	code, results = importTestBundle(t, "conflict=overwrite&dry_run=true", testConfigBundle)
+	if actions := importActions(results); code != http.StatusOK || actions["tracker"] != "updated" || actions["gateway"] != "unchanged" {
+		t.Fatalf("Unexpected overwrite preview %d %v", code, results)
+	}
+	var versions int64
+	database.DB.Model(&models.MessageTypeConfigVersion{}).Where("config_id = ?", tracker.ID).Count(&versions)
+	if versions != 1 {
+		t.Fatalf("Expected dry run not to record a version, got %d", versions)
+	}
+	code, results = importTestBundle(t, "conflict=overwrite", testConfigBundle)
+	if code != http.StatusOK || results[0].Action != "updated" || results[0].ID != tracker.ID || results[0].Version != 2 {
+		t.Fatalf("Unexpected overwrite import %d %v", code, results)
+	}
+	database.DB.First(&current, tracker.ID)
+	version, err := loadConfigVersion(tracker.ID, 2)
+	if err != nil || current.Version != 2 || !strings.Contains(current.Format, "uint16") ||
+		version.Format != current.Format || version.Comment != "imported from version 5" {
+		t.Errorf("Expected overwrite to record version 2, got %+v %+v (%v)", current, version, err)
+	}
+	if version, err := loadConfigVersion(tracker.ID, 1); err != nil || version.Format != tracker.Format {
+		t.Errorf("Expected previous content to stay in version 1, got %+v (%v)", version, err)
+	}
+
+	// rename: 以不重复的新名称创建
+	code, results = importTestBundle(t, "conflict=rename", testConfigBundle)
+	if code != http.StatusOK || results[0].Action != "renamed" || results[0].NewName != "tracker (2)" || results[1].NewName != "gateway (2)" {
+		t.Fatalf("Unexpected rename import %d %v", code, results)
+	}
+	if names := userConfigNames(1); strings.Join(names, ",") != "tracker,gateway,tracker (2),gateway (2)" {
+		t.Errorf("Unexpected configs after rename %v", names)
+	}
+
+	// 任一配置无效时整个配置包都不导入
+	invalid := `{"configs":[{"name":"fresh","protocol":"mqtt","format":{"encoding":"hex","body":[]}},{"name":"broken","protocol":"mqtt","format":{"encoding":"hex","body":[{"name":"x","type":"decimal","offset":0,"length":1}]}}]}`
+	if code, _ := importTestBundle(t, "conflict=rename", invalid); code != http.StatusBadRequest {
+		t.Errorf("Expected invalid bundle to be rejected, got %d", code)
+	}
+	if names := userConfigNames(1); len(names) != 4 {
+		t.Errorf("Expected invalid bundle not to be imported, got %v", names)
+	}
+	if code, _ := importTestBundle(t, "conflict=merge", testConfigBundle); code != http.StatusBadRequest {
+		t.Errorf("Expected unknown conflict mode to be rejected, got %d", code)
+	}
+}
+
+func TestDecodeConfigBundleErrors(t *testing.T) {
+	tests := map[string]string{
+		"wrong kind":     `{"kind":"devices","configs":[{"name":"a","protocol":"mqtt","format":{}}]}`,
+		"empty":          `kind: message-type-configs`,
+		"missing name":   `{"configs":[{"protocol":"mqtt","format":{}}]}`,
+		"duplicate name": "configs:\n  - {name: a, protocol: mqtt, format: {}}\n  - {name: a, protocol: mqtt, format: {}}\n",
+	}
+	for name, input := range tests {
+		if _, err := decodeConfigBundle([]byte(input)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	if _, err := bundleFormatString([]interface{}{1}); err == nil {
+		t.Error("Expected error for non-object format")
+	}
+}
+
+func TestFieldTableToFormat(t *testing.T) {
+	table := strings.Join([]string{
+		"字段名称\t数据类型\t起始字节\t长度（字节）\t字节序\t系数\t单位",
+		"header\tu16\t0\t2\tBE\t\t",
+		"temperature\tint16\t4\t\t小端\t0.1\t℃",
+		"humidity\tu8\t6\t\t\t0.5\t%RH",
+		"status\tbyte\t\t\t\t\t",
+	}, "\n")
+
+	rows, err := parseFieldTable([]byte(table))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	format, warnings, err := buildFieldTableFormat(rows, "hex")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(format.Body) != 5 || format.Body[1].Name != "reserved_2" || format.Body[1].Length != 2 {
+		t.Fatalf("Expected reserved gap field, got %+v", format.Body)
+	}
+	if len(warnings) != 1 {
+		t.Errorf("Expected one gap warning, got %v", warnings)
+	}
+	temperature := format.Body[2]
+	if temperature.Endian != "little" || temperature.Scale != 0.1 || temperature.Unit != "℃" || !temperature.Signed || temperature.Length != 2 {
+		t.Errorf("Unexpected temperature field: %+v", temperature)
+	}
+	if status := format.Body[4]; status.Offset != 7 || status.Type != "uint8" {
+		t.Errorf("Expected status to follow humidity, got %+v", status)
+	}
+
+	formatJSON, _ := json.Marshal(format)
+	payload, _ := hex.DecodeString("aa550000ff00c801")
+	result, err := parseMessageData(string(formatJSON), hex.EncodeToString(payload))
+	if err != nil {
+		t.Fatalf("Failed to parse with imported format: %v", err)
+	}
+	if result.Fields["temperature"] != 25.5 || result.Fields["humidity"] != 100.0 {
+		t.Errorf("Unexpected scaled values: %v", result.Fields)
+	}
+}
+
+func TestFieldTableErrors(t *testing.T) {
+	tests := map[string]string{
+		"missing type":   "name,offset\nfoo,0",
+		"unknown type":   "name,type\nfoo,decimal128",
+		"wrong length":   "name,type,length\nfoo,uint16,4",
+		"string length":  "name,type\nfoo,string",
+		"unknown endian": "name,type,endian\nfoo,uint16,middle",
+		"xlsx":           "PK\x03\x04binary",
+	}
+	for name, input := range tests {
+		if _, err := parseFieldTable([]byte(input)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	rows, err := parseFieldTable([]byte("name,type,offset\na,uint16,0\nb,uint8,1"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, _, err := buildFieldTableFormat(rows, "hex"); err == nil {
+		t.Error("Expected error for overlapping fields")
+	}
+}
@@ -0,0 +1,389 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+	"gorm.io/gorm"
+)
+
+// ConfigChange 配置或字段的单项属性变化
+type ConfigChange struct {
+	Attribute string      `json:"attribute"`
+	From      interface{} `json:"from"`
+	To        interface{} `json:"to"`
+}
+
+// FieldDiff 单个字段定义的变化
+type FieldDiff struct {
+	Section string         `json:"section"` // header, body, footer, checksum, length
+	Name    string         `json:"name"`
+	Status  string         `json:"status"` // added, removed, changed
+	Changes []ConfigChange `json:"changes,omitempty"`
+}
+
+// ConfigDiff 两个配置版本之间的差异
+type ConfigDiff struct {
+	FromVersion int            `json:"from_version"`
+	ToVersion   int            `json:"to_version"`
+	Changes     []ConfigChange `json:"changes"` // 配置及格式级属性的变化
+	Fields      []FieldDiff    `json:"fields"`  // 字段定义的变化
+}
+
+// versionContentChanged 判断配置内容(不含默认标记)是否与版本不同
+func versionContentChanged(config *models.MessageTypeConfig, version *models.MessageTypeConfigVersion) bool {
+	return config.Name != version.Name || config.Description != version.Description ||
+		config.Protocol != version.Protocol || config.Format != version.Format || config.FPort != version.FPort
+}
+
+// recordConfigVersion 将配置当前内容保存为新版本并更新配置的版本号
+func recordConfigVersion(tx *gorm.DB, config *models.MessageTypeConfig, authorID uint, comment string, rollbackOf int) (*models.MessageTypeConfigVersion, error) {
+	var author models.User
+	tx.Select("username").First(&author, authorID)
+
+	var latest int
+	tx.Model(&models.MessageTypeConfigVersion{}).Where("config_id = ?", config.ID).
+		Select("COALESCE(MAX(version), 0)").Scan(&latest)
+
+	version := models.MessageTypeConfigVersion{
+		ConfigID:    config.ID,
+		Version:     latest + 1,
+		Name:        config.Name,
+		Description: config.Description,
+		Protocol:    config.Protocol,
+		Format:      config.Format,
+		FPort:       config.FPort,
+		AuthorID:    authorID,
+		Author:      author.Username,
+		Comment:     comment,
+		RollbackOf:  rollbackOf,
+	}
+	if err := tx.Create(&version).Error; err != nil {
+		return nil, err
+	}
+
+	config.Version = version.Version
+	if err := tx.Model(config).Update("version", version.Version).Error; err != nil {
+		return nil, err
+	}
+	return &version, nil
+}
+
+// ensureConfigVersioned 为引入版本之前创建的配置补充初始版本。启动时已由 VersionLegacyConfigs 补齐，
+// 这里只处理漏网的配置: 事务中先把版本号从 0 占位为 1，占位失败说明已被并发的调用方创建，重新读取版本号
+func ensureConfigVersioned(config *models.MessageTypeConfig) error {
+	if config.Version > 0 {
+		return nil
+	}
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.MessageTypeConfig{}).
+			Where("id = ? AND (version = 0 OR version IS NULL)", config.ID).UpdateColumn("version", 1)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return tx.Model(&models.MessageTypeConfig{}).Where("id = ?", config.ID).
+				Select("version").Row().Scan(&config.Version)
+		}
+		_, err := recordConfigVersion(tx, config, config.UserID, "initial version", 0)
+		return err
+	})
+}
+
+// VersionLegacyConfigs 启动时为引入版本之前创建的配置补充初始版本，数据接入时无需再创建版本
+func VersionLegacyConfigs() {
+	var configs []models.MessageTypeConfig
+	if err := database.DB.Where("version = 0 OR version IS NULL").Find(&configs).Error; err != nil {
+		log.Printf("Failed to load unversioned message type configs: %v", err)
+		return
+	}
+	for i := range configs {
+		if err := ensureConfigVersioned(&configs[i]); err != nil {
+			log.Printf("Failed to version message type config %d: %v", configs[i].ID, err)
+		}
+	}
+}
+
+// loadConfigVersion 获取配置的指定版本
+func loadConfigVersion(configID uint, version int) (*models.MessageTypeConfigVersion, error) {
+	var v models.MessageTypeConfigVersion
+	if err := database.DB.Where("config_id = ? AND version = ?", configID, version).First(&v).Error; err != nil {
+		return nil, fmt.Errorf("version %d of config %d not found", version, configID)
+	}
+	return &v, nil
+}
+
+// configAtVersion 返回使用指定历史版本内容的配置，用于按历史格式重新解析
+func configAtVersion(config models.MessageTypeConfig, version *models.MessageTypeConfigVersion) models.MessageTypeConfig {
+	config.Name = version.Name
+	config.Description = version.Description
+	config.Protocol = version.Protocol
+	config.Format = version.Format
+	config.FPort = version.FPort
+	config.Version = version.Version
+	return config
+}
+
+// fieldDefinitionChanges 按 JSON 属性名逐项比较字段定义
+func fieldDefinitionChanges(from, to models.FieldDefinition) []ConfigChange {
+	var changes []ConfigChange
+	fromValue := reflect.ValueOf(from)
+	toValue := reflect.ValueOf(to)
+	fieldType := fromValue.Type()
+
+	for i := 0; i < fieldType.NumField(); i++ {
+		a := fromValue.Field(i).Interface()
+		b := toValue.Field(i).Interface()
+		if a != b {
+			name := strings.Split(fieldType.Field(i).Tag.Get("json"), ",")[0]
+			changes = append(changes, ConfigChange{Attribute: name, From: a, To: b})
+		}
+	}
+	return changes
+}
+
+// diffFieldSection 比较一个报文段内的字段定义，按字段名称匹配
+func diffFieldSection(section string, from, to []models.FieldDefinition) []FieldDiff {
+	var diffs []FieldDiff
+
+	fromByName := make(map[string]models.FieldDefinition, len(from))
+	for _, field := range from {
+		fromByName[field.Name] = field
+	}
+	toNames := make(map[string]bool, len(to))
+
+	for _, field := range to {
+		toNames[field.Name] = true
+		previous, ok := fromByName[field.Name]
+		if !ok {
+			diffs = append(diffs, FieldDiff{Section: section, Name: field.Name, Status: "added"})
+			continue
+		}
+		if changes := fieldDefinitionChanges(previous, field); len(changes) > 0 {
+			diffs = append(diffs, FieldDiff{Section: section, Name: field.Name, Status: "changed", Changes: changes})
+		}
+	}
+	for _, field := range from {
+		if !toNames[field.Name] {
+			diffs = append(diffs, FieldDiff{Section: section, Name: field.Name, Status: "removed"})
+		}
+	}
+
+	return diffs
+}
+
+// diffOptionalField 比较校验和、长度等可选的单个字段定义
+func diffOptionalField(section string, from, to *models.FieldDefinition) []FieldDiff {
+	switch {
+	case from == nil && to == nil:
+		return nil
+	case from == nil:
+		return []FieldDiff{{Section: section, Name: to.Name, Status: "added"}}
+	case to == nil:
+		return []FieldDiff{{Section: section, Name: from.Name, Status: "removed"}}
+	}
+	if changes := fieldDefinitionChanges(*from, *to); len(changes) > 0 {
+		return []FieldDiff{{Section: section, Name: to.Name, Status: "changed", Changes: changes}}
+	}
+	return nil
+}
+
+// diffConfigVersions 逐项比较两个配置版本
+func diffConfigVersions(from, to *models.MessageTypeConfigVersion) (*ConfigDiff, error) {
+	diff := &ConfigDiff{
+		FromVersion: from.Version,
+		ToVersion:   to.Version,
+		Changes:     []ConfigChange{},
+		Fields:      []FieldDiff{},
+	}
+
+	addChange := func(attribute string, a, b interface{}) {
+		if a != b {
+			diff.Changes = append(diff.Changes, ConfigChange{Attribute: attribute, From: a, To: b})
+		}
+	}
+	addChange("name", from.Name, to.Name)
+	addChange("description", from.Description, to.Description)
+	addChange("protocol", from.Protocol, to.Protocol)
+	addChange("f_port", from.FPort, to.FPort)
+
+	var fromFormat, toFormat models.MessageFormat
+	if err := json.Unmarshal([]byte(from.Format), &fromFormat); err != nil {
+		return nil, fmt.Errorf("invalid format in version %d: %v", from.Version, err)
+	}
+	if err := json.Unmarshal([]byte(to.Format), &toFormat); err != nil {
+		return nil, fmt.Errorf("invalid format in version %d: %v", to.Version, err)
+	}
+
+	addChange("encoding", fromFormat.Encoding, toFormat.Encoding)
+	addChange("kind", fromFormat.Kind, toFormat.Kind)
+	addChange("delimiter", fromFormat.Delimiter, toFormat.Delimiter)
+	addChange("separator", fromFormat.Separator, toFormat.Separator)
+
+	diff.Fields = append(diff.Fields, diffFieldSection("header", fromFormat.Header, toFormat.Header)...)
+	diff.Fields = append(diff.Fields, diffFieldSection("body", fromFormat.Body, toFormat.Body)...)
+	diff.Fields = append(diff.Fields, diffFieldSection("footer", fromFormat.Footer, toFormat.Footer)...)
+	diff.Fields = append(diff.Fields, diffOptionalField("length", fromFormat.Length, toFormat.Length)...)
+	diff.Fields = append(diff.Fields, diffOptionalField("checksum", fromFormat.Checksum, toFormat.Checksum)...)
+
+	return diff, nil
+}
+
+// userConfigFromParam 获取路径参数 id 对应且属于当前用户的配置
+func userConfigFromParam(c *gin.Context) (*models.MessageTypeConfig, bool) {
+	userID := c.MustGet("userID").(uint)
+
+	var config models.MessageTypeConfig
+	if err := database.DB.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&config).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message type config not found"})
+		return nil, false
+	}
+	if err := ensureConfigVersioned(&config); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record config version"})
+		return nil, false
+	}
+	return &config, true
+}
+
+// GetMessageTypeConfigVersions 获取配置的版本历史
+func GetMessageTypeConfigVersions(c *gin.Context) {
+	config, ok := userConfigFromParam(c)
+	if !ok {
+		return
+	}
+
+	var versions []models.MessageTypeConfigVersion
+	if err := database.DB.Where("config_id = ?", config.ID).Order("version DESC").Find(&versions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get config versions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": versions, "current_version": config.Version})
+}
+
+// GetMessageTypeConfigVersion 获取配置的指定版本
+func GetMessageTypeConfigVersion(c *gin.Context) {
+	config, ok := userConfigFromParam(c)
+	if !ok {
+		return
+	}
+
+	number, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid version"})
+		return
+	}
+	version, err := loadConfigVersion(config.ID, number)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": version})
+}
+
+// DiffMessageTypeConfigVersions 比较两个版本，to 为空时与当前版本比较，from 为空时与 to 的上一版本比较
+func DiffMessageTypeConfigVersions(c *gin.Context) {
+	config, ok := userConfigFromParam(c)
+	if !ok {
+		return
+	}
+
+	toNumber := config.Version
+	if value := c.Query("to"); value != "" {
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to version"})
+			return
+		}
+		toNumber = number
+	}
+	fromNumber := toNumber - 1
+	if value := c.Query("from"); value != "" {
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from version"})
+			return
+		}
+		fromNumber = number
+	}
+
+	from, err := loadConfigVersion(config.ID, fromNumber)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	to, err := loadConfigVersion(config.ID, toNumber)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	diff, err := diffConfigVersions(from, to)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": diff})
+}
+
+// RollbackMessageTypeConfig 回滚到指定版本，回滚本身作为新版本保存，历史版本不变
+func RollbackMessageTypeConfig(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	config, ok := userConfigFromParam(c)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Version int    `json:"version" binding:"required"`
+		Comment string `json:"comment"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	target, err := loadConfigVersion(config.ID, input.Version)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if target.Version == config.Version {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Config is already at this version"})
+		return
+	}
+
+	comment := input.Comment
+	if comment == "" {
+		comment = fmt.Sprintf("rollback to version %d", target.Version)
+	}
+
+	previousFormat := config.Format
+	*config = configAtVersion(*config, target)
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(config).Error; err != nil {
+			return err
+		}
+		_, err := recordConfigVersion(tx, config, userID, comment, target.Version)
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to roll back message type config"})
+		return
+	}
+	if previousFormat != config.Format {
+		invalidateDecoder(previousFormat)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": config})
+}
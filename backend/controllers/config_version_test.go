@@ -0,0 +1,137 @@
+package controllers
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+func formatVersion(t *testing.T, version int, format models.MessageFormat) *models.MessageTypeConfigVersion {
+	t.Helper()
+	data, err := json.Marshal(format)
+	if err != nil {
+		t.Fatalf("Failed to marshal format: %v", err)
+	}
+	return &models.MessageTypeConfigVersion{Version: version, Name: "tracker", Protocol: "mqtt", Format: string(data)}
+}
+
+func TestDiffConfigVersions(t *testing.T) {
+	from := formatVersion(t, 1, models.MessageFormat{
+		Encoding: "hex",
+		Header: []models.FieldDefinition{
+			{Name: "device_id", Type: "string", Offset: 0, Length: 8},
+		},
+		Body: []models.FieldDefinition{
+			{Name: "latitude", Type: "float32", Offset: 8, Length: 4, Endian: "big"},
+			{Name: "battery", Type: "uint8", Offset: 12, Length: 1},
+		},
+	})
+	to := formatVersion(t, 2, models.MessageFormat{
+		Encoding: "base64",
+		Header: []models.FieldDefinition{
+			{Name: "device_id", Type: "string", Offset: 0, Length: 8},
+		},
+		Body: []models.FieldDefinition{
+			{Name: "latitude", Type: "float64", Offset: 8, Length: 8, Endian: "big"},
+			{Name: "speed", Type: "uint16", Offset: 16, Length: 2, Endian: "big"},
+		},
+		Checksum: &models.FieldDefinition{Name: "crc", Type: "uint8", Length: 1},
+	})
+	to.Protocol = "tcp"
+
+	diff, err := diffConfigVersions(from, to)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	changes := make(map[string]ConfigChange)
+	for _, change := range diff.Changes {
+		changes[change.Attribute] = change
+	}
+	if len(changes) != 2 || changes["protocol"].To != "tcp" || changes["encoding"].From != "hex" {
+		t.Errorf("Unexpected config changes: %+v", diff.Changes)
+	}
+
+	fields := make(map[string]FieldDiff)
+	for _, field := range diff.Fields {
+		fields[field.Section+"."+field.Name] = field
+	}
+	if len(fields) != 4 {
+		t.Fatalf("Expected 4 field diffs, got %+v", diff.Fields)
+	}
+	if fields["body.battery"].Status != "removed" || fields["body.speed"].Status != "added" || fields["checksum.crc"].Status != "added" {
+		t.Errorf("Unexpected added/removed fields: %+v", diff.Fields)
+	}
+
+	latitude := fields["body.latitude"]
+	if latitude.Status != "changed" || len(latitude.Changes) != 2 {
+		t.Fatalf("Expected type and length change for latitude, got %+v", latitude)
+	}
+	for _, change := range latitude.Changes {
+		switch change.Attribute {
+		case "type":
+			if change.From != "float32" || change.To != "float64" {
+				t.Errorf("Unexpected type change: %+v", change)
+			}
+		case "length":
+			if change.From != 4 || change.To != 8 {
+				t.Errorf("Unexpected length change: %+v", change)
+			}
+		default:
+			t.Errorf("Unexpected attribute change: %+v", change)
+		}
+	}
+}
+
+func TestConfigAtVersion(t *testing.T) {
+	config := models.MessageTypeConfig{UserID: 3, Name: "current", Format: `{"encoding":"hex"}`, IsDefault: true, Version: 5}
+	version := &models.MessageTypeConfigVersion{Version: 2, Name: "old", Protocol: "nmea", Format: `{}`, FPort: 7}
+
+	old := configAtVersion(config, version)
+	if old.Name != "old" || old.Protocol != "nmea" || old.Format != `{}` || old.FPort != 7 || old.Version != 2 {
+		t.Errorf("Expected version content, got %+v", old)
+	}
+	if old.UserID != 3 || !old.IsDefault {
+		t.Errorf("Expected ownership and default flag to be kept, got %+v", old)
+	}
+	if config.Version != 5 {
+		t.Errorf("Original config must not be modified, got version %d", config.Version)
+	}
+}
+
+func TestEnsureConfigVersioned(t *testing.T) {
+	useTestDatabase(t)
+
+	config := models.MessageTypeConfig{Name: "legacy", Protocol: "mqtt", Format: "{}", UserID: 1}
+	database.DB.Create(&config)
+	database.DB.Model(&config).UpdateColumn("version", 0)
+
+	// 两份过期的副本都认为配置未版本化，只能创建一个初始版本
+	first, second := config, config
+	first.Version, second.Version = 0, 0
+	if err := ensureConfigVersioned(&first); err != nil {
+		t.Fatalf("Failed to version config: %v", err)
+	}
+	if err := ensureConfigVersioned(&second); err != nil {
+		t.Fatalf("Failed to version config: %v", err)
+	}
+	if first.Version != 1 || second.Version != 1 {
+		t.Errorf("Expected version 1, got %d and %d", first.Version, second.Version)
+	}
+	var count int64
+	database.DB.Model(&models.MessageTypeConfigVersion{}).Where("config_id = ?", config.ID).Count(&count)
+	if count != 1 {
+		t.Errorf("Expected 1 version record, got %d", count)
+	}
+
+	legacy := models.MessageTypeConfig{Name: "old", Protocol: "mqtt", Format: "{}", UserID: 1}
+	database.DB.Create(&legacy)
+	database.DB.Model(&legacy).UpdateColumn("version", 0)
+	VersionLegacyConfigs()
+	database.DB.First(&legacy, legacy.ID)
+	if legacy.Version != 1 {
+		t.Errorf("Expected legacy config to be versioned at startup, got %d", legacy.Version)
+	}
+}
@@ -24,6 +24,15 @@ type DeviceData struct {
 	Timestamp int64           `json:"timestamp"`
 }
 
+// publishDeviceMessage 向设备主题发布消息，设备处于抓包模式时记录下行帧
+func publishDeviceMessage(topic string, payload []byte) error {
+	if err := mqtt.Publish(topic, payload); err != nil {
+		return err
+	}
+	topicCapture(topic).record(models.CaptureTransportMQTT, models.CaptureDirectionOut, topic, payload, "")
+	return nil
+}
+
 func PushDeviceData(c *gin.Context) {
 	var input DeviceData
 
@@ -76,7 +85,7 @@ func PushDeviceData(c *gin.Context) {
 		return
 	}
 
-	if err := mqtt.Publish(topic, jsonData); err != nil {
+	if err := publishDeviceMessage(topic, jsonData); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to publish to MQTT"})
 		return
 	}
@@ -195,7 +204,7 @@ func PushTestData(c *gin.Context) {
 			continue
 		}
 
-		if err := mqtt.Publish(topic, jsonData); err != nil {
+		if err := publishDeviceMessage(topic, jsonData); err != nil {
 			results = append(results, map[string]interface{}{
 				"device_id": device.ID,
 				"status":    "error",
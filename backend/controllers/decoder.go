@@ -0,0 +1,672 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+// fieldKind 编译后的字段类型
+type fieldKind uint8
+
+const (
+	kindUnsupported fieldKind = iota
+	kindInt8
+	kindUint8
+	kindInt16
+	kindUint16
+	kindInt32
+	kindUint32
+	kindFloat32
+	kindFloat64
+	kindString
+	kindBytes
+)
+
+var fieldKinds = map[string]fieldKind{
+	"int8": kindInt8, "uint8": kindUint8, "int16": kindInt16, "uint16": kindUint16,
+	"int32": kindInt32, "uint32": kindUint32, "float32": kindFloat32, "float64": kindFloat64,
+	"string": kindString, "bytes": kindBytes,
+}
+
+// compiledField 预先确定类型、字节序和缩放规则的字段
+type compiledField struct {
+	def      models.FieldDefinition
+	kind     fieldKind
+	size     int // 定长类型的字节数，Length 不能小于该值
+	order    binary.ByteOrder
+	pow10    float64 // 10^Decimals，Decimals 为 0 时不使用
+	scaled   bool
+	isSigned bool
+}
+
+func compileField(field models.FieldDefinition) compiledField {
+	f := compiledField{def: field, kind: fieldKinds[field.Type], size: fieldTypeSizes[field.Type], order: binary.LittleEndian}
+	if field.Endian == "big" {
+		f.order = binary.BigEndian
+	}
+	if field.Decimals > 0 {
+		f.pow10 = math.Pow10(field.Decimals)
+	}
+	f.scaled = field.Scale != 0 && field.Scale != 1
+	switch f.kind {
+	case kindInt8, kindInt16, kindInt32, kindFloat32, kindFloat64:
+		f.isSigned = true
+	}
+	return f
+}
+
+// decodedValue 未装箱的字段值，解码到结构体时避免 interface{} 分配
+type decodedValue struct {
+	i int64
+	u uint64
+	f float64
+	s string
+	b []byte
+}
+
+// read 读取字段原始值，错误信息与 parseField 保持一致
+func (f *compiledField) read(data []byte, offset int) (decodedValue, int, error) {
+	var v decodedValue
+	// 格式未经校验保存时 Length 可能为负数或小于类型长度，不能直接用于切片和按类型读取
+	if f.def.Length < 0 || f.def.Length < f.size {
+		return v, offset, fmt.Errorf("invalid length %d for %s field '%s'", f.def.Length, f.def.Type, f.def.Name)
+	}
+	if offset < 0 || offset >= len(data) {
+		return v, offset, fmt.Errorf("invalid offset: %d", offset)
+	}
+	if offset+f.def.Length > len(data) {
+		return v, offset, fmt.Errorf("insufficient data for field '%s' (need %d bytes, have %d)", f.def.Name, f.def.Length, len(data)-offset)
+	}
+
+	fieldData := data[offset : offset+f.def.Length]
+	newOffset := offset + f.def.Length
+
+	switch f.kind {
+	case kindInt8:
+		v.i = int64(int8(fieldData[0]))
+	case kindUint8:
+		v.u = uint64(fieldData[0])
+	case kindInt16:
+		v.i = int64(int16(f.order.Uint16(fieldData)))
+	case kindUint16:
+		v.u = uint64(f.order.Uint16(fieldData))
+	case kindInt32:
+		v.i = int64(int32(f.order.Uint32(fieldData)))
+	case kindUint32:
+		v.u = uint64(f.order.Uint32(fieldData))
+	case kindFloat32:
+		value := math.Float32frombits(f.order.Uint32(fieldData))
+		if f.pow10 > 0 {
+			// 应用小数位数
+			value = float32(int64(value*float32(f.pow10))) / float32(f.pow10)
+		}
+		v.f = float64(value)
+	case kindFloat64:
+		value := math.Float64frombits(f.order.Uint64(fieldData))
+		if f.pow10 > 0 {
+			// 应用小数位数
+			value = float64(int64(value*f.pow10)) / f.pow10
+		}
+		v.f = value
+	case kindString:
+		// 去除字符串末尾的空字符
+		str := string(fieldData)
+		if idx := strings.IndexByte(str, 0); idx != -1 {
+			str = str[:idx]
+		}
+		v.s = strings.TrimSpace(str)
+	case kindBytes:
+		v.b = fieldData
+	default:
+		return v, newOffset, fmt.Errorf("unsupported field type: %s", f.def.Type)
+	}
+	return v, newOffset, nil
+}
+
+// value 将原始值转换为解析结果中的类型(与 parseField 返回的类型一致)
+func (f *compiledField) value(v decodedValue) interface{} {
+	switch f.kind {
+	case kindInt8:
+		return int8(v.i)
+	case kindUint8:
+		return uint8(v.u)
+	case kindInt16:
+		return int16(v.i)
+	case kindUint16:
+		return uint16(v.u)
+	case kindInt32:
+		return int32(v.i)
+	case kindUint32:
+		return uint32(v.u)
+	case kindFloat32:
+		return float32(v.f)
+	case kindFloat64:
+		return v.f
+	case kindString:
+		return v.s
+	default:
+		return v.b
+	}
+}
+
+// number 数值字段的 float64 值(已应用缩放系数)
+func (f *compiledField) number(v decodedValue) float64 {
+	var n float64
+	switch f.kind {
+	case kindFloat32, kindFloat64:
+		n = v.f
+	case kindUint8, kindUint16, kindUint32:
+		n = float64(v.u)
+	default:
+		n = float64(v.i)
+	}
+	if f.scaled {
+		n *= f.def.Scale
+		if f.pow10 > 0 {
+			n = math.Round(n*f.pow10) / f.pow10
+		}
+	}
+	return n
+}
+
+// scaledValue 应用缩放系数后的结果值，与 scaleFieldValue 一致
+func (f *compiledField) scaledValue(v decodedValue) interface{} {
+	if f.scaled && f.kind != kindString && f.kind != kindBytes {
+		return f.number(v)
+	}
+	return f.value(v)
+}
+
+// MessageDecoder 编译后的消息格式: Format JSON 只解析一次，字段类型、字节序预先确定，
+// 可并发使用
+type MessageDecoder struct {
+	format   models.MessageFormat
+	err      error  // Format 无法解析时的错误
+	errorMsg string // 对应的 ParseResult.Error
+	text     bool   // 文本类负载
+	script   *messageScript
+
+	header   []compiledField
+	length   *compiledField
+	body     []compiledField
+	footer   []compiledField
+	checksum *compiledField
+
+	structPlans sync.Map // reflect.Type -> *structPlan
+}
+
+// compileMessageDecoder 编译消息格式，兼容被引号包裹的 JSON 字符串
+func compileMessageDecoder(formatStr string) *MessageDecoder {
+	d := &MessageDecoder{}
+
+	data := []byte(formatStr)
+	if len(formatStr) >= 2 && formatStr[0] == '"' && formatStr[len(formatStr)-1] == '"' {
+		var unquoted string
+		if json.Unmarshal(data, &unquoted) == nil {
+			data = []byte(unquoted)
+		} else {
+			// 保存时未转义的引号包围字符串，直接去除引号
+			data = data[1 : len(data)-1]
+		}
+	}
+	if len(formatStr) == 0 {
+		d.err = errors.New("empty format configuration")
+		d.errorMsg = "Invalid format configuration"
+		return d
+	}
+	if err := json.Unmarshal(data, &d.format); err != nil {
+		d.err = err
+		d.errorMsg = "Invalid format configuration"
+		return d
+	}
+
+	switch d.format.Encoding {
+	case "hex", "base64", "ascii", "":
+	default:
+		d.errorMsg = "Unsupported encoding: " + d.format.Encoding
+		return d
+	}
+
+	if d.format.Kind == PayloadKindScript {
+		script, err := compileScript(d.format.Script)
+		if err != nil {
+			d.err = err
+			d.errorMsg = "Invalid decoder script: " + err.Error()
+			return d
+		}
+		d.script = script
+		return d
+	}
+
+	d.text = isTextPayloadKind(d.format.Kind)
+	compileAll := func(fields []models.FieldDefinition) []compiledField {
+		compiled := make([]compiledField, len(fields))
+		for i, field := range fields {
+			compiled[i] = compileField(field)
+		}
+		return compiled
+	}
+	d.header = compileAll(d.format.Header)
+	d.body = compileAll(d.format.Body)
+	d.footer = compileAll(d.format.Footer)
+	if d.format.Length != nil {
+		length := compileField(*d.format.Length)
+		d.length = &length
+	}
+	if d.format.Checksum != nil {
+		checksum := compileField(*d.format.Checksum)
+		d.checksum = &checksum
+	}
+	return d
+}
+
+// DecodeBuffer 可复用的解码缓冲区，单个 goroutine 内循环解码时复用以减少分配
+type DecodeBuffer struct {
+	data []byte
+}
+
+// decodePayload 按编码还原原始字节，提供缓冲区时复用其内存
+func (d *MessageDecoder) decodePayload(rawData string, buf *DecodeBuffer) ([]byte, error) {
+	switch d.format.Encoding {
+	case "hex":
+		if buf == nil {
+			return hex.DecodeString(rawData)
+		}
+		buf.data = grow(buf.data, len(rawData)/2)
+		return buf.data, decodeHexString(buf.data, rawData)
+	case "base64":
+		if buf == nil {
+			return base64.StdEncoding.DecodeString(rawData)
+		}
+		buf.data = grow(buf.data, base64.StdEncoding.DecodedLen(len(rawData)))
+		n, err := base64.StdEncoding.Decode(buf.data, []byte(rawData))
+		return buf.data[:n], err
+	default:
+		if buf == nil {
+			return []byte(rawData), nil
+		}
+		buf.data = append(buf.data[:0], rawData...)
+		return buf.data, nil
+	}
+}
+
+// decodeHexString 将十六进制字符串解码到 dst，避免字符串到字节切片的复制
+func decodeHexString(dst []byte, src string) error {
+	if len(src)%2 == 1 {
+		return hex.ErrLength
+	}
+	for i := 0; i < len(dst); i++ {
+		hi, ok1 := hexNibble(src[2*i])
+		lo, ok2 := hexNibble(src[2*i+1])
+		if !ok1 || !ok2 {
+			bad := src[2*i]
+			if ok1 {
+				bad = src[2*i+1]
+			}
+			return hex.InvalidByteError(bad)
+		}
+		dst[i] = hi<<4 | lo
+	}
+	return nil
+}
+
+func hexNibble(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+func grow(b []byte, n int) []byte {
+	if cap(b) < n {
+		return make([]byte, n)
+	}
+	return b[:n]
+}
+
+// decodeFailure 解码失败时返回的结果，与 parseMessageData 的失败结果一致
+type decodeFailure struct {
+	result models.ParseResult
+	err    error
+	keep   bool // 校验和校验失败时保留已解析的字段
+}
+
+func failDecode(message string, err error) *decodeFailure {
+	return &decodeFailure{result: models.ParseResult{Success: false, Error: message}, err: err}
+}
+
+// error 转换为 error，用于不返回 ParseResult 的解码方式
+func (f *decodeFailure) error() error {
+	if f.err != nil {
+		return f.err
+	}
+	return errors.New(f.result.Error)
+}
+
+// Decode 解析一条消息，结果与 parseMessageData 相同
+func (d *MessageDecoder) Decode(rawData string) (models.ParseResult, error) {
+	return d.DecodeWithMeta(rawData, nil)
+}
+
+// DecodeWithMeta 解析一条消息，meta 作为 decode 函数的第二个参数传给脚本负载
+func (d *MessageDecoder) DecodeWithMeta(rawData string, meta map[string]interface{}) (models.ParseResult, error) {
+	result := models.ParseResult{
+		Success:   true,
+		Fields:    make(map[string]interface{}),
+		RawData:   rawData,
+		Timestamp: time.Now(),
+	}
+	if failure := d.decodeFields(rawData, nil, meta, result.Fields, nil); failure != nil {
+		if failure.keep {
+			result.Success = false
+			result.Error = failure.result.Error
+			return result, nil
+		}
+		return failure.result, failure.err
+	}
+	return result, nil
+}
+
+// DecodeInto 解析消息并写入 fields(先清空)，buf 不为空时复用解码缓冲区。
+// bytes 类型字段会复制一份，不引用缓冲区
+func (d *MessageDecoder) DecodeInto(rawData string, buf *DecodeBuffer, fields map[string]interface{}) error {
+	for key := range fields {
+		delete(fields, key)
+	}
+	if failure := d.decodeFields(rawData, buf, nil, fields, nil); failure != nil {
+		return failure.error()
+	}
+	return nil
+}
+
+// decodeFields 解码核心流程，字段写入 fields，提供 visit 时改为逐个交给 visit 处理
+func (d *MessageDecoder) decodeFields(rawData string, buf *DecodeBuffer, meta, fields map[string]interface{},
+	visit func(f *compiledField, v decodedValue) error) *decodeFailure {
+	if d.errorMsg != "" {
+		return failDecode(d.errorMsg, d.err)
+	}
+
+	// 根据编码类型解码原始数据
+	decodedData, err := d.decodePayload(rawData, buf)
+	if err != nil {
+		return failDecode("Failed to decode data: "+err.Error(), err)
+	}
+
+	// 脚本负载由 decode 函数返回全部字段
+	if d.script != nil {
+		if fields == nil {
+			return failDecode("Struct decoding is not supported for script payloads", nil)
+		}
+		decoded, _, err := d.script.Decode(decodedData, meta)
+		if err != nil {
+			return failDecode("Decoder script failed: "+err.Error(), err)
+		}
+		for key, value := range decoded {
+			fields[key] = value
+		}
+		return nil
+	}
+
+	// 文本类负载(JSON、分隔符、key=value)按字段路径解析
+	if d.text {
+		if fields == nil {
+			return failDecode("Struct decoding is not supported for "+d.format.Kind+" payloads", nil)
+		}
+		result := models.ParseResult{Success: true, Fields: fields}
+		if err := parseTextPayload(d.format, decodedData, &result); err != nil {
+			return failDecode("Failed to parse "+d.format.Kind+" payload: "+err.Error(), err)
+		}
+		return nil
+	}
+	if d.format.Kind != "" && d.format.Kind != PayloadKindBinary {
+		return failDecode("Unsupported payload kind: "+d.format.Kind, nil)
+	}
+
+	store := func(f *compiledField, v decodedValue, scale bool) error {
+		if visit != nil {
+			return visit(f, v)
+		}
+		if f.kind == kindBytes && buf != nil {
+			v.b = append([]byte(nil), v.b...)
+		}
+		if scale {
+			fields[f.def.Name] = f.scaledValue(v)
+		} else {
+			fields[f.def.Name] = f.value(v)
+		}
+		return nil
+	}
+
+	// 解析报文头字段
+	currentOffset := 0
+	for i := range d.header {
+		f := &d.header[i]
+		v, newOffset, err := f.read(decodedData, currentOffset)
+		if err != nil {
+			return failDecode("Failed to parse header field '"+f.def.Name+"': "+err.Error(), err)
+		}
+		if err := store(f, v, true); err != nil {
+			return failDecode(err.Error(), err)
+		}
+		currentOffset = newOffset
+	}
+
+	// 解析长度字段（如果存在）
+	if d.length != nil {
+		_, newOffset, err := d.length.read(decodedData, currentOffset)
+		if err != nil {
+			return failDecode("Failed to parse length field: "+err.Error(), err)
+		}
+		currentOffset = newOffset
+	}
+
+	// 解析报文体、报文尾字段
+	sections := [...]struct {
+		name   string
+		fields []compiledField
+	}{{"body", d.body}, {"footer", d.footer}}
+	for _, section := range sections {
+		for i := range section.fields {
+			f := &section.fields[i]
+			v, newOffset, err := f.read(decodedData, currentOffset)
+			if err != nil {
+				return failDecode("Failed to parse "+section.name+" field '"+f.def.Name+"': "+err.Error(), err)
+			}
+			if err := store(f, v, true); err != nil {
+				return failDecode(err.Error(), err)
+			}
+			currentOffset = newOffset
+		}
+	}
+
+	// 解析校验和字段（如果存在）
+	if d.checksum != nil {
+		v, _, err := d.checksum.read(decodedData, currentOffset)
+		if err != nil {
+			return failDecode("Failed to parse checksum field: "+err.Error(), err)
+		}
+		if err := store(d.checksum, v, false); err != nil {
+			return failDecode(err.Error(), err)
+		}
+
+		// 验证校验和
+		if !validateChecksum(decodedData, currentOffset, d.checksum.def, d.checksum.value(v)) {
+			failure := failDecode("Checksum validation failed", nil)
+			failure.keep = true
+			return failure
+		}
+	}
+
+	return nil
+}
+
+// structPlan 结构体字段与消息字段的对应关系
+type structPlan struct {
+	fields map[string][]int // 消息字段名 -> 结构体字段索引
+}
+
+// structPlanFor 按 msg 标签、json 标签或字段名匹配消息字段，结果按类型缓存
+func (d *MessageDecoder) structPlanFor(t reflect.Type) *structPlan {
+	if plan, ok := d.structPlans.Load(t); ok {
+		return plan.(*structPlan)
+	}
+	plan := &structPlan{fields: make(map[string][]int)}
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		name := sf.Tag.Get("msg")
+		if name == "" {
+			name = strings.Split(sf.Tag.Get("json"), ",")[0]
+		}
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		plan.fields[name] = sf.Index
+	}
+	actual, _ := d.structPlans.LoadOrStore(t, plan)
+	return actual.(*structPlan)
+}
+
+// DecodeStruct 将二进制消息直接解码到结构体指针，数值不经过 interface{} 装箱；
+// 结构体字段按 msg 标签、json 标签或字段名与消息字段对应，未对应的消息字段被忽略
+func (d *MessageDecoder) DecodeStruct(rawData string, buf *DecodeBuffer, out interface{}) error {
+	rv := reflect.ValueOf(out)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return errors.New("DecodeStruct requires a non-nil pointer to a struct")
+	}
+	target := rv.Elem()
+	plan := d.structPlanFor(target.Type())
+
+	visit := func(f *compiledField, v decodedValue) error {
+		index, ok := plan.fields[f.def.Name]
+		if !ok {
+			return nil
+		}
+		return setStructField(target.FieldByIndex(index), f, v)
+	}
+	if failure := d.decodeFields(rawData, buf, nil, nil, visit); failure != nil {
+		return failure.error()
+	}
+	return nil
+}
+
+// setStructField 将字段值写入结构体字段，数值按目标类型转换并检查溢出
+func setStructField(dst reflect.Value, f *compiledField, v decodedValue) error {
+	numeric := f.kind != kindString && f.kind != kindBytes
+	switch dst.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if !numeric {
+			break
+		}
+		var n int64
+		switch {
+		case f.scaled || f.kind == kindFloat32 || f.kind == kindFloat64:
+			n = int64(f.number(v))
+		case f.isSigned:
+			n = v.i
+		default:
+			n = int64(v.u)
+		}
+		if dst.OverflowInt(n) {
+			return fmt.Errorf("field '%s': value %d overflows %s", f.def.Name, n, dst.Type())
+		}
+		dst.SetInt(n)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if !numeric {
+			break
+		}
+		var n uint64
+		switch {
+		case f.scaled || f.kind == kindFloat32 || f.kind == kindFloat64 || f.isSigned:
+			number := f.number(v)
+			if number < 0 {
+				return fmt.Errorf("field '%s': negative value %v cannot be stored in %s", f.def.Name, number, dst.Type())
+			}
+			n = uint64(number)
+		default:
+			n = v.u
+		}
+		if dst.OverflowUint(n) {
+			return fmt.Errorf("field '%s': value %d overflows %s", f.def.Name, n, dst.Type())
+		}
+		dst.SetUint(n)
+		return nil
+	case reflect.Float32, reflect.Float64:
+		if !numeric {
+			break
+		}
+		dst.SetFloat(f.number(v))
+		return nil
+	case reflect.String:
+		if f.kind == kindString {
+			dst.SetString(v.s)
+			return nil
+		}
+	case reflect.Slice:
+		if f.kind == kindBytes && dst.Type().Elem().Kind() == reflect.Uint8 {
+			dst.SetBytes(append(dst.Bytes()[:0], v.b...))
+			return nil
+		}
+	case reflect.Interface:
+		dst.Set(reflect.ValueOf(f.scaledValue(v)))
+		return nil
+	}
+	return fmt.Errorf("field '%s': cannot decode %s into %s", f.def.Name, f.def.Type, dst.Type())
+}
+
+// decoderCacheSize 缓存的已编译格式数量上限，超出时整体清空重新编译
+const decoderCacheSize = 512
+
+// decoderCache 已编译格式的缓存，以 Format 内容为键，格式内容变化后自然使用新的编译结果
+var decoderCache = struct {
+	sync.RWMutex
+	decoders map[string]*MessageDecoder
+}{decoders: make(map[string]*MessageDecoder)}
+
+// messageDecoder 获取格式的已编译解码器，未缓存时编译并缓存
+func messageDecoder(formatStr string) *MessageDecoder {
+	decoderCache.RLock()
+	d, ok := decoderCache.decoders[formatStr]
+	decoderCache.RUnlock()
+	if ok {
+		return d
+	}
+
+	d = compileMessageDecoder(formatStr)
+	decoderCache.Lock()
+	if len(decoderCache.decoders) >= decoderCacheSize {
+		decoderCache.decoders = make(map[string]*MessageDecoder)
+	}
+	decoderCache.decoders[formatStr] = d
+	decoderCache.Unlock()
+	return d
+}
+
+// invalidateDecoder 配置的格式被修改或删除后移除旧格式的编译结果
+func invalidateDecoder(formatStr string) {
+	decoderCache.Lock()
+	delete(decoderCache.decoders, formatStr)
+	decoderCache.Unlock()
+}
@@ -0,0 +1,223 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+// geoTestFormat 与 CreateGeoConfig 相同的设备地理信息格式
+var geoTestFormat = models.MessageFormat{
+	Header: []models.FieldDefinition{
+		{Name: "message_type", Type: "uint8", Length: 1},
+		{Name: "device_id", Type: "string", Length: 8},
+	},
+	Body: []models.FieldDefinition{
+		{Name: "latitude", Type: "float32", Length: 4, Endian: "big", Signed: true},
+		{Name: "longitude", Type: "float32", Length: 4, Endian: "big", Signed: true},
+		{Name: "altitude", Type: "float32", Length: 4, Endian: "big", Signed: true},
+		{Name: "speed", Type: "float32", Length: 4, Endian: "big", Signed: true},
+		{Name: "direction", Type: "uint16", Length: 2, Endian: "big"},
+		{Name: "timestamp", Type: "uint32", Length: 4, Endian: "big"},
+		{Name: "status", Type: "uint8", Length: 1},
+	},
+	Encoding: "hex",
+}
+
+const geoTestPayload = "01444556303030303142200000c2f0000043160000420c0000005a6500000201"
+
+func mustFormatJSON(tb testing.TB, format models.MessageFormat) string {
+	tb.Helper()
+	data, err := json.Marshal(format)
+	if err != nil {
+		tb.Fatalf("Failed to marshal format: %v", err)
+	}
+	return string(data)
+}
+
+func TestMessageDecoderDecodeInto(t *testing.T) {
+	format := models.MessageFormat{
+		Body: []models.FieldDefinition{
+			{Name: "temperature", Type: "int16", Length: 2, Endian: "big", Scale: 0.1},
+			{Name: "payload", Type: "bytes", Length: 2},
+		},
+		Encoding: "hex",
+	}
+	decoder := messageDecoder(mustFormatJSON(t, format))
+
+	var buf DecodeBuffer
+	fields := map[string]interface{}{"stale": true}
+	if err := decoder.DecodeInto("ff38abcd", &buf, fields); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := fields["stale"]; ok {
+		t.Error("Expected fields to be cleared before decoding")
+	}
+	if fields["temperature"] != -20.0 {
+		t.Errorf("Expected temperature -20, got %v", fields["temperature"])
+	}
+	payload := fields["payload"].([]byte)
+
+	// 复用缓冲区解码下一条消息，上一条的 bytes 字段不受影响
+	if err := decoder.DecodeInto("00011234", &buf, map[string]interface{}{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.Equal(payload, []byte{0xab, 0xcd}) {
+		t.Errorf("Expected payload to be copied out of the buffer, got %x", payload)
+	}
+
+	if err := decoder.DecodeInto("zz", &buf, fields); err == nil {
+		t.Error("Expected error for invalid hex data")
+	}
+	if err := decoder.DecodeInto("ff", &buf, fields); err == nil {
+		t.Error("Expected error for short payload")
+	}
+}
+
+func TestMessageDecoderDecodeStruct(t *testing.T) {
+	type location struct {
+		DeviceID  string  `msg:"device_id"`
+		Latitude  float64 `json:"latitude"`
+		Longitude float32 `json:"longitude"`
+		Direction int
+		Timestamp uint64 `msg:"timestamp"`
+		Status    uint8  `msg:"status"`
+		Ignored   string `json:"-"`
+	}
+
+	format := geoTestFormat
+	format.Body = append([]models.FieldDefinition{}, format.Body...)
+	format.Body[4].Name = "Direction"
+	decoder := messageDecoder(mustFormatJSON(t, format))
+
+	var loc location
+	if err := decoder.DecodeStruct(geoTestPayload, &DecodeBuffer{}, &loc); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if loc.DeviceID != "DEV00001" || loc.Latitude != 40 || loc.Longitude != -120 || loc.Direction != 90 || loc.Timestamp != 1694498818 || loc.Status != 1 {
+		t.Errorf("Unexpected decoded struct: %+v", loc)
+	}
+
+	var small struct {
+		Timestamp uint8 `msg:"timestamp"`
+	}
+	if err := decoder.DecodeStruct(geoTestPayload, nil, &small); err == nil {
+		t.Error("Expected overflow error")
+	}
+	if err := decoder.DecodeStruct(geoTestPayload, nil, loc); err == nil {
+		t.Error("Expected error for non-pointer target")
+	}
+}
+
+func TestMessageDecoderCache(t *testing.T) {
+	formatStr := mustFormatJSON(t, geoTestFormat)
+	invalidateDecoder(formatStr)
+
+	first := messageDecoder(formatStr)
+	if messageDecoder(formatStr) != first {
+		t.Error("Expected cached decoder to be reused")
+	}
+	invalidateDecoder(formatStr)
+	if messageDecoder(formatStr) == first {
+		t.Error("Expected decoder to be recompiled after invalidation")
+	}
+
+	result, err := parseMessageData("", "00")
+	if err == nil || result.Success {
+		t.Error("Expected error for empty format")
+	}
+}
+
+// benchmarkFormats 各类负载的典型格式及报文
+var benchmarkFormats = []struct {
+	name    string
+	format  models.MessageFormat
+	payload string
+}{
+	{"binary_geo", geoTestFormat, geoTestPayload},
+	{"json", models.MessageFormat{
+		Kind: PayloadKindJSON,
+		Body: []models.FieldDefinition{
+			{Name: "latitude", Type: "float64", Path: "gps.lat"},
+			{Name: "longitude", Type: "float64", Path: "gps.lng"},
+			{Name: "temperature", Type: "float32", Path: "sensors[0].value"},
+		},
+	}, `{"gps":{"lat":39.909,"lng":116.397},"sensors":[{"value":25.5}]}`},
+	{"delimited", models.MessageFormat{
+		Kind:      PayloadKindDelimited,
+		Delimiter: ",",
+		Body: []models.FieldDefinition{
+			{Name: "device_id", Type: "string", Index: 0},
+			{Name: "temperature", Type: "float32", Index: 1},
+			{Name: "humidity", Type: "uint8", Index: 2},
+		},
+	}, "DEV00001,25.5,60"},
+	{"kv", models.MessageFormat{
+		Kind: PayloadKindKV,
+		Body: []models.FieldDefinition{
+			{Name: "temperature", Type: "float32", Key: "t"},
+			{Name: "humidity", Type: "uint8", Key: "h"},
+		},
+	}, "t=25.5,h=60"},
+}
+
+// BenchmarkDecode 对比每条消息重新编译格式、使用缓存的编译结果、复用缓冲区和解码到结构体的吞吐量
+func BenchmarkDecode(b *testing.B) {
+	for _, bf := range benchmarkFormats {
+		formatStr := mustFormatJSON(b, bf.format)
+
+		b.Run(bf.name+"/uncached", func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(bf.payload)))
+			for i := 0; i < b.N; i++ {
+				if result, _ := compileMessageDecoder(formatStr).Decode(bf.payload); !result.Success {
+					b.Fatal(result.Error)
+				}
+			}
+		})
+
+		b.Run(bf.name+"/cached", func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(bf.payload)))
+			for i := 0; i < b.N; i++ {
+				if result, _ := parseMessageData(formatStr, bf.payload); !result.Success {
+					b.Fatal(result.Error)
+				}
+			}
+		})
+
+		b.Run(bf.name+"/reuse", func(b *testing.B) {
+			decoder := messageDecoder(formatStr)
+			var buf DecodeBuffer
+			fields := make(map[string]interface{})
+			b.ReportAllocs()
+			b.SetBytes(int64(len(bf.payload)))
+			for i := 0; i < b.N; i++ {
+				if err := decoder.DecodeInto(bf.payload, &buf, fields); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+
+	b.Run("binary_geo/struct", func(b *testing.B) {
+		var loc struct {
+			DeviceID  string  `msg:"device_id"`
+			Latitude  float64 `msg:"latitude"`
+			Longitude float64 `msg:"longitude"`
+			Speed     float32 `msg:"speed"`
+			Timestamp uint32  `msg:"timestamp"`
+		}
+		decoder := messageDecoder(mustFormatJSON(b, geoTestFormat))
+		var buf DecodeBuffer
+		b.ReportAllocs()
+		b.SetBytes(int64(len(geoTestPayload)))
+		for i := 0; i < b.N; i++ {
+			if err := decoder.DecodeStruct(geoTestPayload, &buf, &loc); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
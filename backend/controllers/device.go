@@ -18,6 +18,8 @@ func CreateDevice(c *gin.Context) {
 		Longitude float64 `json:"longitude"`
 		Latitude  float64 `json:"latitude"`
 		Address   string  `json:"address"`
+		// 绑定的消息类型配置
+		MessageTypeConfigID *uint `json:"message_type_config_id"`
 	}
 
 	if err := c.ShouldBindJSON(&input); err != nil {
@@ -27,6 +29,13 @@ func CreateDevice(c *gin.Context) {
 
 	userID := c.MustGet("userID").(uint)
 
+	if input.MessageTypeConfigID != nil {
+		if _, err := userConfigByID(userID, *input.MessageTypeConfigID); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Message type config not found"})
+			return
+		}
+	}
+
 	device := models.Device{
 		Name:      input.Name,
 		Topic:     input.Topic,
@@ -38,6 +47,7 @@ func CreateDevice(c *gin.Context) {
 		Status:    "offline",
 		LastSeen:  time.Now().Unix(),
 	}
+	device.MessageTypeConfigID = input.MessageTypeConfigID
 	result := database.DB.Create(&device)
 
 	if result.Error != nil {
@@ -45,6 +55,10 @@ func CreateDevice(c *gin.Context) {
 		return
 	}
 
+	if device.MessageTypeConfigID != nil {
+		refreshMQTTIngestion()
+	}
+
 	c.JSON(http.StatusOK, device)
 }
 
@@ -131,6 +145,7 @@ func DeleteDevice(c *gin.Context) {
 	}
 
 	database.DB.Delete(&device)
+	refreshMQTTIngestion()
 
 	c.JSON(http.StatusOK, gin.H{"message": "Device deleted successfully"})
 }
@@ -226,8 +241,21 @@ func UpdateDevice(c *gin.Context) {
 	if input.Address != "" {
 		device.Address = input.Address
 	}
+	// message_type_config_id 为 0 时解除绑定
+	if input.MessageTypeConfigID != nil {
+		if *input.MessageTypeConfigID == 0 {
+			device.MessageTypeConfigID = nil
+		} else {
+			if _, err := userConfigByID(userID, *input.MessageTypeConfigID); err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Message type config not found"})
+				return
+			}
+			device.MessageTypeConfigID = input.MessageTypeConfigID
+		}
+	}
 
 	database.DB.Save(&device)
+	refreshMQTTIngestion()
 
 	c.JSON(http.StatusOK, device)
 }
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -38,6 +39,12 @@ func CreateDeviceGroup(c *gin.Context) {
 		return
 	}
 
+	configID, err := groupConfigIDFromForm(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	// 处理文件上传
 	var iconURL string
 	file, err := c.FormFile("icon")
@@ -61,6 +68,9 @@ func CreateDeviceGroup(c *gin.Context) {
 		Description: description,
 		IconURL:     iconURL,
 	}
+	if configID != nil && *configID != 0 {
+		group.MessageTypeConfigID = configID
+	}
 	result := database.DB.Create(&group)
 
 	if result.Error != nil {
@@ -72,6 +82,10 @@ func CreateDeviceGroup(c *gin.Context) {
 		return
 	}
 
+	if group.MessageTypeConfigID != nil {
+		refreshMQTTIngestion()
+	}
+
 	c.JSON(http.StatusOK, group)
 }
 
@@ -96,6 +110,20 @@ func UpdateDeviceGroup(c *gin.Context) {
 		group.Description = description
 	}
 
+	// message_type_config_id 为 0 时解除绑定
+	configID, err := groupConfigIDFromForm(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if configID != nil {
+		if *configID == 0 {
+			group.MessageTypeConfigID = nil
+		} else {
+			group.MessageTypeConfigID = configID
+		}
+	}
+
 	// 处理文件上传
 	file, err := c.FormFile("icon")
 	if err == nil {
@@ -122,6 +150,7 @@ func UpdateDeviceGroup(c *gin.Context) {
 	}
 
 	database.DB.Save(&group)
+	refreshMQTTIngestion()
 
 	c.JSON(http.StatusOK, group)
 }
@@ -155,6 +184,28 @@ func DeleteDeviceGroup(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "Device group deleted successfully"})
 }
 
+// groupConfigIDFromForm 读取表单中的 message_type_config_id，未提供时返回 nil，
+// 非 0 时校验配置属于当前用户
+func groupConfigIDFromForm(c *gin.Context) (*uint, error) {
+	value := c.PostForm("message_type_config_id")
+	if value == "" {
+		return nil, nil
+	}
+
+	id, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid message_type_config_id")
+	}
+	configID := uint(id)
+	if configID != 0 {
+		userID := c.MustGet("userID").(uint)
+		if _, err := userConfigByID(userID, configID); err != nil {
+			return nil, err
+		}
+	}
+	return &configID, nil
+}
+
 // isValidSVGFile 验证文件是否为SVG格式
 func isValidSVGFile(file *multipart.FileHeader) bool {
 	// 检查文件扩展名
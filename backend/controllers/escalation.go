@@ -0,0 +1,240 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+	"gorm.io/gorm"
+)
+
+// escalationInterval 升级调度器检查到期升级的间隔
+const escalationInterval = 15 * time.Second
+
+// escalationTier 升级策略的一个层级
+type escalationTier struct {
+	DelayMinutes int    `json:"delay_minutes"` // 通知该层级后等待确认的分钟数，超时升级到下一层级
+	ScheduleIDs  []uint `json:"schedule_ids"`  // 通知值班表当前值班成员
+	ChannelIDs   []uint `json:"channel_ids"`   // 直接通知的渠道
+}
+
+// parseEscalationTiers 解析并校验升级策略的层级
+func parseEscalationTiers(raw string) ([]escalationTier, error) {
+	var tiers []escalationTier
+	if err := json.Unmarshal([]byte(raw), &tiers); err != nil {
+		return nil, fmt.Errorf("invalid tiers: %v", err)
+	}
+	if len(tiers) == 0 {
+		return nil, errors.New("at least one tier is required")
+	}
+	for i, tier := range tiers {
+		if tier.DelayMinutes < 1 {
+			return nil, fmt.Errorf("tier %d: delay_minutes must be at least 1", i+1)
+		}
+		if len(tier.ScheduleIDs) == 0 && len(tier.ChannelIDs) == 0 {
+			return nil, fmt.Errorf("tier %d: no schedule or channel to notify", i+1)
+		}
+	}
+	return tiers, nil
+}
+
+// policyMatchesAlert 升级策略是否适用于告警
+func policyMatchesAlert(policy *models.EscalationPolicy, alert *models.Alert, device *models.Device) bool {
+	if !policy.Enabled {
+		return false
+	}
+	if policy.GroupID != nil && (device.GroupID == nil || *device.GroupID != *policy.GroupID) {
+		return false
+	}
+	return levelListContains(policy.Levels, alert.Level)
+}
+
+// startAlertEscalation 为新建的告警匹配设备所有者的升级策略，第一个适用的策略开始升级
+func startAlertEscalation(alert *models.Alert) {
+	var device models.Device
+	if err := database.DB.First(&device, alert.DeviceID).Error; err != nil {
+		return
+	}
+	var policies []models.EscalationPolicy
+	if err := database.DB.Where("user_id = ? AND enabled = ?", device.UserID, true).Order("id").Find(&policies).Error; err != nil {
+		log.Printf("Failed to load escalation policies for user %d: %v", device.UserID, err)
+		return
+	}
+
+	for i := range policies {
+		if !policyMatchesAlert(&policies[i], alert, &device) {
+			continue
+		}
+		escalation := models.AlertEscalation{
+			AlertID:  alert.ID,
+			PolicyID: policies[i].ID,
+			Status:   models.EscalationStatusActive,
+			NextAt:   time.Now().Unix(),
+		}
+		if err := database.DB.Create(&escalation).Error; err != nil {
+			log.Printf("Failed to start escalation for alert %d: %v", alert.ID, err)
+			return
+		}
+		wakeEscalations()
+		return
+	}
+}
+
+// updateAlertEscalation 告警状态变化时更新升级: 确认、解决或清除停止升级，重新打开时从第一个层级重新开始
+func updateAlertEscalation(tx *gorm.DB, alertID uint, action string) error {
+	query := tx.Model(&models.AlertEscalation{}).Where("alert_id = ?", alertID)
+	switch action {
+	case models.AlertActionAcknowledge, models.AlertActionResolve, models.AlertActionClear:
+		return query.Where("status = ?", models.EscalationStatusActive).
+			Update("status", models.EscalationStatusStopped).Error
+	case models.AlertActionReopen:
+		return query.Updates(map[string]interface{}{
+			"status":  models.EscalationStatusActive,
+			"tier":    0,
+			"round":   0,
+			"next_at": time.Now().Unix(),
+		}).Error
+	}
+	return nil
+}
+
+// escalationWake 唤醒调度器立即检查，用于新开始的升级
+var escalationWake = make(chan struct{}, 1)
+
+// escalationMu 串行化升级处理
+var escalationMu sync.Mutex
+
+func wakeEscalations() {
+	select {
+	case escalationWake <- struct{}{}:
+	default:
+	}
+}
+
+// StartEscalationScheduler 启动升级调度器，升级进度保存在数据库中，重启后继续处理到期的升级
+func StartEscalationScheduler() {
+	go func() {
+		ticker := time.NewTicker(escalationInterval)
+		defer ticker.Stop()
+		for {
+			for _, id := range processEscalations(time.Now()) {
+				enqueueDelivery(id)
+			}
+			select {
+			case <-ticker.C:
+			case <-escalationWake:
+			}
+		}
+	}()
+}
+
+// processEscalations 推进所有到期的升级，返回新建的待发送记录ID
+func processEscalations(now time.Time) []uint {
+	escalationMu.Lock()
+	defer escalationMu.Unlock()
+
+	var escalations []models.AlertEscalation
+	if err := database.DB.Where("status = ? AND next_at <= ?", models.EscalationStatusActive, now.Unix()).
+		Order("next_at").Find(&escalations).Error; err != nil {
+		log.Printf("Failed to load escalations: %v", err)
+		return nil
+	}
+
+	var deliveries []uint
+	for i := range escalations {
+		deliveries = append(deliveries, advanceEscalation(&escalations[i], now)...)
+	}
+	return deliveries
+}
+
+// advanceEscalation 通知升级的当前层级并计算下一次通知时间，告警已不是 open 状态时停止升级
+func advanceEscalation(escalation *models.AlertEscalation, now time.Time) []uint {
+	stop := func(status string) {
+		escalation.Status = status
+		database.DB.Save(escalation)
+	}
+
+	var alert models.Alert
+	if err := database.DB.First(&alert, escalation.AlertID).Error; err != nil || alertState(&alert) != models.AlertStateOpen {
+		stop(models.EscalationStatusStopped)
+		return nil
+	}
+	var policy models.EscalationPolicy
+	if err := database.DB.First(&policy, escalation.PolicyID).Error; err != nil || !policy.Enabled {
+		stop(models.EscalationStatusStopped)
+		return nil
+	}
+	tiers, err := parseEscalationTiers(policy.Tiers)
+	if err != nil {
+		log.Printf("Escalation policy %d is invalid: %v", policy.ID, err)
+		stop(models.EscalationStatusStopped)
+		return nil
+	}
+	if escalation.Tier >= len(tiers) {
+		escalation.Tier = 0
+	}
+
+	tier := tiers[escalation.Tier]
+	deliveries, channelIDs := notifyEscalationTier(&alert, &policy, tier, escalation.Tier+1, now)
+	state := alertState(&alert)
+	recordAlertEvent(database.DB, alert.ID, 0, models.AlertActionEscalate, state, state,
+		fmt.Sprintf("Escalation policy %q tier %d notified channels %v", policy.Name, escalation.Tier+1, channelIDs))
+
+	escalation.Notified++
+	escalation.NextAt = now.Unix() + int64(tier.DelayMinutes)*60
+	escalation.Tier++
+	if escalation.Tier == len(tiers) {
+		escalation.Tier = 0
+		escalation.Round++
+		if escalation.Round > policy.Repeat {
+			escalation.Status = models.EscalationStatusCompleted
+		}
+	}
+	if err := database.DB.Save(escalation).Error; err != nil {
+		log.Printf("Failed to save escalation for alert %d: %v", alert.ID, err)
+	}
+	return deliveries
+}
+
+// notifyEscalationTier 为层级的值班成员和渠道创建待发送记录，返回发送记录ID和通知的渠道ID
+func notifyEscalationTier(alert *models.Alert, policy *models.EscalationPolicy, tier escalationTier, position int, now time.Time) ([]uint, []uint) {
+	targets := append([]uint{}, tier.ChannelIDs...)
+	for _, scheduleID := range tier.ScheduleIDs {
+		var schedule models.OnCallSchedule
+		if err := database.DB.Preload("Overrides", func(db *gorm.DB) *gorm.DB { return db.Order("id") }).
+			Where("id = ? AND user_id = ?", scheduleID, policy.UserID).First(&schedule).Error; err != nil {
+			log.Printf("On-call schedule %d of escalation policy %d not found", scheduleID, policy.ID)
+			continue
+		}
+		if channelID := onCallChannel(&schedule, now.Unix()); channelID != 0 {
+			targets = append(targets, channelID)
+		}
+	}
+
+	var channels []models.NotificationChannel
+	if len(targets) > 0 {
+		database.DB.Where("id IN ? AND user_id = ? AND enabled = ?", targets, policy.UserID, true).Order("id").Find(&channels)
+	}
+
+	var deliveries, channelIDs []uint
+	for _, channel := range channels {
+		delivery := models.NotificationDelivery{
+			AlertID:        alert.ID,
+			ChannelID:      channel.ID,
+			Status:         models.DeliveryStatusPending,
+			EscalationTier: position,
+		}
+		if err := database.DB.Create(&delivery).Error; err != nil {
+			log.Printf("Failed to create escalation delivery for alert %d: %v", alert.ID, err)
+			continue
+		}
+		deliveries = append(deliveries, delivery.ID)
+		channelIDs = append(channelIDs, channel.ID)
+	}
+	return deliveries, channelIDs
+}
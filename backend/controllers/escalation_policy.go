@@ -0,0 +1,163 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+// escalationPolicyInput 创建或修改升级策略的请求，tiers 可以是 JSON 数组或 JSON 字符串
+type escalationPolicyInput struct {
+	Name    string          `json:"name" binding:"required"`
+	Enabled *bool           `json:"enabled"`
+	Levels  *string         `json:"levels"`
+	GroupID *uint           `json:"group_id"`
+	Tiers   json.RawMessage `json:"tiers"`
+	Repeat  int             `json:"repeat"`
+}
+
+// bindEscalationPolicy 校验请求并写入升级策略，层级引用的值班表和渠道须属于策略所有者
+func bindEscalationPolicy(c *gin.Context, policy *models.EscalationPolicy) bool {
+	var input escalationPolicyInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+
+	badRequest := func(err error) bool {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	tiersJSON := string(input.Tiers)
+	var text string
+	if json.Unmarshal(input.Tiers, &text) == nil {
+		tiersJSON = text
+	}
+	tiers, err := parseEscalationTiers(tiersJSON)
+	if err != nil {
+		return badRequest(err)
+	}
+	for _, tier := range tiers {
+		if err := checkUserChannels(policy.UserID, tier.ChannelIDs); err != nil {
+			return badRequest(err)
+		}
+		if len(tier.ScheduleIDs) > 0 {
+			var count int64
+			database.DB.Model(&models.OnCallSchedule{}).Where("id IN ? AND user_id = ?", tier.ScheduleIDs, policy.UserID).Count(&count)
+			if int(count) != len(tier.ScheduleIDs) {
+				return badRequest(errors.New("On-call schedule not found"))
+			}
+		}
+	}
+	if input.Repeat < 0 {
+		return badRequest(errors.New("repeat must not be negative"))
+	}
+	if input.Levels != nil {
+		levels, err := normalizeLevels(*input.Levels)
+		if err != nil {
+			return badRequest(err)
+		}
+		policy.Levels = levels
+	}
+	if err := checkDeviceGroup(input.GroupID); err != nil {
+		return badRequest(err)
+	}
+
+	normalized, _ := json.Marshal(tiers)
+	policy.Name = input.Name
+	if input.Enabled != nil {
+		policy.Enabled = *input.Enabled
+	}
+	policy.GroupID = input.GroupID
+	policy.Tiers = string(normalized)
+	policy.Repeat = input.Repeat
+	return true
+}
+
+// GetEscalationPolicies 获取升级策略列表
+func GetEscalationPolicies(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	var policies []models.EscalationPolicy
+	if err := database.DB.Where("user_id = ?", userID).Order("id").Find(&policies).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get escalation policies"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": policies})
+}
+
+// CreateEscalationPolicy 创建升级策略，levels 为空时默认只升级 critical 告警
+func CreateEscalationPolicy(c *gin.Context) {
+	policy := models.EscalationPolicy{
+		UserID:  c.MustGet("userID").(uint),
+		Enabled: true,
+		Levels:  models.AlertLevelCritical,
+	}
+	if !bindEscalationPolicy(c, &policy) {
+		return
+	}
+	if err := database.DB.Create(&policy).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create escalation policy"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": policy})
+}
+
+// UpdateEscalationPolicy 修改升级策略，进行中的升级按新的层级继续
+func UpdateEscalationPolicy(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	var policy models.EscalationPolicy
+	if err := database.DB.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&policy).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Escalation policy not found"})
+		return
+	}
+	if !bindEscalationPolicy(c, &policy) {
+		return
+	}
+	if err := database.DB.Save(&policy).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update escalation policy"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": policy})
+}
+
+// DeleteEscalationPolicy 删除升级策略，进行中的升级在下次调度时停止
+func DeleteEscalationPolicy(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	var policy models.EscalationPolicy
+	if err := database.DB.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&policy).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Escalation policy not found"})
+		return
+	}
+	if err := database.DB.Delete(&policy).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete escalation policy"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Escalation policy deleted successfully"})
+}
+
+// GetAlertEscalation 获取告警的升级进度，没有适用的升级策略时 data 为空
+func GetAlertEscalation(c *gin.Context) {
+	alert, ok := userAlert(c)
+	if !ok {
+		return
+	}
+
+	var escalation models.AlertEscalation
+	if err := database.DB.Where("alert_id = ?", alert.ID).First(&escalation).Error; err != nil {
+		c.JSON(http.StatusOK, gin.H{"data": nil})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": escalation})
+}
@@ -0,0 +1,184 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+func TestOnCallChannel(t *testing.T) {
+	const week = int64(7 * 24 * 3600)
+	schedule := &models.OnCallSchedule{Members: "3, 5,4", RotationStart: 1000}
+
+	cases := []struct {
+		at   int64
+		want uint
+	}{
+		{1000, 3},
+		{1000 + week - 1, 3},
+		{1000 + week, 5},
+		{1000 + 2*week, 4},
+		{1000 + 3*week, 3},
+		{999, 4},
+		{1000 - week, 4},
+		{1000 - week - 1, 5},
+	}
+	for _, tc := range cases {
+		if got := onCallChannel(schedule, tc.at); got != tc.want {
+			t.Errorf("at %d: got %d, want %d", tc.at, got, tc.want)
+		}
+	}
+
+	// 临时替班优先，重叠时后创建的优先
+	schedule.Overrides = []models.OnCallOverride{
+		{ChannelID: 8, StartAt: 2000, EndAt: 3000},
+		{ChannelID: 9, StartAt: 2500, EndAt: 2600},
+	}
+	for at, want := range map[int64]uint{1999: 3, 2000: 8, 2550: 9, 2600: 8, 3000: 3} {
+		if got := onCallChannel(schedule, at); got != want {
+			t.Errorf("override at %d: got %d, want %d", at, got, want)
+		}
+	}
+
+	if got := onCallChannel(&models.OnCallSchedule{}, 1000); got != 0 {
+		t.Errorf("Expected no on-call member for empty schedule, got %d", got)
+	}
+}
+
+func TestAlertEscalation(t *testing.T) {
+	useTestDatabase(t)
+
+	user := models.User{Username: "ops", Password: "x"}
+	database.DB.Create(&user)
+	device := models.Device{Name: "boiler", Topic: "boiler/1", UserID: user.ID}
+	database.DB.Create(&device)
+	var channels [3]models.NotificationChannel
+	for i := range channels {
+		channels[i] = models.NotificationChannel{UserID: user.ID, Name: fmt.Sprint(i), Type: models.ChannelTypeWebhook,
+			Enabled: true, Config: `{"url":"http://127.0.0.1:1"}`}
+		database.DB.Create(&channels[i])
+	}
+	now := time.Now()
+	schedule := models.OnCallSchedule{UserID: user.ID, Name: "primary",
+		Members: fmt.Sprintf("%d,%d", channels[0].ID, channels[1].ID), RotationStart: now.Unix() - 3600}
+	database.DB.Create(&schedule)
+	policy := models.EscalationPolicy{UserID: user.ID, Name: "critical", Enabled: true, Levels: models.AlertLevelCritical, Repeat: 1,
+		Tiers: fmt.Sprintf(`[{"delay_minutes":10,"schedule_ids":[%d]},{"delay_minutes":5,"channel_ids":[%d]}]`, schedule.ID, channels[2].ID)}
+	database.DB.Create(&policy)
+
+	// 非 critical 告警不升级
+	low := models.Alert{DeviceID: device.ID, Type: "x", Level: models.AlertLevelLow}
+	database.DB.Create(&low)
+	startAlertEscalation(&low)
+	alert := models.Alert{DeviceID: device.ID, Type: "overheat", Level: models.AlertLevelCritical}
+	database.DB.Create(&alert)
+	startAlertEscalation(&alert)
+
+	var count int64
+	database.DB.Model(&models.AlertEscalation{}).Count(&count)
+	if count != 1 {
+		t.Fatalf("Expected one escalation, got %d", count)
+	}
+
+	// 每一步推进后通知的渠道
+	expectNotified := func(at time.Time, tier int, want ...uint) {
+		t.Helper()
+		ids := processEscalations(at)
+		var deliveries []models.NotificationDelivery
+		if len(ids) > 0 {
+			database.DB.Where("id IN ?", ids).Order("channel_id").Find(&deliveries)
+		}
+		if len(deliveries) != len(want) {
+			t.Fatalf("At %v: expected deliveries to %v, got %+v", at.Sub(now), want, deliveries)
+		}
+		for i, delivery := range deliveries {
+			if delivery.ChannelID != want[i] || delivery.EscalationTier != tier || delivery.AlertID != alert.ID {
+				t.Errorf("At %v: unexpected delivery %+v", at.Sub(now), delivery)
+			}
+		}
+	}
+
+	expectNotified(now, 1, channels[0].ID)
+	expectNotified(now.Add(5*time.Minute), 0)
+	expectNotified(now.Add(10*time.Minute), 2, channels[2].ID)
+	// 重复第二轮
+	expectNotified(now.Add(15*time.Minute), 1, channels[0].ID)
+
+	// 确认后停止升级
+	if err := transitionAlert(database.DB, &alert, models.AlertActionAcknowledge, user.ID, ""); err != nil {
+		t.Fatalf("Failed to acknowledge alert: %v", err)
+	}
+	expectNotified(now.Add(time.Hour), 0)
+	var escalation models.AlertEscalation
+	database.DB.Where("alert_id = ?", alert.ID).First(&escalation)
+	if escalation.Status != models.EscalationStatusStopped || escalation.Notified != 3 {
+		t.Errorf("Expected stopped escalation, got %+v", escalation)
+	}
+
+	// 重新打开后从第一个层级重新升级，重复一轮后结束
+	database.DB.First(&alert, alert.ID)
+	transitionAlert(database.DB, &alert, models.AlertActionResolve, user.ID, "")
+	database.DB.First(&alert, alert.ID)
+	if err := transitionAlert(database.DB, &alert, models.AlertActionReopen, user.ID, ""); err != nil {
+		t.Fatalf("Failed to reopen alert: %v", err)
+	}
+	later := time.Now().Add(time.Minute)
+	expectNotified(later, 1, channels[0].ID)
+	expectNotified(later.Add(10*time.Minute), 2, channels[2].ID)
+	expectNotified(later.Add(15*time.Minute), 1, channels[0].ID)
+	expectNotified(later.Add(25*time.Minute), 2, channels[2].ID)
+	expectNotified(later.Add(time.Hour), 0)
+	database.DB.Where("alert_id = ?", alert.ID).First(&escalation)
+	if escalation.Status != models.EscalationStatusCompleted {
+		t.Errorf("Expected completed escalation, got %+v", escalation)
+	}
+
+	database.DB.Model(&models.AlertEvent{}).Where("alert_id = ? AND action = ?", alert.ID, models.AlertActionEscalate).Count(&count)
+	if count != 7 {
+		t.Errorf("Expected 7 escalate events, got %d", count)
+	}
+}
+
+func TestCreateEscalationPolicyEnabled(t *testing.T) {
+	useTestDatabase(t)
+	gin.SetMode(gin.TestMode)
+
+	channel := models.NotificationChannel{UserID: 1, Name: "ops", Type: models.ChannelTypeWebhook, Enabled: true, Config: `{"url":"http://127.0.0.1:1"}`}
+	database.DB.Create(&channel)
+	tiers := fmt.Sprintf(`[{"delay_minutes":5,"channel_ids":[%d]}]`, channel.ID)
+
+	create := func(body string) models.EscalationPolicy {
+		t.Helper()
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/api/escalation-policies", strings.NewReader(body))
+		c.Request.Header.Set("Content-Type", "application/json")
+		c.Set("userID", uint(1))
+		CreateEscalationPolicy(c)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected policy to be created, got %d: %s", w.Code, w.Body.String())
+		}
+		var created struct {
+			Data models.EscalationPolicy `json:"data"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &created)
+		var policy models.EscalationPolicy
+		database.DB.First(&policy, created.Data.ID)
+		return policy
+	}
+
+	if policy := create(`{"name":"critical","tiers":` + tiers + `}`); !policy.Enabled {
+		t.Error("Expected new policy to be enabled by default")
+	}
+	if policy := create(`{"name":"draft","tiers":` + tiers + `,"enabled":false}`); policy.Enabled {
+		t.Error("Expected policy created with enabled=false to stay disabled")
+	}
+}
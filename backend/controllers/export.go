@@ -0,0 +1,449 @@
+package controllers
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+	"gorm.io/gorm"
+)
+
+// 导出对象
+const (
+	ExportTargetAlerts    = "alerts"
+	ExportTargetTelemetry = "telemetry"
+)
+
+const (
+	// exportBatchSize 每批从数据库读取的行数
+	exportBatchSize = 1000
+	// exportRetention 后台导出文件的保留时长
+	exportRetention = 24 * time.Hour
+	// exportMaxRunningJobs 同时执行的后台导出任务数，其余任务排队等待
+	exportMaxRunningJobs = 2
+	// exportMaxActiveJobs 排队和执行中的后台导出任务总数上限
+	exportMaxActiveJobs = 10
+	// exportMaxUserJobs 每个用户排队和执行中的后台导出任务数上限
+	exportMaxUserJobs = 2
+)
+
+// exportDir 后台导出文件的保存目录
+var exportDir = "exports"
+
+// exportJobSlots 限制同时执行的后台导出任务
+var exportJobSlots = make(chan struct{}, exportMaxRunningJobs)
+
+// activeExportJobs 排队和执行中的后台导出任务数
+var activeExportJobs = struct {
+	sync.Mutex
+	total int
+	users map[uint]int
+}{users: make(map[uint]int)}
+
+// reserveExportJob 为用户占用一个后台导出任务名额，超出上限时返回 false
+func reserveExportJob(userID uint) bool {
+	activeExportJobs.Lock()
+	defer activeExportJobs.Unlock()
+	if activeExportJobs.total >= exportMaxActiveJobs || activeExportJobs.users[userID] >= exportMaxUserJobs {
+		return false
+	}
+	activeExportJobs.total++
+	activeExportJobs.users[userID]++
+	return true
+}
+
+// releaseExportJob 释放任务结束或创建失败的名额
+func releaseExportJob(userID uint) {
+	activeExportJobs.Lock()
+	defer activeExportJobs.Unlock()
+	activeExportJobs.total--
+	if activeExportJobs.users[userID]--; activeExportJobs.users[userID] <= 0 {
+		delete(activeExportJobs.users, userID)
+	}
+}
+
+// exporter 按过滤条件分批读取一种数据并逐行写出
+type exporter struct {
+	columns []string
+	rows    func(write func([]interface{}) error) error
+}
+
+// export 以指定格式写出全部数据，onRow 不为空时每写出一行调用，返回写出的行数
+func (e *exporter) export(format string, w io.Writer, onRow func(int)) (int, error) {
+	ew, err := newExportWriter(format, w, e.columns)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	err = e.rows(func(values []interface{}) error {
+		if err := ew.WriteRow(values); err != nil {
+			return err
+		}
+		count++
+		if onRow != nil {
+			onRow(count)
+		}
+		return nil
+	})
+	if closeErr := ew.Close(); err == nil {
+		err = closeErr
+	}
+	return count, err
+}
+
+// userDeviceNames 用户设备ID到名称的映射
+func userDeviceNames(userID uint) map[uint]string {
+	var devices []models.Device
+	database.DB.Select("id", "name").Where("user_id = ?", userID).Find(&devices)
+	names := make(map[uint]string, len(devices))
+	for _, device := range devices {
+		names[device.ID] = device.Name
+	}
+	return names
+}
+
+// newExporter 根据导出对象和过滤条件创建导出
+func newExporter(target string, values url.Values, userID uint) (*exporter, error) {
+	switch target {
+	case ExportTargetAlerts:
+		return newAlertExporter(values, userID)
+	case ExportTargetTelemetry:
+		return newTelemetryExporter(values, userID)
+	}
+	return nil, fmt.Errorf("unsupported export target %q", target)
+}
+
+// newAlertExporter 告警导出，过滤条件和排序同告警查询，按游标分批读取
+func newAlertExporter(values url.Values, userID uint) (*exporter, error) {
+	q, err := parseAlertQuery(values, userID)
+	if err != nil {
+		return nil, err
+	}
+	q.cursor = nil
+	q.limit = exportBatchSize
+
+	columns := []string{"id", "device_id", "device_name", "type", "level", "state", "message", "timestamp", "last_seen",
+		"occurrences", "read", "silenced", "acknowledged_at", "resolved_at", "parsed_data"}
+	return &exporter{columns: columns, rows: func(write func([]interface{}) error) error {
+		names := userDeviceNames(userID)
+		for {
+			var alerts []models.Alert
+			if err := q.scope(database.DB.Model(&models.Alert{})).Scopes(q.order, q.page).Find(&alerts).Error; err != nil {
+				return err
+			}
+			more := len(alerts) > q.limit
+			if more {
+				alerts = alerts[:q.limit]
+			}
+			for i := range alerts {
+				a := &alerts[i]
+				err := write([]interface{}{a.ID, a.DeviceID, names[a.DeviceID], a.Type, a.Level, alertState(a), a.Message,
+					exportTime(a.Timestamp), exportTime(a.LastSeen), a.Occurrences, a.Read, a.Silenced,
+					exportTime(a.AcknowledgedAt), exportTime(a.ResolvedAt), a.ParsedData})
+				if err != nil {
+					return err
+				}
+			}
+			if !more {
+				return nil
+			}
+			last := &alerts[len(alerts)-1]
+			q.cursor = &alertCursor{value: alertSortKeys[q.sort].value(last), id: last.ID}
+		}
+	}}, nil
+}
+
+// newTelemetryExporter 遥测导出，过滤条件同遥测列表: start、end(也可用 from、to)、source，
+// 以及 device_id(可逗号分隔多个，为空时导出用户全部设备)，按 ID 顺序分批读取
+func newTelemetryExporter(values url.Values, userID uint) (*exporter, error) {
+	deviceIDs, err := parseIDList(values.Get("device_id"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid device_id: %v", err)
+	}
+	var start, end int64
+	if value := queryDefault(values, "start", values.Get("from")); value != "" {
+		if start, err = parseQueryTime(value); err != nil {
+			return nil, err
+		}
+	}
+	if value := queryDefault(values, "end", values.Get("to")); value != "" {
+		if end, err = parseQueryTime(value); err != nil {
+			return nil, err
+		}
+	}
+	source := values.Get("source")
+
+	columns := []string{"id", "device_id", "device_name", "source", "timestamp", "latitude", "longitude", "altitude",
+		"speed", "course", "rssi", "snr", "data"}
+	return &exporter{columns: columns, rows: func(write func([]interface{}) error) error {
+		names := userDeviceNames(userID)
+		var allowed []uint
+		for id := range names {
+			if len(deviceIDs) == 0 {
+				allowed = append(allowed, id)
+			}
+		}
+		for _, id := range deviceIDs {
+			if _, ok := names[id]; ok {
+				allowed = append(allowed, id)
+			}
+		}
+		if len(allowed) == 0 {
+			return nil
+		}
+
+		query := database.DB.Model(&models.Telemetry{}).Where("device_id IN ?", allowed)
+		if start != 0 {
+			query = query.Where("timestamp >= ?", start)
+		}
+		if end != 0 {
+			query = query.Where("timestamp <= ?", end)
+		}
+		if source != "" {
+			query = query.Where("source = ?", source)
+		}
+
+		var records []models.Telemetry
+		return query.FindInBatches(&records, exportBatchSize, func(tx *gorm.DB, batch int) error {
+			for i := range records {
+				t := &records[i]
+				err := write([]interface{}{t.ID, t.DeviceID, names[t.DeviceID], t.Source, exportTime(t.Timestamp),
+					t.Latitude, t.Longitude, t.Altitude, t.Speed, t.Course, t.RSSI, t.SNR, t.Data})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}).Error
+	}}, nil
+}
+
+// ExportAlerts 导出告警
+func ExportAlerts(c *gin.Context) {
+	handleExport(c, ExportTargetAlerts)
+}
+
+// ExportTelemetry 导出遥测数据
+func ExportTelemetry(c *gin.Context) {
+	handleExport(c, ExportTargetTelemetry)
+}
+
+// handleExport 导出数据: format 为 csv(默认)、xlsx、jsonl，其余参数为过滤条件。
+// 默认直接流式下载；async=true 时创建后台导出任务，完成后通过任务下载
+func handleExport(c *gin.Context, target string) {
+	userID := c.MustGet("userID").(uint)
+
+	values := c.Request.URL.Query()
+	format := queryDefault(values, "format", ExportFormatCSV)
+	if _, ok := exportContentTypes[format]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unsupported export format %q", format)})
+		return
+	}
+	async := values.Get("async") == "true"
+	values.Del("format")
+	values.Del("async")
+
+	exp, err := newExporter(target, values, userID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if async {
+		if !reserveExportJob(userID) {
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many export jobs in progress, try again later"})
+			return
+		}
+		cleanupExportJobs()
+		job := models.ExportJob{
+			UserID: userID,
+			Target: target,
+			Format: format,
+			Query:  values.Encode(),
+			Status: models.ExportStatusPending,
+		}
+		if err := database.DB.Create(&job).Error; err != nil {
+			releaseExportJob(userID)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create export job"})
+			return
+		}
+		// 后台任务修改自己的副本，响应使用创建时的状态
+		running := job
+		go runExportJob(&running, exp)
+		c.JSON(http.StatusOK, gin.H{"data": job})
+		return
+	}
+
+	filename := fmt.Sprintf("%s-%s.%s", target, time.Now().Format("20060102-150405"), format)
+	c.Header("Content-Type", exportContentTypes[format])
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Status(http.StatusOK)
+	if rows, err := exp.export(format, c.Writer, nil); err != nil {
+		// 响应已开始发送，只能记录错误
+		log.Printf("Export of %s for user %d failed after %d rows: %v", target, userID, rows, err)
+	}
+}
+
+// runExportJob 等待执行名额后执行后台导出任务，导出过程中定期更新已导出行数
+func runExportJob(job *models.ExportJob, exp *exporter) {
+	defer releaseExportJob(job.UserID)
+	exportJobSlots <- struct{}{}
+	defer func() { <-exportJobSlots }()
+
+	path := filepath.Join(exportDir, fmt.Sprintf("export-%d.%s", job.ID, job.Format))
+	fail := func(err error) {
+		os.Remove(path)
+		job.Status = models.ExportStatusFailed
+		job.Message = truncateString(err.Error(), 250)
+		job.FinishedAt = time.Now().Unix()
+		database.DB.Save(job)
+		log.Printf("Export job %d failed: %v", job.ID, err)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			fail(fmt.Errorf("panic: %v", p))
+		}
+	}()
+
+	job.Status = models.ExportStatusRunning
+	job.StartedAt = time.Now().Unix()
+	database.DB.Save(job)
+
+	if err := os.MkdirAll(exportDir, 0755); err != nil {
+		fail(err)
+		return
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		fail(err)
+		return
+	}
+	rows, err := exp.export(job.Format, f, func(rows int) {
+		if rows%exportBatchSize == 0 {
+			database.DB.Model(job).Update("rows", rows)
+		}
+	})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	job.Rows = rows
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	if info, err := os.Stat(path); err == nil {
+		job.Size = info.Size()
+	}
+	job.FilePath = path
+	job.Status = models.ExportStatusCompleted
+	job.FinishedAt = time.Now().Unix()
+	if err := database.DB.Save(job).Error; err != nil {
+		log.Printf("Failed to save export job %d: %v", job.ID, err)
+	}
+}
+
+// cleanupExportJobs 删除超过保留时长的导出任务及其文件
+func cleanupExportJobs() {
+	var jobs []models.ExportJob
+	database.DB.Where("created_at < ?", time.Now().Add(-exportRetention)).Find(&jobs)
+	for _, job := range jobs {
+		if job.FilePath != "" {
+			os.Remove(job.FilePath)
+		}
+		database.DB.Delete(&job)
+	}
+}
+
+// RecoverExportJobs 服务重启后将未完成的导出任务标记为失败，并清理过期的导出文件
+func RecoverExportJobs() {
+	database.DB.Model(&models.ExportJob{}).
+		Where("status IN ?", []string{models.ExportStatusPending, models.ExportStatusRunning}).
+		Updates(map[string]interface{}{
+			"status":      models.ExportStatusFailed,
+			"message":     "interrupted by server restart",
+			"finished_at": time.Now().Unix(),
+		})
+	cleanupExportJobs()
+}
+
+// userExportJob 获取当前用户的导出任务，不存在时返回 404
+func userExportJob(c *gin.Context) (*models.ExportJob, bool) {
+	userID := c.MustGet("userID").(uint)
+
+	var job models.ExportJob
+	if err := database.DB.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&job).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Export job not found"})
+		return nil, false
+	}
+	return &job, true
+}
+
+// GetExportJobs 获取导出任务列表
+func GetExportJobs(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	var jobs []models.ExportJob
+	if err := database.DB.Where("user_id = ?", userID).Order("id DESC").Find(&jobs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get export jobs"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": jobs})
+}
+
+// GetExportJob 获取导出任务
+func GetExportJob(c *gin.Context) {
+	if job, ok := userExportJob(c); ok {
+		c.JSON(http.StatusOK, gin.H{"data": job})
+	}
+}
+
+// DownloadExportJob 下载已完成的导出文件
+func DownloadExportJob(c *gin.Context) {
+	job, ok := userExportJob(c)
+	if !ok {
+		return
+	}
+	if job.Status != models.ExportStatusCompleted || job.FilePath == "" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Export job is not completed"})
+		return
+	}
+
+	filename := fmt.Sprintf("%s-%s.%s", job.Target, time.Unix(job.StartedAt, 0).Format("20060102-150405"), job.Format)
+	c.Header("Content-Type", exportContentTypes[job.Format])
+	c.Header("Content-Length", strconv.FormatInt(job.Size, 10))
+	c.FileAttachment(job.FilePath, filename)
+}
+
+// DeleteExportJob 删除导出任务及其文件
+func DeleteExportJob(c *gin.Context) {
+	job, ok := userExportJob(c)
+	if !ok {
+		return
+	}
+	if job.Status == models.ExportStatusPending || job.Status == models.ExportStatusRunning {
+		c.JSON(http.StatusConflict, gin.H{"error": "Export job is still running"})
+		return
+	}
+
+	if job.FilePath != "" {
+		os.Remove(job.FilePath)
+	}
+	if err := database.DB.Delete(job).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete export job"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Export job deleted successfully"})
+}
@@ -0,0 +1,269 @@
+package controllers
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+func runExport(t *testing.T, handler gin.HandlerFunc, userID uint, query string) *httptest.ResponseRecorder {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/export?"+query, nil)
+	c.Set("userID", userID)
+	handler(c)
+	return w
+}
+
+func createExportFixtures(t *testing.T) (pump, other models.Device) {
+	t.Helper()
+	pump = models.Device{Name: "水泵", Topic: "pump", UserID: 1}
+	other = models.Device{Name: "other", Topic: "other", UserID: 2}
+	database.DB.Create(&pump)
+	database.DB.Create(&other)
+
+	alerts := []models.Alert{
+		{DeviceID: pump.ID, Type: "overheat", Level: "high", Message: "温度过高, 请检查", Timestamp: 1700000000, Occurrences: 3},
+		{DeviceID: pump.ID, Type: "offline", Level: "low", Message: "offline", Timestamp: 1700000100, Occurrences: 1},
+		{DeviceID: pump.ID, Type: "overheat", Level: "high", Message: "again", Timestamp: 1700000200, Occurrences: 1},
+		{DeviceID: other.ID, Type: "overheat", Level: "high", Message: "not mine", Timestamp: 1700000300, Occurrences: 1},
+	}
+	for i := range alerts {
+		database.DB.Create(&alerts[i])
+	}
+	for i, device := range []models.Device{pump, pump, other} {
+		database.DB.Create(&models.Telemetry{DeviceID: device.ID, Source: "zy", Timestamp: 1700000000 + int64(i), Latitude: 31.5, RSSI: -80, Data: `{"t":1}`})
+	}
+	return pump, other
+}
+
+func TestExportAlertsCSV(t *testing.T) {
+	useTestDatabase(t)
+	createExportFixtures(t)
+
+	w := runExport(t, ExportAlerts, 1, "format=csv&level=high&sort=timestamp&order=asc")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/csv") ||
+		!strings.Contains(w.Header().Get("Content-Disposition"), "attachment; filename=\"alerts-") {
+		t.Errorf("Unexpected headers %v", w.Header())
+	}
+	body := w.Body.String()
+	if !strings.HasPrefix(body, "\ufeff") {
+		t.Fatal("CSV export should start with a UTF-8 BOM")
+	}
+
+	records, err := csv.NewReader(strings.NewReader(strings.TrimPrefix(body, "\ufeff"))).ReadAll()
+	if err != nil {
+		t.Fatalf("Invalid CSV: %v", err)
+	}
+	if len(records) != 3 || records[0][0] != "id" || records[0][2] != "device_name" {
+		t.Fatalf("Unexpected records %v", records)
+	}
+	if records[1][2] != "水泵" || records[1][6] != "温度过高, 请检查" || records[2][6] != "again" {
+		t.Errorf("Unexpected rows %v", records[1:])
+	}
+	if records[1][7] != time.Unix(1700000000, 0).Format("2006-01-02 15:04:05") || records[1][13] != "" {
+		t.Errorf("Unexpected time columns %v", records[1])
+	}
+
+	if w := runExport(t, ExportAlerts, 1, "format=pdf"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for unsupported format, got %d", w.Code)
+	}
+	if w := runExport(t, ExportAlerts, 1, "sort=name"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid filter, got %d", w.Code)
+	}
+}
+
+func TestExportAlertsJSONL(t *testing.T) {
+	useTestDatabase(t)
+	createExportFixtures(t)
+
+	w := runExport(t, ExportAlerts, 1, "format=jsonl")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d", w.Code)
+	}
+	var rows []map[string]interface{}
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var row map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			t.Fatalf("Invalid JSON line %q: %v", scanner.Text(), err)
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("Expected 3 rows, got %d", len(rows))
+	}
+	// 默认按创建时间倒序，时间为 Unix 秒
+	if rows[0]["message"] != "again" || rows[0]["timestamp"] != float64(1700000200) || rows[0]["read"] != false {
+		t.Errorf("Unexpected row %v", rows[0])
+	}
+}
+
+func TestExportTelemetryXLSX(t *testing.T) {
+	useTestDatabase(t)
+	pump, other := createExportFixtures(t)
+
+	w := runExport(t, ExportTelemetry, 1, "format=xlsx&source=zy")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d", w.Code)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatalf("Invalid XLSX: %v", err)
+	}
+	var sheet string
+	for _, f := range zr.File {
+		if f.Name == "xl/worksheets/sheet1.xml" {
+			rc, _ := f.Open()
+			data, _ := io.ReadAll(rc)
+			rc.Close()
+			sheet = string(data)
+		}
+	}
+	if strings.Count(sheet, "<row>") != 3 {
+		t.Fatalf("Expected header and 2 rows, got %q", sheet)
+	}
+	if !strings.Contains(sheet, "水泵") || !strings.Contains(sheet, "<v>31.5</v>") || !strings.Contains(sheet, "{&#34;t&#34;:1}") {
+		t.Errorf("Unexpected sheet %q", sheet)
+	}
+
+	// 其他用户的设备不导出
+	w = runExport(t, ExportTelemetry, 1, "format=jsonl&device_id="+fmt.Sprint(other.ID))
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("Expected empty export, got %d %q", w.Code, w.Body.String())
+	}
+	w = runExport(t, ExportTelemetry, 1, "format=jsonl&device_id="+fmt.Sprint(pump.ID)+"&start=1700000001")
+	if strings.Count(w.Body.String(), "\n") != 1 {
+		t.Errorf("Expected 1 row, got %q", w.Body.String())
+	}
+}
+
+func TestExportJob(t *testing.T) {
+	useTestDatabase(t)
+	createExportFixtures(t)
+	exportDir = t.TempDir()
+	defer func() { exportDir = "exports" }()
+
+	w := runExport(t, ExportAlerts, 1, "format=csv&async=true&type=overheat")
+	var created struct {
+		Data models.ExportJob `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	if w.Code != http.StatusOK || created.Data.ID == 0 || created.Data.Query != "type=overheat" {
+		t.Fatalf("Unexpected response %d: %s", w.Code, w.Body.String())
+	}
+
+	var job models.ExportJob
+	for i := 0; i < 100; i++ {
+		database.DB.First(&job, created.Data.ID)
+		if job.Status == models.ExportStatusCompleted || job.Status == models.ExportStatusFailed {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if job.Status != models.ExportStatusCompleted || job.Rows != 2 || job.Size == 0 {
+		t.Fatalf("Unexpected job %+v", job)
+	}
+
+	download := func(userID uint) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/api/export-jobs/1/download", nil)
+		c.Params = gin.Params{{Key: "id", Value: fmt.Sprint(job.ID)}}
+		c.Set("userID", userID)
+		DownloadExportJob(c)
+		return w
+	}
+	if w := download(2); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for another user, got %d", w.Code)
+	}
+	w = download(1)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "\ufeffid,") || strings.Count(w.Body.String(), "\n") != 3 {
+		t.Errorf("Unexpected download %d %q", w.Code, w.Body.String())
+	}
+
+	// 每个用户同时只能有有限个后台任务
+	for i := 0; i < exportMaxUserJobs; i++ {
+		reserveExportJob(3)
+	}
+	if w := runExport(t, ExportAlerts, 3, "async=true"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 when too many jobs are active, got %d", w.Code)
+	}
+	for i := 0; i < exportMaxUserJobs; i++ {
+		releaseExportJob(3)
+	}
+
+	// 重启时未完成的任务标记为失败
+	pending := models.ExportJob{UserID: 1, Target: ExportTargetAlerts, Format: ExportFormatCSV, Status: models.ExportStatusRunning}
+	database.DB.Create(&pending)
+	RecoverExportJobs()
+	database.DB.First(&pending, pending.ID)
+	if pending.Status != models.ExportStatusFailed {
+		t.Errorf("Expected interrupted job to fail, got %s", pending.Status)
+	}
+}
+
+func TestExportUnsafeText(t *testing.T) {
+	useTestDatabase(t)
+	device := models.Device{Name: "@pump", Topic: "pump", UserID: 1}
+	database.DB.Create(&device)
+	database.DB.Create(&models.Alert{DeviceID: device.ID, Type: "99", Level: "high", Message: "=HYPERLINK(\"http://x\")\x01\x1b", Timestamp: 1700000000})
+
+	// CSV 中可能被当作公式的文本前加 '
+	w := runExport(t, ExportAlerts, 1, "format=csv")
+	records, err := csv.NewReader(strings.NewReader(strings.TrimPrefix(w.Body.String(), "\ufeff"))).ReadAll()
+	if err != nil || len(records) != 2 {
+		t.Fatalf("Invalid CSV %v: %q", err, w.Body.String())
+	}
+	if records[1][2] != "'@pump" || !strings.HasPrefix(records[1][6], "'=HYPERLINK") {
+		t.Errorf("Expected formula-like text to be escaped, got %v", records[1])
+	}
+
+	// XLSX 中去除 XML 不允许的控制字符
+	w = runExport(t, ExportAlerts, 1, "format=xlsx")
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatalf("Invalid XLSX: %v", err)
+	}
+	for _, f := range zr.File {
+		if f.Name != "xl/worksheets/sheet1.xml" {
+			continue
+		}
+		rc, _ := f.Open()
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		if strings.ContainsAny(string(data), "\x01\x1b\ufffd") {
+			t.Errorf("Sheet contains invalid characters: %q", data)
+		}
+		decoder := xml.NewDecoder(bytes.NewReader(data))
+		for {
+			if _, err := decoder.Token(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("Sheet is not valid XML: %v", err)
+			}
+		}
+		if !strings.Contains(string(data), `=HYPERLINK(&#34;http://x&#34;)</t>`) {
+			t.Errorf("Unexpected sheet %q", data)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package controllers
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 导出格式
+const (
+	ExportFormatCSV   = "csv"
+	ExportFormatXLSX  = "xlsx"
+	ExportFormatJSONL = "jsonl"
+)
+
+// exportContentTypes 各导出格式的 Content-Type
+var exportContentTypes = map[string]string{
+	ExportFormatCSV:   "text/csv; charset=utf-8",
+	ExportFormatXLSX:  "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	ExportFormatJSONL: "application/x-ndjson; charset=utf-8",
+}
+
+const (
+	// xlsxMaxRows Excel 工作表的最大行数(含表头)
+	xlsxMaxRows = 1048576
+	// xlsxMaxCellLength Excel 单元格的最大字符数
+	xlsxMaxCellLength = 32767
+)
+
+// errExportRowLimit 超出导出格式支持的最大行数
+var errExportRowLimit = errors.New("row limit of the export format exceeded")
+
+// exportTime 导出的时间列，CSV/XLSX 中为本地时间文本，JSONL 中为 Unix 秒，0 表示空
+type exportTime int64
+
+func (t exportTime) String() string {
+	if t == 0 {
+		return ""
+	}
+	return time.Unix(int64(t), 0).Format("2006-01-02 15:04:05")
+}
+
+// exportWriter 逐行写出导出数据，不在内存中保留已写出的行
+type exportWriter interface {
+	WriteRow(values []interface{}) error
+	Close() error
+}
+
+// newExportWriter 创建指定格式的导出写入器，CSV/XLSX 首先写入表头
+func newExportWriter(format string, w io.Writer, columns []string) (exportWriter, error) {
+	switch format {
+	case ExportFormatCSV:
+		return newCSVExportWriter(w, columns)
+	case ExportFormatXLSX:
+		return newXLSXExportWriter(w, columns)
+	case ExportFormatJSONL:
+		return &jsonlExportWriter{w: bufio.NewWriter(w), columns: columns}, nil
+	}
+	return nil, fmt.Errorf("unsupported export format %q", format)
+}
+
+// exportText 导出值的文本形式
+func exportText(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case exportTime:
+		return v.String()
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// csvExportWriter CSV 导出，以 UTF-8 BOM 开头使 Excel 正确识别中文
+type csvExportWriter struct {
+	w *csv.Writer
+}
+
+func newCSVExportWriter(w io.Writer, columns []string) (*csvExportWriter, error) {
+	if _, err := io.WriteString(w, "\ufeff"); err != nil {
+		return nil, err
+	}
+	cw := &csvExportWriter{w: csv.NewWriter(w)}
+	return cw, cw.w.Write(columns)
+}
+
+func (cw *csvExportWriter) WriteRow(values []interface{}) error {
+	record := make([]string, len(values))
+	for i, value := range values {
+		record[i] = exportText(value)
+		if _, ok := value.(string); ok {
+			record[i] = csvSafeText(record[i])
+		}
+	}
+	return cw.w.Write(record)
+}
+
+// csvSafeText 以 = + - @ 等开头的文本在 Excel 中会被当作公式执行，前面加 ' 按文本显示
+func csvSafeText(text string) string {
+	if text != "" && strings.ContainsRune("=+-@\t\r", rune(text[0])) {
+		return "'" + text
+	}
+	return text
+}
+
+func (cw *csvExportWriter) Close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// jsonlExportWriter JSON Lines 导出，每行一个以列名为键的对象
+type jsonlExportWriter struct {
+	w       *bufio.Writer
+	columns []string
+}
+
+func (jw *jsonlExportWriter) WriteRow(values []interface{}) error {
+	row := make(map[string]interface{}, len(values))
+	for i, value := range values {
+		if t, ok := value.(exportTime); ok {
+			value = int64(t)
+		}
+		row[jw.columns[i]] = value
+	}
+	line, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	jw.w.Write(line)
+	return jw.w.WriteByte('\n')
+}
+
+func (jw *jsonlExportWriter) Close() error {
+	return jw.w.Flush()
+}
+
+// xlsxExportWriter 最简 XLSX 导出: 单个工作表，字符串使用内联字符串，
+// 工作表 XML 直接流式写入 zip，不需要共享字符串表
+type xlsxExportWriter struct {
+	zw    *zip.Writer
+	sheet *bufio.Writer
+	rows  int
+}
+
+// xlsxStaticParts XLSX 中工作表以外的固定部分
+var xlsxStaticParts = []struct{ name, content string }{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="Sheet1" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`},
+}
+
+func newXLSXExportWriter(w io.Writer, columns []string) (*xlsxExportWriter, error) {
+	zw := zip.NewWriter(w)
+	for _, part := range xlsxStaticParts {
+		f, err := zw.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(f, part.content); err != nil {
+			return nil, err
+		}
+	}
+	f, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+
+	xw := &xlsxExportWriter{zw: zw, sheet: bufio.NewWriter(f)}
+	xw.sheet.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" +
+		`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	header := make([]interface{}, len(columns))
+	for i, column := range columns {
+		header[i] = column
+	}
+	return xw, xw.WriteRow(header)
+}
+
+func (xw *xlsxExportWriter) WriteRow(values []interface{}) error {
+	if xw.rows >= xlsxMaxRows {
+		return errExportRowLimit
+	}
+	xw.rows++
+
+	xw.sheet.WriteString("<row>")
+	for _, value := range values {
+		switch v := value.(type) {
+		case int, int64, uint, float64:
+			xw.sheet.WriteString("<c><v>" + exportText(v) + "</v></c>")
+		case bool:
+			b := "0"
+			if v {
+				b = "1"
+			}
+			xw.sheet.WriteString(`<c t="b"><v>` + b + "</v></c>")
+		default:
+			text := xlsxText(exportText(v))
+			if text == "" {
+				xw.sheet.WriteString("<c/>")
+				continue
+			}
+			if len(text) > xlsxMaxCellLength {
+				text = strings.ToValidUTF8(text[:xlsxMaxCellLength], "")
+			}
+			xw.sheet.WriteString(`<c t="inlineStr"><is><t xml:space="preserve">`)
+			xml.EscapeText(xw.sheet, []byte(text))
+			xw.sheet.WriteString("</t></is></c>")
+		}
+	}
+	_, err := xw.sheet.WriteString("</row>")
+	return err
+}
+
+// xlsxText 去除 XML 1.0 不允许的字符(制表符、换行、回车以外的控制字符等)，否则 Excel 无法打开文件
+func xlsxText(text string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\t' || r == '\n' || r == '\r',
+			r >= 0x20 && r <= 0xD7FF,
+			r >= 0xE000 && r <= 0xFFFD,
+			r >= 0x10000 && r <= 0x10FFFF:
+			return r
+		}
+		return -1
+	}, text)
+}
+
+func (xw *xlsxExportWriter) Close() error {
+	xw.sheet.WriteString("</sheetData></worksheet>")
+	if err := xw.sheet.Flush(); err != nil {
+		return err
+	}
+	return xw.zw.Close()
+}
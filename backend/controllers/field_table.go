@@ -0,0 +1,317 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+// fieldTableColumns 字段表表头别名(小写)，兼容常见厂商协议文档的中英文表头
+var fieldTableColumns = map[string]string{
+	"name": "name", "field": "name", "field name": "name", "字段": "name", "字段名": "name", "字段名称": "name", "名称": "name",
+	"type": "type", "data type": "type", "datatype": "type", "类型": "type", "数据类型": "type",
+	"offset": "offset", "start": "offset", "start byte": "offset", "偏移": "offset", "偏移量": "offset", "起始字节": "offset", "起始": "offset",
+	"length": "length", "len": "length", "size": "length", "bytes": "length", "长度": "length", "字节数": "length",
+	"endian": "endian", "byte order": "endian", "endianness": "endian", "字节序": "endian",
+	"scale": "scale", "factor": "scale", "ratio": "scale", "resolution": "scale", "系数": "scale", "比例": "scale", "倍率": "scale", "分辨率": "scale",
+	"unit": "unit", "units": "unit", "单位": "unit",
+	"decimals": "decimals", "小数位": "decimals", "小数位数": "decimals",
+	"signed": "signed", "有符号": "signed",
+	"section": "section", "part": "section", "部分": "section", "区段": "section",
+}
+
+// fieldTableTypes 字段类型别名，映射到解析器支持的类型
+var fieldTableTypes = map[string]string{
+	"uint8": "uint8", "u8": "uint8", "byte": "uint8", "uchar": "uint8",
+	"int8": "int8", "i8": "int8", "sbyte": "int8",
+	"uint16": "uint16", "u16": "uint16", "word": "uint16", "ushort": "uint16",
+	"int16": "int16", "i16": "int16", "short": "int16",
+	"uint32": "uint32", "u32": "uint32", "dword": "uint32", "uint": "uint32", "ulong": "uint32",
+	"int32": "int32", "i32": "int32", "int": "int32", "long": "int32",
+	"float32": "float32", "f32": "float32", "float": "float32", "real": "float32", "single": "float32",
+	"float64": "float64", "f64": "float64", "double": "float64",
+	"string": "string", "str": "string", "ascii": "string", "char": "string", "text": "string",
+	"bytes": "bytes", "byte[]": "bytes", "raw": "bytes", "hex": "bytes", "binary": "bytes",
+}
+
+// fieldTypeSizes 定长类型的字节数
+var fieldTypeSizes = map[string]int{
+	"uint8": 1, "int8": 1, "uint16": 2, "int16": 2, "uint32": 4, "int32": 4, "float32": 4, "float64": 8,
+}
+
+// fieldTableRow 字段表中的一行
+type fieldTableRow struct {
+	Line      int
+	Section   string
+	Field     models.FieldDefinition
+	HasOffset bool
+}
+
+// normalizeTableHeader 规范化表头，去除括号中的说明，如 "Offset (byte)"、"长度（字节）"
+func normalizeTableHeader(header string) string {
+	header = strings.ToLower(strings.TrimSpace(header))
+	for _, sep := range []string{"(", "（", "["} {
+		if i := strings.Index(header, sep); i > 0 {
+			header = strings.TrimSpace(header[:i])
+		}
+	}
+	return header
+}
+
+// parseTableInt 解析整数，支持 0x 前缀的十六进制
+func parseTableInt(text string) (int, error) {
+	value, err := strconv.ParseInt(strings.TrimSpace(text), 0, 32)
+	return int(value), err
+}
+
+// parseTableEndian 解析字节序
+func parseTableEndian(text string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(text)) {
+	case "", "big", "be", "big-endian", "big endian", "msb", "abcd", "大端", "大端序":
+		return "big", nil
+	case "little", "le", "little-endian", "little endian", "lsb", "dcba", "小端", "小端序":
+		return "little", nil
+	default:
+		return "", fmt.Errorf("unknown endian %q", text)
+	}
+}
+
+// parseTableBool 解析是/否类取值
+func parseTableBool(text string) bool {
+	switch strings.ToLower(strings.TrimSpace(text)) {
+	case "1", "true", "yes", "y", "是", "有":
+		return true
+	}
+	return false
+}
+
+// parseFieldTable 解析 CSV/TSV 字段表(从 Excel 复制的内容为制表符分隔)，第一行为表头
+func parseFieldTable(data []byte) ([]fieldTableRow, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+		return nil, fmt.Errorf("xlsx files are not supported, save the sheet as CSV or paste the table")
+	}
+
+	firstLine := string(data)
+	if i := strings.IndexByte(firstLine, '\n'); i >= 0 {
+		firstLine = firstLine[:i]
+	}
+	reader := csv.NewReader(bytes.NewReader(data))
+	switch {
+	case strings.Contains(firstLine, "\t"):
+		reader.Comma = '\t'
+	case strings.Contains(firstLine, ";") && !strings.Contains(firstLine, ","):
+		reader.Comma = ';'
+	}
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid field table: %v", err)
+	}
+	if len(records) < 2 {
+		return nil, fmt.Errorf("field table must have a header row and at least one field")
+	}
+
+	columns := make(map[string]int)
+	for i, header := range records[0] {
+		if key, ok := fieldTableColumns[normalizeTableHeader(header)]; ok {
+			if _, exists := columns[key]; !exists {
+				columns[key] = i
+			}
+		}
+	}
+	if _, ok := columns["name"]; !ok {
+		return nil, fmt.Errorf("field table is missing the name column")
+	}
+	if _, ok := columns["type"]; !ok {
+		return nil, fmt.Errorf("field table is missing the type column")
+	}
+
+	var rows []fieldTableRow
+	for i, record := range records[1:] {
+		line := i + 2
+		cell := func(key string) string {
+			if index, ok := columns[key]; ok && index < len(record) {
+				return strings.TrimSpace(record[index])
+			}
+			return ""
+		}
+		if strings.TrimSpace(strings.Join(record, "")) == "" {
+			continue
+		}
+
+		row := fieldTableRow{Line: line, Section: "body"}
+		row.Field.Name = cell("name")
+		if row.Field.Name == "" {
+			return nil, fmt.Errorf("row %d: name is required", line)
+		}
+
+		typeName := strings.ToLower(cell("type"))
+		fieldType, ok := fieldTableTypes[typeName]
+		if !ok {
+			return nil, fmt.Errorf("row %d: unsupported type %q", line, cell("type"))
+		}
+		row.Field.Type = fieldType
+
+		if text := cell("length"); text != "" {
+			length, err := parseTableInt(text)
+			if err != nil || length <= 0 {
+				return nil, fmt.Errorf("row %d: invalid length %q", line, text)
+			}
+			row.Field.Length = length
+		}
+		if size, fixed := fieldTypeSizes[fieldType]; fixed {
+			if row.Field.Length != 0 && row.Field.Length != size {
+				return nil, fmt.Errorf("row %d: %s must be %d bytes, got %d", line, fieldType, size, row.Field.Length)
+			}
+			row.Field.Length = size
+		} else if row.Field.Length == 0 {
+			return nil, fmt.Errorf("row %d: length is required for %s fields", line, fieldType)
+		}
+
+		if text := cell("offset"); text != "" {
+			offset, err := parseTableInt(text)
+			if err != nil || offset < 0 {
+				return nil, fmt.Errorf("row %d: invalid offset %q", line, text)
+			}
+			row.Field.Offset = offset
+			row.HasOffset = true
+		}
+
+		if row.Field.Endian, err = parseTableEndian(cell("endian")); err != nil {
+			return nil, fmt.Errorf("row %d: %v", line, err)
+		}
+		if text := cell("scale"); text != "" {
+			scale, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				return nil, fmt.Errorf("row %d: invalid scale %q", line, text)
+			}
+			row.Field.Scale = scale
+		}
+		if text := cell("decimals"); text != "" {
+			if row.Field.Decimals, err = parseTableInt(text); err != nil {
+				return nil, fmt.Errorf("row %d: invalid decimals %q", line, text)
+			}
+		}
+		row.Field.Unit = cell("unit")
+		row.Field.Signed = strings.HasPrefix(fieldType, "int") || parseTableBool(cell("signed"))
+
+		if section := strings.ToLower(cell("section")); section != "" {
+			switch section {
+			case "header", "head", "报文头", "头":
+				row.Section = "header"
+			case "body", "payload", "报文体", "数据":
+				row.Section = "body"
+			case "footer", "tail", "报文尾", "尾":
+				row.Section = "footer"
+			default:
+				return nil, fmt.Errorf("row %d: unknown section %q", line, section)
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("field table has no fields")
+	}
+	return rows, nil
+}
+
+// buildFieldTableFormat 将字段表转换为报文格式。解析器按顺序连续读取字段，
+// 因此按偏移量排序，字段间的空隙以 reserved 字节字段填充，偏移量重叠时报错
+func buildFieldTableFormat(rows []fieldTableRow, encoding string) (models.MessageFormat, []string, error) {
+	sectionOrder := map[string]int{"header": 0, "body": 1, "footer": 2}
+	format := models.MessageFormat{Encoding: encoding}
+	var warnings []string
+
+	// 未填写偏移量的字段紧跟在上一字段之后
+	cursor := 0
+	for i := range rows {
+		if !rows[i].HasOffset {
+			rows[i].Field.Offset = cursor
+		}
+		cursor = rows[i].Field.Offset + rows[i].Field.Length
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		if sectionOrder[rows[i].Section] != sectionOrder[rows[j].Section] {
+			return sectionOrder[rows[i].Section] < sectionOrder[rows[j].Section]
+		}
+		return rows[i].Field.Offset < rows[j].Field.Offset
+	})
+
+	names := make(map[string]bool)
+	cursor = 0
+	for _, row := range rows {
+		if names[row.Field.Name] {
+			return format, nil, fmt.Errorf("row %d: duplicate field name '%s'", row.Line, row.Field.Name)
+		}
+		names[row.Field.Name] = true
+
+		if row.Field.Offset < cursor {
+			return format, nil, fmt.Errorf("row %d: field '%s' at offset %d overlaps the previous field ending at %d",
+				row.Line, row.Field.Name, row.Field.Offset, cursor)
+		}
+
+		var fields []models.FieldDefinition
+		if gap := row.Field.Offset - cursor; gap > 0 {
+			warnings = append(warnings, fmt.Sprintf("bytes %d-%d are not described, added reserved field", cursor, row.Field.Offset-1))
+			fields = append(fields, models.FieldDefinition{
+				Name:   fmt.Sprintf("reserved_%d", cursor),
+				Type:   "bytes",
+				Offset: cursor,
+				Length: gap,
+			})
+		}
+		fields = append(fields, row.Field)
+		cursor = row.Field.Offset + row.Field.Length
+
+		switch row.Section {
+		case "header":
+			format.Header = append(format.Header, fields...)
+		case "footer":
+			format.Footer = append(format.Footer, fields...)
+		default:
+			format.Body = append(format.Body, fields...)
+		}
+	}
+
+	return format, warnings, nil
+}
+
+// ImportFieldTable 将 CSV/TSV 字段表(名称、类型、偏移、长度、字节序、系数、单位)转换为报文格式，
+// 请求体或表单字段 file 为表格内容，encoding 指定原始数据编码(默认 hex)
+func ImportFieldTable(c *gin.Context) {
+	encoding := c.DefaultQuery("encoding", "hex")
+	if encoding != "hex" && encoding != "base64" && encoding != "ascii" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "encoding must be one of hex, base64, ascii"})
+		return
+	}
+
+	data, err := uploadedContent(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read field table"})
+		return
+	}
+
+	rows, err := parseFieldTable(data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	format, warnings, err := buildFieldTableFormat(rows, encoding)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": format, "warnings": warnings})
+}
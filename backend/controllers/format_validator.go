@@ -0,0 +1,398 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+// 校验问题级别
+const (
+	IssueError   = "error"   // 格式无法正确解析，拒绝保存
+	IssueWarning = "warning" // 可以保存，但配置可能与预期不符
+)
+
+// FormatIssue 格式校验发现的问题，Path 为字段路径，如 body[2].length
+type FormatIssue struct {
+	Path     string `json:"path"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// FormatValidation 格式校验结果
+type FormatValidation struct {
+	Valid     bool          `json:"valid"`
+	Errors    []FormatIssue `json:"errors"`
+	Warnings  []FormatIssue `json:"warnings"`
+	Format    string        `json:"format,omitempty"`     // 规范化后的格式 JSON，即保存的内容
+	MinLength int           `json:"min_length,omitempty"` // 二进制负载的最小字节数
+}
+
+// formatValidator 收集校验问题
+type formatValidator struct {
+	result FormatValidation
+	names  map[string]string // 字段名 -> 首次出现的路径
+}
+
+func (v *formatValidator) errorf(path, message string, args ...interface{}) {
+	v.result.Errors = append(v.result.Errors, FormatIssue{Path: path, Severity: IssueError, Message: fmt.Sprintf(message, args...)})
+}
+
+func (v *formatValidator) warnf(path, message string, args ...interface{}) {
+	v.result.Warnings = append(v.result.Warnings, FormatIssue{Path: path, Severity: IssueWarning, Message: fmt.Sprintf(message, args...)})
+}
+
+// jsonKeys 结构体的 JSON 字段名集合
+func jsonKeys(t reflect.Type) map[string]bool {
+	keys := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			keys[name] = true
+		}
+	}
+	return keys
+}
+
+var (
+	formatKeys = jsonKeys(reflect.TypeOf(models.MessageFormat{}))
+	fieldKeys  = jsonKeys(reflect.TypeOf(models.FieldDefinition{}))
+)
+
+// checkUnknownKeys 未知的键会被解析器忽略，通常是拼写错误
+func (v *formatValidator) checkUnknownKeys(path string, doc interface{}, known map[string]bool) {
+	object, ok := doc.(map[string]interface{})
+	if !ok {
+		return
+	}
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		if !known[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		// encoding/json 匹配键名时不区分大小写，这类键仍会生效
+		if known[strings.ToLower(key)] {
+			v.warnf(joinPath(path, key), "key '%s' should be written as '%s'", key, strings.ToLower(key))
+			continue
+		}
+		v.warnf(joinPath(path, key), "unknown key '%s' is ignored", key)
+	}
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// normalizeField 去除名称两端空白，类型和字节序统一为小写
+func normalizeField(field *models.FieldDefinition) {
+	field.Name = strings.TrimSpace(field.Name)
+	field.Type = strings.ToLower(strings.TrimSpace(field.Type))
+	field.Endian = strings.ToLower(strings.TrimSpace(field.Endian))
+}
+
+// checkName 校验字段名称必填且不重复(重复的字段会在解析结果中相互覆盖)
+func (v *formatValidator) checkName(path string, field models.FieldDefinition) {
+	if field.Name == "" {
+		v.errorf(joinPath(path, "name"), "name is required")
+		return
+	}
+	if first, ok := v.names[field.Name]; ok {
+		v.errorf(joinPath(path, "name"), "duplicate field name '%s' (also defined at %s)", field.Name, first)
+		return
+	}
+	v.names[field.Name] = path
+}
+
+// checkBinaryField 校验二进制字段，offset 为解析器实际读取该字段的位置，返回字段之后的位置
+func (v *formatValidator) checkBinaryField(path string, field *models.FieldDefinition, offset int) int {
+	normalizeField(field)
+	if path != "length" {
+		// 长度字段只用于限定报文体，不写入解析结果
+		v.checkName(path, *field)
+	}
+
+	size, fixed := fieldTypeSizes[field.Type]
+	switch {
+	case field.Type == "":
+		v.errorf(joinPath(path, "type"), "type is required")
+	case fixed:
+		if field.Length == 0 {
+			v.warnf(joinPath(path, "length"), "length is not set, using %d bytes for %s", size, field.Type)
+			field.Length = size
+		} else if field.Length != size {
+			v.errorf(joinPath(path, "length"), "%s requires length %d, got %d", field.Type, size, field.Length)
+		}
+	case field.Type == "string" || field.Type == "bytes":
+		if field.Length <= 0 {
+			v.errorf(joinPath(path, "length"), "length must be greater than 0 for %s fields", field.Type)
+		}
+	default:
+		v.errorf(joinPath(path, "type"), "unsupported type '%s'", field.Type)
+	}
+
+	switch field.Endian {
+	case "big", "little":
+	case "":
+		if fixed && size > 1 {
+			v.warnf(joinPath(path, "endian"), "endian is not set, little endian is used")
+		}
+	default:
+		v.errorf(joinPath(path, "endian"), "endian must be big or little, got '%s'", field.Endian)
+	}
+
+	// 二进制字段按顺序连续读取，偏移量仅作说明，规范化为实际读取位置
+	if field.Offset != 0 && field.Offset != offset {
+		v.warnf(joinPath(path, "offset"), "offset %d is ignored, fields are read sequentially and this field starts at byte %d", field.Offset, offset)
+	}
+	field.Offset = offset
+
+	if field.Decimals < 0 {
+		v.errorf(joinPath(path, "decimals"), "decimals must not be negative")
+	} else if field.Decimals > 0 && field.Scale == 0 && field.Type != "float32" && field.Type != "float64" {
+		v.warnf(joinPath(path, "decimals"), "decimals only applies to float or scaled fields")
+	}
+	if field.Scale != 0 && !fixed {
+		v.warnf(joinPath(path, "scale"), "scale only applies to numeric fields")
+	}
+	if field.Signed && strings.HasPrefix(field.Type, "uint") {
+		v.warnf(joinPath(path, "signed"), "signed is ignored for %s, use an int type instead", field.Type)
+	}
+	if field.Path != "" || field.Key != "" || field.Index != 0 {
+		v.warnf(path, "path, index and key only apply to text payloads")
+	}
+
+	if field.Length > 0 {
+		return offset + field.Length
+	}
+	return offset
+}
+
+// checkBinaryFormat 按解析器的读取顺序校验: 报文头、长度字段、报文体、报文尾、校验和
+func (v *formatValidator) checkBinaryFormat(format *models.MessageFormat) {
+	offset := 0
+	for i := range format.Header {
+		offset = v.checkBinaryField(fmt.Sprintf("header[%d]", i), &format.Header[i], offset)
+	}
+	if format.Length != nil {
+		offset = v.checkBinaryField("length", format.Length, offset)
+		if format.Length.Type != "" && !strings.Contains(format.Length.Type, "int") {
+			v.errorf("length.type", "length field must be an integer type")
+		}
+	}
+	for i := range format.Body {
+		offset = v.checkBinaryField(fmt.Sprintf("body[%d]", i), &format.Body[i], offset)
+	}
+	for i := range format.Footer {
+		offset = v.checkBinaryField(fmt.Sprintf("footer[%d]", i), &format.Footer[i], offset)
+	}
+
+	if format.Checksum != nil {
+		// 校验和覆盖其之前的全部数据，必须位于报文最后
+		if format.Checksum.Offset != 0 && format.Checksum.Offset < offset {
+			v.errorf("checksum.offset", "checksum must be placed after the body and footer (offset %d, fields end at byte %d)", format.Checksum.Offset, offset)
+			format.Checksum.Offset = offset
+		}
+		offset = v.checkBinaryField("checksum", format.Checksum, offset)
+		switch format.Checksum.Type {
+		case "uint8", "uint16", "uint32":
+		default:
+			v.warnf("checksum.type", "checksum of type '%s' is read but not verified", format.Checksum.Type)
+		}
+	}
+
+	if len(format.Header)+len(format.Body)+len(format.Footer) == 0 {
+		v.warnf("body", "format defines no fields")
+	}
+	if format.Separator != "" {
+		v.warnf("separator", "separator only applies to kv payloads")
+	}
+	v.result.MinLength = offset
+}
+
+// checkTextFormat 校验 JSON、分隔符和 key=value 负载
+func (v *formatValidator) checkTextFormat(format *models.MessageFormat) {
+	sections := []struct {
+		name   string
+		fields []models.FieldDefinition
+	}{{"header", format.Header}, {"body", format.Body}, {"footer", format.Footer}}
+
+	indexes := make(map[int]string)
+	count := 0
+	for _, section := range sections {
+		for i := range section.fields {
+			path := fmt.Sprintf("%s[%d]", section.name, i)
+			field := &section.fields[i]
+			normalizeField(field)
+			v.checkName(path, *field)
+			count++
+
+			if _, fixed := fieldTypeSizes[field.Type]; !fixed && field.Type != "" && field.Type != "string" && field.Type != "bytes" {
+				v.errorf(joinPath(path, "type"), "unsupported type '%s'", field.Type)
+			}
+			if field.Endian != "" {
+				v.warnf(joinPath(path, "endian"), "endian only applies to binary payloads")
+			}
+
+			switch format.Kind {
+			case PayloadKindDelimited:
+				if field.Index < 0 {
+					v.errorf(joinPath(path, "index"), "index must not be negative")
+				} else if first, ok := indexes[field.Index]; ok {
+					v.warnf(joinPath(path, "index"), "column %d is also read by %s", field.Index, first)
+				} else {
+					indexes[field.Index] = path
+				}
+			case PayloadKindJSON:
+				if field.Key != "" {
+					v.warnf(joinPath(path, "key"), "key only applies to kv payloads, use path for json payloads")
+				}
+			case PayloadKindKV:
+				if field.Path != "" {
+					v.warnf(joinPath(path, "path"), "path only applies to json payloads, use key for kv payloads")
+				}
+			}
+		}
+	}
+
+	if count == 0 {
+		v.warnf("body", "format defines no fields")
+	}
+	if format.Checksum != nil || format.Length != nil {
+		v.warnf("", "checksum and length fields are ignored for %s payloads", format.Kind)
+	}
+	if format.Separator != "" && format.Kind != PayloadKindKV {
+		v.warnf("separator", "separator only applies to kv payloads")
+	}
+}
+
+// checkScriptFormat 编译脚本解码器(执行脚本顶层代码)，字段定义不参与脚本负载的解析
+func (v *formatValidator) checkScriptFormat(format *models.MessageFormat) {
+	if _, err := compileScript(format.Script); err != nil {
+		v.errorf("script", "invalid decoder script: %v", err)
+	}
+	if len(format.Header)+len(format.Body)+len(format.Footer) > 0 {
+		v.warnf("", "field definitions are ignored for script payloads")
+	}
+	if format.Checksum != nil || format.Length != nil {
+		v.warnf("", "checksum and length fields are ignored for script payloads")
+	}
+}
+
+// validateMessageFormat 静态校验消息格式并返回规范化后的格式:
+// 解开被引号包裹的 JSON 字符串，统一枚举值大小写，将字段偏移量修正为实际读取位置
+func validateMessageFormat(protocol, formatStr string) FormatValidation {
+	v := &formatValidator{names: make(map[string]string)}
+	v.result.Errors = []FormatIssue{}
+	v.result.Warnings = []FormatIssue{}
+
+	var doc interface{}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(formatStr)), &doc); err != nil {
+		v.errorf("", "format is not valid JSON: %v", err)
+		return v.result
+	}
+	if inner, ok := doc.(string); ok {
+		v.warnf("", "format is a JSON-encoded string, it will be stored as an object")
+		formatStr = inner
+		if err := json.Unmarshal([]byte(inner), &doc); err != nil {
+			v.errorf("", "format is not valid JSON: %v", err)
+			return v.result
+		}
+	}
+	object, ok := doc.(map[string]interface{})
+	if !ok {
+		v.errorf("", "format must be a JSON object")
+		return v.result
+	}
+
+	var format models.MessageFormat
+	if err := json.Unmarshal([]byte(formatStr), &format); err != nil {
+		v.errorf("", "invalid format: %v", err)
+		return v.result
+	}
+
+	v.checkUnknownKeys("", object, formatKeys)
+	for _, section := range []string{"header", "body", "footer"} {
+		if items, ok := object[section].([]interface{}); ok {
+			for i, item := range items {
+				v.checkUnknownKeys(fmt.Sprintf("%s[%d]", section, i), item, fieldKeys)
+			}
+		}
+	}
+	for _, key := range []string{"checksum", "length"} {
+		v.checkUnknownKeys(key, object[key], fieldKeys)
+	}
+
+	format.Encoding = strings.ToLower(strings.TrimSpace(format.Encoding))
+	format.Kind = strings.ToLower(strings.TrimSpace(format.Kind))
+	switch format.Encoding {
+	case "", "hex", "base64", "ascii":
+	default:
+		v.errorf("encoding", "encoding must be hex, base64 or ascii, got '%s'", format.Encoding)
+	}
+
+	switch {
+	case protocol == ProtocolNMEA:
+		// NMEA 语句由内置解析器处理，不使用字段定义
+		if len(format.Header)+len(format.Body)+len(format.Footer) > 0 {
+			v.warnf("", "field definitions are ignored for the nmea protocol")
+		}
+	case isTextPayloadKind(format.Kind):
+		v.checkTextFormat(&format)
+	case format.Kind == PayloadKindScript:
+		v.checkScriptFormat(&format)
+	case format.Kind == "" || format.Kind == PayloadKindBinary:
+		v.checkBinaryFormat(&format)
+	default:
+		v.errorf("kind", "unsupported payload kind '%s'", format.Kind)
+	}
+
+	if format.Script != "" && format.Kind != PayloadKindScript && protocol != ProtocolNMEA {
+		v.warnf("script", "script only applies to script payloads")
+	}
+
+	if format.Header == nil {
+		format.Header = []models.FieldDefinition{}
+	}
+	if format.Body == nil {
+		format.Body = []models.FieldDefinition{}
+	}
+	if format.Footer == nil {
+		format.Footer = []models.FieldDefinition{}
+	}
+	normalized, _ := json.Marshal(format)
+	v.result.Format = string(normalized)
+	v.result.Valid = len(v.result.Errors) == 0
+	return v.result
+}
+
+// ValidateMessageFormat 校验消息格式但不保存，供编辑器实时提示，format 可以是 JSON 对象或 JSON 字符串
+func ValidateMessageFormat(c *gin.Context) {
+	var input struct {
+		Protocol string          `json:"protocol"`
+		Format   json.RawMessage `json:"format" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	format := string(input.Format)
+	var text string
+	if json.Unmarshal(input.Format, &text) == nil {
+		format = text
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": validateMessageFormat(input.Protocol, format)})
+}
@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+func issuePaths(issues []FormatIssue) map[string]bool {
+	paths := make(map[string]bool)
+	for _, issue := range issues {
+		paths[issue.Path] = true
+	}
+	return paths
+}
+
+func TestValidateMessageFormatErrors(t *testing.T) {
+	format := `{
+		"encoding": "hex",
+		"body": [
+			{"name": "count", "type": "int32", "length": 2, "endian": "big"},
+			{"name": "label", "type": "string", "length": 0},
+			{"name": "mode", "type": "enum8", "length": 1},
+			{"name": "count", "type": "uint8", "length": 1},
+			{"name": "flags", "type": "uint16", "length": 2, "endian": "middle"}
+		],
+		"checksum": {"name": "crc", "type": "uint8", "length": 1, "offset": 1}
+	}`
+
+	result := validateMessageFormat("mqtt", format)
+	if result.Valid {
+		t.Fatal("Expected format to be invalid")
+	}
+	paths := issuePaths(result.Errors)
+	for _, path := range []string{"body[0].length", "body[1].length", "body[2].type", "body[3].name", "body[4].endian", "checksum.offset"} {
+		if !paths[path] {
+			t.Errorf("Expected error at %s, got %+v", path, result.Errors)
+		}
+	}
+}
+
+func TestValidateMessageFormatNormalizes(t *testing.T) {
+	inner := `{"Encoding":"HEX","typo":1,"body":[` +
+		`{"name":" speed ","type":"UINT16","offset":0},` +
+		`{"name":"battery","type":"uint8","length":1,"offset":9,"signed":true}]}`
+	quoted, _ := json.Marshal(inner)
+
+	result := validateMessageFormat("mqtt", string(quoted))
+	if !result.Valid {
+		t.Fatalf("Expected format to be valid, got %+v", result.Errors)
+	}
+	warnings := issuePaths(result.Warnings)
+	for _, path := range []string{"", "Encoding", "typo", "body[0].length", "body[0].endian", "body[1].offset", "body[1].signed"} {
+		if !warnings[path] {
+			t.Errorf("Expected warning at %q, got %+v", path, result.Warnings)
+		}
+	}
+
+	var format models.MessageFormat
+	if err := json.Unmarshal([]byte(result.Format), &format); err != nil {
+		t.Fatalf("Normalized format is not valid JSON: %v", err)
+	}
+	speed, battery := format.Body[0], format.Body[1]
+	if format.Encoding != "hex" || speed.Name != "speed" || speed.Type != "uint16" || speed.Length != 2 {
+		t.Errorf("Unexpected normalized field: %+v", speed)
+	}
+	if battery.Offset != 2 || result.MinLength != 3 {
+		t.Errorf("Expected battery at offset 2 and min length 3, got %d and %d", battery.Offset, result.MinLength)
+	}
+}
+
+func TestValidateMessageFormatTextPayload(t *testing.T) {
+	format := `{"kind":"delimited","delimiter":",","body":[` +
+		`{"name":"id","type":"string","index":0},` +
+		`{"name":"temperature","type":"float32","index":1,"endian":"big"},` +
+		`{"name":"humidity","type":"float32","index":1}]}`
+
+	result := validateMessageFormat("mqtt", format)
+	if !result.Valid {
+		t.Fatalf("Expected format to be valid, got %+v", result.Errors)
+	}
+	warnings := issuePaths(result.Warnings)
+	if !warnings["body[1].endian"] || !warnings["body[2].index"] {
+		t.Errorf("Unexpected warnings: %+v", result.Warnings)
+	}
+
+	for _, invalid := range []string{`[]`, `not json`, `{"kind":"xml"}`, `{"encoding":"utf16"}`} {
+		if validateMessageFormat("mqtt", invalid).Valid {
+			t.Errorf("Expected %s to be invalid", invalid)
+		}
+	}
+	if !validateMessageFormat(ProtocolNMEA, `{}`).Valid {
+		t.Error("Expected empty NMEA format to be valid")
+	}
+}
@@ -0,0 +1,186 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+// defaultMessageConfig 获取用户的默认消息类型配置，没有默认配置时返回第一个配置
+func defaultMessageConfig(userID uint) (*models.MessageTypeConfig, error) {
+	var config models.MessageTypeConfig
+	if err := database.DB.Where("user_id = ? AND is_default = ?", userID, true).First(&config).Error; err != nil {
+		if err := database.DB.Where("user_id = ?", userID).First(&config).Error; err != nil {
+			return nil, fmt.Errorf("no message type config found for user %d", userID)
+		}
+	}
+	return &config, nil
+}
+
+// deviceMessageConfig 获取设备解析上行数据使用的消息类型配置(按设备主题匹配绑定)
+func deviceMessageConfig(device *models.Device) (*models.MessageTypeConfig, error) {
+	config, _, err := resolveMessageConfig(device, device.Topic)
+	return config, err
+}
+
+// encodePayloadForConfig 将二进制负载转换为配置编码方式(hex/base64/ascii)对应的字符串
+func encodePayloadForConfig(config *models.MessageTypeConfig, payload []byte) string {
+	return encodePayload(configPayloadEncoding(config), payload)
+}
+
+// encodePayload 按编码方式将二进制负载转换为字符串，未知编码按 ascii 处理
+func encodePayload(encoding string, payload []byte) string {
+	switch encoding {
+	case "hex":
+		return hex.EncodeToString(payload)
+	case "base64":
+		return base64.StdEncoding.EncodeToString(payload)
+	default:
+		return string(payload)
+	}
+}
+
+// fieldFloat 从解析结果中按候选字段名读取数值
+func fieldFloat(fields map[string]interface{}, names ...string) (float64, bool) {
+	for _, name := range names {
+		if value, ok := numericFloat(fields[name]); ok {
+			return value, true
+		}
+	}
+	return 0, false
+}
+
+// numericFloat 将解析出的数值类型转换为 float64，非数值返回 false
+func numericFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// resolveDeviceByPayload 设备标识不在地址中时，使用默认用户的默认配置解析负载，
+// 按 device_id / imei 字段匹配设备 topic
+func resolveDeviceByPayload(payload []byte) (*models.Device, error) {
+	config, err := defaultMessageConfig(1)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := parseWithConfig(*config, encodePayloadForConfig(config, payload))
+	if err != nil || !result.Success {
+		return nil, fmt.Errorf("failed to parse payload: %s", result.Error)
+	}
+
+	for _, name := range []string{"device_id", "imei"} {
+		if value, ok := result.Fields[name]; ok {
+			var device models.Device
+			if err := database.DB.Where("topic = ?", fmt.Sprint(value)).First(&device).Error; err == nil {
+				return &device, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("device not found in payload")
+}
+
+// ingestDevicePayload 使用设备的消息类型配置解析上行负载，更新设备位置、状态并保存遥测数据
+func ingestDevicePayload(device *models.Device, source string, payload []byte) (models.ParseResult, error) {
+	config, err := deviceMessageConfig(device)
+	if err != nil {
+		return models.ParseResult{Success: false, Error: err.Error()}, err
+	}
+
+	return ingestPayloadWithConfig(device, config, payload, &models.Telemetry{Source: source})
+}
+
+// ingestPayloadWithConfig 使用指定配置解析负载并保存遥测数据，
+// telemetry 可预先填写来源、时间及接入元数据(RSSI/SNR/Metadata)
+func ingestPayloadWithConfig(device *models.Device, config *models.MessageTypeConfig, payload []byte, telemetry *models.Telemetry) (models.ParseResult, error) {
+	// 遥测记录解析所用的版本，旧配置先补充初始版本
+	if err := ensureConfigVersioned(config); err != nil {
+		return models.ParseResult{Success: false, Error: err.Error()}, err
+	}
+
+	rawData := encodePayloadForConfig(config, payload)
+	result, err := parseWithConfig(*config, rawData)
+	if err != nil || !result.Success {
+		if err == nil {
+			err = fmt.Errorf("%s", result.Error)
+		}
+		return result, err
+	}
+
+	telemetry.RawData = rawData
+	telemetry.ConfigID = config.ID
+	telemetry.ConfigVersion = config.Version
+	if err := storeDeviceTelemetry(device, telemetry, result.Fields); err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
+
+// applyTelemetryFields 从解析字段中提取位置、高度、速度和方向写入遥测记录，返回是否包含经纬度
+func applyTelemetryFields(telemetry *models.Telemetry, fields map[string]interface{}) bool {
+	latitude, hasLat := fieldFloat(fields, "latitude", "lat")
+	longitude, hasLng := fieldFloat(fields, "longitude", "lng", "lon")
+	if hasLat && hasLng {
+		telemetry.Latitude = latitude
+		telemetry.Longitude = longitude
+	}
+	telemetry.Altitude, _ = fieldFloat(fields, "altitude")
+	telemetry.Speed, _ = fieldFloat(fields, "speed")
+	telemetry.Course, _ = fieldFloat(fields, "course", "direction")
+	return hasLat && hasLng
+}
+
+// storeDeviceTelemetry 使用解析出的字段更新设备位置、状态并保存遥测数据
+func storeDeviceTelemetry(device *models.Device, telemetry *models.Telemetry, fields map[string]interface{}) error {
+	now := time.Now().Unix()
+	telemetry.DeviceID = device.ID
+	if telemetry.Timestamp == 0 {
+		telemetry.Timestamp = now
+	}
+
+	if applyTelemetryFields(telemetry, fields) {
+		device.Latitude = telemetry.Latitude
+		device.Longitude = telemetry.Longitude
+	}
+
+	device.Status = "online"
+	device.LastSeen = now
+	if err := database.DB.Save(device).Error; err != nil {
+		return fmt.Errorf("failed to update device: %v", err)
+	}
+
+	if err := recordTelemetry(telemetry, fields); err != nil {
+		return fmt.Errorf("failed to save telemetry: %v", err)
+	}
+
+	return nil
+}
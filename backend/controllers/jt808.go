@@ -0,0 +1,817 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+// JT/T 808 消息ID
+const (
+	jt808TerminalResponse = 0x0001 // 终端通用应答
+	jt808Heartbeat        = 0x0002 // 终端心跳
+	jt808Logout           = 0x0003 // 终端注销
+	jt808Register         = 0x0100 // 终端注册
+	jt808Auth             = 0x0102 // 终端鉴权
+	jt808Location         = 0x0200 // 位置信息汇报
+	jt808BatchLocation    = 0x0704 // 定位数据批量上传
+	jt808PlatformResponse = 0x8001 // 平台通用应答
+	jt808RegisterResponse = 0x8100 // 终端注册应答
+)
+
+// 平台通用应答结果
+const (
+	jt808ResultSuccess      = 0
+	jt808ResultFailure      = 1
+	jt808ResultMessageError = 2
+	jt808ResultUnsupported  = 3
+)
+
+// 终端注册应答结果
+const (
+	jt808RegisterSuccess            = 0
+	jt808RegisterVehicleRegistered  = 1 // 车辆已被注册
+	jt808RegisterNoVehicle          = 2 // 数据库中无该车辆
+	jt808RegisterTerminalRegistered = 3 // 终端已被注册
+	jt808RegisterNoTerminal         = 4 // 数据库中无该终端
+)
+
+// JT/T 808 帧标识及转义字节
+const (
+	jt808FlagByte   = 0x7e
+	jt808EscapeByte = 0x7d
+)
+
+// jt808MaxBuffer 未找到帧尾时允许缓存的最大字节数
+const jt808MaxBuffer = 64 * 1024
+
+// 分包重组限制，防止终端通过大量未收齐的分包耗尽内存
+const (
+	jt808MaxFragmentParts    = 256              // 单条消息的最大分包数
+	jt808MaxFragmentMessages = 8                // 同时重组的消息数
+	jt808MaxFragmentBytes    = 256 * 1024       // 单个会话缓存的分包总字节数
+	jt808FragmentTimeout     = 60 * time.Second // 未收齐的分包消息的最长保留时间
+)
+
+// JT808IdleTimeout 连接空闲超时，终端需在该时间内发送心跳或其他消息
+const JT808IdleTimeout = 5 * time.Minute
+
+// jt808Zone 位置信息中的时间为 GMT+8
+var jt808Zone = time.FixedZone("GMT+8", 8*3600)
+
+// JT808Header 消息头
+type JT808Header struct {
+	MsgID           uint16
+	BodyLength      int
+	Encryption      uint8 // 数据加密方式, 0 表示不加密
+	Subpackage      bool
+	Version         int   // 协议版本: 2013, 2019
+	ProtocolVersion uint8 // 2019版消息头中的协议版本号
+	PhoneBCD        []byte
+	Phone           string // 终端手机号(去除前导0)
+	Serial          uint16
+	PackageTotal    uint16
+	PackageIndex    uint16
+}
+
+// JT808Message 完整消息(已反转义并通过校验)
+type JT808Message struct {
+	Header JT808Header
+	Body   []byte
+}
+
+// JT808Location 位置基本信息及附加信息
+type JT808Location struct {
+	Alarm     uint32
+	Status    uint32
+	Latitude  float64
+	Longitude float64
+	Altitude  float64 // 米
+	Speed     float64 // km/h
+	Course    float64 // 度, 正北为0
+	Time      time.Time
+	Extras    map[string]interface{}
+}
+
+// Positioned 状态位1: 是否已定位
+func (l *JT808Location) Positioned() bool {
+	return l.Status&0x02 != 0
+}
+
+// Fields 返回位置信息字段
+func (l *JT808Location) Fields() map[string]interface{} {
+	fields := map[string]interface{}{
+		"alarm":      l.Alarm,
+		"status":     l.Status,
+		"acc":        l.Status&0x01 != 0,
+		"positioned": l.Positioned(),
+		"latitude":   l.Latitude,
+		"longitude":  l.Longitude,
+		"altitude":   l.Altitude,
+		"speed":      l.Speed,
+		"course":     l.Course,
+		"datetime":   l.Time.Format("2006-01-02 15:04:05"),
+	}
+	for k, v := range l.Extras {
+		fields[k] = v
+	}
+	return fields
+}
+
+// unescapeJT808 还原转义: 0x7d 0x02 -> 0x7e, 0x7d 0x01 -> 0x7d
+func unescapeJT808(data []byte) ([]byte, error) {
+	result := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		if data[i] != jt808EscapeByte {
+			result = append(result, data[i])
+			continue
+		}
+		if i+1 >= len(data) {
+			return nil, fmt.Errorf("truncated escape sequence")
+		}
+		switch data[i+1] {
+		case 0x01:
+			result = append(result, jt808EscapeByte)
+		case 0x02:
+			result = append(result, jt808FlagByte)
+		default:
+			return nil, fmt.Errorf("invalid escape sequence: 7d %02x", data[i+1])
+		}
+		i++
+	}
+	return result, nil
+}
+
+// escapeJT808 转义: 0x7e -> 0x7d 0x02, 0x7d -> 0x7d 0x01
+func escapeJT808(data []byte) []byte {
+	result := make([]byte, 0, len(data)+4)
+	for _, b := range data {
+		switch b {
+		case jt808FlagByte:
+			result = append(result, jt808EscapeByte, 0x02)
+		case jt808EscapeByte:
+			result = append(result, jt808EscapeByte, 0x01)
+		default:
+			result = append(result, b)
+		}
+	}
+	return result
+}
+
+// jt808BCC 异或校验
+func jt808BCC(data []byte) byte {
+	var bcc byte
+	for _, b := range data {
+		bcc ^= b
+	}
+	return bcc
+}
+
+// decodeBCD 将BCD码转换为数字字符串
+func decodeBCD(data []byte) string {
+	return hex.EncodeToString(data)
+}
+
+// decodeGBK 将GBK编码的字节转换为字符串，去除末尾的0字节
+func decodeGBK(data []byte) string {
+	data = bytes.TrimRight(data, "\x00")
+	decoded, err := simplifiedchinese.GBK.NewDecoder().Bytes(data)
+	if err != nil {
+		return strings.TrimSpace(string(data))
+	}
+	return strings.TrimSpace(string(decoded))
+}
+
+// decodeJT808Frame 解析一帧数据(不含首尾标识位): 反转义、校验BCC、解析消息头
+func decodeJT808Frame(frame []byte) (*JT808Message, error) {
+	data, err := unescapeJT808(frame)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 13 {
+		return nil, fmt.Errorf("frame too short: %d bytes", len(data))
+	}
+
+	content := data[:len(data)-1]
+	if bcc := jt808BCC(content); bcc != data[len(data)-1] {
+		return nil, fmt.Errorf("BCC mismatch: expected %02x, got %02x", data[len(data)-1], bcc)
+	}
+
+	header, headerLen, err := parseJT808Header(content)
+	if err != nil {
+		return nil, err
+	}
+	if len(content)-headerLen != header.BodyLength {
+		return nil, fmt.Errorf("body length mismatch: header says %d, got %d", header.BodyLength, len(content)-headerLen)
+	}
+
+	return &JT808Message{Header: header, Body: content[headerLen:]}, nil
+}
+
+// parseJT808Header 解析消息头，根据版本标识区分2013与2019版
+func parseJT808Header(data []byte) (JT808Header, int, error) {
+	var header JT808Header
+	if len(data) < 4 {
+		return header, 0, fmt.Errorf("header too short")
+	}
+
+	header.MsgID = binary.BigEndian.Uint16(data[0:2])
+	props := binary.BigEndian.Uint16(data[2:4])
+	header.BodyLength = int(props & 0x03ff)
+	header.Encryption = uint8((props >> 10) & 0x07)
+	header.Subpackage = props&0x2000 != 0
+
+	offset := 4
+	phoneLen := 6
+	header.Version = 2013
+	if props&0x4000 != 0 {
+		header.Version = 2019
+		phoneLen = 10
+		if len(data) < offset+1 {
+			return header, 0, fmt.Errorf("header too short")
+		}
+		header.ProtocolVersion = data[offset]
+		offset++
+	}
+
+	if len(data) < offset+phoneLen+2 {
+		return header, 0, fmt.Errorf("header too short")
+	}
+	header.PhoneBCD = data[offset : offset+phoneLen]
+	header.Phone = strings.TrimLeft(decodeBCD(header.PhoneBCD), "0")
+	offset += phoneLen
+
+	header.Serial = binary.BigEndian.Uint16(data[offset : offset+2])
+	offset += 2
+
+	if header.Subpackage {
+		if len(data) < offset+4 {
+			return header, 0, fmt.Errorf("header too short for subpackage")
+		}
+		header.PackageTotal = binary.BigEndian.Uint16(data[offset : offset+2])
+		header.PackageIndex = binary.BigEndian.Uint16(data[offset+2 : offset+4])
+		offset += 4
+	}
+
+	return header, offset, nil
+}
+
+// encodeJT808Frame 组装下行消息帧: 消息头 + 消息体 + BCC，转义后加首尾标识位
+func encodeJT808Frame(msgID uint16, request JT808Header, serial uint16, body []byte) []byte {
+	var buf bytes.Buffer
+
+	props := uint16(len(body)) & 0x03ff
+	if request.Version == 2019 {
+		props |= 0x4000
+	}
+	binary.Write(&buf, binary.BigEndian, msgID)
+	binary.Write(&buf, binary.BigEndian, props)
+
+	if request.Version == 2019 {
+		buf.WriteByte(request.ProtocolVersion)
+	}
+	// 应答沿用终端上报的手机号BCD码
+	buf.Write(request.PhoneBCD)
+	binary.Write(&buf, binary.BigEndian, serial)
+	buf.Write(body)
+
+	content := buf.Bytes()
+	frame := make([]byte, 0, len(content)+8)
+	frame = append(frame, jt808FlagByte)
+	frame = append(frame, escapeJT808(append(content, jt808BCC(content)))...)
+	frame = append(frame, jt808FlagByte)
+	return frame
+}
+
+// decodeJT808Location 解析位置基本信息(28字节)及附加信息项
+func decodeJT808Location(body []byte) (*JT808Location, error) {
+	if len(body) < 28 {
+		return nil, fmt.Errorf("location body too short: %d bytes", len(body))
+	}
+
+	loc := &JT808Location{
+		Alarm:    binary.BigEndian.Uint32(body[0:4]),
+		Status:   binary.BigEndian.Uint32(body[4:8]),
+		Altitude: float64(binary.BigEndian.Uint16(body[16:18])),
+		Speed:    float64(binary.BigEndian.Uint16(body[18:20])) / 10.0,
+		Course:   float64(binary.BigEndian.Uint16(body[20:22])),
+		Extras:   make(map[string]interface{}),
+	}
+
+	// 纬度、经度: 以度为单位乘以10^6，方向由状态位2、3表示
+	loc.Latitude = float64(binary.BigEndian.Uint32(body[8:12])) / 1000000.0
+	loc.Longitude = float64(binary.BigEndian.Uint32(body[12:16])) / 1000000.0
+	if loc.Status&0x04 != 0 {
+		loc.Latitude = -loc.Latitude
+	}
+	if loc.Status&0x08 != 0 {
+		loc.Longitude = -loc.Longitude
+	}
+
+	// 时间: BCD[6] YYMMDDhhmmss
+	t, err := time.ParseInLocation("060102150405", decodeBCD(body[22:28]), jt808Zone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid location time: %s", decodeBCD(body[22:28]))
+	}
+	loc.Time = t
+
+	// 附加信息项: ID(1) + 长度(1) + 内容
+	extra := body[28:]
+	for len(extra) > 0 {
+		if len(extra) < 2 {
+			return nil, fmt.Errorf("truncated additional info item")
+		}
+		id, size := extra[0], int(extra[1])
+		if len(extra) < 2+size {
+			return nil, fmt.Errorf("additional info item 0x%02x truncated", id)
+		}
+		decodeJT808Extra(id, extra[2:2+size], loc.Extras)
+		extra = extra[2+size:]
+	}
+
+	return loc, nil
+}
+
+// decodeJT808Extra 解析常用附加信息项，未识别的项以十六进制保存
+func decodeJT808Extra(id byte, value []byte, extras map[string]interface{}) {
+	switch {
+	case id == 0x01 && len(value) == 4: // 里程, 1/10km
+		extras["mileage"] = float64(binary.BigEndian.Uint32(value)) / 10.0
+	case id == 0x02 && len(value) == 2: // 油量, 1/10L
+		extras["fuel"] = float64(binary.BigEndian.Uint16(value)) / 10.0
+	case id == 0x03 && len(value) == 2: // 行驶记录功能获取的速度, 1/10km/h
+		extras["recorder_speed"] = float64(binary.BigEndian.Uint16(value)) / 10.0
+	case id == 0x04 && len(value) == 2: // 需要人工确认报警事件的ID
+		extras["alarm_event_id"] = binary.BigEndian.Uint16(value)
+	case id == 0x25 && len(value) == 4: // 扩展车辆信号状态位
+		extras["vehicle_signal"] = binary.BigEndian.Uint32(value)
+	case id == 0x2A && len(value) == 2: // IO状态位
+		extras["io_status"] = binary.BigEndian.Uint16(value)
+	case id == 0x2B && len(value) == 4: // 模拟量: bit0-15 AD0, bit16-31 AD1
+		analog := binary.BigEndian.Uint32(value)
+		extras["analog_ad0"] = uint16(analog & 0xffff)
+		extras["analog_ad1"] = uint16(analog >> 16)
+	case id == 0x30 && len(value) == 1: // 无线通信网络信号强度
+		extras["signal_strength"] = value[0]
+	case id == 0x31 && len(value) == 1: // GNSS定位卫星数
+		extras["satellites"] = value[0]
+	default:
+		extras[fmt.Sprintf("extra_%02x", id)] = hex.EncodeToString(value)
+	}
+}
+
+// JT808Session 单个终端TCP连接的会话状态
+type JT808Session struct {
+	conn          net.Conn
+	buffer        []byte
+	serial        uint16
+	authenticated bool
+	phone         string // 鉴权通过的终端手机号
+	deviceID      uint
+	fragments     map[uint16]*jt808Fragments
+	fragmentBytes int
+}
+
+// jt808Fragments 正在重组的分包消息
+type jt808Fragments struct {
+	total   uint16
+	parts   map[uint16][]byte
+	updated time.Time
+}
+
+// NewJT808Session 创建会话
+func NewJT808Session(conn net.Conn) *JT808Session {
+	return &JT808Session{
+		conn:      conn,
+		fragments: make(map[uint16]*jt808Fragments),
+	}
+}
+
+// HandleData 处理收到的TCP数据，按0x7e拆分出完整帧后逐帧处理
+func (s *JT808Session) HandleData(data []byte) {
+	s.buffer = append(s.buffer, data...)
+
+	for {
+		start := bytes.IndexByte(s.buffer, jt808FlagByte)
+		if start == -1 {
+			s.buffer = s.buffer[:0]
+			return
+		}
+		end := bytes.IndexByte(s.buffer[start+1:], jt808FlagByte)
+		if end == -1 {
+			s.buffer = s.buffer[start:]
+			if len(s.buffer) > jt808MaxBuffer {
+				fmt.Printf("JT808 frame exceeds %d bytes, dropping buffer\n", jt808MaxBuffer)
+				s.buffer = s.buffer[:0]
+			}
+			return
+		}
+		end += start + 1
+
+		frame := s.buffer[start+1 : end]
+		if len(frame) == 0 {
+			// 连续的两个标识位，后一个作为下一帧的帧头
+			s.buffer = s.buffer[end:]
+			continue
+		}
+
+		msg, err := decodeJT808Frame(frame)
+		if err != nil {
+			fmt.Printf("Error decoding JT808 frame: %v\n", err)
+		} else {
+			s.handleMessage(msg)
+		}
+		s.buffer = s.buffer[end+1:]
+	}
+}
+
+// handleMessage 按消息ID分发处理
+func (s *JT808Session) handleMessage(msg *JT808Message) {
+	header := msg.Header
+
+	if header.Encryption != 0 {
+		s.respond(header, jt808ResultUnsupported)
+		return
+	}
+
+	// 鉴权前只处理注册和鉴权消息，鉴权后只接受本终端手机号的消息
+	switch header.MsgID {
+	case jt808Register, jt808Auth:
+	default:
+		if !s.authenticated {
+			if header.MsgID != jt808TerminalResponse {
+				fmt.Printf("JT808 terminal %s sent 0x%04x before authentication\n", header.Phone, header.MsgID)
+				s.respond(header, jt808ResultFailure)
+			}
+			return
+		}
+		if header.Phone != s.phone {
+			fmt.Printf("JT808 session authenticated as %s received 0x%04x for %s\n", s.phone, header.MsgID, header.Phone)
+			s.respond(header, jt808ResultFailure)
+			return
+		}
+	}
+
+	// 分包消息: 缓存各包，全部收到后合并处理
+	if header.Subpackage {
+		body, complete := s.collectFragment(header, msg.Body)
+		if !complete {
+			s.respond(header, jt808ResultSuccess)
+			return
+		}
+		header.Subpackage = false
+		msg = &JT808Message{Header: header, Body: body}
+	}
+
+	switch header.MsgID {
+	case jt808TerminalResponse:
+		return
+	case jt808Register:
+		s.handleRegister(msg)
+	case jt808Auth:
+		s.handleAuth(msg)
+	case jt808Heartbeat:
+		s.touchDevice("online")
+		s.respond(header, jt808ResultSuccess)
+	case jt808Logout:
+		// 注销后清除鉴权码，终端可以重新注册
+		database.DB.Model(&models.JT808Terminal{}).Where("phone = ?", s.phone).Update("auth_code", "")
+		s.touchDevice("offline")
+		s.authenticated = false
+		s.phone = ""
+		s.respond(header, jt808ResultSuccess)
+	case jt808Location:
+		s.respond(header, s.handleLocation(msg.Body))
+	case jt808BatchLocation:
+		s.respond(header, s.handleBatchLocation(msg.Body))
+	default:
+		s.respond(header, jt808ResultUnsupported)
+	}
+}
+
+// collectFragment 缓存分包，返回合并后的消息体及是否已收齐
+func (s *JT808Session) collectFragment(header JT808Header, body []byte) ([]byte, bool) {
+	if header.PackageTotal == 0 || header.PackageIndex == 0 || header.PackageIndex > header.PackageTotal {
+		return nil, false
+	}
+	if header.PackageTotal > jt808MaxFragmentParts {
+		fmt.Printf("JT808 terminal %s sent 0x%04x in %d packages, dropping\n", header.Phone, header.MsgID, header.PackageTotal)
+		return nil, false
+	}
+
+	now := time.Now()
+	s.expireFragments(now)
+
+	pending := s.fragments[header.MsgID]
+	if pending != nil && pending.total != header.PackageTotal {
+		s.dropFragments(header.MsgID)
+		pending = nil
+	}
+	if pending == nil {
+		if len(s.fragments) >= jt808MaxFragmentMessages {
+			fmt.Printf("JT808 terminal %s has too many partial messages, dropping 0x%04x\n", header.Phone, header.MsgID)
+			return nil, false
+		}
+		pending = &jt808Fragments{total: header.PackageTotal, parts: make(map[uint16][]byte)}
+		s.fragments[header.MsgID] = pending
+	}
+
+	s.fragmentBytes -= len(pending.parts[header.PackageIndex])
+	if s.fragmentBytes+len(body) > jt808MaxFragmentBytes {
+		fmt.Printf("JT808 terminal %s exceeded %d buffered package bytes, dropping 0x%04x\n", header.Phone, jt808MaxFragmentBytes, header.MsgID)
+		delete(pending.parts, header.PackageIndex)
+		s.dropFragments(header.MsgID)
+		return nil, false
+	}
+	pending.parts[header.PackageIndex] = append([]byte(nil), body...)
+	pending.updated = now
+	s.fragmentBytes += len(body)
+	if len(pending.parts) < int(pending.total) {
+		return nil, false
+	}
+
+	var merged []byte
+	for i := 1; i <= int(pending.total); i++ {
+		merged = append(merged, pending.parts[uint16(i)]...)
+	}
+	s.dropFragments(header.MsgID)
+	return merged, true
+}
+
+// expireFragments 丢弃长时间未收齐的分包消息
+func (s *JT808Session) expireFragments(now time.Time) {
+	for msgID, pending := range s.fragments {
+		if now.Sub(pending.updated) > jt808FragmentTimeout {
+			s.dropFragments(msgID)
+		}
+	}
+}
+
+// dropFragments 丢弃一条消息已缓存的分包
+func (s *JT808Session) dropFragments(msgID uint16) {
+	if pending, ok := s.fragments[msgID]; ok {
+		for _, part := range pending.parts {
+			s.fragmentBytes -= len(part)
+		}
+		delete(s.fragments, msgID)
+	}
+}
+
+// handleRegister 终端注册，分配鉴权码并关联设备
+func (s *JT808Session) handleRegister(msg *JT808Message) {
+	header := msg.Header
+	body := msg.Body
+
+	// 2013: 制造商ID 5, 终端型号 20, 终端ID 7; 2019: 11, 30, 30
+	manufacturerLen, modelLen, terminalIDLen := 5, 20, 7
+	if header.Version == 2019 {
+		manufacturerLen, modelLen, terminalIDLen = 11, 30, 30
+	}
+	fixedLen := 4 + manufacturerLen + modelLen + terminalIDLen + 1
+	if len(body) < fixedLen {
+		s.sendRegisterResponse(header, jt808RegisterNoTerminal, "")
+		return
+	}
+
+	// 已注册的终端须先注销才能重新注册，否则知道手机号即可取得鉴权码
+	terminal := models.JT808Terminal{}
+	database.DB.Where("phone = ?", header.Phone).First(&terminal)
+	if terminal.AuthCode != "" {
+		fmt.Printf("JT808 terminal %s is already registered\n", header.Phone)
+		s.sendRegisterResponse(header, jt808RegisterTerminalRegistered, "")
+		return
+	}
+
+	offset := 4
+	terminal.Phone = header.Phone
+	terminal.Version = header.Version
+	terminal.ProvinceID = binary.BigEndian.Uint16(body[0:2])
+	terminal.CityID = binary.BigEndian.Uint16(body[2:4])
+	terminal.Manufacturer = decodeGBK(body[offset : offset+manufacturerLen])
+	offset += manufacturerLen
+	terminal.TerminalType = decodeGBK(body[offset : offset+modelLen])
+	offset += modelLen
+	terminal.TerminalID = decodeGBK(body[offset : offset+terminalIDLen])
+	offset += terminalIDLen
+	terminal.PlateColor = body[offset]
+	terminal.Plate = decodeGBK(body[offset+1:])
+
+	if terminal.Plate != "" {
+		var count int64
+		database.DB.Model(&models.JT808Terminal{}).
+			Where("plate = ? AND phone <> ? AND auth_code <> ''", terminal.Plate, header.Phone).Count(&count)
+		if count > 0 {
+			fmt.Printf("JT808 vehicle %s is already registered by another terminal\n", terminal.Plate)
+			s.sendRegisterResponse(header, jt808RegisterVehicleRegistered, "")
+			return
+		}
+	}
+
+	// 查找或创建设备，设备以 jt808/<手机号> 作为 topic
+	topic := "jt808/" + header.Phone
+	var device models.Device
+	if err := database.DB.Where("topic = ?", topic).First(&device).Error; err != nil {
+		name := terminal.Plate
+		if name == "" {
+			name = topic
+		}
+		device = models.Device{
+			Name:     name,
+			Topic:    topic,
+			UserID:   1, // 默认用户ID
+			Status:   "offline",
+			LastSeen: time.Now().Unix(),
+		}
+		if err := database.DB.Create(&device).Error; err != nil {
+			fmt.Printf("Failed to create device for JT808 terminal %s: %v\n", header.Phone, err)
+			s.sendRegisterResponse(header, jt808RegisterNoVehicle, "")
+			return
+		}
+	}
+	terminal.DeviceID = device.ID
+
+	terminal.AuthCode = newJT808AuthCode()
+
+	if err := database.DB.Save(&terminal).Error; err != nil {
+		fmt.Printf("Failed to save JT808 terminal %s: %v\n", header.Phone, err)
+		s.sendRegisterResponse(header, jt808RegisterNoTerminal, "")
+		return
+	}
+
+	fmt.Printf("JT808 terminal %s registered (plate: %s, device ID: %d)\n", header.Phone, terminal.Plate, device.ID)
+	s.sendRegisterResponse(header, jt808RegisterSuccess, terminal.AuthCode)
+}
+
+// handleAuth 终端鉴权
+func (s *JT808Session) handleAuth(msg *JT808Message) {
+	header := msg.Header
+	body := msg.Body
+
+	var authCode, imei, firmware string
+	if header.Version == 2019 {
+		// 鉴权码长度(1) + 鉴权码 + IMEI(15) + 软件版本号(20)
+		if len(body) < 1 || len(body) < 1+int(body[0]) {
+			s.respond(header, jt808ResultMessageError)
+			return
+		}
+		codeLen := int(body[0])
+		authCode = string(body[1 : 1+codeLen])
+		rest := body[1+codeLen:]
+		if len(rest) >= 15 {
+			imei = decodeGBK(rest[:15])
+			firmware = decodeGBK(rest[15:])
+		}
+	} else {
+		authCode = decodeGBK(body)
+	}
+
+	var terminal models.JT808Terminal
+	if err := database.DB.Where("phone = ?", header.Phone).First(&terminal).Error; err != nil || terminal.AuthCode != authCode {
+		fmt.Printf("JT808 terminal %s authentication failed\n", header.Phone)
+		s.respond(header, jt808ResultFailure)
+		return
+	}
+
+	terminal.LastAuthAt = time.Now().Unix()
+	if imei != "" {
+		terminal.IMEI = imei
+	}
+	if firmware != "" {
+		terminal.Firmware = firmware
+	}
+	database.DB.Save(&terminal)
+
+	s.authenticated = true
+	s.phone = header.Phone
+	s.deviceID = terminal.DeviceID
+	s.touchDevice("online")
+
+	fmt.Printf("JT808 terminal %s authenticated\n", header.Phone)
+	s.respond(header, jt808ResultSuccess)
+}
+
+// handleLocation 处理单条位置信息汇报
+func (s *JT808Session) handleLocation(body []byte) uint8 {
+	loc, err := decodeJT808Location(body)
+	if err != nil {
+		fmt.Printf("Error decoding JT808 location: %v\n", err)
+		return jt808ResultMessageError
+	}
+
+	if err := s.saveLocation(loc, body); err != nil {
+		fmt.Printf("Error saving JT808 location: %v\n", err)
+		return jt808ResultFailure
+	}
+	return jt808ResultSuccess
+}
+
+// handleBatchLocation 处理定位数据批量上传: 数据项个数(2) + 类型(1) + [长度(2) + 位置信息]...
+func (s *JT808Session) handleBatchLocation(body []byte) uint8 {
+	if len(body) < 3 {
+		return jt808ResultMessageError
+	}
+
+	count := int(binary.BigEndian.Uint16(body[0:2]))
+	items := body[3:]
+	for i := 0; i < count; i++ {
+		if len(items) < 2 {
+			return jt808ResultMessageError
+		}
+		size := int(binary.BigEndian.Uint16(items[0:2]))
+		if len(items) < 2+size {
+			return jt808ResultMessageError
+		}
+		if result := s.handleLocation(items[2 : 2+size]); result != jt808ResultSuccess {
+			return result
+		}
+		items = items[2+size:]
+	}
+
+	return jt808ResultSuccess
+}
+
+// saveLocation 更新设备位置并保存遥测数据
+func (s *JT808Session) saveLocation(loc *JT808Location, raw []byte) error {
+	var device models.Device
+	if err := database.DB.First(&device, s.deviceID).Error; err != nil {
+		return fmt.Errorf("device %d not found", s.deviceID)
+	}
+
+	timestamp := loc.Time.Unix()
+	if loc.Positioned() {
+		device.Latitude = loc.Latitude
+		device.Longitude = loc.Longitude
+	}
+	device.Status = "online"
+	device.LastSeen = time.Now().Unix()
+	if err := database.DB.Save(&device).Error; err != nil {
+		return err
+	}
+
+	telemetry := models.Telemetry{
+		DeviceID:  device.ID,
+		Source:    "jt808",
+		Timestamp: timestamp,
+		Latitude:  loc.Latitude,
+		Longitude: loc.Longitude,
+		Altitude:  loc.Altitude,
+		Speed:     loc.Speed,
+		Course:    loc.Course,
+		RawData:   hex.EncodeToString(raw),
+	}
+	return recordTelemetry(&telemetry, loc.Fields())
+}
+
+// touchDevice 更新设备状态及最后在线时间
+func (s *JT808Session) touchDevice(status string) {
+	database.DB.Model(&models.Device{}).
+		Where("id = ?", s.deviceID).
+		Updates(map[string]interface{}{"status": status, "last_seen": time.Now().Unix()})
+}
+
+// respond 发送平台通用应答: 应答流水号(2) + 应答ID(2) + 结果(1)
+func (s *JT808Session) respond(request JT808Header, result uint8) {
+	body := make([]byte, 5)
+	binary.BigEndian.PutUint16(body[0:2], request.Serial)
+	binary.BigEndian.PutUint16(body[2:4], request.MsgID)
+	body[4] = result
+	s.send(jt808PlatformResponse, request, body)
+}
+
+// sendRegisterResponse 发送终端注册应答: 应答流水号(2) + 结果(1) + 鉴权码，结果为终端注册应答结果
+func (s *JT808Session) sendRegisterResponse(request JT808Header, result uint8, authCode string) {
+	body := make([]byte, 3, 3+len(authCode))
+	binary.BigEndian.PutUint16(body[0:2], request.Serial)
+	body[2] = result
+	if result == jt808RegisterSuccess {
+		body = append(body, authCode...)
+	}
+	s.send(jt808RegisterResponse, request, body)
+}
+
+// send 发送下行消息，平台流水号自增
+func (s *JT808Session) send(msgID uint16, request JT808Header, body []byte) {
+	frame := encodeJT808Frame(msgID, request, s.serial, body)
+	s.serial++
+	if _, err := s.conn.Write(frame); err != nil {
+		fmt.Printf("Error writing JT808 response: %v\n", err)
+	}
+}
+
+// newJT808AuthCode 生成随机鉴权码
+func newJT808AuthCode() string {
+	code := make([]byte, 8)
+	if _, err := rand.Read(code); err != nil {
+		return fmt.Sprintf("%016x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(code)
+}
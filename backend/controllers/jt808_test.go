@@ -0,0 +1,375 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+// buildJT808Frame 按2013版消息头组装终端上行帧
+func buildJT808Frame(msgID uint16, phone string, serial uint16, body []byte) []byte {
+	phoneBCD, _ := hex.DecodeString(phone)
+	request := JT808Header{Version: 2013, PhoneBCD: phoneBCD}
+	return encodeJT808Frame(msgID, request, serial, body)
+}
+
+// buildJT808Location 组装位置基本信息及附加信息
+func buildJT808Location() []byte {
+	body := make([]byte, 28)
+	binary.BigEndian.PutUint32(body[0:4], 0x00000001)             // 紧急报警
+	binary.BigEndian.PutUint32(body[4:8], 0x02|0x04)              // 已定位, 南纬
+	binary.BigEndian.PutUint32(body[8:12], 31123456)              // 纬度
+	binary.BigEndian.PutUint32(body[12:16], 121654321)            // 经度
+	binary.BigEndian.PutUint16(body[16:18], 15)                   // 高程
+	binary.BigEndian.PutUint16(body[18:20], 605)                  // 速度 60.5km/h
+	binary.BigEndian.PutUint16(body[20:22], 90)                   // 方向
+	copy(body[22:28], []byte{0x24, 0x01, 0x05, 0x08, 0x30, 0x00}) // 2024-01-05 08:30:00
+
+	// 附加信息: 里程 1234.5km, 信号强度 25, 卫星数 12, 未知项 0xE1
+	body = append(body, 0x01, 0x04, 0x00, 0x00, 0x30, 0x39)
+	body = append(body, 0x30, 0x01, 25)
+	body = append(body, 0x31, 0x01, 12)
+	body = append(body, 0xE1, 0x02, 0x7e, 0x7d)
+	return body
+}
+
+// buildJT808Subpackage 组装2013版分包帧
+func buildJT808Subpackage(msgID uint16, phone string, serial, total, index uint16, body []byte) []byte {
+	phoneBCD, _ := hex.DecodeString(phone)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, msgID)
+	binary.Write(&buf, binary.BigEndian, uint16(len(body))|0x2000)
+	buf.Write(phoneBCD)
+	binary.Write(&buf, binary.BigEndian, serial)
+	binary.Write(&buf, binary.BigEndian, total)
+	binary.Write(&buf, binary.BigEndian, index)
+	buf.Write(body)
+	content := buf.Bytes()
+	frame := []byte{jt808FlagByte}
+	frame = append(frame, escapeJT808(append(content, jt808BCC(content)))...)
+	return append(frame, jt808FlagByte)
+}
+
+func TestJT808Escape(t *testing.T) {
+	raw := []byte{0x30, 0x7e, 0x08, 0x7d, 0x55}
+	escaped := escapeJT808(raw)
+
+	expected := []byte{0x30, 0x7d, 0x02, 0x08, 0x7d, 0x01, 0x55}
+	if !bytes.Equal(escaped, expected) {
+		t.Fatalf("Expected %x, got %x", expected, escaped)
+	}
+
+	unescaped, err := unescapeJT808(escaped)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.Equal(unescaped, raw) {
+		t.Errorf("Expected %x, got %x", raw, unescaped)
+	}
+
+	if _, err := unescapeJT808([]byte{0x7d, 0x03}); err == nil {
+		t.Error("Expected error for invalid escape sequence, but got none")
+	}
+}
+
+func TestDecodeJT808Frame(t *testing.T) {
+	body := buildJT808Location()
+	frame := buildJT808Frame(jt808Location, "013912345678", 0x007e, body)
+
+	msg, err := decodeJT808Frame(frame[1 : len(frame)-1])
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if msg.Header.MsgID != jt808Location {
+		t.Errorf("Expected msg ID 0x0200, got 0x%04x", msg.Header.MsgID)
+	}
+	if msg.Header.Phone != "13912345678" {
+		t.Errorf("Expected phone '13912345678', got '%s'", msg.Header.Phone)
+	}
+	if msg.Header.Serial != 0x007e {
+		t.Errorf("Expected serial 0x007e, got 0x%04x", msg.Header.Serial)
+	}
+	if !bytes.Equal(msg.Body, body) {
+		t.Errorf("Body mismatch: %x", msg.Body)
+	}
+
+	// 篡改校验码
+	tampered := append([]byte(nil), frame...)
+	tampered[len(tampered)-2] ^= 0xff
+	if _, err := decodeJT808Frame(tampered[1 : len(tampered)-1]); err == nil {
+		t.Error("Expected BCC error, but got none")
+	}
+}
+
+func TestParseJT808Header2019(t *testing.T) {
+	header := []byte{
+		0x01, 0x02, // 消息ID
+		0x40, 0x05, // 版本标识 + 消息体长度5
+		0x01,                                                       // 协议版本号
+		0x00, 0x00, 0x00, 0x00, 0x01, 0x39, 0x12, 0x34, 0x56, 0x78, // 手机号 BCD[10]
+		0x00, 0x09, // 流水号
+	}
+
+	parsed, headerLen, err := parseJT808Header(header)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if parsed.Version != 2019 || parsed.ProtocolVersion != 1 {
+		t.Errorf("Expected version 2019/1, got %d/%d", parsed.Version, parsed.ProtocolVersion)
+	}
+	if parsed.Phone != "13912345678" {
+		t.Errorf("Expected phone '13912345678', got '%s'", parsed.Phone)
+	}
+	if parsed.BodyLength != 5 || parsed.Serial != 9 || headerLen != 17 {
+		t.Errorf("Unexpected header values: body=%d serial=%d len=%d", parsed.BodyLength, parsed.Serial, headerLen)
+	}
+}
+
+func TestDecodeJT808Location(t *testing.T) {
+	loc, err := decodeJT808Location(buildJT808Location())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !loc.Positioned() {
+		t.Error("Expected positioned status")
+	}
+	if math.Abs(loc.Latitude+31.123456) > 1e-9 {
+		t.Errorf("Expected latitude=-31.123456, got %f", loc.Latitude)
+	}
+	if math.Abs(loc.Longitude-121.654321) > 1e-9 {
+		t.Errorf("Expected longitude=121.654321, got %f", loc.Longitude)
+	}
+	if loc.Speed != 60.5 || loc.Course != 90 || loc.Altitude != 15 {
+		t.Errorf("Unexpected speed/course/altitude: %f/%f/%f", loc.Speed, loc.Course, loc.Altitude)
+	}
+	if got := loc.Time.UTC().Format(time.RFC3339); got != "2024-01-05T00:30:00Z" {
+		t.Errorf("Expected time 2024-01-05T00:30:00Z, got %s", got)
+	}
+	if loc.Extras["mileage"] != 1234.5 {
+		t.Errorf("Expected mileage=1234.5, got %v", loc.Extras["mileage"])
+	}
+	if loc.Extras["signal_strength"] != uint8(25) || loc.Extras["satellites"] != uint8(12) {
+		t.Errorf("Unexpected signal/satellites: %v/%v", loc.Extras["signal_strength"], loc.Extras["satellites"])
+	}
+	if loc.Extras["extra_e1"] != "7e7d" {
+		t.Errorf("Expected extra_e1='7e7d', got %v", loc.Extras["extra_e1"])
+	}
+
+	if _, err := decodeJT808Location(append(buildJT808Location(), 0x01, 0x04, 0x00)); err == nil {
+		t.Error("Expected error for truncated additional info, but got none")
+	}
+}
+
+func TestJT808SessionRequiresAuthentication(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	session := NewJT808Session(server)
+	frame := buildJT808Frame(jt808Location, "013912345678", 42, buildJT808Location())
+
+	// 帧被拆分为两次读取，前面带有噪声字节
+	go func() {
+		session.HandleData(append([]byte{0x00, 0x11}, frame[:10]...))
+		session.HandleData(frame[10:])
+	}()
+
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	response := make([]byte, 64)
+	n, err := client.Read(response)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+
+	msg, err := decodeJT808Frame(response[1 : n-1])
+	if err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if msg.Header.MsgID != jt808PlatformResponse {
+		t.Fatalf("Expected 0x8001 response, got 0x%04x", msg.Header.MsgID)
+	}
+	if serial := binary.BigEndian.Uint16(msg.Body[0:2]); serial != 42 {
+		t.Errorf("Expected reply serial 42, got %d", serial)
+	}
+	if replyID := binary.BigEndian.Uint16(msg.Body[2:4]); replyID != jt808Location {
+		t.Errorf("Expected reply ID 0x0200, got 0x%04x", replyID)
+	}
+	if msg.Body[4] != jt808ResultFailure {
+		t.Errorf("Expected failure result for unauthenticated terminal, got %d", msg.Body[4])
+	}
+}
+
+// jt808Exchange 发送一帧并读取平台应答，等待会话处理完毕后返回
+func jt808Exchange(t *testing.T, session *JT808Session, client net.Conn, frame []byte) *JT808Message {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		session.HandleData(frame)
+		close(done)
+	}()
+	defer func() { <-done }()
+
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	response := make([]byte, 256)
+	n, err := client.Read(response)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	msg, err := decodeJT808Frame(response[1 : n-1])
+	if err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	return msg
+}
+
+func TestJT808RegisterOnce(t *testing.T) {
+	useTestDatabase(t)
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	session := NewJT808Session(server)
+
+	// 省域ID(2) + 市县域ID(2) + 制造商ID(5) + 终端型号(20) + 终端ID(7) + 车牌颜色(1) + 车牌
+	register := make([]byte, 4+5+20+7+1)
+	copy(register[4:], "MAKER")
+	register = append(register, "A12345"...)
+
+	msg := jt808Exchange(t, session, client, buildJT808Frame(jt808Register, "013912345678", 1, register))
+	if msg.Header.MsgID != jt808RegisterResponse || msg.Body[2] != jt808RegisterSuccess || len(msg.Body) <= 3 {
+		t.Fatalf("Expected successful registration, got %x", msg.Body)
+	}
+	authCode := string(msg.Body[3:])
+
+	// 重复注册不能取得鉴权码
+	msg = jt808Exchange(t, session, client, buildJT808Frame(jt808Register, "013912345678", 2, register))
+	if msg.Body[2] != jt808RegisterTerminalRegistered || len(msg.Body) != 3 {
+		t.Fatalf("Expected terminal registered result, got %x", msg.Body)
+	}
+	// 同一车辆不能被其他终端注册
+	msg = jt808Exchange(t, session, client, buildJT808Frame(jt808Register, "013900000000", 3, register))
+	if msg.Body[2] != jt808RegisterVehicleRegistered {
+		t.Fatalf("Expected vehicle registered result, got %x", msg.Body)
+	}
+
+	// 鉴权并注销后可以重新注册，鉴权码更新
+	if msg := jt808Exchange(t, session, client, buildJT808Frame(jt808Auth, "013912345678", 4, []byte(authCode))); len(msg.Body) < 5 || msg.Body[4] != jt808ResultSuccess {
+		t.Fatalf("Expected authentication to succeed, got %04x %x", msg.Header.MsgID, msg.Body)
+	}
+	if msg := jt808Exchange(t, session, client, buildJT808Frame(jt808Logout, "013912345678", 5, nil)); msg.Body[4] != jt808ResultSuccess {
+		t.Fatalf("Expected logout to succeed, got %x", msg.Body)
+	}
+	msg = jt808Exchange(t, session, client, buildJT808Frame(jt808Register, "013912345678", 6, register))
+	if msg.Body[2] != jt808RegisterSuccess || string(msg.Body[3:]) == authCode {
+		t.Errorf("Expected a new auth code after logout, got %x", msg.Body)
+	}
+}
+
+func TestJT808SessionPhoneBinding(t *testing.T) {
+	useTestDatabase(t)
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	session := NewJT808Session(server)
+
+	attacker := models.Device{Name: "attacker", Topic: "jt808/13900000001", UserID: 1}
+	victim := models.Device{Name: "victim", Topic: "jt808/13900000002", UserID: 1}
+	database.DB.Create(&attacker)
+	database.DB.Create(&victim)
+	database.DB.Create(&models.JT808Terminal{Phone: "13900000001", DeviceID: attacker.ID, AuthCode: "attacker"})
+	database.DB.Create(&models.JT808Terminal{Phone: "13900000002", DeviceID: victim.ID, AuthCode: "victim"})
+
+	if msg := jt808Exchange(t, session, client, buildJT808Frame(jt808Auth, "013900000001", 1, []byte("attacker"))); msg.Body[4] != jt808ResultSuccess {
+		t.Fatalf("Expected authentication to succeed, got %x", msg.Body)
+	}
+
+	// 以其他终端的手机号发送注销和位置信息均被拒绝
+	if msg := jt808Exchange(t, session, client, buildJT808Frame(jt808Logout, "013900000002", 2, nil)); msg.Body[4] != jt808ResultFailure {
+		t.Errorf("Expected logout for another phone to fail, got %x", msg.Body)
+	}
+	if msg := jt808Exchange(t, session, client, buildJT808Frame(jt808Location, "013900000002", 3, buildJT808Location())); msg.Body[4] != jt808ResultFailure {
+		t.Errorf("Expected location for another phone to fail, got %x", msg.Body)
+	}
+	var terminal models.JT808Terminal
+	database.DB.Where("phone = ?", "13900000002").First(&terminal)
+	if terminal.AuthCode != "victim" {
+		t.Errorf("Expected victim auth code to be kept, got %q", terminal.AuthCode)
+	}
+	var count int64
+	database.DB.Model(&models.Telemetry{}).Count(&count)
+	if count != 0 {
+		t.Errorf("Expected no telemetry, got %d", count)
+	}
+
+	// 注销只清除本终端的鉴权码
+	if msg := jt808Exchange(t, session, client, buildJT808Frame(jt808Logout, "013900000001", 4, nil)); msg.Body[4] != jt808ResultSuccess {
+		t.Fatalf("Expected logout to succeed, got %x", msg.Body)
+	}
+	var own models.JT808Terminal
+	database.DB.Where("phone = ?", "13900000001").First(&own)
+	if own.AuthCode != "" || session.authenticated {
+		t.Errorf("Expected own auth code to be cleared, got %q", own.AuthCode)
+	}
+}
+
+func TestJT808FragmentLimits(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	session := NewJT808Session(server)
+
+	// 鉴权前的分包不缓存
+	if msg := jt808Exchange(t, session, client, buildJT808Subpackage(jt808Location, "013912345678", 1, 2, 1, []byte{1, 2, 3})); msg.Body[4] != jt808ResultFailure {
+		t.Errorf("Expected failure before authentication, got %x", msg.Body)
+	}
+	if len(session.fragments) != 0 {
+		t.Fatalf("Expected no buffered packages before authentication, got %d", len(session.fragments))
+	}
+
+	session.authenticated = true
+	session.phone = "13912345678"
+	chunk := make([]byte, 1000)
+
+	// 同时重组的消息数受限
+	for i := 0; i < jt808MaxFragmentMessages+2; i++ {
+		jt808Exchange(t, session, client, buildJT808Subpackage(uint16(0x0900+i), "013912345678", uint16(i), 2, 1, chunk))
+	}
+	if len(session.fragments) != jt808MaxFragmentMessages {
+		t.Errorf("Expected %d partial messages, got %d", jt808MaxFragmentMessages, len(session.fragments))
+	}
+
+	// 超时的分包被丢弃
+	for _, pending := range session.fragments {
+		pending.updated = time.Now().Add(-2 * jt808FragmentTimeout)
+	}
+	jt808Exchange(t, session, client, buildJT808Subpackage(0x0a00, "013912345678", 20, 2, 1, chunk))
+	if len(session.fragments) != 1 || session.fragmentBytes != len(chunk) {
+		t.Errorf("Expected stale messages to be dropped, got %d messages, %d bytes", len(session.fragments), session.fragmentBytes)
+	}
+
+	// 分包数过多或缓存字节数超限的消息被丢弃
+	jt808Exchange(t, session, client, buildJT808Subpackage(0x0a01, "013912345678", 21, jt808MaxFragmentParts+1, 1, chunk))
+	if _, ok := session.fragments[0x0a01]; ok {
+		t.Error("Expected message with too many packages to be dropped")
+	}
+	for i := uint16(1); i < jt808MaxFragmentParts; i++ {
+		jt808Exchange(t, session, client, buildJT808Subpackage(0x0a02, "013912345678", i, jt808MaxFragmentParts, i, chunk))
+	}
+	for i := uint16(1); i <= 7; i++ {
+		jt808Exchange(t, session, client, buildJT808Subpackage(0x0a03, "013912345678", i, jt808MaxFragmentParts, i, chunk))
+	}
+	if _, ok := session.fragments[0x0a03]; ok || session.fragmentBytes > jt808MaxFragmentBytes {
+		t.Errorf("Expected message exceeding the byte limit to be dropped, buffered %d bytes", session.fragmentBytes)
+	}
+	if want := len(chunk) * jt808MaxFragmentParts; session.fragmentBytes != want {
+		t.Errorf("Expected %d buffered bytes, got %d", want, session.fragmentBytes)
+	}
+}
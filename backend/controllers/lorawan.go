@@ -0,0 +1,554 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+// LoRaWAN 网络服务器类型
+const (
+	LoRaWANNetworkChirpStack = "chirpstack"
+	LoRaWANNetworkTTN        = "ttn"
+)
+
+// LoRaWANUplink 网络服务器上行事件中与平台相关的部分
+type LoRaWANUplink struct {
+	Network         string
+	DevEUI          string
+	DevAddr         string
+	ApplicationID   string
+	NetworkDeviceID string
+	FPort           int
+	FCnt            uint32
+	Payload         []byte
+	ReceivedAt      int64
+	RSSI            int
+	SNR             float64
+	Gateway         string
+	Frequency       int64
+	SpreadingFactor int
+	Bandwidth       int
+	GatewayCount    int
+}
+
+// Metadata 返回写入遥测记录的接入元数据
+func (u *LoRaWANUplink) Metadata() map[string]interface{} {
+	metadata := map[string]interface{}{
+		"network":       u.Network,
+		"dev_eui":       u.DevEUI,
+		"f_port":        u.FPort,
+		"f_cnt":         u.FCnt,
+		"gateway":       u.Gateway,
+		"gateway_count": u.GatewayCount,
+	}
+	if u.DevAddr != "" {
+		metadata["dev_addr"] = u.DevAddr
+	}
+	if u.Frequency != 0 {
+		metadata["frequency"] = u.Frequency
+	}
+	if u.SpreadingFactor != 0 {
+		metadata["spreading_factor"] = u.SpreadingFactor
+	}
+	if u.Bandwidth != 0 {
+		metadata["bandwidth"] = u.Bandwidth
+	}
+	return metadata
+}
+
+// chirpStackUplink ChirpStack v4 HTTP 集成的 up 事件
+type chirpStackUplink struct {
+	Time       string `json:"time"`
+	DeviceInfo struct {
+		ApplicationID string `json:"applicationId"`
+		DeviceName    string `json:"deviceName"`
+		DevEUI        string `json:"devEui"`
+	} `json:"deviceInfo"`
+	DevAddr string `json:"devAddr"`
+	FCnt    uint32 `json:"fCnt"`
+	FPort   int    `json:"fPort"`
+	Data    string `json:"data"`
+	RxInfo  []struct {
+		GatewayID string  `json:"gatewayId"`
+		RSSI      int     `json:"rssi"`
+		SNR       float64 `json:"snr"`
+	} `json:"rxInfo"`
+	TxInfo struct {
+		Frequency  int64 `json:"frequency"`
+		Modulation struct {
+			LoRa struct {
+				Bandwidth       int `json:"bandwidth"`
+				SpreadingFactor int `json:"spreadingFactor"`
+			} `json:"lora"`
+		} `json:"modulation"`
+	} `json:"txInfo"`
+}
+
+// ttnUplink TTN v3 Webhook 的 uplink_message 事件
+type ttnUplink struct {
+	EndDeviceIDs struct {
+		DeviceID       string `json:"device_id"`
+		ApplicationIDs struct {
+			ApplicationID string `json:"application_id"`
+		} `json:"application_ids"`
+		DevEUI  string `json:"dev_eui"`
+		DevAddr string `json:"dev_addr"`
+	} `json:"end_device_ids"`
+	ReceivedAt    string `json:"received_at"`
+	UplinkMessage *struct {
+		FPort      int    `json:"f_port"`
+		FCnt       uint32 `json:"f_cnt"`
+		FRMPayload string `json:"frm_payload"`
+		RxMetadata []struct {
+			GatewayIDs struct {
+				GatewayID string `json:"gateway_id"`
+			} `json:"gateway_ids"`
+			RSSI int     `json:"rssi"`
+			SNR  float64 `json:"snr"`
+		} `json:"rx_metadata"`
+		Settings struct {
+			DataRate struct {
+				LoRa struct {
+					Bandwidth       int `json:"bandwidth"`
+					SpreadingFactor int `json:"spreading_factor"`
+				} `json:"lora"`
+			} `json:"data_rate"`
+			Frequency string `json:"frequency"`
+		} `json:"settings"`
+	} `json:"uplink_message"`
+}
+
+// parseLoRaWANTime 解析 RFC3339 时间，失败时返回当前时间
+func parseLoRaWANTime(value string) int64 {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t.Unix()
+	}
+	return time.Now().Unix()
+}
+
+// parseChirpStackUplink 解析 ChirpStack v4 up 事件
+func parseChirpStackUplink(body []byte) (*LoRaWANUplink, error) {
+	var event chirpStackUplink
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, fmt.Errorf("invalid ChirpStack event: %v", err)
+	}
+	if event.DeviceInfo.DevEUI == "" {
+		return nil, fmt.Errorf("missing deviceInfo.devEui")
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(event.Data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 data: %v", err)
+	}
+
+	uplink := &LoRaWANUplink{
+		Network:         LoRaWANNetworkChirpStack,
+		DevEUI:          strings.ToLower(event.DeviceInfo.DevEUI),
+		DevAddr:         strings.ToLower(event.DevAddr),
+		ApplicationID:   event.DeviceInfo.ApplicationID,
+		NetworkDeviceID: event.DeviceInfo.DeviceName,
+		FPort:           event.FPort,
+		FCnt:            event.FCnt,
+		Payload:         payload,
+		ReceivedAt:      parseLoRaWANTime(event.Time),
+		Frequency:       event.TxInfo.Frequency,
+		SpreadingFactor: event.TxInfo.Modulation.LoRa.SpreadingFactor,
+		Bandwidth:       event.TxInfo.Modulation.LoRa.Bandwidth,
+		GatewayCount:    len(event.RxInfo),
+	}
+
+	// 多网关接收时取信号最好的网关
+	for i, rx := range event.RxInfo {
+		if i == 0 || rx.RSSI > uplink.RSSI {
+			uplink.RSSI = rx.RSSI
+			uplink.SNR = rx.SNR
+			uplink.Gateway = rx.GatewayID
+		}
+	}
+
+	return uplink, nil
+}
+
+// parseTTNUplink 解析 TTN v3 uplink_message 事件
+func parseTTNUplink(body []byte) (*LoRaWANUplink, error) {
+	var event ttnUplink
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, fmt.Errorf("invalid TTN event: %v", err)
+	}
+	if event.UplinkMessage == nil {
+		return nil, fmt.Errorf("missing uplink_message")
+	}
+	if event.EndDeviceIDs.DevEUI == "" {
+		return nil, fmt.Errorf("missing end_device_ids.dev_eui")
+	}
+
+	message := event.UplinkMessage
+	payload, err := base64.StdEncoding.DecodeString(message.FRMPayload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 frm_payload: %v", err)
+	}
+
+	frequency, _ := strconv.ParseInt(message.Settings.Frequency, 10, 64)
+	uplink := &LoRaWANUplink{
+		Network:         LoRaWANNetworkTTN,
+		DevEUI:          strings.ToLower(event.EndDeviceIDs.DevEUI),
+		DevAddr:         strings.ToLower(event.EndDeviceIDs.DevAddr),
+		ApplicationID:   event.EndDeviceIDs.ApplicationIDs.ApplicationID,
+		NetworkDeviceID: event.EndDeviceIDs.DeviceID,
+		FPort:           message.FPort,
+		FCnt:            message.FCnt,
+		Payload:         payload,
+		ReceivedAt:      parseLoRaWANTime(event.ReceivedAt),
+		Frequency:       frequency,
+		SpreadingFactor: message.Settings.DataRate.LoRa.SpreadingFactor,
+		Bandwidth:       message.Settings.DataRate.LoRa.Bandwidth,
+		GatewayCount:    len(message.RxMetadata),
+	}
+
+	for i, rx := range message.RxMetadata {
+		if i == 0 || rx.RSSI > uplink.RSSI {
+			uplink.RSSI = rx.RSSI
+			uplink.SNR = rx.SNR
+			uplink.Gateway = rx.GatewayIDs.GatewayID
+		}
+	}
+
+	return uplink, nil
+}
+
+// parseLoRaWANUplink 根据事件结构识别网络服务器类型并解析上行事件，
+// 非上行事件(join、ack、status 等)返回 nil
+func parseLoRaWANUplink(body []byte) (*LoRaWANUplink, error) {
+	var probe struct {
+		DeviceInfo    json.RawMessage `json:"deviceInfo"`
+		EndDeviceIDs  json.RawMessage `json:"end_device_ids"`
+		UplinkMessage json.RawMessage `json:"uplink_message"`
+		Data          json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &probe); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+
+	switch {
+	case probe.DeviceInfo != nil:
+		if probe.Data == nil {
+			return nil, nil
+		}
+		return parseChirpStackUplink(body)
+	case probe.EndDeviceIDs != nil:
+		if probe.UplinkMessage == nil {
+			return nil, nil
+		}
+		return parseTTNUplink(body)
+	default:
+		return nil, fmt.Errorf("unknown LoRaWAN network server event")
+	}
+}
+
+// lorawanMessageConfig 选择 fPort 对应的消息类型配置，没有时使用设备默认配置
+func lorawanMessageConfig(device *models.Device, fPort int) (*models.MessageTypeConfig, error) {
+	if fPort > 0 {
+		var config models.MessageTypeConfig
+		if err := database.DB.Where("user_id = ? AND f_port = ?", device.UserID, fPort).First(&config).Error; err == nil {
+			return &config, nil
+		}
+	}
+	return deviceMessageConfig(device)
+}
+
+// resolveLoRaWANDevice 按 DevEUI 查找映射的设备，不存在时自动创建设备(topic 为 lorawan/<deveui>)
+func resolveLoRaWANDevice(uplink *LoRaWANUplink) (*models.Device, *models.LoRaWANDevice, error) {
+	var mapping models.LoRaWANDevice
+	var device models.Device
+
+	if err := database.DB.Where("dev_eui = ?", uplink.DevEUI).First(&mapping).Error; err == nil {
+		if err := database.DB.First(&device, mapping.DeviceID).Error; err != nil {
+			return nil, nil, fmt.Errorf("device %d for DevEUI %s not found", mapping.DeviceID, uplink.DevEUI)
+		}
+	} else {
+		topic := "lorawan/" + uplink.DevEUI
+		if err := database.DB.Where("topic = ?", topic).First(&device).Error; err != nil {
+			name := uplink.NetworkDeviceID
+			if name == "" {
+				name = topic
+			}
+			device = models.Device{
+				Name:   name,
+				Topic:  topic,
+				UserID: 1, // Default user ID, adjust as needed
+				Status: "online",
+			}
+			if err := database.DB.Create(&device).Error; err != nil {
+				return nil, nil, err
+			}
+		}
+		mapping = models.LoRaWANDevice{DevEUI: uplink.DevEUI, DeviceID: device.ID}
+	}
+
+	mapping.Network = uplink.Network
+	mapping.ApplicationID = uplink.ApplicationID
+	mapping.NetworkDeviceID = uplink.NetworkDeviceID
+	mapping.DevAddr = uplink.DevAddr
+	mapping.LastFCnt = uplink.FCnt
+	if err := database.DB.Save(&mapping).Error; err != nil {
+		return nil, nil, err
+	}
+
+	return &device, &mapping, nil
+}
+
+// processLoRaWANUplink 解析上行负载并保存遥测数据及无线元数据
+func processLoRaWANUplink(uplink *LoRaWANUplink) (*models.Device, models.ParseResult, error) {
+	device, _, err := resolveLoRaWANDevice(uplink)
+	if err != nil {
+		return nil, models.ParseResult{Success: false, Error: err.Error()}, err
+	}
+
+	metadata, _ := json.Marshal(uplink.Metadata())
+	telemetry := &models.Telemetry{
+		Source:    "lorawan",
+		Timestamp: uplink.ReceivedAt,
+		RSSI:      uplink.RSSI,
+		SNR:       uplink.SNR,
+		Metadata:  string(metadata),
+	}
+
+	// fPort 0 为 MAC 命令帧，没有应用负载
+	if uplink.FPort == 0 || len(uplink.Payload) == 0 {
+		device.Status = "online"
+		device.LastSeen = time.Now().Unix()
+		if err := database.DB.Save(device).Error; err != nil {
+			return device, models.ParseResult{Success: false, Error: err.Error()}, err
+		}
+		telemetry.DeviceID = device.ID
+		return device, models.ParseResult{Success: true, Fields: map[string]interface{}{}}, recordTelemetry(telemetry, nil)
+	}
+
+	config, err := lorawanMessageConfig(device, uplink.FPort)
+	if err != nil {
+		return device, models.ParseResult{Success: false, Error: err.Error()}, err
+	}
+
+	result, err := ingestPayloadWithConfig(device, config, uplink.Payload, telemetry)
+	return device, result, err
+}
+
+// verifyLoRaWANWebhook 校验集成请求携带的共享密钥(Authorization: Bearer <LORAWAN_WEBHOOK_SECRET>)，
+// 未配置密钥时拒绝所有请求
+func verifyLoRaWANWebhook(c *gin.Context) error {
+	secret := os.Getenv("LORAWAN_WEBHOOK_SECRET")
+	if secret == "" {
+		return fmt.Errorf("LORAWAN_WEBHOOK_SECRET is not configured")
+	}
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+		return fmt.Errorf("invalid webhook secret")
+	}
+	return nil
+}
+
+// HandleLoRaWANUplink 接收 ChirpStack v4 / TTN v3 的 HTTP 集成上行事件，
+// 集成须配置 Authorization: Bearer <LORAWAN_WEBHOOK_SECRET> 请求头
+func HandleLoRaWANUplink(c *gin.Context) {
+	if err := verifyLoRaWANWebhook(c); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	// ChirpStack 通过 event 参数区分事件类型，仅处理 up 事件
+	if event := c.Query("event"); event != "" && event != "up" {
+		c.JSON(http.StatusOK, gin.H{"result": "ignored", "event": event})
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	uplink, err := parseLoRaWANUplink(body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if uplink == nil {
+		c.JSON(http.StatusOK, gin.H{"result": "ignored"})
+		return
+	}
+
+	device, result, err := processLoRaWANUplink(uplink)
+	if err != nil {
+		fmt.Printf("Error processing LoRaWAN uplink from %s: %v\n", uplink.DevEUI, err)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"result":    "success",
+		"device_id": device.ID,
+		"fields":    result.Fields,
+	})
+}
+
+// lorawanHTTPClient 调用网络服务器 API 使用的 HTTP 客户端
+var lorawanHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// buildLoRaWANDownlinkRequest 按网络服务器 API 格式构造下行入队请求
+//
+// ChirpStack: POST {CHIRPSTACK_API_URL}/api/devices/{devEui}/queue
+// TTN:        POST {TTN_API_URL}/api/v3/as/applications/{app}/webhooks/{TTN_WEBHOOK_ID}/devices/{dev}/down/push
+//
+// 地址和 API Key 只来自服务端配置，不使用上行请求携带的下行地址
+func buildLoRaWANDownlinkRequest(mapping *models.LoRaWANDevice, fPort int, payload []byte, confirmed bool) (*http.Request, error) {
+	if fPort < 1 || fPort > 223 {
+		return nil, fmt.Errorf("f_port must be between 1 and 223")
+	}
+	data := base64.StdEncoding.EncodeToString(payload)
+
+	var endpoint, authorization string
+	var body interface{}
+
+	switch mapping.Network {
+	case LoRaWANNetworkChirpStack:
+		baseURL := strings.TrimRight(os.Getenv("CHIRPSTACK_API_URL"), "/")
+		if baseURL == "" {
+			return nil, fmt.Errorf("CHIRPSTACK_API_URL is not configured")
+		}
+		endpoint = fmt.Sprintf("%s/api/devices/%s/queue", baseURL, mapping.DevEUI)
+		authorization = os.Getenv("CHIRPSTACK_API_TOKEN")
+		body = gin.H{
+			"queueItem": gin.H{
+				"confirmed": confirmed,
+				"fPort":     fPort,
+				"data":      data,
+			},
+		}
+	case LoRaWANNetworkTTN:
+		baseURL := strings.TrimRight(os.Getenv("TTN_API_URL"), "/")
+		webhookID := os.Getenv("TTN_WEBHOOK_ID")
+		if baseURL == "" || webhookID == "" {
+			return nil, fmt.Errorf("TTN_API_URL and TTN_WEBHOOK_ID are not configured")
+		}
+		if mapping.ApplicationID == "" || mapping.NetworkDeviceID == "" {
+			return nil, fmt.Errorf("TTN application or device ID is not known")
+		}
+		endpoint = fmt.Sprintf("%s/api/v3/as/applications/%s/webhooks/%s/devices/%s/down/push",
+			baseURL, neturl.PathEscape(mapping.ApplicationID), neturl.PathEscape(webhookID), neturl.PathEscape(mapping.NetworkDeviceID))
+		authorization = os.Getenv("TTN_API_KEY")
+		body = gin.H{
+			"downlinks": []gin.H{{
+				"frm_payload": data,
+				"f_port":      fPort,
+				"priority":    "NORMAL",
+				"confirmed":   confirmed,
+			}},
+		}
+	default:
+		return nil, fmt.Errorf("unsupported LoRaWAN network: %s", mapping.Network)
+	}
+
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if authorization != "" {
+		if mapping.Network == LoRaWANNetworkChirpStack {
+			req.Header.Set("Grpc-Metadata-Authorization", "Bearer "+authorization)
+		} else {
+			req.Header.Set("Authorization", "Bearer "+authorization)
+		}
+	}
+
+	return req, nil
+}
+
+// SendLoRaWANDownlink 通过网络服务器 API 为设备下行入队
+func SendLoRaWANDownlink(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	id := c.Param("id")
+
+	var device models.Device
+	if err := database.DB.Where("id = ? AND user_id = ?", id, userID).First(&device).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	var mapping models.LoRaWANDevice
+	if err := database.DB.Where("device_id = ?", device.ID).First(&mapping).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device is not a LoRaWAN device"})
+		return
+	}
+
+	var input struct {
+		FPort     int    `json:"f_port" binding:"required"`
+		Data      string `json:"data"` // base64
+		Hex       string `json:"hex"`
+		Confirmed bool   `json:"confirmed"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var payload []byte
+	var err error
+	if input.Hex != "" {
+		payload, err = hex.DecodeString(input.Hex)
+	} else {
+		payload, err = base64.StdEncoding.DecodeString(input.Data)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payload: " + err.Error()})
+		return
+	}
+
+	req, err := buildLoRaWANDownlinkRequest(&mapping, input.FPort, payload, input.Confirmed)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp, err := lorawanHTTPClient.Do(req)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to reach network server: " + err.Error()})
+		return
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error":  fmt.Sprintf("Network server returned %d", resp.StatusCode),
+			"detail": string(respBody),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "Downlink enqueued",
+		"network":  mapping.Network,
+		"response": string(respBody),
+	})
+}
@@ -0,0 +1,243 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+func TestParseChirpStackUplink(t *testing.T) {
+	body := []byte(`{
+		"deduplicationId": "3ac7e3c4-4401-4b8d-9386-a5c902f9202d",
+		"time": "2024-03-05T08:15:30.123Z",
+		"deviceInfo": {
+			"applicationId": "17c82e96-be03-4f38-aef3-f83d48582d97",
+			"deviceName": "soil-sensor-01",
+			"devEui": "0101010101010101"
+		},
+		"devAddr": "00189440",
+		"fCnt": 42,
+		"fPort": 2,
+		"data": "AQIDBA==",
+		"rxInfo": [
+			{"gatewayId": "0016c001ff10a235", "rssi": -97, "snr": 3.5},
+			{"gatewayId": "0016c001ff10a236", "rssi": -60, "snr": 10.25}
+		],
+		"txInfo": {
+			"frequency": 868100000,
+			"modulation": {"lora": {"bandwidth": 125000, "spreadingFactor": 7}}
+		}
+	}`)
+
+	uplink, err := parseLoRaWANUplink(body)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if uplink.Network != LoRaWANNetworkChirpStack {
+		t.Errorf("Expected network chirpstack, got %s", uplink.Network)
+	}
+	if uplink.DevEUI != "0101010101010101" || uplink.FPort != 2 || uplink.FCnt != 42 {
+		t.Errorf("Unexpected device info: %+v", uplink)
+	}
+	if !bytes.Equal(uplink.Payload, []byte{1, 2, 3, 4}) {
+		t.Errorf("Expected payload 01020304, got %x", uplink.Payload)
+	}
+	if uplink.RSSI != -60 || uplink.SNR != 10.25 || uplink.Gateway != "0016c001ff10a236" {
+		t.Errorf("Expected best gateway metadata, got rssi=%d snr=%v gateway=%s", uplink.RSSI, uplink.SNR, uplink.Gateway)
+	}
+	if uplink.ReceivedAt != 1709626530 {
+		t.Errorf("Expected timestamp 1709626530, got %d", uplink.ReceivedAt)
+	}
+	if uplink.Frequency != 868100000 || uplink.SpreadingFactor != 7 || uplink.GatewayCount != 2 {
+		t.Errorf("Unexpected radio metadata: %+v", uplink.Metadata())
+	}
+}
+
+func TestParseTTNUplink(t *testing.T) {
+	body := []byte(`{
+		"end_device_ids": {
+			"device_id": "eui-0004a30b001c0530",
+			"application_ids": {"application_id": "tracker-app"},
+			"dev_eui": "0004A30B001C0530",
+			"dev_addr": "00BCB929"
+		},
+		"received_at": "2024-03-05T08:15:30.123456789Z",
+		"uplink_message": {
+			"f_port": 15,
+			"f_cnt": 7,
+			"frm_payload": "3q2+7w==",
+			"rx_metadata": [
+				{"gateway_ids": {"gateway_id": "gw-roof"}, "rssi": -35, "snr": 8.2}
+			],
+			"settings": {
+				"data_rate": {"lora": {"bandwidth": 125000, "spreading_factor": 9}},
+				"frequency": "868300000"
+			}
+		}
+	}`)
+
+	uplink, err := parseLoRaWANUplink(body)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if uplink.Network != LoRaWANNetworkTTN {
+		t.Errorf("Expected network ttn, got %s", uplink.Network)
+	}
+	if uplink.DevEUI != "0004a30b001c0530" {
+		t.Errorf("Expected lowercase DevEUI, got %s", uplink.DevEUI)
+	}
+	if uplink.ApplicationID != "tracker-app" || uplink.NetworkDeviceID != "eui-0004a30b001c0530" {
+		t.Errorf("Unexpected identifiers: %+v", uplink)
+	}
+	if !bytes.Equal(uplink.Payload, []byte{0xde, 0xad, 0xbe, 0xef}) {
+		t.Errorf("Expected payload deadbeef, got %x", uplink.Payload)
+	}
+	if uplink.FPort != 15 || uplink.RSSI != -35 || uplink.SNR != 8.2 || uplink.Frequency != 868300000 {
+		t.Errorf("Unexpected radio metadata: %+v", uplink.Metadata())
+	}
+}
+
+func TestParseLoRaWANUplinkNonUplinkEvents(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr bool
+	}{
+		{name: "ChirpStack join event", body: `{"deviceInfo":{"devEui":"0101010101010101"},"devAddr":"00189440"}`},
+		{name: "TTN join accept", body: `{"end_device_ids":{"dev_eui":"0004A30B001C0530"},"join_accept":{}}`},
+		{name: "Unknown network server", body: `{"foo":"bar"}`, wantErr: true},
+		{name: "Invalid base64", body: `{"deviceInfo":{"devEui":"01"},"fPort":1,"data":"***"}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uplink, err := parseLoRaWANUplink([]byte(tt.body))
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Expected error, but got none")
+				}
+				return
+			}
+			if err != nil || uplink != nil {
+				t.Errorf("Expected event to be ignored, got %+v, %v", uplink, err)
+			}
+		})
+	}
+}
+
+func TestBuildLoRaWANDownlinkRequest(t *testing.T) {
+	t.Run("ChirpStack queue item", func(t *testing.T) {
+		t.Setenv("CHIRPSTACK_API_URL", "http://chirpstack:8090/")
+		t.Setenv("CHIRPSTACK_API_TOKEN", "cs-token")
+
+		mapping := &models.LoRaWANDevice{Network: LoRaWANNetworkChirpStack, DevEUI: "0101010101010101"}
+		req, err := buildLoRaWANDownlinkRequest(mapping, 10, []byte{0x01, 0x02}, true)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if req.URL.String() != "http://chirpstack:8090/api/devices/0101010101010101/queue" {
+			t.Errorf("Unexpected URL: %s", req.URL)
+		}
+		if req.Header.Get("Grpc-Metadata-Authorization") != "Bearer cs-token" {
+			t.Errorf("Unexpected authorization header: %v", req.Header)
+		}
+
+		var body struct {
+			QueueItem struct {
+				Confirmed bool   `json:"confirmed"`
+				FPort     int    `json:"fPort"`
+				Data      string `json:"data"`
+			} `json:"queueItem"`
+		}
+		data, _ := io.ReadAll(req.Body)
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Fatalf("Invalid body: %v", err)
+		}
+		if !body.QueueItem.Confirmed || body.QueueItem.FPort != 10 || body.QueueItem.Data != "AQI=" {
+			t.Errorf("Unexpected queue item: %s", data)
+		}
+	})
+
+	t.Run("TTN push with configured webhook", func(t *testing.T) {
+		t.Setenv("TTN_API_URL", "https://eu1.cloud.thethings.network/")
+		t.Setenv("TTN_WEBHOOK_ID", "hook")
+		t.Setenv("TTN_API_KEY", "NNSXS.KEY")
+		mapping := &models.LoRaWANDevice{Network: LoRaWANNetworkTTN, ApplicationID: "app", NetworkDeviceID: "dev"}
+		req, err := buildLoRaWANDownlinkRequest(mapping, 1, []byte{0xff}, false)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if req.URL.String() != "https://eu1.cloud.thethings.network/api/v3/as/applications/app/webhooks/hook/devices/dev/down/push" {
+			t.Errorf("Unexpected URL: %s", req.URL)
+		}
+		if req.Header.Get("Authorization") != "Bearer NNSXS.KEY" {
+			t.Errorf("Unexpected authorization header: %v", req.Header)
+		}
+
+		var body struct {
+			Downlinks []struct {
+				FRMPayload string `json:"frm_payload"`
+				FPort      int    `json:"f_port"`
+				Priority   string `json:"priority"`
+			} `json:"downlinks"`
+		}
+		data, _ := io.ReadAll(req.Body)
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Fatalf("Invalid body: %v", err)
+		}
+		if len(body.Downlinks) != 1 || body.Downlinks[0].FRMPayload != "/w==" || body.Downlinks[0].FPort != 1 || body.Downlinks[0].Priority != "NORMAL" {
+			t.Errorf("Unexpected downlinks: %s", data)
+		}
+	})
+
+	t.Run("TTN push without configuration", func(t *testing.T) {
+		t.Setenv("TTN_API_URL", "")
+		mapping := &models.LoRaWANDevice{Network: LoRaWANNetworkTTN, ApplicationID: "app", NetworkDeviceID: "dev"}
+		if _, err := buildLoRaWANDownlinkRequest(mapping, 1, []byte{0xff}, false); err == nil {
+			t.Error("Expected error, but got none")
+		}
+	})
+
+	t.Run("Invalid fPort", func(t *testing.T) {
+		mapping := &models.LoRaWANDevice{Network: LoRaWANNetworkTTN, ApplicationID: "app", NetworkDeviceID: "dev"}
+		if _, err := buildLoRaWANDownlinkRequest(mapping, 0, nil, false); err == nil {
+			t.Error("Expected error, but got none")
+		}
+	})
+}
+
+func TestLoRaWANUplinkRequiresSecret(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	post := func(authorization string) int {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/api/lorawan/uplink?event=join", bytes.NewBufferString("{}"))
+		if authorization != "" {
+			c.Request.Header.Set("Authorization", authorization)
+		}
+		HandleLoRaWANUplink(c)
+		return w.Code
+	}
+
+	t.Setenv("LORAWAN_WEBHOOK_SECRET", "")
+	if code := post("Bearer anything"); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without configured secret, got %d", code)
+	}
+
+	t.Setenv("LORAWAN_WEBHOOK_SECRET", "s3cret")
+	if code := post(""); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without secret, got %d", code)
+	}
+	if code := post("Bearer wrong"); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for wrong secret, got %d", code)
+	}
+	if code := post("Bearer s3cret"); code != http.StatusOK {
+		t.Errorf("Expected 200 with secret, got %d", code)
+	}
+}
@@ -239,6 +239,18 @@ func TestParseField(t *testing.T) {
 			}
 		})
 	}
+
+	// 未经校验的格式中长度小于类型长度或为负数时返回错误而不是越界
+	invalid := []models.FieldDefinition{
+		{Name: "short", Type: "uint16", Length: 1},
+		{Name: "zero", Type: "float32"},
+		{Name: "negative", Type: "bytes", Length: -1},
+	}
+	for _, field := range invalid {
+		if _, _, err := parseField(testData, 0, field); err == nil {
+			t.Errorf("Expected error for field %+v", field)
+		}
+	}
 }
 
 func TestValidateChecksum(t *testing.T) {
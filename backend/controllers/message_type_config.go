@@ -1,19 +1,18 @@
 package controllers
 
 import (
-	"encoding/base64"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"math"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/liang/mqtt-app/backend/database"
 	"github.com/liang/mqtt-app/backend/models"
+	"gorm.io/gorm"
 )
 
 // GetMessageTypeConfigs 获取用户的消息类型配置
@@ -53,6 +52,8 @@ func CreateMessageTypeConfig(c *gin.Context) {
 		Protocol    string `json:"protocol" binding:"required"`
 		Format      string `json:"format" binding:"required"`
 		IsDefault   bool   `json:"is_default"`
+		FPort       int    `json:"f_port"`
+		Comment     string `json:"comment"` // 版本说明
 	}
 
 	if err := c.ShouldBindJSON(&input); err != nil {
@@ -60,11 +61,10 @@ func CreateMessageTypeConfig(c *gin.Context) {
 		return
 	}
 
-	// 验证格式是否为有效的JSON
-	var format models.MessageFormat
-	if err := json.Unmarshal([]byte(input.Format), &format); err != nil {
-		fmt.Println(err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid format JSON"})
+	// 静态校验格式，保存规范化后的格式
+	validation := validateMessageFormat(input.Protocol, input.Format)
+	if !validation.Valid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message format", "data": validation})
 		return
 	}
 
@@ -83,16 +83,24 @@ func CreateMessageTypeConfig(c *gin.Context) {
 		Name:        input.Name,
 		Description: input.Description,
 		Protocol:    input.Protocol,
-		Format:      string(input.Format),
+		Format:      validation.Format,
 		IsDefault:   input.IsDefault,
+		FPort:       input.FPort,
 	}
 
-	if err := database.DB.Create(&config).Error; err != nil {
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&config).Error; err != nil {
+			return err
+		}
+		_, err := recordConfigVersion(tx, &config, userID, input.Comment, 0)
+		return err
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create message type config"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"data": config})
+	c.JSON(http.StatusOK, gin.H{"data": config, "warnings": validation.Warnings})
 }
 
 // UpdateMessageTypeConfig 更新消息类型配置
@@ -112,6 +120,8 @@ func UpdateMessageTypeConfig(c *gin.Context) {
 		Protocol    string `json:"protocol"`
 		Format      string `json:"format"`
 		IsDefault   bool   `json:"is_default"`
+		FPort       *int   `json:"f_port"`
+		Comment     string `json:"comment"` // 版本说明
 	}
 
 	if err := c.ShouldBindJSON(&input); err != nil {
@@ -119,11 +129,30 @@ func UpdateMessageTypeConfig(c *gin.Context) {
 		return
 	}
 
-	// 验证格式是否为有效的JSON（如果提供了）
+	// 静态校验格式（如果提供了），保存规范化后的格式
+	warnings := []FormatIssue{}
+	if input.Format != "" {
+		protocol := input.Protocol
+		if protocol == "" {
+			protocol = config.Protocol
+		}
+		validation := validateMessageFormat(protocol, input.Format)
+		if !validation.Valid {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message format", "data": validation})
+			return
+		}
+		input.Format = validation.Format
+		warnings = validation.Warnings
+	}
 
-	var format models.MessageFormat
-	if err := json.Unmarshal([]byte(input.Format), &format); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid format JSON"})
+	// 修改前确保当前内容已有版本记录
+	if err := ensureConfigVersioned(&config); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record config version"})
+		return
+	}
+	current, err := loadConfigVersion(config.ID, config.Version)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
@@ -146,14 +175,36 @@ func UpdateMessageTypeConfig(c *gin.Context) {
 	if input.Protocol != "" {
 		config.Protocol = input.Protocol
 	}
+	previousFormat := config.Format
+	if input.Format != "" {
+		config.Format = input.Format
+	}
+	if input.FPort != nil {
+		config.FPort = *input.FPort
+	}
 	config.IsDefault = input.IsDefault
 
-	if err := database.DB.Save(&config).Error; err != nil {
+	// 内容有变化时保存为新版本，仅修改默认标记不产生版本
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&config).Error; err != nil {
+			return err
+		}
+		if versionContentChanged(&config, current) {
+			if _, err := recordConfigVersion(tx, &config, userID, input.Comment, 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update message type config"})
 		return
 	}
+	if previousFormat != config.Format {
+		invalidateDecoder(previousFormat)
+	}
 
-	c.JSON(http.StatusOK, gin.H{"data": config})
+	c.JSON(http.StatusOK, gin.H{"data": config, "warnings": warnings})
 }
 
 // DeleteMessageTypeConfig 删除消息类型配置
@@ -171,6 +222,7 @@ func DeleteMessageTypeConfig(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete message type config"})
 		return
 	}
+	invalidateDecoder(config.Format)
 
 	c.JSON(http.StatusOK, gin.H{"message": "Message type config deleted successfully"})
 }
@@ -206,6 +258,7 @@ func ParseMessageData(c *gin.Context) {
 	var input struct {
 		ConfigID uint   `json:"config_id" binding:"required"`
 		RawData  string `json:"raw_data" binding:"required"`
+		Version  int    `json:"version"` // 使用指定的历史版本解析，为 0 时使用当前版本
 	}
 
 	if err := c.ShouldBindJSON(&input); err != nil {
@@ -219,9 +272,17 @@ func ParseMessageData(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Message type config not found"})
 		return
 	}
+	if input.Version != 0 && input.Version != config.Version {
+		version, err := loadConfigVersion(config.ID, input.Version)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		config = configAtVersion(config, version)
+	}
 
 	// 解析消息数据
-	result, err := parseMessageData(config.Format, input.RawData)
+	result, err := parseWithConfig(config, input.RawData)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -230,245 +291,50 @@ func ParseMessageData(c *gin.Context) {
 	c.JSON(http.StatusOK, result)
 }
 
-// parseMessageData 解析消息数据的辅助函数
-func parseMessageData(formatStr, rawData string) (models.ParseResult, error) {
-	var format models.MessageFormat
-	// 由于 formatStr 是从数据库读取的 JSON 字符串，需要先检查它是否是有效的 JSON
-	// 如果是字符串形式的 JSON，需要先解析它
-	if formatStr[0] == '"' && formatStr[len(formatStr)-1] == '"' {
-		// 如果是引号包围的字符串，先去除引号
-		unquotedStr := formatStr[1 : len(formatStr)-1]
-		if err := json.Unmarshal([]byte(unquotedStr), &format); err != nil {
-			return models.ParseResult{Success: false, Error: "Invalid format configuration"}, err
-		}
-	} else {
-		// 直接是 JSON 对象
-		if err := json.Unmarshal([]byte(formatStr), &format); err != nil {
-			return models.ParseResult{Success: false, Error: "Invalid format configuration"}, err
-		}
-	}
-
-	result := models.ParseResult{
-		Success:   true,
-		Fields:    make(map[string]interface{}),
-		RawData:   rawData,
-		Timestamp: time.Now(),
-	}
-
-	// 根据编码类型解码原始数据
-	var decodedData []byte
-	var err error
-	switch format.Encoding {
-	case "hex":
-		decodedData, err = hex.DecodeString(rawData)
-	case "base64":
-		decodedData, err = base64.StdEncoding.DecodeString(rawData)
-	case "ascii", "":
-		decodedData = []byte(rawData)
+// parseWithConfig 按配置的协议选择解析器，内置协议(如 NMEA)不依赖 Format 字段定义
+func parseWithConfig(config models.MessageTypeConfig, rawData string) (models.ParseResult, error) {
+	switch config.Protocol {
+	case ProtocolNMEA:
+		return parseNMEAData(rawData)
 	default:
-		return models.ParseResult{Success: false, Error: "Unsupported encoding: " + format.Encoding}, nil
-	}
-
-	if err != nil {
-		return models.ParseResult{Success: false, Error: "Failed to decode data: " + err.Error()}, err
-	}
-
-	// 解析报文头字段
-	currentOffset := 0
-	for _, field := range format.Header {
-		value, newOffset, err := parseField(decodedData, currentOffset, field)
-		if err != nil {
-			return models.ParseResult{Success: false, Error: "Failed to parse header field '" + field.Name + "': " + err.Error()}, err
-		}
-		result.Fields[field.Name] = value
-		currentOffset = newOffset
-	}
-
-	// 解析长度字段（如果存在）
-	if format.Length != nil {
-		lengthValue, newOffset, err := parseField(decodedData, currentOffset, *format.Length)
-		if err != nil {
-			return models.ParseResult{Success: false, Error: "Failed to parse length field: " + err.Error()}, err
-		}
-		currentOffset = newOffset
-
-		// 根据长度字段调整数据范围
-		if length, ok := lengthValue.(int64); ok {
-			// 确保有足够的数据
-			if currentOffset+int(length) > len(decodedData) {
-				return models.ParseResult{Success: false, Error: "Insufficient data for specified length"}, nil
-			}
-			decodedData = decodedData[:currentOffset+int(length)]
-		}
-	}
-
-	// 解析报文体字段
-	for _, field := range format.Body {
-		value, newOffset, err := parseField(decodedData, currentOffset, field)
-		if err != nil {
-			return models.ParseResult{Success: false, Error: "Failed to parse body field '" + field.Name + "': " + err.Error()}, err
-		}
-		result.Fields[field.Name] = value
-		currentOffset = newOffset
-	}
-
-	// 解析报文尾字段
-	for _, field := range format.Footer {
-		value, newOffset, err := parseField(decodedData, currentOffset, field)
-		if err != nil {
-			return models.ParseResult{Success: false, Error: "Failed to parse footer field '" + field.Name + "': " + err.Error()}, err
-		}
-		result.Fields[field.Name] = value
-		currentOffset = newOffset
-	}
-
-	// 解析校验和字段（如果存在）
-	if format.Checksum != nil {
-		checksumValue, _, err := parseField(decodedData, currentOffset, *format.Checksum)
-		if err != nil {
-			return models.ParseResult{Success: false, Error: "Failed to parse checksum field: " + err.Error()}, err
-		}
-		result.Fields[format.Checksum.Name] = checksumValue
-
-		// 验证校验和
-		if !validateChecksum(decodedData, currentOffset, *format.Checksum, checksumValue) {
-			result.Success = false
-			result.Error = "Checksum validation failed"
-			return result, nil
+		decoder := messageDecoder(config.Format)
+		if decoder.script != nil {
+			return decoder.DecodeWithMeta(rawData, scriptMeta(config, decoder.format.Encoding))
 		}
+		return decoder.Decode(rawData)
 	}
+}
 
-	return result, nil
+// parseMessageData 解析消息数据的辅助函数，格式编译结果按 Format 内容缓存
+func parseMessageData(formatStr, rawData string) (models.ParseResult, error) {
+	return messageDecoder(formatStr).Decode(rawData)
 }
 
-// parseField 解析单个字段
+// parseField 从 offset 处读取单个字段，返回字段值和下一个字段的偏移量
 func parseField(data []byte, offset int, field models.FieldDefinition) (interface{}, int, error) {
-	// 检查偏移量是否有效
-	if offset < 0 || offset >= len(data) {
-		return nil, offset, fmt.Errorf("invalid offset: %d", offset)
+	compiled := compileField(field)
+	value, newOffset, err := compiled.read(data, offset)
+	if err != nil {
+		return nil, newOffset, err
 	}
+	return compiled.value(value), newOffset, nil
+}
 
-	// 检查是否有足够的数据
-	if offset+field.Length > len(data) {
-		return nil, offset, fmt.Errorf("insufficient data for field '%s' (need %d bytes, have %d)", field.Name, field.Length, len(data)-offset)
+// scaleFieldValue 按字段的缩放系数换算数值(如厂商协议中 0.1℃/LSB)，未设置缩放系数或非数值时原样返回
+func scaleFieldValue(value interface{}, field models.FieldDefinition) interface{} {
+	if field.Scale == 0 || field.Scale == 1 {
+		return value
 	}
-
-	fieldData := data[offset : offset+field.Length]
-	newOffset := offset + field.Length
-
-	switch field.Type {
-	case "int8":
-		value := int8(fieldData[0])
-		if !field.Signed {
-			value = int8(uint8(fieldData[0]))
-		}
-		return value, newOffset, nil
-
-	case "uint8":
-		return uint8(fieldData[0]), newOffset, nil
-
-	case "int16":
-		var value int16
-		if field.Endian == "big" {
-			value = int16(binary.BigEndian.Uint16(fieldData))
-		} else {
-			value = int16(binary.LittleEndian.Uint16(fieldData))
-		}
-		if !field.Signed {
-			if field.Endian == "big" {
-				value = int16(binary.BigEndian.Uint16(fieldData))
-			} else {
-				value = int16(binary.LittleEndian.Uint16(fieldData))
-			}
-		} else {
-			// For signed values, we need to handle two's complement
-			if field.Endian == "big" {
-				value = int16(binary.BigEndian.Uint16(fieldData))
-			} else {
-				value = int16(binary.LittleEndian.Uint16(fieldData))
-			}
-		}
-		return value, newOffset, nil
-
-	case "uint16":
-		if field.Endian == "big" {
-			return binary.BigEndian.Uint16(fieldData), newOffset, nil
-		}
-		return binary.LittleEndian.Uint16(fieldData), newOffset, nil
-
-	case "int32":
-		var value int32
-		if field.Endian == "big" {
-			value = int32(binary.BigEndian.Uint32(fieldData))
-		} else {
-			value = int32(binary.LittleEndian.Uint32(fieldData))
-		}
-		if !field.Signed {
-			if field.Endian == "big" {
-				value = int32(binary.BigEndian.Uint32(fieldData))
-			} else {
-				value = int32(binary.LittleEndian.Uint32(fieldData))
-			}
-		} else {
-			// For signed values, we need to handle two's complement
-			if field.Endian == "big" {
-				value = int32(binary.BigEndian.Uint32(fieldData))
-			} else {
-				value = int32(binary.LittleEndian.Uint32(fieldData))
-			}
-		}
-		return value, newOffset, nil
-
-	case "uint32":
-		if field.Endian == "big" {
-			return binary.BigEndian.Uint32(fieldData), newOffset, nil
-		}
-		return binary.LittleEndian.Uint32(fieldData), newOffset, nil
-
-	case "float32":
-		var bits uint32
-		if field.Endian == "big" {
-			bits = binary.BigEndian.Uint32(fieldData)
-		} else {
-			bits = binary.LittleEndian.Uint32(fieldData)
-		}
-		value := math.Float32frombits(bits)
-		if field.Decimals > 0 {
-			// 应用小数位数
-			value = float32(int64(value*float32(math.Pow10(field.Decimals)))) / float32(math.Pow10(field.Decimals))
-		}
-		return value, newOffset, nil
-
-	case "float64":
-		var bits uint64
-		if field.Endian == "big" {
-			bits = binary.BigEndian.Uint64(fieldData)
-		} else {
-			bits = binary.LittleEndian.Uint64(fieldData)
-		}
-		value := math.Float64frombits(bits)
-		if field.Decimals > 0 {
-			// 应用小数位数
-			value = float64(int64(value*math.Pow10(field.Decimals))) / math.Pow10(field.Decimals)
-		}
-		return value, newOffset, nil
-
-	case "string":
-		// 去除字符串末尾的空字符
-		str := string(fieldData)
-		// 找到第一个空字符
-		if idx := strings.IndexByte(str, 0); idx != -1 {
-			str = str[:idx]
-		}
-
-		return strings.TrimSpace(str), newOffset, nil
-
-	case "bytes":
-		return fieldData, newOffset, nil
-
-	default:
-		return nil, newOffset, fmt.Errorf("unsupported field type: %s", field.Type)
+	number, ok := numericFloat(value)
+	if !ok {
+		return value
 	}
+	scaled := number * field.Scale
+	if field.Decimals > 0 {
+		// 应用小数位数
+		scaled = math.Round(scaled*math.Pow10(field.Decimals)) / math.Pow10(field.Decimals)
+	}
+	return scaled
 }
 
 // validateChecksum 验证校验和
@@ -536,13 +402,11 @@ func calculateChecksum32(data []byte) uint32 {
 func GetDefaultMessageTypeConfig(c *gin.Context) {
 	userID := c.MustGet("userID").(uint)
 
-	var config models.MessageTypeConfig
-	if err := database.DB.Where("user_id = ? AND is_default = ?", userID, true).First(&config).Error; err != nil {
-		// 如果没有默认配置，返回第一个配置
-		if err := database.DB.Where("user_id = ?", userID).First(&config).Error; err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": "No message type config found"})
-			return
-		}
+	// 如果没有默认配置，返回第一个配置
+	config, err := defaultMessageConfig(userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No message type config found"})
+		return
 	}
 
 	c.JSON(http.StatusOK, config)
@@ -552,6 +416,7 @@ func GetDefaultMessageTypeConfig(c *gin.Context) {
 func TestMessageFormat(c *gin.Context) {
 
 	var input struct {
+		Protocol string          `json:"protocol"`
 		Format   json.RawMessage `json:"format" binding:"required"`
 		TestData string          `json:"test_data" binding:"required"`
 	}
@@ -569,7 +434,8 @@ func TestMessageFormat(c *gin.Context) {
 	}
 
 	// 测试解析
-	result, err := parseMessageData(string(input.Format), input.TestData)
+	config := models.MessageTypeConfig{Protocol: input.Protocol, Format: string(input.Format)}
+	result, err := parseWithConfig(config, input.TestData)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -625,7 +491,14 @@ func CreateGeoConfig(c *gin.Context) {
 		IsDefault:   true,
 	}
 
-	if err := database.DB.Create(&config).Error; err != nil {
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&config).Error; err != nil {
+			return err
+		}
+		_, err := recordConfigVersion(tx, &config, userID, "", 0)
+		return err
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create message type config"})
 		return
 	}
@@ -0,0 +1,575 @@
+package controllers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+// Modbus 帧格式
+const (
+	ModbusModeRTU = "rtu" // DTU 透传 RTU 帧(带 CRC)
+	ModbusModeTCP = "tcp" // Modbus TCP(MBAP 报文头)
+)
+
+// Modbus 功能码
+const (
+	modbusReadHoldingRegisters = 0x03
+	modbusReadInputRegisters   = 0x04
+)
+
+const (
+	modbusMaxQuantity      = 125
+	modbusDefaultInterval  = 60
+	modbusDefaultTimeout   = 3000
+	modbusMinInterval      = 1
+	modbusRegistrationSize = 64
+)
+
+// ModbusRegisterTimeout DTU 建立连接后发送注册包的超时时间
+const ModbusRegisterTimeout = 30 * time.Second
+
+// modbusExceptions Modbus 异常码说明
+var modbusExceptions = map[uint8]string{
+	0x01: "illegal function",
+	0x02: "illegal data address",
+	0x03: "illegal data value",
+	0x04: "slave device failure",
+	0x05: "acknowledge",
+	0x06: "slave device busy",
+	0x0A: "gateway path unavailable",
+	0x0B: "gateway target device failed to respond",
+}
+
+// ModbusException 从站返回的异常响应
+type ModbusException struct {
+	Function uint8
+	Code     uint8
+}
+
+func (e *ModbusException) Error() string {
+	if desc, ok := modbusExceptions[e.Code]; ok {
+		return fmt.Sprintf("modbus exception 0x%02x on function 0x%02x: %s", e.Code, e.Function, desc)
+	}
+	return fmt.Sprintf("modbus exception 0x%02x on function 0x%02x", e.Code, e.Function)
+}
+
+// modbusCRC16 计算 Modbus RTU CRC16(多项式 0xA001，初值 0xFFFF)
+func modbusCRC16(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&0x0001 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// encodeModbusReadPDU 构造读寄存器请求 PDU
+func encodeModbusReadPDU(function uint8, address, quantity uint16) []byte {
+	pdu := make([]byte, 5)
+	pdu[0] = function
+	binary.BigEndian.PutUint16(pdu[1:3], address)
+	binary.BigEndian.PutUint16(pdu[3:5], quantity)
+	return pdu
+}
+
+// encodeModbusRTUFrame 构造 RTU 帧: 从站地址 + PDU + CRC(低字节在前)
+func encodeModbusRTUFrame(slaveID uint8, pdu []byte) []byte {
+	frame := append([]byte{slaveID}, pdu...)
+	crc := modbusCRC16(frame)
+	return append(frame, byte(crc), byte(crc>>8))
+}
+
+// encodeModbusTCPFrame 构造 Modbus TCP 帧: MBAP(事务号、协议号0、长度、单元标识) + PDU
+func encodeModbusTCPFrame(transactionID uint16, unitID uint8, pdu []byte) []byte {
+	frame := make([]byte, 7, 7+len(pdu))
+	binary.BigEndian.PutUint16(frame[0:2], transactionID)
+	binary.BigEndian.PutUint16(frame[4:6], uint16(len(pdu)+1))
+	frame[6] = unitID
+	return append(frame, pdu...)
+}
+
+// decodeModbusReadPDU 校验读寄存器响应 PDU 并返回寄存器数据
+func decodeModbusReadPDU(pdu []byte, function uint8, quantity uint16) ([]byte, error) {
+	if len(pdu) < 2 {
+		return nil, fmt.Errorf("response too short: %d bytes", len(pdu))
+	}
+	if pdu[0] == function|0x80 {
+		return nil, &ModbusException{Function: function, Code: pdu[1]}
+	}
+	if pdu[0] != function {
+		return nil, fmt.Errorf("unexpected function code 0x%02x, expected 0x%02x", pdu[0], function)
+	}
+
+	count := int(pdu[1])
+	if count != int(quantity)*2 || len(pdu) != 2+count {
+		return nil, fmt.Errorf("unexpected byte count %d for %d registers", count, quantity)
+	}
+	return pdu[2:], nil
+}
+
+// readModbusRTUResponse 从连接读取一个 RTU 响应帧，返回去掉地址和 CRC 的 PDU
+func readModbusRTUResponse(r *bufio.Reader, slaveID uint8) ([]byte, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != slaveID {
+		return nil, fmt.Errorf("unexpected slave ID %d, expected %d", header[0], slaveID)
+	}
+
+	// 异常响应: 地址 + 功能码|0x80 + 异常码 + CRC；正常响应: 地址 + 功能码 + 字节数 + 数据 + CRC
+	remaining := 2
+	if header[1]&0x80 == 0 {
+		remaining += int(header[2])
+	}
+	frame := make([]byte, 3+remaining)
+	copy(frame, header)
+	if _, err := io.ReadFull(r, frame[3:]); err != nil {
+		return nil, err
+	}
+
+	crc := modbusCRC16(frame[:len(frame)-2])
+	if binary.LittleEndian.Uint16(frame[len(frame)-2:]) != crc {
+		return nil, fmt.Errorf("CRC mismatch")
+	}
+	return frame[1 : len(frame)-2], nil
+}
+
+// readModbusTCPResponse 从连接读取一个 Modbus TCP 响应帧，返回事务号和 PDU
+func readModbusTCPResponse(r *bufio.Reader) (uint16, []byte, error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	if protocol := binary.BigEndian.Uint16(header[2:4]); protocol != 0 {
+		return 0, nil, fmt.Errorf("unexpected protocol ID %d", protocol)
+	}
+	length := int(binary.BigEndian.Uint16(header[4:6]))
+	if length < 2 || length > 254 {
+		return 0, nil, fmt.Errorf("invalid MBAP length %d", length)
+	}
+
+	pdu := make([]byte, length-1)
+	if _, err := io.ReadFull(r, pdu); err != nil {
+		return 0, nil, err
+	}
+	return binary.BigEndian.Uint16(header[0:2]), pdu, nil
+}
+
+// parseModbusBlocks 解析并校验寄存器块配置
+func parseModbusBlocks(blocksJSON string) ([]models.ModbusRegisterBlock, error) {
+	var blocks []models.ModbusRegisterBlock
+	if blocksJSON == "" {
+		return blocks, nil
+	}
+	if err := json.Unmarshal([]byte(blocksJSON), &blocks); err != nil {
+		return nil, fmt.Errorf("invalid blocks JSON: %v", err)
+	}
+
+	for i, block := range blocks {
+		if block.Function != modbusReadHoldingRegisters && block.Function != modbusReadInputRegisters {
+			return nil, fmt.Errorf("block %d: unsupported function code %d", i, block.Function)
+		}
+		if block.Quantity < 1 || block.Quantity > modbusMaxQuantity {
+			return nil, fmt.Errorf("block %d: quantity must be between 1 and %d", i, modbusMaxQuantity)
+		}
+		size := int(block.Quantity) * 2
+		for _, field := range block.Fields {
+			if field.Offset < 0 || field.Length <= 0 || field.Offset+field.Length > size {
+				return nil, fmt.Errorf("block %d: field '%s' is outside the %d register bytes", i, field.Name, size)
+			}
+		}
+	}
+	return blocks, nil
+}
+
+// decodeModbusBlock 按字段定义将寄存器数据映射为字段，类型与缩放规则与报文字段一致
+func decodeModbusBlock(block models.ModbusRegisterBlock, data []byte, fields map[string]interface{}) error {
+	for _, field := range block.Fields {
+		value, _, err := parseField(data, field.Offset, field)
+		if err != nil {
+			return fmt.Errorf("failed to parse field '%s': %v", field.Name, err)
+		}
+		fields[field.Name] = scaleFieldValue(value, field)
+	}
+	return nil
+}
+
+// ModbusSession 单个 DTU/Modbus TCP 连接，由服务器主动发起轮询
+type ModbusSession struct {
+	conn          net.Conn
+	reader        *bufio.Reader
+	mu            sync.Mutex
+	config        models.ModbusDevice
+	transactionID uint16
+	closed        chan struct{}
+	closeOnce     sync.Once
+}
+
+var (
+	modbusSessionsMu sync.Mutex
+	modbusSessions   = make(map[uint]*ModbusSession)
+)
+
+// NewModbusSession 创建会话
+func NewModbusSession(conn net.Conn) *ModbusSession {
+	return &ModbusSession{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// Register 读取 DTU 注册包并匹配 Modbus 设备配置
+func (s *ModbusSession) Register() error {
+	s.conn.SetReadDeadline(time.Now().Add(ModbusRegisterTimeout))
+	buffer := make([]byte, modbusRegistrationSize)
+	n, err := s.conn.Read(buffer)
+	if err != nil {
+		return fmt.Errorf("failed to read registration packet: %v", err)
+	}
+
+	registration := strings.TrimSpace(string(buffer[:n]))
+	var config models.ModbusDevice
+	if err := database.DB.Where("(registration_id = ? OR registration_id = ?) AND enabled = ?",
+		registration, hex.EncodeToString(buffer[:n]), true).First(&config).Error; err != nil {
+		return fmt.Errorf("unknown registration packet %q", registration)
+	}
+	s.config = config
+
+	modbusSessionsMu.Lock()
+	if previous, ok := modbusSessions[config.DeviceID]; ok {
+		previous.Close()
+	}
+	modbusSessions[config.DeviceID] = s
+	modbusSessionsMu.Unlock()
+
+	return nil
+}
+
+// Close 关闭连接并从会话表中移除
+func (s *ModbusSession) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.conn.Close()
+
+		modbusSessionsMu.Lock()
+		if modbusSessions[s.config.DeviceID] == s {
+			delete(modbusSessions, s.config.DeviceID)
+		}
+		modbusSessionsMu.Unlock()
+	})
+}
+
+// Run 按配置的间隔轮询，直到连接断开
+func (s *ModbusSession) Run() {
+	defer s.Close()
+
+	for {
+		if _, err := s.Poll(); err != nil {
+			fmt.Printf("Error polling Modbus device %d: %v\n", s.config.DeviceID, err)
+			// 从站响应超时或报文错误时保留连接，连接断开时退出
+			var netErr net.Error
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || (errors.As(err, &netErr) && !netErr.Timeout()) {
+				return
+			}
+		}
+
+		interval := s.config.Interval
+		if interval < modbusMinInterval {
+			interval = modbusDefaultInterval
+		}
+		timer := time.NewTimer(time.Duration(interval) * time.Second)
+		select {
+		case <-timer.C:
+		case <-s.closed:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// ReadRegisters 发送读寄存器请求并等待响应
+func (s *ModbusSession) ReadRegisters(function uint8, address, quantity uint16) ([]byte, error) {
+	timeout := s.config.Timeout
+	if timeout <= 0 {
+		timeout = modbusDefaultTimeout
+	}
+
+	// 丢弃上次轮询后收到的心跳等残留数据
+	s.reader.Discard(s.reader.Buffered())
+
+	pdu := encodeModbusReadPDU(function, address, quantity)
+	var frame []byte
+	if s.config.Mode == ModbusModeTCP {
+		s.transactionID++
+		frame = encodeModbusTCPFrame(s.transactionID, s.config.SlaveID, pdu)
+	} else {
+		frame = encodeModbusRTUFrame(s.config.SlaveID, pdu)
+	}
+
+	deadline := time.Now().Add(time.Duration(timeout) * time.Millisecond)
+	s.conn.SetWriteDeadline(deadline)
+	if _, err := s.conn.Write(frame); err != nil {
+		return nil, err
+	}
+
+	s.conn.SetReadDeadline(deadline)
+	for {
+		if err := s.skipHeartbeat(); err != nil {
+			return nil, err
+		}
+
+		if s.config.Mode == ModbusModeTCP {
+			transactionID, response, err := readModbusTCPResponse(s.reader)
+			if err != nil {
+				return nil, err
+			}
+			// 忽略超时请求的迟到响应
+			if transactionID != s.transactionID {
+				continue
+			}
+			return decodeModbusReadPDU(response, function, quantity)
+		}
+
+		response, err := readModbusRTUResponse(s.reader, s.config.SlaveID)
+		if err != nil {
+			return nil, err
+		}
+		return decodeModbusReadPDU(response, function, quantity)
+	}
+}
+
+// skipHeartbeat 跳过 DTU 插入在响应前的心跳包
+func (s *ModbusSession) skipHeartbeat() error {
+	heartbeat := []byte(s.config.Heartbeat)
+	if len(heartbeat) == 0 {
+		return nil
+	}
+	for {
+		peek, err := s.reader.Peek(len(heartbeat))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(peek, heartbeat) {
+			return nil
+		}
+		s.reader.Discard(len(heartbeat))
+	}
+}
+
+// Poll 读取所有寄存器块，映射字段后写入设备遥测数据
+func (s *ModbusSession) Poll() (map[string]interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 每次轮询重新加载配置，使接口修改的配置立即生效
+	if err := database.DB.First(&s.config, s.config.ID).Error; err != nil {
+		return nil, fmt.Errorf("modbus config not found: %v", err)
+	}
+	blocks, err := parseModbusBlocks(s.config.Blocks)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]interface{})
+	var raw []string
+	pollErr := func() error {
+		for _, block := range blocks {
+			data, err := s.ReadRegisters(block.Function, block.Address, block.Quantity)
+			if err != nil {
+				return err
+			}
+			if err := decodeModbusBlock(block, data, fields); err != nil {
+				return err
+			}
+			raw = append(raw, fmt.Sprintf("%02x@%d:%s", block.Function, block.Address, hex.EncodeToString(data)))
+		}
+		return nil
+	}()
+
+	updates := map[string]interface{}{"last_poll_at": time.Now().Unix(), "last_error": ""}
+	if pollErr != nil {
+		updates["last_error"] = pollErr.Error()
+	}
+	database.DB.Model(&models.ModbusDevice{}).Where("id = ?", s.config.ID).Updates(updates)
+	if pollErr != nil {
+		return nil, pollErr
+	}
+	if len(blocks) == 0 {
+		return fields, nil
+	}
+
+	var device models.Device
+	if err := database.DB.First(&device, s.config.DeviceID).Error; err != nil {
+		return nil, fmt.Errorf("device %d not found", s.config.DeviceID)
+	}
+	telemetry := &models.Telemetry{Source: "modbus", RawData: strings.Join(raw, " ")}
+	if err := storeDeviceTelemetry(&device, telemetry, fields); err != nil {
+		return nil, err
+	}
+
+	return fields, nil
+}
+
+// ServeModbusConnection 处理 DTU/Modbus TCP 连接: 识别注册包后按计划轮询
+func ServeModbusConnection(conn net.Conn) error {
+	session := NewModbusSession(conn)
+	if err := session.Register(); err != nil {
+		return err
+	}
+	session.Run()
+	return nil
+}
+
+// findModbusSession 获取设备当前的 Modbus 连接
+func findModbusSession(deviceID uint) (*ModbusSession, bool) {
+	modbusSessionsMu.Lock()
+	defer modbusSessionsMu.Unlock()
+	session, ok := modbusSessions[deviceID]
+	return session, ok
+}
+
+// GetModbusConfig 获取设备的 Modbus 轮询配置及连接状态
+func GetModbusConfig(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	id := c.Param("id")
+
+	var device models.Device
+	if err := database.DB.Where("id = ? AND user_id = ?", id, userID).First(&device).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	var config models.ModbusDevice
+	if err := database.DB.Where("device_id = ?", device.ID).First(&config).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Modbus config not found"})
+		return
+	}
+
+	_, connected := findModbusSession(device.ID)
+	c.JSON(http.StatusOK, gin.H{"data": config, "connected": connected})
+}
+
+// SaveModbusConfig 创建或更新设备的 Modbus 轮询配置
+func SaveModbusConfig(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	id := c.Param("id")
+
+	var device models.Device
+	if err := database.DB.Where("id = ? AND user_id = ?", id, userID).First(&device).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	var input struct {
+		RegistrationID string `json:"registration_id" binding:"required"`
+		Heartbeat      string `json:"heartbeat"`
+		Mode           string `json:"mode"`
+		SlaveID        uint8  `json:"slave_id"`
+		Interval       int    `json:"interval"`
+		Timeout        int    `json:"timeout"`
+		Blocks         string `json:"blocks" binding:"required"`
+		Enabled        *bool  `json:"enabled"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if input.Mode == "" {
+		input.Mode = ModbusModeRTU
+	}
+	if input.Mode != ModbusModeRTU && input.Mode != ModbusModeTCP {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "mode must be rtu or tcp"})
+		return
+	}
+	if input.Interval == 0 {
+		input.Interval = modbusDefaultInterval
+	}
+	if input.Interval < modbusMinInterval {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "interval must be positive"})
+		return
+	}
+	if input.Timeout == 0 {
+		input.Timeout = modbusDefaultTimeout
+	}
+	if _, err := parseModbusBlocks(input.Blocks); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var config models.ModbusDevice
+	if err := database.DB.Where("device_id = ?", device.ID).First(&config).Error; err != nil {
+		config = models.ModbusDevice{DeviceID: device.ID, Enabled: true}
+	}
+	config.RegistrationID = input.RegistrationID
+	config.Heartbeat = input.Heartbeat
+	config.Mode = input.Mode
+	config.SlaveID = input.SlaveID
+	config.Interval = input.Interval
+	config.Timeout = input.Timeout
+	config.Blocks = input.Blocks
+	if input.Enabled != nil {
+		config.Enabled = *input.Enabled
+	}
+
+	if err := database.DB.Save(&config).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save Modbus config"})
+		return
+	}
+
+	// 停用时断开当前连接
+	if session, ok := findModbusSession(device.ID); ok && !config.Enabled {
+		session.Close()
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": config})
+}
+
+// PollModbusDevice 立即轮询设备并返回读取到的字段
+func PollModbusDevice(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	id := c.Param("id")
+
+	var device models.Device
+	if err := database.DB.Where("id = ? AND user_id = ?", id, userID).First(&device).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	session, ok := findModbusSession(device.ID)
+	if !ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "Device is not connected"})
+		return
+	}
+
+	fields, err := session.Poll()
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": fields})
+}
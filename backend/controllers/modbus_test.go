@@ -0,0 +1,203 @@
+package controllers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+func TestModbusRTUFrame(t *testing.T) {
+	frame := encodeModbusRTUFrame(0x01, encodeModbusReadPDU(modbusReadHoldingRegisters, 0x0000, 0x000A))
+	expected := []byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x0A, 0xC5, 0xCD}
+	if !bytes.Equal(frame, expected) {
+		t.Errorf("Expected %x, got %x", expected, frame)
+	}
+}
+
+func TestModbusTCPFrame(t *testing.T) {
+	frame := encodeModbusTCPFrame(0x0102, 0x11, encodeModbusReadPDU(modbusReadInputRegisters, 0x0008, 0x0002))
+	expected := []byte{0x01, 0x02, 0x00, 0x00, 0x00, 0x06, 0x11, 0x04, 0x00, 0x08, 0x00, 0x02}
+	if !bytes.Equal(frame, expected) {
+		t.Errorf("Expected %x, got %x", expected, frame)
+	}
+}
+
+func TestReadModbusRTUResponse(t *testing.T) {
+	t.Run("Register data", func(t *testing.T) {
+		response := []byte{0x01, 0x03, 0x04, 0x00, 0xEB, 0xFF, 0x38}
+		crc := modbusCRC16(response)
+		response = append(response, byte(crc), byte(crc>>8))
+
+		pdu, err := readModbusRTUResponse(bufio.NewReader(bytes.NewReader(response)), 0x01)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		data, err := decodeModbusReadPDU(pdu, modbusReadHoldingRegisters, 2)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !bytes.Equal(data, []byte{0x00, 0xEB, 0xFF, 0x38}) {
+			t.Errorf("Unexpected register data %x", data)
+		}
+	})
+
+	t.Run("Exception response", func(t *testing.T) {
+		response := []byte{0x01, 0x83, 0x02}
+		crc := modbusCRC16(response)
+		response = append(response, byte(crc), byte(crc>>8))
+
+		pdu, err := readModbusRTUResponse(bufio.NewReader(bytes.NewReader(response)), 0x01)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		_, err = decodeModbusReadPDU(pdu, modbusReadHoldingRegisters, 2)
+		var exception *ModbusException
+		if !errors.As(err, &exception) || exception.Code != 0x02 {
+			t.Errorf("Expected illegal data address exception, got %v", err)
+		}
+	})
+
+	t.Run("CRC mismatch", func(t *testing.T) {
+		response := []byte{0x01, 0x03, 0x02, 0x00, 0x01, 0x00, 0x00}
+		if _, err := readModbusRTUResponse(bufio.NewReader(bytes.NewReader(response)), 0x01); err == nil {
+			t.Error("Expected error, but got none")
+		}
+	})
+}
+
+func TestParseModbusBlocks(t *testing.T) {
+	tests := []struct {
+		name    string
+		blocks  string
+		wantErr bool
+	}{
+		{name: "Valid holding and input blocks", blocks: `[{"function":3,"address":0,"quantity":2,"fields":[{"name":"t","type":"int16","offset":0,"length":2,"endian":"big"}]},{"function":4,"address":100,"quantity":1}]`},
+		{name: "Unsupported function", blocks: `[{"function":6,"address":0,"quantity":1}]`, wantErr: true},
+		{name: "Quantity too large", blocks: `[{"function":3,"address":0,"quantity":126}]`, wantErr: true},
+		{name: "Field outside block", blocks: `[{"function":3,"address":0,"quantity":1,"fields":[{"name":"v","type":"uint32","offset":0,"length":4}]}]`, wantErr: true},
+		{name: "Invalid JSON", blocks: `{`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseModbusBlocks(tt.blocks)
+			if tt.wantErr && err == nil {
+				t.Error("Expected error, but got none")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestDecodeModbusBlock(t *testing.T) {
+	block := models.ModbusRegisterBlock{
+		Function: modbusReadInputRegisters,
+		Address:  0,
+		Quantity: 4,
+		Fields: []models.FieldDefinition{
+			{Name: "temperature", Type: "int16", Offset: 0, Length: 2, Endian: "big", Signed: true},
+			{Name: "humidity", Type: "uint16", Offset: 2, Length: 2, Endian: "big"},
+			{Name: "flow", Type: "float32", Offset: 4, Length: 4, Endian: "big", Decimals: 2},
+		},
+	}
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint16(data[0:2], 0xFF38) // -200
+	binary.BigEndian.PutUint16(data[2:4], 655)
+	binary.BigEndian.PutUint32(data[4:8], 0x41460000) // 12.375
+
+	fields := make(map[string]interface{})
+	if err := decodeModbusBlock(block, data, fields); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if fields["temperature"] != int16(-200) {
+		t.Errorf("Expected temperature -200, got %v", fields["temperature"])
+	}
+	if fields["humidity"] != uint16(655) {
+		t.Errorf("Expected humidity 655, got %v", fields["humidity"])
+	}
+	if fields["flow"] != float32(12.37) {
+		t.Errorf("Expected flow 12.37, got %v", fields["flow"])
+	}
+}
+
+func TestModbusSessionReadRegisters(t *testing.T) {
+	t.Run("RTU with DTU heartbeat", func(t *testing.T) {
+		server, client := net.Pipe()
+		defer server.Close()
+		defer client.Close()
+
+		session := NewModbusSession(server)
+		session.config = models.ModbusDevice{Mode: ModbusModeRTU, SlaveID: 0x02, Heartbeat: "HB", Timeout: 1000}
+
+		go func() {
+			request := make([]byte, 8)
+			io.ReadFull(client, request)
+			response := []byte{0x02, 0x03, 0x02, 0x12, 0x34}
+			crc := modbusCRC16(response)
+			client.Write(append(append([]byte("HB"), response...), byte(crc), byte(crc>>8)))
+		}()
+
+		data, err := session.ReadRegisters(modbusReadHoldingRegisters, 0x0010, 1)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !bytes.Equal(data, []byte{0x12, 0x34}) {
+			t.Errorf("Unexpected register data %x", data)
+		}
+	})
+
+	t.Run("TCP skips stale transaction", func(t *testing.T) {
+		server, client := net.Pipe()
+		defer server.Close()
+		defer client.Close()
+
+		session := NewModbusSession(server)
+		session.config = models.ModbusDevice{Mode: ModbusModeTCP, SlaveID: 0x01, Timeout: 1000}
+		session.transactionID = 4
+
+		go func() {
+			request := make([]byte, 12)
+			io.ReadFull(client, request)
+			stale := encodeModbusTCPFrame(4, 0x01, []byte{0x04, 0x02, 0x00, 0x00})
+			current := encodeModbusTCPFrame(binary.BigEndian.Uint16(request[0:2]), 0x01, []byte{0x04, 0x02, 0xAB, 0xCD})
+			client.Write(append(stale, current...))
+		}()
+
+		data, err := session.ReadRegisters(modbusReadInputRegisters, 0, 1)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !bytes.Equal(data, []byte{0xAB, 0xCD}) {
+			t.Errorf("Unexpected register data %x", data)
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		server, client := net.Pipe()
+		defer server.Close()
+		defer client.Close()
+
+		session := NewModbusSession(server)
+		session.config = models.ModbusDevice{Mode: ModbusModeRTU, SlaveID: 0x01, Timeout: 50}
+		go io.Copy(io.Discard, client)
+
+		start := time.Now()
+		_, err := session.ReadRegisters(modbusReadHoldingRegisters, 0, 1)
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Errorf("Expected timeout error, got %v", err)
+		}
+		if time.Since(start) > time.Second {
+			t.Errorf("Timeout took too long: %v", time.Since(start))
+		}
+	})
+}
@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+	"github.com/liang/mqtt-app/backend/mqtt"
+)
+
+// mqttIngestSubscriptions 数据接入当前订阅的主题及其取消函数
+var (
+	mqttIngestMu            sync.Mutex
+	mqttIngestSubscriptions = make(map[string]func())
+)
+
+// mqttIngestTopics 需要接入的主题: 匹配设备所有者主题绑定模式的设备主题，以及绑定了配置的设备(含设备组绑定)的主题。
+// 只订阅各用户已有设备的具体主题，绑定模式本身不订阅，避免一个用户的 # 等模式接入整个服务器的消息
+func mqttIngestTopics() map[string]bool {
+	topics := make(map[string]bool)
+
+	var bindings []models.TopicConfigBinding
+	database.DB.Select("user_id", "pattern").Find(&bindings)
+	patterns := make(map[uint][]string)
+	for _, binding := range bindings {
+		patterns[binding.UserID] = append(patterns[binding.UserID], binding.Pattern)
+	}
+	if len(patterns) > 0 {
+		userIDs := make([]uint, 0, len(patterns))
+		for userID := range patterns {
+			userIDs = append(userIDs, userID)
+		}
+		var devices []models.Device
+		database.DB.Select("topic", "user_id").Where("user_id IN ?", userIDs).Find(&devices)
+		for _, device := range devices {
+			for _, pattern := range patterns[device.UserID] {
+				if mqttTopicMatch(pattern, device.Topic) {
+					topics[device.Topic] = true
+					break
+				}
+			}
+		}
+	}
+
+	var deviceTopics []string
+	database.DB.Model(&models.Device{}).
+		Joins("LEFT JOIN device_groups ON device_groups.id = devices.group_id").
+		Where("devices.message_type_config_id IS NOT NULL OR device_groups.message_type_config_id IS NOT NULL").
+		Pluck("devices.topic", &deviceTopics)
+	for _, topic := range deviceTopics {
+		topics[topic] = true
+	}
+
+	// 设备主题中的通配符会订阅到其他设备的消息
+	for topic := range topics {
+		if strings.ContainsAny(topic, "+#") {
+			delete(topics, topic)
+		}
+	}
+	return topics
+}
+
+// refreshMQTTIngestion 按当前绑定增减数据接入的 MQTT 订阅
+func refreshMQTTIngestion() {
+	if mqtt.Client == nil || database.DB == nil {
+		return
+	}
+
+	mqttIngestMu.Lock()
+	defer mqttIngestMu.Unlock()
+
+	topics := mqttIngestTopics()
+	for topic, unsubscribe := range mqttIngestSubscriptions {
+		if !topics[topic] {
+			unsubscribe()
+			delete(mqttIngestSubscriptions, topic)
+		}
+	}
+	for topic := range topics {
+		if _, ok := mqttIngestSubscriptions[topic]; ok {
+			continue
+		}
+		unsubscribe, err := mqtt.Subscribe(topic, handleMQTTIngestMessage)
+		if err != nil {
+			log.Printf("Failed to subscribe to ingestion topic %s: %v", topic, err)
+			continue
+		}
+		mqttIngestSubscriptions[topic] = unsubscribe
+	}
+}
+
+// StartMQTTIngestion 启动 MQTT 数据接入，订阅已绑定解析配置的主题
+func StartMQTTIngestion() {
+	refreshMQTTIngestion()
+}
+
+// handleMQTTIngestMessage MQTT 消息处理函数
+func handleMQTTIngestMessage(client MQTT.Client, msg MQTT.Message) {
+	if err := ingestMQTTMessage(msg.Topic(), msg.Payload()); err != nil {
+		log.Printf("Error ingesting MQTT message from topic %s: %v", msg.Topic(), err)
+	}
+}
+
+// ingestMQTTMessage 按主题查找设备，使用设备/主题/设备组绑定的配置解析并保存遥测数据，
+// 未知设备的消息直接丢弃
+func ingestMQTTMessage(topic string, payload []byte) (err error) {
+	capture := topicCapture(topic)
+	defer func() {
+		capture.record(models.CaptureTransportMQTT, models.CaptureDirectionIn, topic, payload, errorNote(err))
+	}()
+
+	device, err := findDeviceByTopic(topic)
+	if err != nil {
+		return err
+	}
+	if capture == nil {
+		capture = deviceCapture(device.ID)
+	}
+
+	config, _, err := resolveMessageConfig(device, topic)
+	if err != nil {
+		return err
+	}
+
+	if _, err := ingestPayloadWithConfig(device, config, payload, &models.Telemetry{Source: "mqtt"}); err != nil {
+		return fmt.Errorf("failed to ingest payload for device %s: %v", device.Topic, err)
+	}
+	return nil
+}
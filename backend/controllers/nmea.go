@@ -0,0 +1,415 @@
+package controllers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+// ProtocolNMEA NMEA 0183 协议，MessageTypeConfig.Protocol 取该值时使用内置 NMEA 解析
+const ProtocolNMEA = "nmea"
+
+// knotsToKmh 节转换为公里/小时
+const knotsToKmh = 1.852
+
+// NMEAFix 由一组 NMEA 语句(RMC/GGA/GSA)合并得到的定位结果
+type NMEAFix struct {
+	Date        string  // 日期 yyyy-mm-dd (RMC)
+	Time        string  // UTC时间 hh:mm:ss (RMC/GGA)
+	Valid       bool    // 定位是否有效 (RMC状态A 或 GGA定位质量>0)
+	HasPosition bool    // 是否包含经纬度
+	Latitude    float64 // 纬度, 南纬为负
+	Longitude   float64 // 经度, 西经为负
+	Altitude    float64 // 海拔高度(米, GGA)
+	SpeedKnots  float64 // 速度(节, RMC)
+	Course      float64 // 航向(度, RMC)
+	FixQuality  int     // 定位质量 (GGA): 0=无效 1=GPS 2=差分 4=RTK固定 5=RTK浮点
+	FixType     int     // 定位类型 (GSA): 1=无 2=2D 3=3D
+	Satellites  int     // 使用卫星数 (GGA)
+	HDOP        float64 // 水平精度因子
+	PDOP        float64 // 位置精度因子 (GSA)
+	VDOP        float64 // 垂直精度因子 (GSA)
+	Sentences   []string
+}
+
+// Speed 返回速度(km/h)
+func (f *NMEAFix) Speed() float64 {
+	return f.SpeedKnots * knotsToKmh
+}
+
+// DateTime 返回 yyyy-mm-dd hh:mm:ss 格式的时间，缺少日期时只返回时间
+func (f *NMEAFix) DateTime() string {
+	if f.Date == "" {
+		return f.Time
+	}
+	return f.Date + " " + f.Time
+}
+
+// Timestamp 返回定位时间的 Unix 时间戳，缺少日期或时间时返回 0
+func (f *NMEAFix) Timestamp() int64 {
+	if f.Date == "" || f.Time == "" {
+		return 0
+	}
+	t, err := time.Parse("2006-01-02 15:04:05", f.DateTime())
+	if err != nil {
+		return 0
+	}
+	return t.Unix()
+}
+
+// Fields 返回解析结果字段，字段名与 ContentData 的 ParsedData 保持一致
+func (f *NMEAFix) Fields() map[string]interface{} {
+	fields := map[string]interface{}{
+		"valid":     f.Valid,
+		"sentences": f.Sentences,
+	}
+	if dt := f.DateTime(); dt != "" {
+		fields["datetime"] = dt
+	}
+	if f.HasPosition {
+		fields["latitude"] = f.Latitude
+		fields["longitude"] = f.Longitude
+		fields["speed"] = f.Speed()
+		fields["speed_knots"] = f.SpeedKnots
+		fields["course"] = f.Course
+	}
+	if containsSentence(f.Sentences, "GGA") {
+		fields["altitude"] = f.Altitude
+		fields["fix_quality"] = f.FixQuality
+		fields["satellites"] = f.Satellites
+		fields["hdop"] = f.HDOP
+	}
+	if containsSentence(f.Sentences, "GSA") {
+		fields["fix_type"] = f.FixType
+		fields["pdop"] = f.PDOP
+		fields["hdop"] = f.HDOP
+		fields["vdop"] = f.VDOP
+	}
+	return fields
+}
+
+// containsSentence 判断是否解析过指定类型的语句
+func containsSentence(sentences []string, kind string) bool {
+	for _, s := range sentences {
+		if s == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// isNMEAPayload 判断数据是否为 NMEA 语句
+func isNMEAPayload(data []byte) bool {
+	trimmed := strings.TrimSpace(string(data))
+	return len(trimmed) > 6 && trimmed[0] == '$'
+}
+
+// parseNMEA 解析一条或多条 NMEA 语句(以换行分隔)，合并为一个定位结果
+// 不支持的语句类型会被忽略，校验和错误的语句返回错误
+func parseNMEA(raw string) (*NMEAFix, error) {
+	fix := &NMEAFix{}
+
+	for _, line := range strings.Split(raw, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		fields, err := splitNMEASentence(line)
+		if err != nil {
+			return nil, err
+		}
+
+		// 地址字段: 2位发送器标识(GP/GN/GL/BD/GB/GA) + 3位语句类型
+		address := fields[0]
+		if len(address) < 5 {
+			return nil, fmt.Errorf("invalid NMEA address: %s", address)
+		}
+		kind := address[len(address)-3:]
+
+		switch kind {
+		case "RMC":
+			err = parseNMEARMC(fields, fix)
+		case "GGA":
+			err = parseNMEAGGA(fields, fix)
+		case "GSA":
+			err = parseNMEAGSA(fields, fix)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", address, err)
+		}
+		fix.Sentences = append(fix.Sentences, kind)
+	}
+
+	if len(fix.Sentences) == 0 {
+		return nil, fmt.Errorf("no supported NMEA sentence found")
+	}
+
+	return fix, nil
+}
+
+// splitNMEASentence 校验 NMEA 语句的校验和并按逗号拆分字段
+func splitNMEASentence(sentence string) ([]string, error) {
+	if !strings.HasPrefix(sentence, "$") {
+		return nil, fmt.Errorf("NMEA sentence must start with '$'")
+	}
+
+	star := strings.LastIndexByte(sentence, '*')
+	if star == -1 || star+3 != len(sentence) {
+		return nil, fmt.Errorf("NMEA sentence missing checksum: %s", sentence)
+	}
+
+	body := sentence[1:star]
+	expected, err := strconv.ParseUint(sentence[star+1:], 16, 8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NMEA checksum: %s", sentence[star+1:])
+	}
+
+	var checksum uint8
+	for i := 0; i < len(body); i++ {
+		checksum ^= body[i]
+	}
+	if checksum != uint8(expected) {
+		return nil, fmt.Errorf("NMEA checksum mismatch: expected %02X, got %02X", expected, checksum)
+	}
+
+	return strings.Split(body, ","), nil
+}
+
+// parseNMEARMC 解析推荐最小定位信息
+// $GPRMC,hhmmss.ss,A,ddmm.mmmm,N,dddmm.mmmm,E,speed,course,ddmmyy,magvar,E,mode*hh
+func parseNMEARMC(fields []string, fix *NMEAFix) error {
+	if len(fields) < 10 {
+		return fmt.Errorf("too few fields: %d", len(fields))
+	}
+
+	if t, err := parseNMEATime(fields[1]); err != nil {
+		return err
+	} else if t != "" {
+		fix.Time = t
+	}
+	fix.Valid = fields[2] == "A"
+
+	if err := parseNMEAPosition(fields[3], fields[4], fields[5], fields[6], fix); err != nil {
+		return err
+	}
+
+	var err error
+	if fix.SpeedKnots, err = parseNMEAFloat(fields[7]); err != nil {
+		return fmt.Errorf("invalid speed: %v", err)
+	}
+	if fix.Course, err = parseNMEAFloat(fields[8]); err != nil {
+		return fmt.Errorf("invalid course: %v", err)
+	}
+
+	if fields[9] != "" {
+		date, err := time.Parse("020106", fields[9])
+		if err != nil {
+			return fmt.Errorf("invalid date: %s", fields[9])
+		}
+		fix.Date = date.Format("2006-01-02")
+	}
+
+	return nil
+}
+
+// parseNMEAGGA 解析定位数据
+// $GPGGA,hhmmss.ss,ddmm.mmmm,N,dddmm.mmmm,E,quality,satellites,hdop,altitude,M,geoid,M,age,station*hh
+func parseNMEAGGA(fields []string, fix *NMEAFix) error {
+	if len(fields) < 10 {
+		return fmt.Errorf("too few fields: %d", len(fields))
+	}
+
+	if t, err := parseNMEATime(fields[1]); err != nil {
+		return err
+	} else if t != "" {
+		fix.Time = t
+	}
+
+	if err := parseNMEAPosition(fields[2], fields[3], fields[4], fields[5], fix); err != nil {
+		return err
+	}
+
+	var err error
+	if fix.FixQuality, err = parseNMEAInt(fields[6]); err != nil {
+		return fmt.Errorf("invalid fix quality: %v", err)
+	}
+	if fix.FixQuality > 0 {
+		fix.Valid = true
+	}
+	if fix.Satellites, err = parseNMEAInt(fields[7]); err != nil {
+		return fmt.Errorf("invalid satellites: %v", err)
+	}
+	if fix.HDOP, err = parseNMEAFloat(fields[8]); err != nil {
+		return fmt.Errorf("invalid hdop: %v", err)
+	}
+	if fix.Altitude, err = parseNMEAFloat(fields[9]); err != nil {
+		return fmt.Errorf("invalid altitude: %v", err)
+	}
+
+	return nil
+}
+
+// parseNMEAGSA 解析精度因子及有效卫星
+// $GPGSA,mode,fixType,prn1,...,prn12,pdop,hdop,vdop*hh
+func parseNMEAGSA(fields []string, fix *NMEAFix) error {
+	if len(fields) < 18 {
+		return fmt.Errorf("too few fields: %d", len(fields))
+	}
+
+	var err error
+	if fix.FixType, err = parseNMEAInt(fields[2]); err != nil {
+		return fmt.Errorf("invalid fix type: %v", err)
+	}
+	if fix.PDOP, err = parseNMEAFloat(fields[15]); err != nil {
+		return fmt.Errorf("invalid pdop: %v", err)
+	}
+	if fix.HDOP, err = parseNMEAFloat(fields[16]); err != nil {
+		return fmt.Errorf("invalid hdop: %v", err)
+	}
+	// NMEA 4.1 在 VDOP 之后追加了系统标识，只取 VDOP 本身
+	if fix.VDOP, err = parseNMEAFloat(fields[17]); err != nil {
+		return fmt.Errorf("invalid vdop: %v", err)
+	}
+
+	return nil
+}
+
+// parseNMEAPosition 解析 ddmm.mmmm / dddmm.mmmm 格式的经纬度
+func parseNMEAPosition(lat, latHemi, lng, lngHemi string, fix *NMEAFix) error {
+	if lat == "" || lng == "" {
+		return nil
+	}
+
+	latitude, err := parseNMEACoordinate(lat, latHemi, "N", "S")
+	if err != nil {
+		return fmt.Errorf("invalid latitude: %v", err)
+	}
+	longitude, err := parseNMEACoordinate(lng, lngHemi, "E", "W")
+	if err != nil {
+		return fmt.Errorf("invalid longitude: %v", err)
+	}
+	if latitude < -90 || latitude > 90 || longitude < -180 || longitude > 180 {
+		return fmt.Errorf("position out of range: %f, %f", latitude, longitude)
+	}
+
+	fix.Latitude = latitude
+	fix.Longitude = longitude
+	fix.HasPosition = true
+	return nil
+}
+
+// parseNMEACoordinate 将度分格式转换为十进制度数
+func parseNMEACoordinate(value, hemisphere, positive, negative string) (float64, error) {
+	raw, err := strconv.ParseFloat(value, 64)
+	if err != nil || raw < 0 {
+		return 0, fmt.Errorf("%q", value)
+	}
+
+	degrees := float64(int(raw / 100))
+	minutes := raw - degrees*100
+	if minutes >= 60 {
+		return 0, fmt.Errorf("minutes out of range in %q", value)
+	}
+	result := degrees + minutes/60
+
+	switch hemisphere {
+	case positive:
+		return result, nil
+	case negative:
+		return -result, nil
+	default:
+		return 0, fmt.Errorf("invalid hemisphere %q", hemisphere)
+	}
+}
+
+// parseNMEATime 将 hhmmss.ss 转换为 hh:mm:ss
+func parseNMEATime(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	if len(value) < 6 {
+		return "", fmt.Errorf("invalid time: %s", value)
+	}
+	t, err := time.Parse("150405", value[:6])
+	if err != nil {
+		return "", fmt.Errorf("invalid time: %s", value)
+	}
+	return t.Format("15:04:05"), nil
+}
+
+// parseNMEAFloat 解析可为空的浮点字段
+func parseNMEAFloat(value string) (float64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.ParseFloat(value, 64)
+}
+
+// parseNMEAInt 解析可为空的整数字段
+func parseNMEAInt(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// parseNMEAData 解析 NMEA 数据，返回与 parseMessageData 相同结构的解析结果
+func parseNMEAData(rawData string) (models.ParseResult, error) {
+	fix, err := parseNMEA(rawData)
+	if err != nil {
+		return models.ParseResult{Success: false, Error: "Failed to parse NMEA data: " + err.Error()}, err
+	}
+
+	return models.ParseResult{
+		Success:   true,
+		Fields:    fix.Fields(),
+		RawData:   rawData,
+		Timestamp: time.Now(),
+	}, nil
+}
+
+// processNMEAData 处理设备上报的 NMEA 语句，更新设备位置并保存遥测数据
+func processNMEAData(deviceID string, timestamp uint32, raw string) error {
+	fix, err := parseNMEA(raw)
+	if err != nil {
+		return fmt.Errorf("failed to parse NMEA data: %v", err)
+	}
+	if !fix.HasPosition || !fix.Valid {
+		return fmt.Errorf("no valid position in NMEA data")
+	}
+
+	// 优先使用定位时间
+	fixTime := fix.Timestamp()
+	if fixTime == 0 {
+		fixTime = int64(timestamp)
+	}
+
+	device, err := upsertDeviceLocation(deviceID, fixTime, fix.Latitude, fix.Longitude)
+	if err != nil {
+		return err
+	}
+
+	telemetry := models.Telemetry{
+		DeviceID:  device.ID,
+		Source:    ProtocolNMEA,
+		Timestamp: fixTime,
+		Latitude:  fix.Latitude,
+		Longitude: fix.Longitude,
+		Altitude:  fix.Altitude,
+		Speed:     fix.Speed(),
+		Course:    fix.Course,
+		RawData:   raw,
+	}
+	if err := recordTelemetry(&telemetry, fix.Fields()); err != nil {
+		return fmt.Errorf("failed to save telemetry: %v", err)
+	}
+
+	fmt.Printf("Updated device %s location from NMEA: lat=%f, lng=%f\n", deviceID, fix.Latitude, fix.Longitude)
+	return nil
+}
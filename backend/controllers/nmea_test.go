@@ -0,0 +1,87 @@
+package controllers
+
+import (
+	"math"
+	"testing"
+
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+func TestParseNMEA(t *testing.T) {
+	t.Run("RMC GGA and GSA merged into one fix", func(t *testing.T) {
+		raw := "$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*6A\r\n" +
+			"$GNGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*59\r\n" +
+			"$GPGSA,A,3,04,05,,09,12,,,24,,,,,2.5,1.3,2.1*39\r\n"
+
+		fix, err := parseNMEA(raw)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		if !fix.Valid || !fix.HasPosition {
+			t.Fatalf("Expected a valid position fix")
+		}
+		if math.Abs(fix.Latitude-48.1173) > 1e-6 {
+			t.Errorf("Expected latitude=48.1173, got %f", fix.Latitude)
+		}
+		if math.Abs(fix.Longitude-11.516667) > 1e-6 {
+			t.Errorf("Expected longitude=11.516667, got %f", fix.Longitude)
+		}
+		if math.Abs(fix.Speed()-22.4*knotsToKmh) > 1e-9 {
+			t.Errorf("Expected speed=%f km/h, got %f", 22.4*knotsToKmh, fix.Speed())
+		}
+		if fix.Course != 84.4 {
+			t.Errorf("Expected course=84.4, got %f", fix.Course)
+		}
+		if fix.DateTime() != "1994-03-23 12:35:19" {
+			t.Errorf("Expected datetime='1994-03-23 12:35:19', got '%s'", fix.DateTime())
+		}
+		if fix.FixQuality != 1 || fix.Satellites != 8 || fix.Altitude != 545.4 {
+			t.Errorf("Unexpected GGA values: quality=%d satellites=%d altitude=%f", fix.FixQuality, fix.Satellites, fix.Altitude)
+		}
+		if fix.FixType != 3 || fix.PDOP != 2.5 || fix.HDOP != 1.3 || fix.VDOP != 2.1 {
+			t.Errorf("Unexpected GSA values: type=%d pdop=%f hdop=%f vdop=%f", fix.FixType, fix.PDOP, fix.HDOP, fix.VDOP)
+		}
+	})
+
+	t.Run("Southern and western hemisphere", func(t *testing.T) {
+		fix, err := parseNMEA("$GPRMC,081836,A,3751.65,S,14507.36,W,000.0,360.0,130998,011.3,E*70")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if fix.Latitude >= 0 || fix.Longitude >= 0 {
+			t.Errorf("Expected negative coordinates, got %f, %f", fix.Latitude, fix.Longitude)
+		}
+	})
+
+	t.Run("Checksum mismatch", func(t *testing.T) {
+		_, err := parseNMEA("$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*6B")
+		if err == nil {
+			t.Error("Expected checksum error, but got none")
+		}
+	})
+
+	t.Run("Missing checksum", func(t *testing.T) {
+		_, err := parseNMEA("$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W")
+		if err == nil {
+			t.Error("Expected missing checksum error, but got none")
+		}
+	})
+
+	t.Run("Protocol selected through config", func(t *testing.T) {
+		config := models.MessageTypeConfig{Protocol: ProtocolNMEA}
+		result, err := parseWithConfig(config, "$GNGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*59")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !result.Success {
+			t.Fatalf("Parsing failed: %s", result.Error)
+		}
+		if result.Fields["satellites"] != 8 {
+			t.Errorf("Expected satellites=8, got %v", result.Fields["satellites"])
+		}
+		if result.Fields["hdop"] != 0.9 {
+			t.Errorf("Expected hdop=0.9, got %v", result.Fields["hdop"])
+		}
+	})
+}
@@ -0,0 +1,585 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+const (
+	// notificationTimeout 单次发送的超时时间
+	notificationTimeout = 10 * time.Second
+	// notificationQueueSize 待发送队列长度
+	notificationQueueSize = 1000
+	// notificationWorkerCount 并发发送的协程数
+	notificationWorkerCount = 4
+	// notificationSchedulerInterval 检查到期重试的间隔
+	notificationSchedulerInterval = time.Second
+	// notificationQueueFullDelay 发送队列已满时等待后重新加入队列
+	notificationQueueFullDelay = 5 * time.Second
+)
+
+// notificationRetryDelays 发送失败后的重试间隔，重试次数为其长度
+var notificationRetryDelays = []time.Duration{5 * time.Second, 30 * time.Second, 2 * time.Minute}
+
+// errNotificationAddress 通知目标为本机、内网或链路本地地址
+var errNotificationAddress = errors.New("destination address is not allowed")
+
+// notificationAddressAllowed 判断是否允许连接该地址，防止通过通知渠道访问服务器内部网络
+var notificationAddressAllowed = func(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsUnspecified() && !ip.IsMulticast()
+}
+
+// notificationDialer 在域名解析后检查实际连接的地址
+var notificationDialer = &net.Dialer{
+	Timeout: notificationTimeout,
+	Control: func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || !notificationAddressAllowed(ip) {
+			return fmt.Errorf("%w: %s", errNotificationAddress, host)
+		}
+		return nil
+	},
+}
+
+// notificationHTTPClient 发送 webhook 和机器人通知，不使用代理且不跟随重定向
+var notificationHTTPClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext:         notificationDialer.DialContext,
+		TLSHandshakeTimeout: notificationTimeout,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// checkNotificationHost 配置时拒绝明显指向本机或内网的地址，域名在连接时检查
+func checkNotificationHost(host string) error {
+	if strings.EqualFold(host, "localhost") || strings.HasSuffix(strings.ToLower(host), ".localhost") {
+		return errNotificationAddress
+	}
+	if ip := net.ParseIP(host); ip != nil && !notificationAddressAllowed(ip) {
+		return errNotificationAddress
+	}
+	return nil
+}
+
+// ChannelConfig 通知渠道配置
+type ChannelConfig struct {
+	URL     string            `json:"url,omitempty"`     // 回调或机器人地址
+	Secret  string            `json:"secret,omitempty"`  // webhook HMAC 密钥或机器人加签密钥
+	Headers map[string]string `json:"headers,omitempty"` // webhook 附加请求头
+	// SMTP 邮件
+	Host     string   `json:"host,omitempty"`
+	Port     int      `json:"port,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from,omitempty"`
+	To       []string `json:"to,omitempty"`
+	TLS      bool     `json:"tls,omitempty"` // 使用 SMTPS(465) 直接建立 TLS 连接，否则服务器支持时使用 STARTTLS
+}
+
+// parseChannelConfig 解析并校验渠道配置
+func parseChannelConfig(channelType, raw string) (*ChannelConfig, error) {
+	var config ChannelConfig
+	if raw != "" {
+		if err := json.Unmarshal([]byte(raw), &config); err != nil {
+			return nil, fmt.Errorf("invalid config: %v", err)
+		}
+	}
+
+	switch channelType {
+	case models.ChannelTypeWebhook, models.ChannelTypeWeCom, models.ChannelTypeDingTalk, models.ChannelTypeFeishu:
+		u, err := url.Parse(config.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, errors.New("config.url must be an http(s) URL")
+		}
+		if err := checkNotificationHost(u.Hostname()); err != nil {
+			return nil, fmt.Errorf("config.url: %v", err)
+		}
+	case models.ChannelTypeEmail:
+		if config.Host == "" || config.From == "" || len(config.To) == 0 {
+			return nil, errors.New("config.host, config.from and config.to are required")
+		}
+		if err := checkNotificationHost(config.Host); err != nil {
+			return nil, fmt.Errorf("config.host: %v", err)
+		}
+		if config.Port == 0 {
+			config.Port = 25
+			if config.TLS {
+				config.Port = 465
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported channel type %q", channelType)
+	}
+	return &config, nil
+}
+
+// defaultNotificationTemplate 默认的 Markdown 消息模板
+const defaultNotificationTemplate = `### {{.Title}}
+- **设备**: {{.Device.Name}} ({{.Device.Topic}})
+- **级别**: {{.Alert.Level}}
+- **类型**: {{.Alert.Type}}
+- **时间**: {{.Time}}
+
+{{.Alert.Message}}`
+
+// notificationMessage 渲染通知模板的数据
+type notificationMessage struct {
+	Alert  *models.Alert
+	Device *models.Device
+	Title  string
+	Time   string
+	Text   string // 渲染后的 Markdown 内容
+}
+
+// newNotificationMessage 按渠道模板渲染告警通知
+func newNotificationMessage(channel *models.NotificationChannel, alert *models.Alert, device *models.Device) (*notificationMessage, error) {
+	msg := &notificationMessage{
+		Alert:  alert,
+		Device: device,
+		Title:  fmt.Sprintf("[%s] %s %s告警", strings.ToUpper(alert.Level), device.Name, alert.Type),
+		Time:   time.Unix(alert.Timestamp, 0).Format("2006-01-02 15:04:05"),
+	}
+
+	text := channel.Template
+	if text == "" {
+		text = defaultNotificationTemplate
+	}
+	tmpl, err := template.New("notification").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, msg); err != nil {
+		return nil, fmt.Errorf("failed to render template: %v", err)
+	}
+	msg.Text = buf.String()
+	return msg, nil
+}
+
+// deliveryError 发送失败，retry 表示可以重试(网络错误、5xx、429)
+type deliveryError struct {
+	err   error
+	retry bool
+}
+
+func (e *deliveryError) Error() string { return e.err.Error() }
+
+func (e *deliveryError) Unwrap() error { return e.err }
+
+// sendNotification 通过渠道发送通知，返回 HTTP 响应状态码(邮件为 0)
+func sendNotification(ctx context.Context, channel *models.NotificationChannel, config *ChannelConfig, msg *notificationMessage) (int, error) {
+	switch channel.Type {
+	case models.ChannelTypeEmail:
+		return 0, sendEmailNotification(config, msg)
+	case models.ChannelTypeWebhook:
+		body, err := json.Marshal(gin.H{
+			"event":  "alert",
+			"alert":  msg.Alert,
+			"device": gin.H{"id": msg.Device.ID, "name": msg.Device.Name, "topic": msg.Device.Topic},
+			"title":  msg.Title,
+			"text":   msg.Text,
+		})
+		if err != nil {
+			return 0, err
+		}
+		headers := map[string]string{}
+		for k, v := range config.Headers {
+			headers[k] = v
+		}
+		if config.Secret != "" {
+			timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+			headers["X-Signature-Timestamp"] = timestamp
+			headers["X-Signature"] = "sha256=" + webhookSignature(config.Secret, timestamp, body)
+		}
+		return postNotification(ctx, config.URL, headers, body, nil)
+	case models.ChannelTypeWeCom:
+		body, _ := json.Marshal(gin.H{"msgtype": "markdown", "markdown": gin.H{"content": msg.Text}})
+		return postNotification(ctx, config.URL, nil, body, robotResponseError("errcode", "errmsg"))
+	case models.ChannelTypeDingTalk:
+		target := config.URL
+		if config.Secret != "" {
+			timestamp := strconv.FormatInt(time.Now().UnixMilli(), 10)
+			mac := hmac.New(sha256.New, []byte(config.Secret))
+			mac.Write([]byte(timestamp + "\n" + config.Secret))
+			sign := url.QueryEscape(base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+			target += joinQuery(target) + "timestamp=" + timestamp + "&sign=" + sign
+		}
+		body, _ := json.Marshal(gin.H{"msgtype": "markdown", "markdown": gin.H{"title": msg.Title, "text": msg.Text}})
+		return postNotification(ctx, target, nil, body, robotResponseError("errcode", "errmsg"))
+	case models.ChannelTypeFeishu:
+		payload := gin.H{
+			"msg_type": "interactive",
+			"card": gin.H{
+				"header":   gin.H{"title": gin.H{"tag": "plain_text", "content": msg.Title}},
+				"elements": []gin.H{{"tag": "markdown", "content": msg.Text}},
+			},
+		}
+		if config.Secret != "" {
+			timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+			mac := hmac.New(sha256.New, []byte(timestamp+"\n"+config.Secret))
+			payload["timestamp"] = timestamp
+			payload["sign"] = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+		}
+		body, _ := json.Marshal(payload)
+		return postNotification(ctx, config.URL, nil, body, robotResponseError("code", "msg"))
+	}
+	return 0, fmt.Errorf("unsupported channel type %q", channel.Type)
+}
+
+// joinQuery 返回在 URL 后追加查询参数需要的分隔符
+func joinQuery(target string) string {
+	if strings.Contains(target, "?") {
+		return "&"
+	}
+	return "?"
+}
+
+// webhookSignature webhook 签名: HMAC-SHA256(secret, timestamp + "." + body) 的十六进制
+func webhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// robotResponseError 检查机器人接口响应中的错误码字段，非 0 时返回错误。
+// 响应内容只记录到日志，不返回给用户
+func robotResponseError(codeField, msgField string) func([]byte) error {
+	return func(body []byte) error {
+		var resp map[string]interface{}
+		if err := json.Unmarshal(body, &resp); err != nil {
+			log.Printf("Invalid robot response: %s", truncateString(string(body), 100))
+			return errors.New("invalid robot response")
+		}
+		if code, ok := numericFloat(resp[codeField]); ok && code != 0 {
+			log.Printf("Robot error %v: %v", resp[codeField], resp[msgField])
+			return fmt.Errorf("robot error %v", resp[codeField])
+		}
+		return nil
+	}
+}
+
+// postNotification 发送 JSON 请求，check 不为空时检查 2xx 响应体
+func postNotification(ctx context.Context, target string, headers map[string]string, body []byte, check func([]byte) error) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, notificationTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := notificationHTTPClient.Do(req)
+	if err != nil {
+		return 0, &deliveryError{err: err, retry: !errors.Is(err, errNotificationAddress)}
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		log.Printf("Notification to %s failed with HTTP %d: %s", req.URL.Host, resp.StatusCode, truncateString(string(respBody), 100))
+		return resp.StatusCode, &deliveryError{err: fmt.Errorf("HTTP %d", resp.StatusCode), retry: retry}
+	}
+	if check != nil {
+		if err := check(respBody); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// truncateString 截断过长的字符串
+func truncateString(s string, n int) string {
+	if len(s) > n {
+		return s[:n] + "..."
+	}
+	return s
+}
+
+// sendEmailNotification 通过 SMTP 发送纯文本邮件，内容为渲染后的 Markdown
+func sendEmailNotification(config *ChannelConfig, msg *notificationMessage) error {
+	addr := net.JoinHostPort(config.Host, strconv.Itoa(config.Port))
+	tlsConfig := &tls.Config{ServerName: config.Host}
+
+	var conn net.Conn
+	var err error
+	if config.TLS {
+		conn, err = tls.DialWithDialer(notificationDialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = notificationDialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return &deliveryError{err: err, retry: !errors.Is(err, errNotificationAddress)}
+	}
+	conn.SetDeadline(time.Now().Add(notificationTimeout))
+
+	client, err := smtp.NewClient(conn, config.Host)
+	if err != nil {
+		conn.Close()
+		return &deliveryError{err: err, retry: true}
+	}
+	defer client.Close()
+
+	if !config.TLS {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		}
+	}
+	if config.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", config.Username, config.Password, config.Host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(config.From); err != nil {
+		return err
+	}
+	for _, to := range config.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	header := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\n"+
+		"Content-Type: text/plain; charset=UTF-8\r\nContent-Transfer-Encoding: base64\r\n\r\n",
+		config.From, strings.Join(config.To, ", "), mime.BEncoding.Encode("UTF-8", msg.Title),
+		time.Now().Format(time.RFC1123Z))
+	if _, err := io.WriteString(w, header); err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString([]byte(msg.Text))
+	for len(encoded) > 76 {
+		io.WriteString(w, encoded[:76]+"\r\n")
+		encoded = encoded[76:]
+	}
+	io.WriteString(w, encoded+"\r\n")
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// channelMatchesAlert 判断告警是否路由到渠道: 渠道已启用，级别和设备组满足条件
+func channelMatchesAlert(channel *models.NotificationChannel, alert *models.Alert, device *models.Device) bool {
+	if !channel.Enabled {
+		return false
+	}
+	if channel.GroupID != nil && (device.GroupID == nil || *device.GroupID != *channel.GroupID) {
+		return false
+	}
+	return levelListContains(channel.Levels, alert.Level)
+}
+
+// levelListContains 逗号分隔的级别列表是否包含 level，列表为空表示全部级别
+func levelListContains(levels, level string) bool {
+	if strings.TrimSpace(levels) == "" {
+		return true
+	}
+	for _, item := range strings.Split(levels, ",") {
+		if strings.TrimSpace(item) == level {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyAlert 为新告警创建设备所属用户匹配渠道的发送记录并加入发送队列
+func notifyAlert(alert *models.Alert) {
+	var device models.Device
+	if err := database.DB.First(&device, alert.DeviceID).Error; err != nil {
+		return
+	}
+	var channels []models.NotificationChannel
+	if err := database.DB.Where("user_id = ? AND enabled = ?", device.UserID, true).Find(&channels).Error; err != nil {
+		log.Printf("Failed to load notification channels for user %d: %v", device.UserID, err)
+		return
+	}
+
+	for i := range channels {
+		if !channelMatchesAlert(&channels[i], alert, &device) {
+			continue
+		}
+		delivery := models.NotificationDelivery{AlertID: alert.ID, ChannelID: channels[i].ID, Status: models.DeliveryStatusPending}
+		if err := database.DB.Create(&delivery).Error; err != nil {
+			log.Printf("Failed to create notification delivery for alert %d: %v", alert.ID, err)
+			continue
+		}
+		enqueueDelivery(delivery.ID)
+	}
+}
+
+// notificationQueue 待发送的发送记录ID
+var notificationQueue = make(chan uint, notificationQueueSize)
+
+var startNotificationWorkers sync.Once
+
+// enqueueDelivery 将发送记录加入队列，首次调用时启动发送协程。
+// 队列已满时发送记录保持待发送，由调度协程稍后重新加入队列
+func enqueueDelivery(id uint) bool {
+	startNotificationWorkers.Do(func() {
+		for i := 0; i < notificationWorkerCount; i++ {
+			go func() {
+				for id := range notificationQueue {
+					deliverNotification(id)
+				}
+			}()
+		}
+	})
+
+	select {
+	case notificationQueue <- id:
+		return true
+	default:
+		log.Printf("Notification queue is full, delivery %d postponed", id)
+		database.DB.Model(&models.NotificationDelivery{}).Where("id = ?", id).Updates(map[string]interface{}{
+			"next_attempt_at": time.Now().Add(notificationQueueFullDelay).Unix(),
+			"error":           "notification queue is full",
+		})
+		return false
+	}
+}
+
+// enqueueDueDeliveries 将到达重试时间的待发送记录重新加入发送队列
+func enqueueDueDeliveries(now time.Time) {
+	var deliveries []models.NotificationDelivery
+	if err := database.DB.Select("id, next_attempt_at").
+		Where("status = ? AND next_attempt_at > 0 AND next_attempt_at <= ?", models.DeliveryStatusPending, now.Unix()).
+		Order("next_attempt_at, id").Limit(notificationQueueSize).Find(&deliveries).Error; err != nil {
+		log.Printf("Failed to load due notification deliveries: %v", err)
+		return
+	}
+
+	for _, delivery := range deliveries {
+		// 清除重试时间表示已加入队列，条件更新避免同一记录被重复加入
+		result := database.DB.Model(&models.NotificationDelivery{}).
+			Where("id = ? AND next_attempt_at = ?", delivery.ID, delivery.NextAttemptAt).
+			Update("next_attempt_at", 0)
+		if result.Error != nil || result.RowsAffected == 0 {
+			continue
+		}
+		if !enqueueDelivery(delivery.ID) {
+			return
+		}
+	}
+}
+
+// StartNotificationScheduler 定期将到达重试时间的通知重新加入发送队列
+func StartNotificationScheduler() {
+	go func() {
+		ticker := time.NewTicker(notificationSchedulerInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			enqueueDueDeliveries(time.Now())
+		}
+	}()
+}
+
+// ResumeNotificationDeliveries 启动时重新发送上次退出前已在发送队列中的通知，等待重试的通知由调度协程处理
+func ResumeNotificationDeliveries() {
+	var ids []uint
+	database.DB.Model(&models.NotificationDelivery{}).
+		Where("status = ? AND next_attempt_at = 0", models.DeliveryStatusPending).Order("id").Pluck("id", &ids)
+	for _, id := range ids {
+		enqueueDelivery(id)
+	}
+}
+
+// deliverNotification 尝试发送一次通知并更新发送记录，可重试的失败按 notificationRetryDelays
+// 记录下次尝试时间，由调度协程到期后重新加入队列，发送协程不等待
+func deliverNotification(id uint) {
+	var delivery models.NotificationDelivery
+	if err := database.DB.First(&delivery, id).Error; err != nil ||
+		delivery.Status != models.DeliveryStatusPending || delivery.NextAttemptAt != 0 {
+		return
+	}
+
+	fail := func(err error) {
+		delivery.Status = models.DeliveryStatusFailed
+		delivery.Error = truncateString(err.Error(), 250)
+		database.DB.Save(&delivery)
+	}
+
+	var channel models.NotificationChannel
+	var alert models.Alert
+	var device models.Device
+	if err := database.DB.First(&channel, delivery.ChannelID).Error; err != nil {
+		fail(errors.New("notification channel not found"))
+		return
+	}
+	if err := database.DB.First(&alert, delivery.AlertID).Error; err != nil {
+		fail(errors.New("alert not found"))
+		return
+	}
+	database.DB.First(&device, alert.DeviceID)
+
+	config, err := parseChannelConfig(channel.Type, channel.Config)
+	if err != nil {
+		fail(err)
+		return
+	}
+	msg, err := newNotificationMessage(&channel, &alert, &device)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	delivery.Attempts++
+	delivery.StatusCode, err = sendNotification(context.Background(), &channel, config, msg)
+	if err == nil {
+		delivery.Status = models.DeliveryStatusSent
+		delivery.Error = ""
+		delivery.SentAt = time.Now().Unix()
+		database.DB.Save(&delivery)
+		return
+	}
+
+	var de *deliveryError
+	if !errors.As(err, &de) || !de.retry || delivery.Attempts > len(notificationRetryDelays) {
+		fail(err)
+		return
+	}
+	delivery.Error = truncateString(err.Error(), 250)
+	delivery.NextAttemptAt = time.Now().Add(notificationRetryDelays[delivery.Attempts-1]).Unix()
+	database.DB.Save(&delivery)
+}
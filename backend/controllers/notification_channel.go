@@ -0,0 +1,232 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+// notificationChannelInput 创建或修改通知渠道的请求，config 可以是 JSON 对象或 JSON 字符串
+type notificationChannelInput struct {
+	Name     string          `json:"name" binding:"required"`
+	Type     string          `json:"type" binding:"required"`
+	Enabled  *bool           `json:"enabled"`
+	Config   json.RawMessage `json:"config"`
+	Template string          `json:"template"`
+	Levels   string          `json:"levels"`
+	GroupID  *uint           `json:"group_id"`
+}
+
+// validate 校验渠道配置、模板、级别和设备组，返回规范化的配置 JSON
+func (input *notificationChannelInput) validate() (string, error) {
+	config := string(input.Config)
+	var text string
+	if json.Unmarshal(input.Config, &text) == nil {
+		config = text
+	}
+	if _, err := parseChannelConfig(input.Type, config); err != nil {
+		return "", err
+	}
+
+	if input.Template != "" {
+		if _, err := template.New("notification").Parse(input.Template); err != nil {
+			return "", fmt.Errorf("invalid template: %v", err)
+		}
+	}
+
+	levels, err := normalizeLevels(input.Levels)
+	if err != nil {
+		return "", err
+	}
+	input.Levels = levels
+
+	if err := checkDeviceGroup(input.GroupID); err != nil {
+		return "", err
+	}
+	return config, nil
+}
+
+// normalizeLevels 校验逗号分隔的告警级别列表并去掉空白
+func normalizeLevels(input string) (string, error) {
+	var levels []string
+	for _, level := range strings.Split(input, ",") {
+		switch level = strings.TrimSpace(level); level {
+		case "":
+		case models.AlertLevelCritical, models.AlertLevelHigh, models.AlertLevelMedium, models.AlertLevelLow:
+			levels = append(levels, level)
+		default:
+			return "", fmt.Errorf("invalid level %q", level)
+		}
+	}
+	return strings.Join(levels, ","), nil
+}
+
+// checkDeviceGroup 设备组不为空时检查其是否存在
+func checkDeviceGroup(groupID *uint) error {
+	if groupID == nil {
+		return nil
+	}
+	var group models.DeviceGroup
+	if err := database.DB.First(&group, *groupID).Error; err != nil {
+		return errors.New("Device group not found")
+	}
+	return nil
+}
+
+// apply 将请求写入渠道
+func (input *notificationChannelInput) apply(channel *models.NotificationChannel, config string) {
+	channel.Name = input.Name
+	channel.Type = input.Type
+	if input.Enabled != nil {
+		channel.Enabled = *input.Enabled
+	}
+	channel.Config = config
+	channel.Template = input.Template
+	channel.Levels = input.Levels
+	channel.GroupID = input.GroupID
+}
+
+// GetNotificationChannels 获取通知渠道列表
+func GetNotificationChannels(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	var channels []models.NotificationChannel
+	if err := database.DB.Where("user_id = ?", userID).Order("id").Find(&channels).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get notification channels"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": channels})
+}
+
+// CreateNotificationChannel 创建通知渠道
+func CreateNotificationChannel(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	var input notificationChannelInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	config, err := input.validate()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	channel := models.NotificationChannel{UserID: userID, Enabled: true}
+	input.apply(&channel, config)
+	if err := database.DB.Create(&channel).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create notification channel"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": channel})
+}
+
+// UpdateNotificationChannel 修改通知渠道
+func UpdateNotificationChannel(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	id := c.Param("id")
+
+	var channel models.NotificationChannel
+	if err := database.DB.Where("id = ? AND user_id = ?", id, userID).First(&channel).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Notification channel not found"})
+		return
+	}
+
+	var input notificationChannelInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	config, err := input.validate()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	input.apply(&channel, config)
+	if err := database.DB.Save(&channel).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update notification channel"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": channel})
+}
+
+// DeleteNotificationChannel 删除通知渠道
+func DeleteNotificationChannel(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	id := c.Param("id")
+
+	var channel models.NotificationChannel
+	if err := database.DB.Where("id = ? AND user_id = ?", id, userID).First(&channel).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Notification channel not found"})
+		return
+	}
+
+	if err := database.DB.Delete(&channel).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete notification channel"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Notification channel deleted successfully"})
+}
+
+// TestNotificationChannel 通过渠道发送一条测试通知，同步返回发送结果
+func TestNotificationChannel(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	id := c.Param("id")
+
+	var channel models.NotificationChannel
+	if err := database.DB.Where("id = ? AND user_id = ?", id, userID).First(&channel).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Notification channel not found"})
+		return
+	}
+	config, err := parseChannelConfig(channel.Type, channel.Config)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	alert := &models.Alert{Type: "test", Level: models.AlertLevelLow, Message: "测试通知", Timestamp: time.Now().Unix()}
+	device := &models.Device{Name: "测试设备", Topic: "test"}
+	msg, err := newNotificationMessage(&channel, alert, device)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	statusCode, err := sendNotification(context.Background(), &channel, config, msg)
+	result := gin.H{"success": err == nil, "status_code": statusCode, "text": msg.Text}
+	if err != nil {
+		result["error"] = err.Error()
+	}
+	c.JSON(http.StatusOK, gin.H{"data": result})
+}
+
+// GetAlertDeliveries 获取告警的通知发送记录
+func GetAlertDeliveries(c *gin.Context) {
+	alert, ok := userAlert(c)
+	if !ok {
+		return
+	}
+
+	var deliveries []models.NotificationDelivery
+	if err := database.DB.Where("alert_id = ?", alert.ID).Order("id").Find(&deliveries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get notification deliveries"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": deliveries})
+}
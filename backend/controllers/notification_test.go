@@ -0,0 +1,330 @@
+package controllers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+// createTestDelivery 创建设备、告警、渠道和待发送记录
+func createTestDelivery(t *testing.T, channelType, config string) models.NotificationDelivery {
+	t.Helper()
+	device := models.Device{Name: "pump-1", Topic: "pump/1", UserID: 1}
+	database.DB.Create(&device)
+	alert := models.Alert{DeviceID: device.ID, Type: "99", Level: models.AlertLevelHigh, Message: "压力过高", Timestamp: time.Now().Unix()}
+	database.DB.Create(&alert)
+	channel := models.NotificationChannel{UserID: 1, Name: channelType, Type: channelType, Enabled: true, Config: config}
+	if err := database.DB.Create(&channel).Error; err != nil {
+		t.Fatalf("Failed to create channel: %v", err)
+	}
+	delivery := models.NotificationDelivery{AlertID: alert.ID, ChannelID: channel.ID, Status: models.DeliveryStatusPending}
+	database.DB.Create(&delivery)
+	return delivery
+}
+
+// useTestNotificationQueue 使用指定容量的发送队列，队列中的记录由测试自行取出发送
+func useTestNotificationQueue(t *testing.T, size int) chan uint {
+	t.Helper()
+	startNotificationWorkers.Do(func() {}) // 发送协程只处理原队列
+	queue := notificationQueue
+	notificationQueue = make(chan uint, size)
+	t.Cleanup(func() { notificationQueue = queue })
+	return notificationQueue
+}
+
+// allowLoopbackNotifications 允许通知发送到本机的测试服务器
+func allowLoopbackNotifications(t *testing.T) {
+	t.Helper()
+	allowed := notificationAddressAllowed
+	notificationAddressAllowed = func(ip net.IP) bool { return ip.IsLoopback() || allowed(ip) }
+	t.Cleanup(func() { notificationAddressAllowed = allowed })
+}
+
+func TestWebhookDeliveryRetry(t *testing.T) {
+	useTestDatabase(t)
+	allowLoopbackNotifications(t)
+	queue := useTestNotificationQueue(t, 10)
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		body, _ := io.ReadAll(r.Body)
+		timestamp := r.Header.Get("X-Signature-Timestamp")
+		if r.Header.Get("X-Signature") != "sha256="+webhookSignature("s3cret", timestamp, body) {
+			t.Errorf("Invalid signature %q", r.Header.Get("X-Signature"))
+		}
+		var payload struct {
+			Title string `json:"title"`
+			Text  string `json:"text"`
+		}
+		json.Unmarshal(body, &payload)
+		if !strings.Contains(payload.Text, "压力过高") || !strings.Contains(payload.Text, "pump-1") {
+			t.Errorf("Unexpected webhook text %q", payload.Text)
+		}
+		if requests == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	delivery := createTestDelivery(t, models.ChannelTypeWebhook, fmt.Sprintf(`{"url":%q,"secret":"s3cret"}`, server.URL))
+	start := time.Now()
+	deliverNotification(delivery.ID)
+
+	// 失败后不等待，记录下次尝试时间
+	database.DB.First(&delivery, delivery.ID)
+	if delivery.Status != models.DeliveryStatusPending || delivery.Attempts != 1 ||
+		delivery.NextAttemptAt < start.Add(notificationRetryDelays[0]).Unix() {
+		t.Fatalf("Expected delivery to wait for retry, got %+v", delivery)
+	}
+	if time.Since(start) > notificationRetryDelays[0] {
+		t.Errorf("Delivery blocked for %v", time.Since(start))
+	}
+
+	// 到期前不重新加入队列
+	enqueueDueDeliveries(start)
+	if len(queue) != 0 {
+		t.Fatalf("Expected no due deliveries, got %d", len(queue))
+	}
+	enqueueDueDeliveries(start.Add(time.Minute))
+	enqueueDueDeliveries(start.Add(time.Minute))
+	if len(queue) != 1 {
+		t.Fatalf("Expected delivery to be enqueued once, got %d", len(queue))
+	}
+	deliverNotification(<-queue)
+
+	database.DB.First(&delivery, delivery.ID)
+	if delivery.Status != models.DeliveryStatusSent || delivery.Attempts != 2 || delivery.StatusCode != http.StatusOK ||
+		delivery.SentAt == 0 || delivery.NextAttemptAt != 0 {
+		t.Errorf("Unexpected delivery: %+v", delivery)
+	}
+}
+
+func TestNotificationQueueFull(t *testing.T) {
+	useTestDatabase(t)
+	useTestNotificationQueue(t, 0)
+
+	delivery := createTestDelivery(t, models.ChannelTypeWebhook, `{"url":"http://127.0.0.1:1"}`)
+	if enqueueDelivery(delivery.ID) {
+		t.Fatal("Expected full queue to reject delivery")
+	}
+
+	// 队列已满的记录保持待发送，稍后由调度协程重新加入队列
+	database.DB.First(&delivery, delivery.ID)
+	if delivery.Status != models.DeliveryStatusPending || delivery.NextAttemptAt == 0 {
+		t.Fatalf("Expected delivery to stay pending, got %+v", delivery)
+	}
+	notificationQueue = make(chan uint, 1)
+	enqueueDueDeliveries(time.Now().Add(notificationQueueFullDelay))
+	if len(notificationQueue) != 1 {
+		t.Errorf("Expected postponed delivery to be enqueued")
+	}
+}
+
+func TestRobotDeliveryError(t *testing.T) {
+	useTestDatabase(t)
+	allowLoopbackNotifications(t)
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Query().Get("sign") == "" {
+			t.Errorf("Expected signed DingTalk URL, got %s", r.URL)
+		}
+		w.Write([]byte(`{"errcode":310000,"errmsg":"sign not match"}`))
+	}))
+	defer server.Close()
+
+	// 机器人返回错误码时不重试
+	delivery := createTestDelivery(t, models.ChannelTypeDingTalk, fmt.Sprintf(`{"url":%q,"secret":"SEC1"}`, server.URL+"/robot/send?access_token=x"))
+	deliverNotification(delivery.ID)
+
+	database.DB.First(&delivery, delivery.ID)
+	if delivery.Status != models.DeliveryStatusFailed || delivery.Attempts != 1 || requests != 1 ||
+		!strings.Contains(delivery.Error, "310000") || strings.Contains(delivery.Error, "sign not match") {
+		t.Errorf("Unexpected delivery: %+v (requests %d)", delivery, requests)
+	}
+}
+
+func TestEmailDelivery(t *testing.T) {
+	useTestDatabase(t)
+	allowLoopbackNotifications(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	// 最简 SMTP 服务端，记录收到的命令
+	commands := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var received []string
+		r := bufio.NewReader(conn)
+		fmt.Fprint(conn, "220 localhost ESMTP\r\n")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				break
+			}
+			line = strings.TrimRight(line, "\r\n")
+			received = append(received, line)
+			switch cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); cmd {
+			case "EHLO", "HELO":
+				fmt.Fprint(conn, "250 localhost\r\n")
+			case "DATA":
+				fmt.Fprint(conn, "354 go ahead\r\n")
+				for {
+					data, err := r.ReadString('\n')
+					if err != nil || data == ".\r\n" {
+						break
+					}
+				}
+				fmt.Fprint(conn, "250 queued\r\n")
+			case "QUIT":
+				fmt.Fprint(conn, "221 bye\r\n")
+				commands <- received
+				return
+			default:
+				fmt.Fprint(conn, "250 ok\r\n")
+			}
+		}
+		commands <- received
+	}()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	delivery := createTestDelivery(t, models.ChannelTypeEmail,
+		fmt.Sprintf(`{"host":"127.0.0.1","port":%d,"from":"alert@example.com","to":["ops@example.com"]}`, port))
+	deliverNotification(delivery.ID)
+
+	database.DB.First(&delivery, delivery.ID)
+	if delivery.Status != models.DeliveryStatusSent {
+		t.Fatalf("Unexpected delivery: %+v", delivery)
+	}
+	received := strings.Join(<-commands, "\n")
+	if !strings.Contains(received, "MAIL FROM:<alert@example.com>") || !strings.Contains(received, "RCPT TO:<ops@example.com>") {
+		t.Errorf("Unexpected SMTP session:\n%s", received)
+	}
+}
+
+func TestChannelMatchesAlert(t *testing.T) {
+	groupID := uint(2)
+	device := &models.Device{GroupID: &groupID}
+	alert := &models.Alert{Level: models.AlertLevelHigh}
+
+	cases := []struct {
+		levels string
+		group  *uint
+		want   bool
+	}{
+		{"", nil, true},
+		{"critical,high", nil, true},
+		{"low", nil, false},
+		{"", &groupID, true},
+		{"high", new(uint), false},
+	}
+	for _, tc := range cases {
+		channel := &models.NotificationChannel{Enabled: true, Levels: tc.levels, GroupID: tc.group}
+		if got := channelMatchesAlert(channel, alert, device); got != tc.want {
+			t.Errorf("levels %q group %v: got %v, want %v", tc.levels, tc.group, got, tc.want)
+		}
+	}
+}
+
+func TestCreateNotificationChannelEnabled(t *testing.T) {
+	useTestDatabase(t)
+	gin.SetMode(gin.TestMode)
+
+	create := func(body string) models.NotificationChannel {
+		t.Helper()
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/api/notification-channels", strings.NewReader(body))
+		c.Request.Header.Set("Content-Type", "application/json")
+		c.Set("userID", uint(1))
+		CreateNotificationChannel(c)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected channel to be created, got %d: %s", w.Code, w.Body.String())
+		}
+		var created struct {
+			Data models.NotificationChannel `json:"data"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &created)
+		var channel models.NotificationChannel
+		database.DB.First(&channel, created.Data.ID)
+		return channel
+	}
+
+	if channel := create(`{"name":"ops","type":"webhook","config":{"url":"https://example.com/hook"}}`); !channel.Enabled {
+		t.Error("Expected new channel to be enabled by default")
+	}
+	if channel := create(`{"name":"muted","type":"webhook","config":{"url":"https://example.com/hook"},"enabled":false}`); channel.Enabled {
+		t.Error("Expected channel created with enabled=false to stay disabled")
+	}
+}
+
+func TestNotificationInternalAddress(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/internal", http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("internal secret"))
+	}))
+	defer server.Close()
+
+	// 配置时拒绝本机和内网地址
+	for _, config := range []string{
+		`{"url":"http://127.0.0.1/hook"}`,
+		`{"url":"http://169.254.169.254/latest/meta-data"}`,
+		`{"url":"http://10.0.0.5/hook"}`,
+		`{"url":"http://[::1]:8080/hook"}`,
+		`{"url":"http://localhost/hook"}`,
+	} {
+		if _, err := parseChannelConfig(models.ChannelTypeWebhook, config); err == nil {
+			t.Errorf("Expected %s to be rejected", config)
+		}
+	}
+	if _, err := parseChannelConfig(models.ChannelTypeEmail, `{"host":"192.168.1.10","from":"a@example.com","to":["b@example.com"]}`); err == nil {
+		t.Error("Expected private SMTP host to be rejected")
+	}
+
+	// 连接时检查实际地址，拒绝后不重试
+	_, err := postNotification(context.Background(), server.URL, nil, []byte("{}"), nil)
+	var failure *deliveryError
+	if !errors.As(err, &failure) || failure.retry || !errors.Is(err, errNotificationAddress) || requests != 0 {
+		t.Fatalf("Expected loopback connection to be refused, got %v (requests %d)", err, requests)
+	}
+
+	// 不跟随重定向，不返回响应内容
+	allowLoopbackNotifications(t)
+	status, err := postNotification(context.Background(), server.URL+"/redirect", nil, []byte("{}"), nil)
+	if status != http.StatusFound || err == nil || requests != 1 {
+		t.Errorf("Expected redirect not to be followed, got %d %v (requests %d)", status, err, requests)
+	}
+	_, err = postNotification(context.Background(), server.URL, nil, []byte("{}"), nil)
+	if err == nil || strings.Contains(err.Error(), "internal secret") {
+		t.Errorf("Expected response body not to be returned, got %v", err)
+	}
+}
@@ -0,0 +1,270 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+	"gorm.io/gorm"
+)
+
+// onCallRotation 值班轮换周期
+const onCallRotation = 7 * 24 * time.Hour
+
+// parseIDList 解析逗号分隔的ID列表
+func parseIDList(s string) ([]uint, error) {
+	var ids []uint
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(item, 10, 64)
+		if err != nil || id == 0 {
+			return nil, fmt.Errorf("invalid id %q", item)
+		}
+		ids = append(ids, uint(id))
+	}
+	return ids, nil
+}
+
+// onCallChannel 值班表在 t 时刻的值班成员(通知渠道ID): 临时替班优先(后创建的优先)，
+// 否则按轮换起点计算当前周的成员，没有成员时返回 0
+func onCallChannel(schedule *models.OnCallSchedule, t int64) uint {
+	for i := len(schedule.Overrides) - 1; i >= 0; i-- {
+		override := schedule.Overrides[i]
+		if t >= override.StartAt && t < override.EndAt {
+			return override.ChannelID
+		}
+	}
+
+	members, _ := parseIDList(schedule.Members)
+	if len(members) == 0 {
+		return 0
+	}
+	period := int64(onCallRotation / time.Second)
+	elapsed := t - schedule.RotationStart
+	week := elapsed / period
+	if elapsed < 0 && elapsed%period != 0 {
+		week--
+	}
+	n := int64(len(members))
+	return members[((week%n)+n)%n]
+}
+
+// checkUserChannels 检查通知渠道都属于用户
+func checkUserChannels(userID uint, ids []uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	unique := make(map[uint]bool)
+	for _, id := range ids {
+		unique[id] = true
+	}
+	var count int64
+	database.DB.Model(&models.NotificationChannel{}).Where("id IN ? AND user_id = ?", ids, userID).Count(&count)
+	if int(count) != len(unique) {
+		return errors.New("Notification channel not found")
+	}
+	return nil
+}
+
+// onCallScheduleInput 创建或修改值班表的请求
+type onCallScheduleInput struct {
+	Name          string `json:"name" binding:"required"`
+	Members       string `json:"members"`
+	RotationStart int64  `json:"rotation_start"`
+}
+
+// userSchedule 获取当前用户的值班表(含临时替班)，不存在时返回 404
+func userSchedule(c *gin.Context) (*models.OnCallSchedule, bool) {
+	userID := c.MustGet("userID").(uint)
+
+	var schedule models.OnCallSchedule
+	if err := database.DB.Preload("Overrides", func(db *gorm.DB) *gorm.DB { return db.Order("id") }).
+		Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&schedule).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "On-call schedule not found"})
+		return nil, false
+	}
+	return &schedule, true
+}
+
+// bindSchedule 校验请求并写入值班表
+func bindSchedule(c *gin.Context, schedule *models.OnCallSchedule) bool {
+	var input onCallScheduleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	members, err := parseIDList(input.Members)
+	if err == nil {
+		err = checkUserChannels(schedule.UserID, members)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+
+	ids := make([]string, len(members))
+	for i, id := range members {
+		ids[i] = strconv.FormatUint(uint64(id), 10)
+	}
+	schedule.Name = input.Name
+	schedule.Members = strings.Join(ids, ",")
+	schedule.RotationStart = input.RotationStart
+	if schedule.RotationStart == 0 {
+		schedule.RotationStart = time.Now().Unix()
+	}
+	return true
+}
+
+// GetOnCallSchedules 获取值班表列表
+func GetOnCallSchedules(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	var schedules []models.OnCallSchedule
+	if err := database.DB.Preload("Overrides", func(db *gorm.DB) *gorm.DB { return db.Order("id") }).
+		Where("user_id = ?", userID).Order("id").Find(&schedules).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get on-call schedules"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": schedules})
+}
+
+// CreateOnCallSchedule 创建值班表，rotation_start 为空时从当前时刻开始轮换
+func CreateOnCallSchedule(c *gin.Context) {
+	schedule := models.OnCallSchedule{UserID: c.MustGet("userID").(uint)}
+	if !bindSchedule(c, &schedule) {
+		return
+	}
+	if err := database.DB.Create(&schedule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create on-call schedule"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": schedule})
+}
+
+// UpdateOnCallSchedule 修改值班表
+func UpdateOnCallSchedule(c *gin.Context) {
+	schedule, ok := userSchedule(c)
+	if !ok || !bindSchedule(c, schedule) {
+		return
+	}
+	if err := database.DB.Omit("Overrides").Save(schedule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update on-call schedule"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": schedule})
+}
+
+// DeleteOnCallSchedule 删除值班表及其临时替班
+func DeleteOnCallSchedule(c *gin.Context) {
+	schedule, ok := userSchedule(c)
+	if !ok {
+		return
+	}
+
+	database.DB.Where("schedule_id = ?", schedule.ID).Delete(&models.OnCallOverride{})
+	if err := database.DB.Delete(schedule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete on-call schedule"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "On-call schedule deleted successfully"})
+}
+
+// GetOnCall 获取值班表在指定时刻(at，Unix 秒，默认当前)的值班成员
+func GetOnCall(c *gin.Context) {
+	schedule, ok := userSchedule(c)
+	if !ok {
+		return
+	}
+	at := time.Now().Unix()
+	if value := c.Query("at"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid at"})
+			return
+		}
+		at = parsed
+	}
+
+	result := gin.H{"at": at, "channel_id": nil, "channel": nil}
+	if channelID := onCallChannel(schedule, at); channelID != 0 {
+		var channel models.NotificationChannel
+		database.DB.Select("id", "name", "type").First(&channel, channelID)
+		result["channel_id"] = channelID
+		result["channel"] = gin.H{"id": channel.ID, "name": channel.Name, "type": channel.Type}
+	}
+	c.JSON(http.StatusOK, gin.H{"data": result})
+}
+
+// CreateOnCallOverride 添加临时替班
+func CreateOnCallOverride(c *gin.Context) {
+	schedule, ok := userSchedule(c)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		ChannelID uint   `json:"channel_id" binding:"required"`
+		StartAt   int64  `json:"start_at" binding:"required"`
+		EndAt     int64  `json:"end_at" binding:"required"`
+		Note      string `json:"note"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.EndAt <= input.StartAt {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "end_at must be after start_at"})
+		return
+	}
+	if err := checkUserChannels(schedule.UserID, []uint{input.ChannelID}); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	override := models.OnCallOverride{
+		ScheduleID: schedule.ID,
+		ChannelID:  input.ChannelID,
+		StartAt:    input.StartAt,
+		EndAt:      input.EndAt,
+		Note:       input.Note,
+	}
+	if err := database.DB.Create(&override).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create override"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": override})
+}
+
+// DeleteOnCallOverride 删除临时替班
+func DeleteOnCallOverride(c *gin.Context) {
+	schedule, ok := userSchedule(c)
+	if !ok {
+		return
+	}
+
+	result := database.DB.Where("id = ? AND schedule_id = ?", c.Param("overrideId"), schedule.ID).Delete(&models.OnCallOverride{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete override"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Override not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Override deleted successfully"})
+}
@@ -0,0 +1,298 @@
+package controllers
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+// 种子语料位于 testdata/fuzz/<Fuzz函数名>，按协议文档的报文布局构造，模糊测试发现的问题输入也保存在该目录作为回归用例。
+// testdata/captures 中的 JSONL 文件其上行帧同样作为种子语料。目前的 zy_tianqi.jsonl 是按抓包导出格式构造的合成数据，
+// 并非现场抓包(对端地址为文档保留地址，token 为占位符)；拿到现场设备的抓包后，
+// 用 GET /api/captures/:id/export 导出并脱敏 token、设备号和对端地址，放入该目录替换或扩充语料。
+// 运行模糊测试: go test ./controllers -run '^$' -fuzz '^FuzzParseZYDataPacket$' -fuzztime 60s
+
+// encodeZYDataPacket 按 ParseZYDataPacket 的布局编码数据包，用于往返测试
+func encodeZYDataPacket(packet *ZYDataPacket) []byte {
+	data := make([]byte, 0, 28+len(packet.Msg_id)+len(packet.Content))
+	data = binary.BigEndian.AppendUint32(data, packet.Total_len)
+	data = append(data, packet.Cmd_code)
+	token := make([]byte, 20)
+	copy(token, packet.Token)
+	data = append(data, token...)
+	data = append(data, byte(len(packet.Msg_id)))
+	data = append(data, packet.Msg_id...)
+	data = binary.BigEndian.AppendUint16(data, uint16(len(packet.Content)))
+	return append(data, packet.Content...)
+}
+
+// encodeContentData 按 parseContentData 的换算规则编码 content，用于往返测试
+func encodeContentData(d *ContentData) ([]byte, error) {
+	var year, month, day, hour, minute, second int
+	if _, err := fmt.Sscanf(d.DateTime, "%d-%d-%d %d:%d:%d", &year, &month, &day, &hour, &minute, &second); err != nil {
+		return nil, err
+	}
+	coordinate := func(value float64) uint32 {
+		raw := uint32(math.Round(math.Abs(value) * 1000000))
+		if math.Signbit(value) {
+			raw |= 0x80000000
+		}
+		return raw
+	}
+
+	data := []byte{d.DeviceType, byte(year - 2000), byte(month), byte(day), byte(hour), byte(minute), byte(second)}
+	data = binary.BigEndian.AppendUint32(data, coordinate(d.Latitude))
+	data = binary.BigEndian.AppendUint32(data, coordinate(d.Longitude))
+	data = binary.BigEndian.AppendUint16(data, uint16(d.Altitude+500))
+	data = append(data, byte(d.SNR), byte(d.Temperature+50), byte(math.Round(d.Voltage*1000/50)))
+	return data, nil
+}
+
+// capturedFrames 读取 testdata/captures 中指定接入方式的上行帧
+func capturedFrames(tb testing.TB, transport string) [][]byte {
+	tb.Helper()
+	files, err := filepath.Glob(filepath.Join("testdata", "captures", "*.jsonl"))
+	if err != nil {
+		tb.Fatalf("Failed to list captures: %v", err)
+	}
+	var frames [][]byte
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			tb.Fatalf("Failed to read %s: %v", file, err)
+		}
+		for i, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var record CaptureRecord
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				tb.Fatalf("%s line %d: %v", file, i+1, err)
+			}
+			if record.Transport != transport || record.Direction != models.CaptureDirectionIn {
+				continue
+			}
+			payload, err := hex.DecodeString(record.Payload)
+			if err != nil {
+				tb.Fatalf("%s line %d: %v", file, i+1, err)
+			}
+			frames = append(frames, payload)
+		}
+	}
+	return frames
+}
+
+// capturedContents 抓包中 ZY TCP 数据包和 HTTP 转发请求携带的 content(十六进制)
+func capturedContents(tb testing.TB) []string {
+	tb.Helper()
+	var contents []string
+	for _, frame := range capturedFrames(tb, models.CaptureTransportZyTCP) {
+		if packet, err := ParseZYDataPacket(frame); err == nil {
+			contents = append(contents, hex.EncodeToString(packet.Content))
+		}
+	}
+	for _, frame := range capturedFrames(tb, models.CaptureTransportHTTPForward) {
+		var data ZyForwardData
+		if err := json.Unmarshal(frame, &data); err != nil {
+			tb.Fatalf("Invalid forward request %s: %v", frame, err)
+		}
+		contents = append(contents, data.Content)
+		contents = append(contents, data.ContentList...)
+	}
+	return contents
+}
+
+func FuzzParseZYDataPacket(f *testing.F) {
+	f.Add(make([]byte, 30))
+	f.Add(append(make([]byte, 25), 0xff))
+	for _, frame := range capturedFrames(f, models.CaptureTransportZyTCP) {
+		f.Add(frame)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		packet, err := ParseZYDataPacket(data)
+		if err != nil {
+			return
+		}
+		if len(packet.Token) != 20 || len(packet.Msg_id) != int(packet.Msg_id_len) || len(packet.Content) != int(packet.Content_len) {
+			t.Fatalf("Inconsistent packet lengths: %+v", packet)
+		}
+
+		// 往返: 重新编码得到原始数据包(不含末尾多余字节)
+		encoded := encodeZYDataPacket(packet)
+		if string(encoded) != string(data[:len(encoded)]) {
+			t.Fatalf("Round trip mismatch:\n got %x\nwant %x", encoded, data[:len(encoded)])
+		}
+	})
+}
+
+func FuzzParseContentData(f *testing.F) {
+	f.Add("")
+	f.Add("11150C15")
+	for _, content := range capturedContents(f) {
+		f.Add(content)
+	}
+
+	f.Fuzz(func(t *testing.T, hexContent string) {
+		data, err := parseContentData(hexContent)
+		if err != nil {
+			return
+		}
+		if _, err := json.Marshal(data.Fields()); err != nil {
+			t.Fatalf("Fields are not JSON serializable: %v", err)
+		}
+
+		// 往返: 编码后得到原 content 的前 20 字节
+		raw, _ := hex.DecodeString(hexContent)
+		encoded, err := encodeContentData(data)
+		if err != nil {
+			t.Fatalf("Failed to encode %+v: %v", data, err)
+		}
+		if string(encoded) != string(raw[:20]) {
+			t.Fatalf("Round trip mismatch:\n got %x\nwant %x", encoded, raw[:20])
+		}
+	})
+}
+
+func FuzzParseMessageData(f *testing.F) {
+	seeds := []struct{ format, raw string }{
+		{`{"header":[{"name":"t","type":"uint8","length":1}],"body":[{"name":"v","type":"int16","length":2,"endian":"big","scale":0.1}],` +
+			`"checksum":{"name":"crc","type":"uint8","length":1},"encoding":"hex"}`, "01ff3838"},
+		{`{"kind":"json","body":[{"name":"lat","type":"float64","path":"gps.lat"},{"name":"v","type":"uint8","path":"items[1].v"}]}`,
+			`{"gps":{"lat":39.9},"items":[{"v":1},{"v":2}]}`},
+		{`{"kind":"delimited","delimiter":",","body":[{"name":"id","type":"string","index":0},{"name":"t","type":"float32","index":1}]}`, "DEV1,25.5"},
+		{`{"kind":"kv","separator":":","body":[{"name":"t","type":"int8","key":"temp"}]}`, "temp:-5,hum:60"},
+		{`"{\"body\":[{\"name\":\"b\",\"type\":\"bytes\",\"length\":3}],\"encoding\":\"base64\"}"`, "AQID"},
+		{`{"body":[{"name":"s","type":"string","length":4}],"encoding":"ascii"}`, "ab\x00d"},
+		{`"`, ""},
+		{"", "00"},
+	}
+	for _, seed := range seeds {
+		f.Add(seed.format, seed.raw)
+	}
+
+	f.Fuzz(func(t *testing.T, formatStr, rawData string) {
+		// 脚本负载的执行由 script_test 覆盖，这里避免每个输入都启动解释器
+		if strings.Contains(formatStr, PayloadKindScript) {
+			return
+		}
+		result, _ := parseMessageData(formatStr, rawData)
+		if result.Success && result.Fields == nil {
+			t.Fatal("Successful result has no fields")
+		}
+	})
+}
+
+// roundTripFormat 覆盖全部定长类型及字节序的二进制格式
+var roundTripFormat = models.MessageFormat{
+	Header: []models.FieldDefinition{
+		{Name: "i8", Type: "int8", Length: 1},
+		{Name: "u8", Type: "uint8", Length: 1},
+	},
+	Body: []models.FieldDefinition{
+		{Name: "i16", Type: "int16", Length: 2, Endian: "big"},
+		{Name: "u16", Type: "uint16", Length: 2, Endian: "little"},
+		{Name: "i32", Type: "int32", Length: 4, Endian: "little"},
+		{Name: "u32", Type: "uint32", Length: 4, Endian: "big"},
+		{Name: "f32", Type: "float32", Length: 4, Endian: "big"},
+		{Name: "f64", Type: "float64", Length: 8, Endian: "little"},
+		{Name: "bytes", Type: "bytes", Length: 3},
+	},
+	Footer: []models.FieldDefinition{
+		{Name: "s", Type: "string", Length: 6},
+	},
+	Checksum: &models.FieldDefinition{Name: "sum", Type: "uint16", Length: 2, Endian: "big"},
+	Encoding: "hex",
+}
+
+// encodeBinaryFields 按格式定义编码字段值(解析器的逆过程)，用于往返测试
+func encodeBinaryFields(format models.MessageFormat, fields map[string]interface{}) []byte {
+	var data []byte
+	sections := [][]models.FieldDefinition{format.Header, format.Body, format.Footer}
+	for _, section := range sections {
+		for _, field := range section {
+			var order binary.AppendByteOrder = binary.LittleEndian
+			if field.Endian == "big" {
+				order = binary.BigEndian
+			}
+			switch value := fields[field.Name].(type) {
+			case int8:
+				data = append(data, byte(value))
+			case uint8:
+				data = append(data, value)
+			case int16:
+				data = order.AppendUint16(data, uint16(value))
+			case uint16:
+				data = order.AppendUint16(data, value)
+			case int32:
+				data = order.AppendUint32(data, uint32(value))
+			case uint32:
+				data = order.AppendUint32(data, value)
+			case float32:
+				data = order.AppendUint32(data, math.Float32bits(value))
+			case float64:
+				data = order.AppendUint64(data, math.Float64bits(value))
+			case []byte:
+				data = append(data, value...)
+			case string:
+				padded := make([]byte, field.Length)
+				copy(padded, value)
+				data = append(data, padded...)
+			}
+		}
+	}
+	if format.Checksum != nil {
+		data = binary.BigEndian.AppendUint16(data, calculateChecksum16(data))
+	}
+	return data
+}
+
+func FuzzBinaryFormatRoundTrip(f *testing.F) {
+	f.Add(int8(-1), uint8(255), int16(-32768), uint16(65535), int32(-1), uint32(1694498818), float32(25.5), 39.909, []byte{1, 2, 3}, "DEV01")
+	f.Add(int8(0), uint8(0), int16(0), uint16(0), int32(0), uint32(0), float32(0), 0.0, []byte{}, "")
+
+	formatStr := mustFormatJSON(f, roundTripFormat)
+	f.Fuzz(func(t *testing.T, i8 int8, u8 uint8, i16 int16, u16 uint16, i32 int32, u32 uint32, f32 float32, f64 float64, raw []byte, s string) {
+		// bytes、string 为定长字段，string 解析时在空字符处截断并去除首尾空白
+		padded := make([]byte, 3)
+		copy(padded, raw)
+		if len(s) > 6 {
+			s = s[:6]
+		}
+
+		input := map[string]interface{}{
+			"i8": i8, "u8": u8, "i16": i16, "u16": u16, "i32": i32, "u32": u32,
+			"f32": f32, "f64": f64, "bytes": padded, "s": s,
+		}
+		encoded := encodeBinaryFields(roundTripFormat, input)
+		result, err := parseMessageData(formatStr, hex.EncodeToString(encoded))
+		if err != nil || !result.Success {
+			t.Fatalf("Failed to decode %x: %v %s", encoded, err, result.Error)
+		}
+
+		input["s"] = strings.TrimSpace(strings.SplitN(s, "\x00", 2)[0])
+		for name, want := range input {
+			got := result.Fields[name]
+			switch w := want.(type) {
+			case float32:
+				if g, ok := got.(float32); !ok || math.Float32bits(g) != math.Float32bits(w) && !(g != g && w != w) {
+					t.Errorf("%s: got %v, want %v", name, got, want)
+				}
+			case float64:
+				if g, ok := got.(float64); !ok || math.Float64bits(g) != math.Float64bits(w) && !(g != g && w != w) {
+					t.Errorf("%s: got %v, want %v", name, got, want)
+				}
+			default:
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("%s: got %#v, want %#v", name, got, want)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,312 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+// 文本类负载类型
+const (
+	PayloadKindBinary    = "binary"
+	PayloadKindJSON      = "json"
+	PayloadKindDelimited = "delimited"
+	PayloadKindKV        = "kv"
+)
+
+// isTextPayloadKind 判断负载类型是否为文本类负载
+func isTextPayloadKind(kind string) bool {
+	switch kind {
+	case PayloadKindJSON, PayloadKindDelimited, PayloadKindKV:
+		return true
+	}
+	return false
+}
+
+// textFields 返回文本负载需要解析的全部字段(报文头、报文体、报文尾)
+func textFields(format models.MessageFormat) []models.FieldDefinition {
+	fields := make([]models.FieldDefinition, 0, len(format.Header)+len(format.Body)+len(format.Footer))
+	fields = append(fields, format.Header...)
+	fields = append(fields, format.Body...)
+	fields = append(fields, format.Footer...)
+	return fields
+}
+
+// parseTextPayload 按负载类型解析文本数据，结果写入 result.Fields
+func parseTextPayload(format models.MessageFormat, data []byte, result *models.ParseResult) error {
+	switch format.Kind {
+	case PayloadKindJSON:
+		return parseJSONPayload(format, data, result)
+	case PayloadKindDelimited:
+		return parseDelimitedPayload(format, data, result)
+	case PayloadKindKV:
+		return parseKVPayload(format, data, result)
+	default:
+		return fmt.Errorf("unsupported payload kind: %s", format.Kind)
+	}
+}
+
+// parseJSONPayload 按 JSON 路径提取字段
+func parseJSONPayload(format models.MessageFormat, data []byte, result *models.ParseResult) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return fmt.Errorf("invalid JSON payload: %v", err)
+	}
+
+	for _, field := range textFields(format) {
+		path := field.Path
+		if path == "" {
+			path = field.Name
+		}
+
+		raw, ok := lookupJSONPath(doc, path)
+		if !ok {
+			return fmt.Errorf("field '%s': path '%s' not found", field.Name, path)
+		}
+
+		value, err := convertJSONValue(raw, field)
+		if err != nil {
+			return fmt.Errorf("field '%s': %v", field.Name, err)
+		}
+		result.Fields[field.Name] = scaleFieldValue(value, field)
+	}
+
+	return nil
+}
+
+// parseDelimitedPayload 按分隔符切分文本，按列序号提取字段
+func parseDelimitedPayload(format models.MessageFormat, data []byte, result *models.ParseResult) error {
+	delimiter := format.Delimiter
+	if delimiter == "" {
+		delimiter = ","
+	}
+
+	line := strings.TrimSpace(string(data))
+	columns := strings.Split(line, delimiter)
+
+	for _, field := range textFields(format) {
+		if field.Index < 0 || field.Index >= len(columns) {
+			return fmt.Errorf("field '%s': column %d out of range (have %d columns)", field.Name, field.Index, len(columns))
+		}
+
+		value, err := convertTextValue(columns[field.Index], field)
+		if err != nil {
+			return fmt.Errorf("field '%s': %v", field.Name, err)
+		}
+		result.Fields[field.Name] = scaleFieldValue(value, field)
+	}
+
+	return nil
+}
+
+// parseKVPayload 解析 key=value 形式的文本，按键名提取字段
+func parseKVPayload(format models.MessageFormat, data []byte, result *models.ParseResult) error {
+	delimiter := format.Delimiter
+	if delimiter == "" {
+		delimiter = ","
+	}
+	separator := format.Separator
+	if separator == "" {
+		separator = "="
+	}
+
+	pairs := make(map[string]string)
+	for _, pair := range strings.Split(strings.TrimSpace(string(data)), delimiter) {
+		key, value, found := strings.Cut(pair, separator)
+		if !found {
+			continue
+		}
+		pairs[strings.TrimSpace(key)] = value
+	}
+
+	for _, field := range textFields(format) {
+		key := field.Key
+		if key == "" {
+			key = field.Name
+		}
+
+		raw, ok := pairs[key]
+		if !ok {
+			return fmt.Errorf("field '%s': key '%s' not found", field.Name, key)
+		}
+
+		value, err := convertTextValue(raw, field)
+		if err != nil {
+			return fmt.Errorf("field '%s': %v", field.Name, err)
+		}
+		result.Fields[field.Name] = scaleFieldValue(value, field)
+	}
+
+	return nil
+}
+
+// lookupJSONPath 按路径查找 JSON 值，支持 a.b[0].c 以及可选的 $. 前缀
+func lookupJSONPath(doc interface{}, path string) (interface{}, bool) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	current := doc
+
+	for _, segment := range strings.Split(path, ".") {
+		if segment == "" {
+			return nil, false
+		}
+
+		// 拆分键名与数组下标，如 items[0][1]
+		name := segment
+		var indexes []string
+		if idx := strings.IndexByte(segment, '['); idx != -1 {
+			name = segment[:idx]
+			rest := segment[idx:]
+			for rest != "" {
+				if rest[0] != '[' {
+					return nil, false
+				}
+				end := strings.IndexByte(rest, ']')
+				if end == -1 {
+					return nil, false
+				}
+				indexes = append(indexes, rest[1:end])
+				rest = rest[end+1:]
+			}
+		}
+
+		if name != "" {
+			obj, ok := current.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if current, ok = obj[name]; !ok {
+				return nil, false
+			}
+		}
+
+		for _, index := range indexes {
+			arr, ok := current.([]interface{})
+			if !ok {
+				return nil, false
+			}
+			i, err := strconv.Atoi(index)
+			if err != nil || i < 0 || i >= len(arr) {
+				return nil, false
+			}
+			current = arr[i]
+		}
+	}
+
+	return current, true
+}
+
+// convertJSONValue 将 JSON 值转换为字段定义的类型，未指定类型时保留原值
+func convertJSONValue(raw interface{}, field models.FieldDefinition) (interface{}, error) {
+	if field.Type == "" {
+		if number, ok := raw.(json.Number); ok {
+			if i, err := number.Int64(); err == nil {
+				return i, nil
+			}
+			return number.Float64()
+		}
+		return raw, nil
+	}
+
+	switch v := raw.(type) {
+	case json.Number:
+		return convertTextValue(v.String(), field)
+	case string:
+		return convertTextValue(v, field)
+	case bool:
+		if field.Type == "string" {
+			return strconv.FormatBool(v), nil
+		}
+		if v {
+			return convertTextValue("1", field)
+		}
+		return convertTextValue("0", field)
+	case nil:
+		return nil, fmt.Errorf("value is null")
+	default:
+		if field.Type != "string" {
+			return nil, fmt.Errorf("cannot convert %T to %s", raw, field.Type)
+		}
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return string(encoded), nil
+	}
+}
+
+// convertTextValue 将文本值转换为字段定义的类型，类型与二进制解析保持一致
+func convertTextValue(raw string, field models.FieldDefinition) (interface{}, error) {
+	text := strings.TrimSpace(raw)
+
+	switch field.Type {
+	case "int8", "int16", "int32":
+		bits := map[string]int{"int8": 8, "int16": 16, "int32": 32}[field.Type]
+		value, err := strconv.ParseInt(text, 10, bits)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s value %q", field.Type, text)
+		}
+		switch field.Type {
+		case "int8":
+			return int8(value), nil
+		case "int16":
+			return int16(value), nil
+		default:
+			return int32(value), nil
+		}
+
+	case "uint8", "uint16", "uint32":
+		bits := map[string]int{"uint8": 8, "uint16": 16, "uint32": 32}[field.Type]
+		value, err := strconv.ParseUint(text, 10, bits)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s value %q", field.Type, text)
+		}
+		switch field.Type {
+		case "uint8":
+			return uint8(value), nil
+		case "uint16":
+			return uint16(value), nil
+		default:
+			return uint32(value), nil
+		}
+
+	case "float32":
+		value, err := strconv.ParseFloat(text, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid float32 value %q", text)
+		}
+		result := float32(value)
+		if field.Decimals > 0 {
+			// 应用小数位数
+			result = float32(int64(result*float32(math.Pow10(field.Decimals)))) / float32(math.Pow10(field.Decimals))
+		}
+		return result, nil
+
+	case "float64":
+		value, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid float64 value %q", text)
+		}
+		if field.Decimals > 0 {
+			// 应用小数位数
+			value = float64(int64(value*math.Pow10(field.Decimals))) / math.Pow10(field.Decimals)
+		}
+		return value, nil
+
+	case "string", "":
+		return text, nil
+
+	case "bytes":
+		return []byte(raw), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported field type: %s", field.Type)
+	}
+}
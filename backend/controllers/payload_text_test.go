@@ -0,0 +1,137 @@
+package controllers
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+func TestParseTextPayload(t *testing.T) {
+	t.Run("JSON payload with paths", func(t *testing.T) {
+		format := models.MessageFormat{
+			Kind: PayloadKindJSON,
+			Body: []models.FieldDefinition{
+				{Name: "latitude", Type: "float64", Path: "$.latitude"},
+				{Name: "temperature", Type: "float32", Path: "data.temperature"},
+				{Name: "humidity", Type: "uint8", Path: "data.humidity"},
+				{Name: "first_reading", Type: "int16", Path: "readings[0].value"},
+				{Name: "status"},
+			},
+		}
+
+		formatJSON, _ := json.Marshal(format)
+		rawData := `{"latitude":39.90923,"status":"online","data":{"temperature":25.5,"humidity":60},"readings":[{"value":-12}]}`
+
+		result, err := parseMessageData(string(formatJSON), rawData)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !result.Success {
+			t.Fatalf("Parsing failed: %s", result.Error)
+		}
+
+		if result.Fields["latitude"] != 39.90923 {
+			t.Errorf("Expected latitude=39.90923, got %v", result.Fields["latitude"])
+		}
+		if result.Fields["temperature"] != float32(25.5) {
+			t.Errorf("Expected temperature=25.5, got %v", result.Fields["temperature"])
+		}
+		if result.Fields["humidity"] != uint8(60) {
+			t.Errorf("Expected humidity=60, got %v", result.Fields["humidity"])
+		}
+		if result.Fields["first_reading"] != int16(-12) {
+			t.Errorf("Expected first_reading=-12, got %v", result.Fields["first_reading"])
+		}
+		if result.Fields["status"] != "online" {
+			t.Errorf("Expected status='online', got %v", result.Fields["status"])
+		}
+	})
+
+	t.Run("JSON payload with missing path", func(t *testing.T) {
+		format := models.MessageFormat{
+			Kind: PayloadKindJSON,
+			Body: []models.FieldDefinition{
+				{Name: "voltage", Type: "float32", Path: "data.voltage"},
+			},
+		}
+
+		formatJSON, _ := json.Marshal(format)
+		result, err := parseMessageData(string(formatJSON), `{"data":{}}`)
+		if err == nil {
+			t.Error("Expected error for missing path, but got none")
+		}
+		if result.Success {
+			t.Error("Expected parsing to fail for missing path")
+		}
+	})
+
+	t.Run("Delimited payload", func(t *testing.T) {
+		format := models.MessageFormat{
+			Kind:      PayloadKindDelimited,
+			Delimiter: ",",
+			Header: []models.FieldDefinition{
+				{Name: "device_id", Type: "string", Index: 0},
+			},
+			Body: []models.FieldDefinition{
+				{Name: "temperature", Type: "float32", Index: 1, Decimals: 1},
+				{Name: "humidity", Type: "uint8", Index: 2},
+			},
+		}
+
+		formatJSON, _ := json.Marshal(format)
+		result, err := parseMessageData(string(formatJSON), "dev001,23.47,55\r\n")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		if result.Fields["device_id"] != "dev001" {
+			t.Errorf("Expected device_id='dev001', got %v", result.Fields["device_id"])
+		}
+		if result.Fields["temperature"] != float32(23.4) {
+			t.Errorf("Expected temperature=23.4, got %v", result.Fields["temperature"])
+		}
+		if result.Fields["humidity"] != uint8(55) {
+			t.Errorf("Expected humidity=55, got %v", result.Fields["humidity"])
+		}
+	})
+
+	t.Run("Hex encoded key=value payload", func(t *testing.T) {
+		format := models.MessageFormat{
+			Kind:      PayloadKindKV,
+			Delimiter: ";",
+			Encoding:  "hex",
+			Body: []models.FieldDefinition{
+				{Name: "voltage", Type: "float64", Key: "V"},
+				{Name: "alarm", Type: "uint8"},
+			},
+		}
+
+		formatJSON, _ := json.Marshal(format)
+		// "V=3.6;alarm=1"
+		result, err := parseMessageData(string(formatJSON), "563d332e363b616c61726d3d31")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		if result.Fields["voltage"] != 3.6 {
+			t.Errorf("Expected voltage=3.6, got %v", result.Fields["voltage"])
+		}
+		if result.Fields["alarm"] != uint8(1) {
+			t.Errorf("Expected alarm=1, got %v", result.Fields["alarm"])
+		}
+	})
+
+	t.Run("Unsupported payload kind", func(t *testing.T) {
+		format := models.MessageFormat{Kind: "xml"}
+
+		formatJSON, _ := json.Marshal(format)
+		result, err := parseMessageData(string(formatJSON), "<a/>")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if result.Success {
+			t.Error("Expected parsing to fail with unsupported payload kind")
+		}
+	})
+}
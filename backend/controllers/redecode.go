@@ -0,0 +1,580 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+	"gorm.io/gorm"
+)
+
+// 重新解析的处理对象
+const (
+	RedecodeTargetAlerts    = "alerts"
+	RedecodeTargetTelemetry = "telemetry"
+	RedecodeTargetAll       = "all"
+)
+
+const (
+	redecodeBatchSize  = 200 // 每批读取的记录数，每批结束后保存一次进度
+	redecodeMaxErrors  = 50  // 任务中保留的错误明细条数
+	redecodeMaxSamples = 10  // 任务中保留的解析前后对比样本条数
+)
+
+var errRedecodeCancelled = errors.New("redecode job cancelled")
+
+// RedecodeError 单条记录的解析错误
+type RedecodeError struct {
+	Target   string `json:"target"`
+	RecordID uint   `json:"record_id"`
+	DeviceID uint   `json:"device_id"`
+	Error    string `json:"error"`
+}
+
+// RedecodeSample 单条记录解析前后的对比
+type RedecodeSample struct {
+	Target    string                 `json:"target"`
+	RecordID  uint                   `json:"record_id"`
+	DeviceID  uint                   `json:"device_id"`
+	Timestamp int64                  `json:"timestamp"`
+	Changed   bool                   `json:"changed"`
+	Before    json.RawMessage        `json:"before"`
+	After     map[string]interface{} `json:"after"`
+}
+
+// redecodeCancels 运行中任务的取消信号
+var (
+	redecodeMu      sync.Mutex
+	redecodeCancels = make(map[uint]chan struct{})
+)
+
+// configPayloadEncoding 配置期望的原始数据编码: hex、base64 或 ascii
+func configPayloadEncoding(config *models.MessageTypeConfig) string {
+	if config.Protocol == ProtocolNMEA {
+		return "ascii"
+	}
+
+	var format struct {
+		Encoding string `json:"encoding"`
+	}
+	json.Unmarshal([]byte(config.Format), &format)
+
+	switch format.Encoding {
+	case "hex", "base64":
+		return format.Encoding
+	default:
+		return "ascii"
+	}
+}
+
+// decodeStoredPayload 按编码还原保存的原始字节
+func decodeStoredPayload(raw, encoding string) ([]byte, error) {
+	switch encoding {
+	case "hex":
+		return hex.DecodeString(raw)
+	case "base64":
+		return base64.StdEncoding.DecodeString(raw)
+	default:
+		return []byte(raw), nil
+	}
+}
+
+// convertStoredPayload 将按 from 配置编码保存的原始数据转换为 to 配置期望的编码，字节内容不变
+func convertStoredPayload(raw string, from, to *models.MessageTypeConfig) (string, error) {
+	fromEncoding := configPayloadEncoding(from)
+	if fromEncoding == configPayloadEncoding(to) {
+		return raw, nil
+	}
+	payload, err := decodeStoredPayload(raw, fromEncoding)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode stored %s payload: %v", fromEncoding, err)
+	}
+	return encodePayloadForConfig(to, payload), nil
+}
+
+// jsonEqual 比较两个 JSON 文本的内容是否相同，无法解析时按字符串比较
+func jsonEqual(a, b string) bool {
+	var va, vb interface{}
+	if json.Unmarshal([]byte(a), &va) != nil || json.Unmarshal([]byte(b), &vb) != nil {
+		return a == b
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+// storedJSON 将保存的解析结果转换为样本中的 JSON，非 JSON 内容按字符串输出
+func storedJSON(data string) json.RawMessage {
+	if data != "" && json.Valid([]byte(data)) {
+		return json.RawMessage(data)
+	}
+	encoded, _ := json.Marshal(data)
+	return encoded
+}
+
+// redecodeRunner 执行一个重新解析任务
+type redecodeRunner struct {
+	job     *models.RedecodeJob
+	config  models.MessageTypeConfig          // 任务指定版本的配置
+	current models.MessageTypeConfig          // 当前配置，用于还原入库时的版本
+	sources map[int]*models.MessageTypeConfig // 入库时使用的配置版本缓存
+	devices []uint
+	errors  []RedecodeError
+	samples []RedecodeSample
+	cancel  chan struct{}
+}
+
+// sourceConfig 记录入库时使用的配置版本，未知时返回 nil(视为与目标版本编码相同)
+func (r *redecodeRunner) sourceConfig(version int) *models.MessageTypeConfig {
+	if version <= 0 {
+		return nil
+	}
+	if config, ok := r.sources[version]; ok {
+		return config
+	}
+
+	var config *models.MessageTypeConfig
+	if v, err := loadConfigVersion(r.current.ID, version); err == nil {
+		c := configAtVersion(r.current, v)
+		config = &c
+	}
+	r.sources[version] = config
+	return config
+}
+
+// decode 使用目标版本解析一条原始数据，返回解析字段及按目标版本编码的原始数据
+func (r *redecodeRunner) decode(raw string, version int) (map[string]interface{}, string, error) {
+	if source := r.sourceConfig(version); source != nil {
+		converted, err := convertStoredPayload(raw, source, &r.config)
+		if err != nil {
+			return nil, raw, err
+		}
+		raw = converted
+	}
+
+	result, err := parseWithConfig(r.config, raw)
+	if err != nil {
+		return nil, raw, err
+	}
+	if !result.Success {
+		return nil, raw, errors.New(result.Error)
+	}
+	return result.Fields, raw, nil
+}
+
+// scope 按设备和时间范围筛选记录
+func (r *redecodeRunner) scope(db *gorm.DB) *gorm.DB {
+	db = db.Where("device_id IN ? AND raw_data <> ''", r.devices)
+	if r.job.StartTime > 0 {
+		db = db.Where("timestamp >= ?", r.job.StartTime)
+	}
+	if r.job.EndTime > 0 {
+		db = db.Where("timestamp <= ?", r.job.EndTime)
+	}
+	return db
+}
+
+// alertQuery 需要重新解析的告警: 使用该配置解析的告警，以及早期以配置ID作为类型、未记录配置的告警
+func (r *redecodeRunner) alertQuery() *gorm.DB {
+	return r.scope(database.DB.Model(&models.Alert{})).
+		Where("config_id = ? OR (config_id = 0 AND type = ?)", r.config.ID, strconv.FormatUint(uint64(r.config.ID), 10))
+}
+
+// telemetryQuery 需要重新解析的遥测数据: 使用该配置解析的记录
+func (r *redecodeRunner) telemetryQuery() *gorm.DB {
+	return r.scope(database.DB.Model(&models.Telemetry{})).Where("config_id = ?", r.config.ID)
+}
+
+func (r *redecodeRunner) includes(target string) bool {
+	return r.job.Target == RedecodeTargetAll || r.job.Target == target
+}
+
+// count 统计待处理的记录数
+func (r *redecodeRunner) count() (int, error) {
+	var total int64
+	if r.includes(RedecodeTargetAlerts) {
+		var n int64
+		if err := r.alertQuery().Count(&n).Error; err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	if r.includes(RedecodeTargetTelemetry) {
+		var n int64
+		if err := r.telemetryQuery().Count(&n).Error; err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return int(total), nil
+}
+
+func (r *redecodeRunner) addError(target string, recordID, deviceID uint, err error) {
+	r.job.Failed++
+	if len(r.errors) < redecodeMaxErrors {
+		r.errors = append(r.errors, RedecodeError{Target: target, RecordID: recordID, DeviceID: deviceID, Error: err.Error()})
+	}
+}
+
+func (r *redecodeRunner) addSample(sample RedecodeSample) {
+	if len(r.samples) < redecodeMaxSamples {
+		r.samples = append(r.samples, sample)
+	}
+}
+
+// processAlert 重新解析一条告警
+func (r *redecodeRunner) processAlert(alert *models.Alert) error {
+	r.job.Processed++
+	fields, raw, err := r.decode(alert.RawData, alert.ConfigVersion)
+	if err != nil {
+		r.addError(RedecodeTargetAlerts, alert.ID, alert.DeviceID, err)
+		return nil
+	}
+	parsed, err := json.Marshal(fields)
+	if err != nil {
+		r.addError(RedecodeTargetAlerts, alert.ID, alert.DeviceID, err)
+		return nil
+	}
+
+	r.job.Succeeded++
+	changed := !jsonEqual(alert.ParsedData, string(parsed))
+	if changed {
+		r.job.Changed++
+	}
+	r.addSample(RedecodeSample{
+		Target:    RedecodeTargetAlerts,
+		RecordID:  alert.ID,
+		DeviceID:  alert.DeviceID,
+		Timestamp: alert.Timestamp,
+		Changed:   changed,
+		Before:    storedJSON(alert.ParsedData),
+		After:     fields,
+	})
+
+	if r.job.DryRun {
+		return nil
+	}
+	return database.DB.Model(alert).UpdateColumns(map[string]interface{}{
+		"raw_data":       raw,
+		"parsed_data":    string(parsed),
+		"config_id":      r.config.ID,
+		"config_version": r.config.Version,
+	}).Error
+}
+
+// processTelemetry 重新解析一条遥测数据，同时更新位置等派生字段
+func (r *redecodeRunner) processTelemetry(telemetry *models.Telemetry) error {
+	r.job.Processed++
+	fields, raw, err := r.decode(telemetry.RawData, telemetry.ConfigVersion)
+	if err != nil {
+		r.addError(RedecodeTargetTelemetry, telemetry.ID, telemetry.DeviceID, err)
+		return nil
+	}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		r.addError(RedecodeTargetTelemetry, telemetry.ID, telemetry.DeviceID, err)
+		return nil
+	}
+
+	r.job.Succeeded++
+	changed := !jsonEqual(telemetry.Data, string(data))
+	if changed {
+		r.job.Changed++
+	}
+	r.addSample(RedecodeSample{
+		Target:    RedecodeTargetTelemetry,
+		RecordID:  telemetry.ID,
+		DeviceID:  telemetry.DeviceID,
+		Timestamp: telemetry.Timestamp,
+		Changed:   changed,
+		Before:    storedJSON(telemetry.Data),
+		After:     fields,
+	})
+
+	if r.job.DryRun {
+		return nil
+	}
+	applyTelemetryFields(telemetry, fields)
+	return database.DB.Model(telemetry).UpdateColumns(map[string]interface{}{
+		"raw_data":       raw,
+		"data":           string(data),
+		"latitude":       telemetry.Latitude,
+		"longitude":      telemetry.Longitude,
+		"altitude":       telemetry.Altitude,
+		"speed":          telemetry.Speed,
+		"course":         telemetry.Course,
+		"config_id":      r.config.ID,
+		"config_version": r.config.Version,
+	}).Error
+}
+
+// checkpoint 保存任务进度，收到取消信号时返回 errRedecodeCancelled
+func (r *redecodeRunner) checkpoint() error {
+	errorsJSON, _ := json.Marshal(r.errors)
+	samplesJSON, _ := json.Marshal(r.samples)
+	r.job.Errors = string(errorsJSON)
+	r.job.Samples = string(samplesJSON)
+	if err := database.DB.Save(r.job).Error; err != nil {
+		return err
+	}
+
+	select {
+	case <-r.cancel:
+		return errRedecodeCancelled
+	default:
+		return nil
+	}
+}
+
+// run 分批处理告警和遥测数据，结束后记录任务状态
+func (r *redecodeRunner) run() {
+	defer func() {
+		if p := recover(); p != nil {
+			r.finish(fmt.Errorf("panic: %v", p))
+		}
+		redecodeMu.Lock()
+		delete(redecodeCancels, r.job.ID)
+		redecodeMu.Unlock()
+	}()
+
+	r.job.Status = models.RedecodeStatusRunning
+	r.job.StartedAt = time.Now().Unix()
+	if err := r.checkpoint(); err != nil {
+		r.finish(err)
+		return
+	}
+
+	if r.includes(RedecodeTargetAlerts) {
+		var alerts []models.Alert
+		err := r.alertQuery().FindInBatches(&alerts, redecodeBatchSize, func(tx *gorm.DB, batch int) error {
+			for i := range alerts {
+				if err := r.processAlert(&alerts[i]); err != nil {
+					return err
+				}
+			}
+			return r.checkpoint()
+		}).Error
+		if err != nil {
+			r.finish(err)
+			return
+		}
+	}
+
+	if r.includes(RedecodeTargetTelemetry) {
+		var records []models.Telemetry
+		err := r.telemetryQuery().FindInBatches(&records, redecodeBatchSize, func(tx *gorm.DB, batch int) error {
+			for i := range records {
+				if err := r.processTelemetry(&records[i]); err != nil {
+					return err
+				}
+			}
+			return r.checkpoint()
+		}).Error
+		if err != nil {
+			r.finish(err)
+			return
+		}
+	}
+
+	r.finish(nil)
+}
+
+// finish 根据结束原因记录任务最终状态
+func (r *redecodeRunner) finish(err error) {
+	switch {
+	case err == nil:
+		r.job.Status = models.RedecodeStatusCompleted
+	case errors.Is(err, errRedecodeCancelled):
+		r.job.Status = models.RedecodeStatusCancelled
+	default:
+		r.job.Status = models.RedecodeStatusFailed
+		r.job.Message = err.Error()
+		log.Printf("Redecode job %d failed: %v", r.job.ID, err)
+	}
+	r.job.FinishedAt = time.Now().Unix()
+
+	errorsJSON, _ := json.Marshal(r.errors)
+	samplesJSON, _ := json.Marshal(r.samples)
+	r.job.Errors = string(errorsJSON)
+	r.job.Samples = string(samplesJSON)
+	if err := database.DB.Save(r.job).Error; err != nil {
+		log.Printf("Failed to save redecode job %d: %v", r.job.ID, err)
+	}
+}
+
+// RecoverRedecodeJobs 服务重启后将未完成的任务标记为失败
+func RecoverRedecodeJobs() {
+	database.DB.Model(&models.RedecodeJob{}).
+		Where("status IN ?", []string{models.RedecodeStatusPending, models.RedecodeStatusRunning}).
+		Updates(map[string]interface{}{
+			"status":      models.RedecodeStatusFailed,
+			"message":     "interrupted by server restart",
+			"finished_at": time.Now().Unix(),
+		})
+}
+
+// CreateRedecodeJob 创建重新解析任务: 使用指定配置版本重新解析设备在时间范围内保存的原始数据
+func CreateRedecodeJob(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	config, ok := userConfigFromParam(c)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Version   int    `json:"version"`    // 配置版本，为空时使用当前版本
+		DeviceIDs []uint `json:"device_ids"` // 设备列表，为空时处理用户的所有设备
+		StartTime int64  `json:"start_time"`
+		EndTime   int64  `json:"end_time"`
+		Target    string `json:"target"` // alerts, telemetry, all(默认)
+		DryRun    bool   `json:"dry_run"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if input.Target == "" {
+		input.Target = RedecodeTargetAll
+	}
+	if input.Target != RedecodeTargetAlerts && input.Target != RedecodeTargetTelemetry && input.Target != RedecodeTargetAll {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "target must be one of alerts, telemetry, all"})
+		return
+	}
+	if input.StartTime > 0 && input.EndTime > 0 && input.EndTime < input.StartTime {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "end_time must not be before start_time"})
+		return
+	}
+
+	if input.Version == 0 {
+		input.Version = config.Version
+	}
+	version, err := loadConfigVersion(config.ID, input.Version)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	// 校验设备归属，未指定时使用用户的所有设备
+	var devices []uint
+	query := database.DB.Model(&models.Device{}).Where("user_id = ?", userID)
+	if len(input.DeviceIDs) > 0 {
+		query = query.Where("id IN ?", input.DeviceIDs)
+	}
+	if err := query.Pluck("id", &devices).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get devices"})
+		return
+	}
+	if len(input.DeviceIDs) > 0 && len(devices) != len(input.DeviceIDs) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+	if len(devices) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No devices to redecode"})
+		return
+	}
+	deviceIDs, _ := json.Marshal(devices)
+
+	job := models.RedecodeJob{
+		UserID:        userID,
+		ConfigID:      config.ID,
+		ConfigVersion: version.Version,
+		DeviceIDs:     string(deviceIDs),
+		StartTime:     input.StartTime,
+		EndTime:       input.EndTime,
+		Target:        input.Target,
+		DryRun:        input.DryRun,
+		Status:        models.RedecodeStatusPending,
+	}
+	runner := &redecodeRunner{
+		job:     &job,
+		config:  configAtVersion(*config, version),
+		current: *config,
+		sources: make(map[int]*models.MessageTypeConfig),
+		devices: devices,
+		errors:  []RedecodeError{},
+		samples: []RedecodeSample{},
+		cancel:  make(chan struct{}),
+	}
+	if job.Total, err = runner.count(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count records"})
+		return
+	}
+	if err := database.DB.Create(&job).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create redecode job"})
+		return
+	}
+
+	// 任务协程会修改 job，响应使用创建时的副本
+	created := job
+	redecodeMu.Lock()
+	redecodeCancels[job.ID] = runner.cancel
+	redecodeMu.Unlock()
+	go runner.run()
+
+	c.JSON(http.StatusOK, gin.H{"data": created})
+}
+
+// GetRedecodeJobs 获取配置的重新解析任务列表
+func GetRedecodeJobs(c *gin.Context) {
+	config, ok := userConfigFromParam(c)
+	if !ok {
+		return
+	}
+
+	var jobs []models.RedecodeJob
+	if err := database.DB.Where("config_id = ?", config.ID).Order("id DESC").Find(&jobs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get redecode jobs"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": jobs})
+}
+
+// GetRedecodeJob 获取重新解析任务的进度、错误和对比样本
+func GetRedecodeJob(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	var job models.RedecodeJob
+	if err := database.DB.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&job).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Redecode job not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": job})
+}
+
+// CancelRedecodeJob 取消运行中的重新解析任务，已处理的批次不会回滚
+func CancelRedecodeJob(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	var job models.RedecodeJob
+	if err := database.DB.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&job).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Redecode job not found"})
+		return
+	}
+
+	redecodeMu.Lock()
+	cancel, ok := redecodeCancels[job.ID]
+	if ok {
+		close(cancel)
+		delete(redecodeCancels, job.ID)
+	}
+	redecodeMu.Unlock()
+
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Redecode job is not running"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Redecode job cancellation requested"})
+}
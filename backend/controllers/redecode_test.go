@@ -0,0 +1,295 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+	"gorm.io/gorm"
+)
+
+func TestConvertStoredPayload(t *testing.T) {
+	hexConfig := models.MessageTypeConfig{Format: `{"encoding":"hex"}`}
+	base64Config := models.MessageTypeConfig{Format: `{"encoding":"base64"}`}
+	nmeaConfig := models.MessageTypeConfig{Protocol: ProtocolNMEA, Format: `{"encoding":"hex"}`}
+
+	if encoding := configPayloadEncoding(&nmeaConfig); encoding != "ascii" {
+		t.Errorf("Expected NMEA config to use ascii, got %s", encoding)
+	}
+
+	converted, err := convertStoredPayload("0102ff", &hexConfig, &base64Config)
+	if err != nil || converted != "AQL/" {
+		t.Errorf("Expected AQL/, got %q (%v)", converted, err)
+	}
+
+	converted, err = convertStoredPayload("0102ff", &hexConfig, &hexConfig)
+	if err != nil || converted != "0102ff" {
+		t.Errorf("Expected payload to be unchanged, got %q (%v)", converted, err)
+	}
+
+	if _, err := convertStoredPayload("zz", &hexConfig, &base64Config); err == nil {
+		t.Error("Expected error for invalid hex payload")
+	}
+}
+
+func TestJSONEqual(t *testing.T) {
+	if !jsonEqual(`{"a":1,"b":[1,2]}`, `{"b":[1,2],"a":1.0}`) {
+		t.Error("Expected equivalent JSON to be equal")
+	}
+	if jsonEqual(`{"a":1}`, `{"a":2}`) {
+		t.Error("Expected different JSON to differ")
+	}
+	if !jsonEqual("not json", "not json") || jsonEqual("", `{}`) {
+		t.Error("Unexpected comparison result for non-JSON data")
+	}
+}
+
+func TestRedecodeRunnerDecode(t *testing.T) {
+	oldVersion := configAtVersion(models.MessageTypeConfig{}, formatVersion(t, 1, models.MessageFormat{
+		Encoding: "hex",
+		Body: []models.FieldDefinition{
+			{Name: "temperature", Type: "uint8", Offset: 0, Length: 1},
+		},
+	}))
+	newVersion := configAtVersion(models.MessageTypeConfig{}, formatVersion(t, 2, models.MessageFormat{
+		Encoding: "base64",
+		Body: []models.FieldDefinition{
+			{Name: "temperature", Type: "int16", Offset: 0, Length: 2, Endian: "big"},
+		},
+	}))
+
+	runner := &redecodeRunner{
+		job:     &models.RedecodeJob{},
+		config:  newVersion,
+		sources: map[int]*models.MessageTypeConfig{1: &oldVersion},
+	}
+
+	// 入库时按版本 1 的 hex 编码保存，重新解析前转换为版本 2 的 base64 编码
+	fields, raw, err := runner.decode("ff38", 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if raw != "/zg=" {
+		t.Errorf("Expected raw data to be re-encoded as /zg=, got %s", raw)
+	}
+	if value, _ := fieldFloat(fields, "temperature"); value != -200 {
+		t.Errorf("Expected temperature -200, got %v", fields["temperature"])
+	}
+
+	if _, _, err := runner.decode("AQ==", 0); err == nil {
+		t.Error("Expected error for payload shorter than the format")
+	}
+}
+
+// createRedecodeConfig 创建单字节温度格式的配置并记录初始版本
+func createRedecodeConfig(t *testing.T) models.MessageTypeConfig {
+	t.Helper()
+	config := models.MessageTypeConfig{UserID: 1, Name: "meter", Protocol: "mqtt",
+		Format: `{"encoding":"hex","body":[{"name":"temperature","type":"uint8","offset":0,"length":1}]}`}
+	database.DB.Create(&config)
+	if err := ensureConfigVersioned(&config); err != nil {
+		t.Fatalf("Failed to version config: %v", err)
+	}
+	return config
+}
+
+// startRedecodeJob 通过接口创建任务并等待任务结束
+func startRedecodeJob(t *testing.T, configID uint, body string) (int, models.RedecodeJob) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/message-types/redecode-jobs", bytes.NewBufferString(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	c.Params = gin.Params{{Key: "id", Value: fmt.Sprint(configID)}}
+	c.Set("userID", uint(1))
+	CreateRedecodeJob(c)
+
+	var response struct {
+		Data models.RedecodeJob `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if w.Code != http.StatusOK {
+		return w.Code, response.Data
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var job models.RedecodeJob
+		database.DB.First(&job, response.Data.ID)
+		switch job.Status {
+		case models.RedecodeStatusCompleted, models.RedecodeStatusFailed, models.RedecodeStatusCancelled:
+			return w.Code, job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Redecode job %d did not finish: %+v", job.ID, job)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRedecodeJob(t *testing.T) {
+	useTestDatabase(t)
+	gin.SetMode(gin.TestMode)
+	config := createRedecodeConfig(t)
+
+	first := models.Device{Name: "first", Topic: "meters/1", UserID: 1}
+	second := models.Device{Name: "second", Topic: "meters/2", UserID: 1}
+	unselected := models.Device{Name: "unselected", Topic: "meters/3", UserID: 1}
+	foreign := models.Device{Name: "foreign", Topic: "meters/4", UserID: 2}
+	for _, device := range []*models.Device{&first, &second, &unselected, &foreign} {
+		database.DB.Create(device)
+	}
+
+	alerts := []models.Alert{
+		{DeviceID: first.ID, Type: "warning", RawData: "05", ParsedData: `{"temperature":1}`, ConfigID: config.ID, Timestamp: 1000},  // 结果变化
+		{DeviceID: second.ID, Type: "warning", RawData: "zz", ParsedData: `{"temperature":2}`, ConfigID: config.ID, Timestamp: 1200}, // 解析失败
+		{DeviceID: first.ID, Type: "warning", RawData: "09", ParsedData: `{"temperature":1}`, ConfigID: config.ID, Timestamp: 5000},  // 超出时间范围
+		{DeviceID: unselected.ID, Type: "warning", RawData: "09", ParsedData: `{"temperature":1}`, ConfigID: config.ID, Timestamp: 1000},
+	}
+	for i := range alerts {
+		database.DB.Create(&alerts[i])
+	}
+	telemetry := models.Telemetry{DeviceID: first.ID, RawData: "07", Data: `{"temperature":7}`, ConfigID: config.ID, Timestamp: 1500} // 结果不变
+	database.DB.Create(&telemetry)
+
+	request := fmt.Sprintf(`{"device_ids":[%d,%d],"start_time":500,"end_time":2000,"dry_run":true}`, first.ID, second.ID)
+	code, job := startRedecodeJob(t, config.ID, request)
+	if code != http.StatusOK || job.Status != models.RedecodeStatusCompleted {
+		t.Fatalf("Expected dry run to complete, got %d %+v", code, job)
+	}
+	if job.Total != 3 || job.Processed != 3 || job.Succeeded != 2 || job.Failed != 1 || job.Changed != 1 || job.ConfigVersion != config.Version {
+		t.Errorf("Unexpected progress %+v", job)
+	}
+	var errs []RedecodeError
+	json.Unmarshal([]byte(job.Errors), &errs)
+	if len(errs) != 1 || errs[0].RecordID != alerts[1].ID || errs[0].DeviceID != second.ID {
+		t.Errorf("Unexpected errors %s", job.Errors)
+	}
+	var samples []RedecodeSample
+	json.Unmarshal([]byte(job.Samples), &samples)
+	if len(samples) != 2 || samples[0].RecordID != alerts[0].ID || !samples[0].Changed ||
+		string(samples[0].Before) != `{"temperature":1}` || fmt.Sprint(samples[0].After["temperature"]) != "5" ||
+		samples[1].Target != RedecodeTargetTelemetry || samples[1].Changed {
+		t.Errorf("Unexpected samples %s", job.Samples)
+	}
+
+	// 预览不修改数据
+	var alert models.Alert
+	database.DB.First(&alert, alerts[0].ID)
+	if alert.ParsedData != `{"temperature":1}` || alert.ConfigVersion != 0 {
+		t.Fatalf("Expected dry run to leave alert untouched, got %+v", alert)
+	}
+
+	code, job = startRedecodeJob(t, config.ID, fmt.Sprintf(`{"device_ids":[%d,%d],"start_time":500,"end_time":2000,"target":"alerts"}`, first.ID, second.ID))
+	if code != http.StatusOK || job.Status != models.RedecodeStatusCompleted || job.Total != 2 || job.Changed != 1 {
+		t.Fatalf("Unexpected job %d %+v", code, job)
+	}
+	database.DB.First(&alert, alerts[0].ID)
+	if !jsonEqual(alert.ParsedData, `{"temperature":5}`) || alert.ConfigVersion != config.Version {
+		t.Errorf("Expected alert to be redecoded, got %+v", alert)
+	}
+	for _, untouched := range []models.Alert{alerts[1], alerts[2], alerts[3]} {
+		var alert models.Alert
+		database.DB.First(&alert, untouched.ID)
+		if alert.ParsedData != untouched.ParsedData || alert.ConfigVersion != 0 {
+			t.Errorf("Expected alert %d to stay untouched, got %+v", untouched.ID, alert)
+		}
+	}
+
+	// 只能选择自己的设备
+	if code, _ := startRedecodeJob(t, config.ID, fmt.Sprintf(`{"device_ids":[%d]}`, foreign.ID)); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for another user's device, got %d", code)
+	}
+	if code, _ := startRedecodeJob(t, config.ID, `{"start_time":2000,"end_time":1000}`); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid time range, got %d", code)
+	}
+}
+
+func TestRedecodeJobBatchesAndCancel(t *testing.T) {
+	useTestDatabase(t)
+	config := createRedecodeConfig(t)
+	device := models.Device{Name: "meter", Topic: "meters/1", UserID: 1}
+	database.DB.Create(&device)
+	records := make([]models.Telemetry, redecodeBatchSize+50)
+	for i := range records {
+		records[i] = models.Telemetry{DeviceID: device.ID, RawData: "05", Data: `{}`, ConfigID: config.ID, Timestamp: int64(i)}
+	}
+	database.DB.CreateInBatches(records, 100)
+
+	newRunner := func() *redecodeRunner {
+		version, _ := loadConfigVersion(config.ID, config.Version)
+		job := &models.RedecodeJob{UserID: 1, ConfigID: config.ID, ConfigVersion: config.Version, Target: RedecodeTargetAll, Status: models.RedecodeStatusPending}
+		database.DB.Create(job)
+		return &redecodeRunner{job: job, config: configAtVersion(config, version), current: config,
+			sources: make(map[int]*models.MessageTypeConfig), devices: []uint{device.ID}, cancel: make(chan struct{})}
+	}
+
+	// 每批结束后保存进度，第一批结束后取消，已处理的批次保留
+	cancelled := newRunner()
+	var checkpoints []int
+	database.DB.Callback().Update().After("gorm:update").Register("test:redecode_checkpoint", func(db *gorm.DB) {
+		if job, ok := db.Statement.Dest.(*models.RedecodeJob); ok && job.ID == cancelled.job.ID && job.Status == models.RedecodeStatusRunning {
+			checkpoints = append(checkpoints, job.Processed)
+			if job.Processed == redecodeBatchSize {
+				close(cancelled.cancel)
+			}
+		}
+	})
+	cancelled.run()
+
+	var job models.RedecodeJob
+	database.DB.First(&job, cancelled.job.ID)
+	if job.Status != models.RedecodeStatusCancelled || job.Processed != redecodeBatchSize || job.FinishedAt == 0 {
+		t.Fatalf("Expected job to be cancelled after the first batch, got %+v", job)
+	}
+	if len(checkpoints) != 2 || checkpoints[0] != 0 || checkpoints[1] != redecodeBatchSize {
+		t.Errorf("Expected checkpoints at start and after the first batch, got %v", checkpoints)
+	}
+	var redecoded int64
+	database.DB.Model(&models.Telemetry{}).Where("config_version = ?", config.Version).Count(&redecoded)
+	if redecoded != redecodeBatchSize {
+		t.Errorf("Expected %d records to be redecoded before cancel, got %d", redecodeBatchSize, redecoded)
+	}
+
+	// 未取消时处理全部批次
+	runner := newRunner()
+	runner.run()
+	var completed models.RedecodeJob
+	database.DB.First(&completed, runner.job.ID)
+	if completed.Status != models.RedecodeStatusCompleted || completed.Processed != len(records) || completed.Succeeded != len(records) {
+		t.Errorf("Expected all batches to be processed, got %+v", completed)
+	}
+}
+
+func TestRecoverRedecodeJobs(t *testing.T) {
+	useTestDatabase(t)
+
+	jobs := []models.RedecodeJob{
+		{Status: models.RedecodeStatusPending},
+		{Status: models.RedecodeStatusRunning},
+		{Status: models.RedecodeStatusCompleted},
+	}
+	for i := range jobs {
+		database.DB.Create(&jobs[i])
+	}
+	RecoverRedecodeJobs()
+
+	want := []string{models.RedecodeStatusFailed, models.RedecodeStatusFailed, models.RedecodeStatusCompleted}
+	for i := range jobs {
+		var job models.RedecodeJob
+		database.DB.First(&job, jobs[i].ID)
+		if job.Status != want[i] {
+			t.Errorf("Job %d: expected %s, got %s", i, want[i], job.Status)
+		}
+		if want[i] == models.RedecodeStatusFailed && (job.Message == "" || job.FinishedAt == 0) {
+			t.Errorf("Job %d: expected interruption to be recorded, got %+v", i, job)
+		}
+	}
+}
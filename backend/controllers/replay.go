@@ -0,0 +1,380 @@
+package controllers
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+// ReplayOptions 回放选项
+type ReplayOptions struct {
+	// Config 不为空时 MQTT 负载和 ZY 内容都使用该配置解析，否则按数据库中设备绑定的配置解析
+	Config *models.MessageTypeConfig
+}
+
+// ReplayResult 一帧上行数据的回放结果，只解析不写入数据库
+type ReplayResult struct {
+	Index     int                    `json:"index"` // 帧在抓包文件中的序号(从 0 开始)
+	Time      time.Time              `json:"ts"`
+	Device    string                 `json:"device"`
+	Transport string                 `json:"transport"`
+	Success   bool                   `json:"success"`
+	Error     string                 `json:"error,omitempty"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+	Note      string                 `json:"note,omitempty"` // 抓包时记录的处理结果，便于对比
+}
+
+// ReplaySummary 回放统计
+type ReplaySummary struct {
+	Frames    int `json:"frames"`
+	Replayed  int `json:"replayed"`
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+	Skipped   int `json:"skipped"` // 下行帧不解析
+}
+
+func (s *ReplaySummary) add(result ReplayResult) {
+	s.Replayed++
+	if result.Success {
+		s.Succeeded++
+	} else {
+		s.Failed++
+	}
+}
+
+// replayConfigFor 查找设备绑定的配置，没有数据库或未绑定时返回 nil
+func replayConfigFor(topic string, withDefault bool) *models.MessageTypeConfig {
+	if database.DB == nil {
+		return nil
+	}
+	device, err := findDeviceByTopic(topic)
+	if err != nil {
+		return nil
+	}
+	if withDefault {
+		config, _, _ := resolveMessageConfig(device, topic)
+		return config
+	}
+	config, _ := boundMessageConfig(device, topic)
+	return config
+}
+
+// replayPayload 使用配置解析负载
+func replayPayload(config *models.MessageTypeConfig, payload []byte) (map[string]interface{}, error) {
+	result, err := parseWithConfig(*config, encodePayloadForConfig(config, payload))
+	if err != nil {
+		return nil, err
+	}
+	if !result.Success {
+		return nil, errors.New(result.Error)
+	}
+	return result.Fields, nil
+}
+
+// replayZyContent 按 ZY TCP 接入的顺序解析定位内容: 绑定的配置、NMEA 语句、中移终端内容格式
+func replayZyContent(topic string, content []byte, opts ReplayOptions) (map[string]interface{}, error) {
+	config := opts.Config
+	if config == nil {
+		config = replayConfigFor(topic, false)
+	}
+	if config != nil {
+		return replayPayload(config, content)
+	}
+	if isNMEAPayload(content) {
+		result, err := parseNMEAData(string(content))
+		if err != nil {
+			return nil, err
+		}
+		if !result.Success {
+			return nil, errors.New(result.Error)
+		}
+		return result.Fields, nil
+	}
+	data, err := parseContentData(hex.EncodeToString(content))
+	if err != nil {
+		return nil, err
+	}
+	return data.Fields(), nil
+}
+
+// replayZyForward 解析 HTTP 转发的 JSON 请求体中的全部内容
+func replayZyForward(payload []byte, opts ReplayOptions) (map[string]interface{}, error) {
+	var data ZyForwardData
+	if err := json.Unmarshal(payload, &data); err != nil {
+		return nil, fmt.Errorf("invalid forward request: %v", err)
+	}
+
+	// 与 HandleZyForwardData 相同: dataCount 大于 1 时使用 contentList
+	var contents []string
+	if data.DataCount > 1 {
+		contents = data.ContentList
+	} else if data.Content != "" {
+		contents = []string{data.Content}
+	}
+
+	items := make([]interface{}, 0, len(contents))
+	for i, content := range contents {
+		if content == "" {
+			continue
+		}
+		var fields map[string]interface{}
+		var err error
+		switch {
+		case opts.Config != nil:
+			var raw []byte
+			if raw, err = hex.DecodeString(content); err == nil {
+				fields, err = replayPayload(opts.Config, raw)
+			}
+		case database.DB != nil:
+			fields, _, err = decodeZyForwardContent(data, content)
+		default:
+			var parsed *ContentData
+			if parsed, err = parseContentData(content); err == nil {
+				fields = parsed.Fields()
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("content %d: %v", i, err)
+		}
+		items = append(items, fields)
+	}
+
+	if len(items) == 0 {
+		return nil, errors.New("no content data")
+	}
+	if len(items) == 1 {
+		return items[0].(map[string]interface{}), nil
+	}
+	return map[string]interface{}{"items": items}, nil
+}
+
+// replayFrame 将一帧上行数据送入对应接入方式的解析流程
+func replayFrame(index int, record CaptureRecord, opts ReplayOptions) ReplayResult {
+	result := ReplayResult{Index: index, Time: record.Time, Device: record.Device, Transport: record.Transport, Note: record.Note}
+	fields, err := func() (map[string]interface{}, error) {
+		payload, err := hex.DecodeString(record.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("invalid payload_hex: %v", err)
+		}
+
+		switch record.Transport {
+		case models.CaptureTransportZyTCP:
+			packet, err := ParseZYDataPacket(payload)
+			if err != nil {
+				return nil, err
+			}
+			topic := strings.TrimSpace(string(packet.Msg_id))
+			result.Device = topic
+			fields := map[string]interface{}{}
+			if packet.Cmd_code == 0x01 {
+				fields, err = replayZyContent(topic, packet.Content, opts)
+			} else if data, parseErr := parseContentData(hex.EncodeToString(packet.Content)); parseErr == nil {
+				fields = data.Fields()
+			} else {
+				err = parseErr
+			}
+			if err != nil {
+				return nil, err
+			}
+			fields["cmd_code"] = packet.Cmd_code
+			return fields, nil
+
+		case models.CaptureTransportMQTT:
+			config := opts.Config
+			topic := record.Peer
+			if topic == "" {
+				topic = record.Device
+			}
+			if config == nil {
+				config = replayConfigFor(topic, true)
+			}
+			if config == nil {
+				return nil, errors.New("no message config for topic " + topic + ", specify a format or database")
+			}
+			return replayPayload(config, payload)
+
+		case models.CaptureTransportHTTPForward:
+			return replayZyForward(payload, opts)
+
+		default:
+			return nil, fmt.Errorf("unsupported transport %q", record.Transport)
+		}
+	}()
+
+	if err != nil {
+		result.Error = err.Error()
+		if record.Truncated {
+			result.Error += " (frame was truncated during capture)"
+		}
+		return result
+	}
+	result.Success = true
+	result.Fields = fields
+	return result
+}
+
+// ReplayCapture 读取 JSONL 抓包文件，逐帧回放上行数据并将结果按 JSONL 写入 w
+func ReplayCapture(r io.Reader, w io.Writer, opts ReplayOptions) (ReplaySummary, error) {
+	var summary ReplaySummary
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*captureMaxFrameSize)
+	encoder := json.NewEncoder(w)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var record CaptureRecord
+		if err := json.Unmarshal([]byte(text), &record); err != nil {
+			return summary, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		index := summary.Frames
+		summary.Frames++
+		if record.Direction != models.CaptureDirectionIn {
+			summary.Skipped++
+			continue
+		}
+		result := replayFrame(index, record, opts)
+		summary.add(result)
+		if err := encoder.Encode(result); err != nil {
+			return summary, err
+		}
+	}
+	return summary, scanner.Err()
+}
+
+// RunReplayCommand replay 子命令: 离线回放抓包文件，默认不连接数据库，
+// -db 指定数据库副本时按设备绑定的配置解析，-format 指定格式文件时使用该格式解析
+func RunReplayCommand(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	dbPath := flags.String("db", "", "database copy used to resolve device configs")
+	formatPath := flags.String("format", "", "message format JSON used to decode payloads")
+	protocol := flags.String("protocol", "mqtt", "protocol of the message format")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: replay [-db mqtt_app.db] [-format format.json] [-protocol mqtt] capture.jsonl")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	var opts ReplayOptions
+	if *formatPath != "" {
+		content, err := os.ReadFile(*formatPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read format: %v\n", err)
+			return 1
+		}
+		validation := validateMessageFormat(*protocol, string(content))
+		if !validation.Valid {
+			for _, issue := range validation.Errors {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", issue.Path, issue.Message)
+			}
+			return 1
+		}
+		opts.Config = &models.MessageTypeConfig{Name: *formatPath, Protocol: *protocol, Format: validation.Format}
+	}
+	if *dbPath != "" {
+		database.ConnectDatabaseAt(*dbPath)
+	}
+
+	input := os.Stdin
+	if path := flags.Arg(0); path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open capture: %v\n", err)
+			return 1
+		}
+		defer file.Close()
+		input = file
+	}
+
+	output := bufio.NewWriter(os.Stdout)
+	summary, err := ReplayCapture(input, output, opts)
+	output.Flush()
+	fmt.Fprintf(os.Stderr, "frames=%d replayed=%d succeeded=%d failed=%d skipped=%d\n",
+		summary.Frames, summary.Replayed, summary.Succeeded, summary.Failed, summary.Skipped)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Replay failed: %v\n", err)
+		return 1
+	}
+	if summary.Failed > 0 {
+		return 3
+	}
+	return 0
+}
+
+// ReplayCaptureSession 回放会话记录的上行帧，可传入 format 验证修改后的格式能否解析
+func ReplayCaptureSession(c *gin.Context) {
+	session, ok := userCaptureSession(c)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Protocol string          `json:"protocol"`
+		Format   json.RawMessage `json:"format"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	var opts ReplayOptions
+	if len(input.Format) > 0 {
+		format := string(input.Format)
+		var text string
+		if json.Unmarshal(input.Format, &text) == nil {
+			format = text
+		}
+		validation := validateMessageFormat(input.Protocol, format)
+		if !validation.Valid {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message format", "data": validation})
+			return
+		}
+		opts.Config = &models.MessageTypeConfig{Protocol: input.Protocol, Format: validation.Format}
+	}
+
+	var summary ReplaySummary
+	results := []ReplayResult{}
+	err := eachCapturedFrame(session.ID, func(frame *models.CapturedFrame) error {
+		index := summary.Frames
+		summary.Frames++
+		if frame.Direction != models.CaptureDirectionIn {
+			summary.Skipped++
+			return nil
+		}
+		result := replayFrame(index, captureRecord(session, frame), opts)
+		summary.add(result)
+		results = append(results, result)
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read captured frames"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": results, "summary": summary})
+}
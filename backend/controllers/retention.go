@@ -0,0 +1,445 @@
+package controllers
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+	"gorm.io/gorm"
+)
+
+const (
+	// retentionBatchSize 每批删除的记录数，每批使用单独的事务，避免长时间占用数据库写锁
+	retentionBatchSize = 500
+	// retentionBatchPause 批次之间的暂停，让数据接入等其他写入获得数据库锁
+	retentionBatchPause = 50 * time.Millisecond
+	// retentionCheckInterval 检查清理和压缩计划的间隔
+	retentionCheckInterval = time.Minute
+)
+
+// retentionArchiveDir 清理前归档数据的保存目录
+var retentionArchiveDir = "archives"
+
+// errRetentionRunning 已有清理任务在执行
+var errRetentionRunning = errors.New("a retention run is already in progress")
+
+// retentionMu 保证同一时刻只有一个清理任务
+var retentionMu sync.Mutex
+
+// retentionTarget 一种数据的清理方式
+type retentionTarget struct {
+	table string
+	// expired 返回早于 cutoff 的数据的查询条件
+	expired func(db *gorm.DB, cutoff time.Time) *gorm.DB
+	// grouped 数据属于设备，可以按设备分组设置策略
+	grouped bool
+	// cleanup 删除记录前删除其关联数据
+	cleanup func(tx *gorm.DB, ids []uint) error
+}
+
+// retentionTargets 支持设置保留策略的数据类型，deleted 单独处理
+var retentionTargets = map[string]retentionTarget{
+	models.RetentionTargetAlerts: {
+		table: "alerts",
+		// 持续发生的告警以最后发生时间为准
+		expired: func(db *gorm.DB, cutoff time.Time) *gorm.DB {
+			return db.Where("timestamp < ? AND last_seen < ?", cutoff.Unix(), cutoff.Unix())
+		},
+		grouped: true,
+		cleanup: deleteDependents("alert_id", &models.AlertComment{}, &models.AlertEvent{}, &models.AlertEscalation{}, &models.NotificationDelivery{}),
+	},
+	models.RetentionTargetTelemetry: {
+		table: "telemetries",
+		expired: func(db *gorm.DB, cutoff time.Time) *gorm.DB {
+			return db.Where("timestamp < ?", cutoff.Unix())
+		},
+		grouped: true,
+	},
+	models.RetentionTargetDeliveries: {
+		table: "notification_deliveries",
+		expired: func(db *gorm.DB, cutoff time.Time) *gorm.DB {
+			return db.Where("created_at < ?", cutoff)
+		},
+	},
+}
+
+// deleteDependents 返回删除关联数据的清理函数: 永久删除各模型中 column 引用了待删除记录的数据
+func deleteDependents(column string, dependents ...interface{}) func(tx *gorm.DB, ids []uint) error {
+	return func(tx *gorm.DB, ids []uint) error {
+		for _, model := range dependents {
+			if err := tx.Unscoped().Where(column+" IN ?", ids).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// softDeleteModel 使用软删除的模型，cleanup 在永久删除记录前删除其关联数据
+type softDeleteModel struct {
+	model   interface{}
+	cleanup func(tx *gorm.DB, ids []uint) error
+}
+
+// softDeleteModels deleted 策略永久删除其中已软删除的记录。用户、设备、设备组、消息配置及版本、
+// 通知渠道和值班表被其他数据引用，且引用数据不随之删除，永久删除会留下孤立数据，因此不在其中
+var softDeleteModels = []softDeleteModel{
+	{model: &models.Alert{}, cleanup: retentionTargets[models.RetentionTargetAlerts].cleanup},
+	{model: &models.Telemetry{}},
+	{model: &models.MessageType{}},
+	{model: &models.JT808Terminal{}}, {model: &models.LoRaWANDevice{}}, {model: &models.ModbusDevice{}},
+	{model: &models.TopicConfigBinding{}},
+	{model: &models.RedecodeJob{}},
+	{model: &models.CaptureSession{}, cleanup: deleteDependents("session_id", &models.CapturedFrame{})},
+	{model: &models.AlertRule{}, cleanup: deleteDependents("rule_id", &models.AlertRuleState{})},
+	{model: &models.AlertRuleState{}}, {model: &models.AlertEvent{}}, {model: &models.AlertComment{}},
+	{model: &models.NotificationDelivery{}},
+	{model: &models.OnCallOverride{}},
+	{model: &models.EscalationPolicy{}, cleanup: deleteDependents("policy_id", &models.AlertEscalation{})},
+	{model: &models.AlertEscalation{}},
+	{model: &models.Silence{}}, {model: &models.ExportJob{}},
+	{model: &models.RetentionPolicy{}}, {model: &models.RetentionRun{}},
+}
+
+// RetentionResult 一条保留策略的清理结果
+type RetentionResult struct {
+	PolicyID uint     `json:"policy_id"`
+	Target   string   `json:"target"`
+	GroupID  *uint    `json:"group_id,omitempty"`
+	Purged   int      `json:"purged"`
+	Archived int      `json:"archived"`
+	Archives []string `json:"archives,omitempty"` // 归档文件名
+	Error    string   `json:"error,omitempty"`
+}
+
+// retentionArchive 归档文件(gzip 压缩的 JSON Lines)，写入第一批数据时才创建
+type retentionArchive struct {
+	path string
+	file *os.File
+	gz   *gzip.Writer
+	enc  *json.Encoder
+	rows int
+}
+
+func (a *retentionArchive) write(rows []map[string]interface{}) error {
+	if a.file == nil {
+		if err := os.MkdirAll(filepath.Dir(a.path), 0755); err != nil {
+			return err
+		}
+		file, err := os.Create(a.path)
+		if err != nil {
+			return err
+		}
+		a.file = file
+		a.gz = gzip.NewWriter(file)
+		a.enc = json.NewEncoder(a.gz)
+	}
+	for _, row := range rows {
+		if err := a.enc.Encode(row); err != nil {
+			return err
+		}
+		a.rows++
+	}
+	return nil
+}
+
+func (a *retentionArchive) close() error {
+	if a.file == nil {
+		return nil
+	}
+	err := a.gz.Close()
+	if closeErr := a.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// tableName 模型对应的表名
+func tableName(model interface{}) string {
+	stmt := &gorm.Statement{DB: database.DB}
+	if err := stmt.Parse(model); err != nil {
+		return ""
+	}
+	return stmt.Schema.Table
+}
+
+// retentionRunner 执行一次清理任务
+type retentionRunner struct {
+	run     *models.RetentionRun
+	now     time.Time
+	purge   bool
+	vacuum  bool
+	results []RetentionResult
+}
+
+// purgeBatches 分批永久删除 scope 匹配的记录，archive 不为空时先归档再删除，返回删除的记录数
+func (r *retentionRunner) purgeBatches(table string, scope func(*gorm.DB) *gorm.DB, archive *retentionArchive, cleanup func(*gorm.DB, []uint) error) (int, error) {
+	purged := 0
+	for {
+		var ids []uint
+		if err := scope(database.DB.Table(table)).Order("id").Limit(retentionBatchSize).Pluck("id", &ids).Error; err != nil {
+			return purged, err
+		}
+		if len(ids) == 0 {
+			return purged, nil
+		}
+
+		err := database.DB.Transaction(func(tx *gorm.DB) error {
+			if archive != nil {
+				var rows []map[string]interface{}
+				if err := tx.Table(table).Where("id IN ?", ids).Order("id").Find(&rows).Error; err != nil {
+					return err
+				}
+				if err := archive.write(rows); err != nil {
+					return fmt.Errorf("archive: %v", err)
+				}
+			}
+			if cleanup != nil {
+				if err := cleanup(tx, ids); err != nil {
+					return err
+				}
+			}
+			return tx.Exec("DELETE FROM "+table+" WHERE id IN ?", ids).Error
+		})
+		if err != nil {
+			return purged, err
+		}
+		purged += len(ids)
+		if len(ids) < retentionBatchSize {
+			return purged, nil
+		}
+		time.Sleep(retentionBatchPause)
+	}
+}
+
+// newArchive 策略需要归档时创建归档文件，文件名包含数据类型、表名、分组和任务ID
+func (r *retentionRunner) newArchive(policy *models.RetentionPolicy, table string) *retentionArchive {
+	if !policy.Archive {
+		return nil
+	}
+	name := policy.Target
+	if policy.Target == models.RetentionTargetDeleted {
+		name += "-" + table
+	}
+	if policy.GroupID != nil {
+		name += fmt.Sprintf("-group%d", *policy.GroupID)
+	}
+	name += fmt.Sprintf("-run%d-%s.jsonl.gz", r.run.ID, r.now.Format("20060102-150405"))
+	return &retentionArchive{path: filepath.Join(retentionArchiveDir, name)}
+}
+
+// purgePolicy 执行一条保留策略，grouped 为其他有分组策略的分组，不分组的策略跳过这些分组的设备
+func (r *retentionRunner) purgePolicy(policy *models.RetentionPolicy, grouped []uint) RetentionResult {
+	result := RetentionResult{PolicyID: policy.ID, Target: policy.Target, GroupID: policy.GroupID}
+	cutoff := r.now.AddDate(0, 0, -policy.Days)
+
+	type purgeStep struct {
+		table   string
+		scope   func(*gorm.DB) *gorm.DB
+		cleanup func(*gorm.DB, []uint) error
+	}
+	var steps []purgeStep
+	if policy.Target == models.RetentionTargetDeleted {
+		for _, deleted := range softDeleteModels {
+			steps = append(steps, purgeStep{table: tableName(deleted.model), cleanup: deleted.cleanup, scope: func(db *gorm.DB) *gorm.DB {
+				return db.Where("deleted_at IS NOT NULL AND deleted_at < ?", cutoff)
+			}})
+		}
+	} else {
+		target := retentionTargets[policy.Target]
+		steps = append(steps, purgeStep{table: target.table, cleanup: target.cleanup, scope: func(db *gorm.DB) *gorm.DB {
+			db = target.expired(db, cutoff)
+			if target.grouped && policy.GroupID != nil {
+				db = db.Where("device_id IN (SELECT id FROM devices WHERE group_id = ?)", *policy.GroupID)
+			} else if target.grouped && len(grouped) > 0 {
+				db = db.Where("device_id NOT IN (SELECT id FROM devices WHERE group_id IN ?)", grouped)
+			}
+			return db
+		}})
+	}
+
+	for _, step := range steps {
+		archive := r.newArchive(policy, step.table)
+		purged, err := r.purgeBatches(step.table, step.scope, archive, step.cleanup)
+		result.Purged += purged
+		if archive != nil {
+			if closeErr := archive.close(); err == nil {
+				err = closeErr
+			}
+			if archive.rows > 0 {
+				result.Archived += archive.rows
+				result.Archives = append(result.Archives, filepath.Base(archive.path))
+			}
+		}
+		if err != nil {
+			result.Error = truncateString(err.Error(), 250)
+			log.Printf("Retention policy %d failed on %s: %v", policy.ID, step.table, err)
+			break
+		}
+	}
+	return result
+}
+
+// purgeAll 依次执行所有启用的保留策略，一条策略失败不影响其他策略
+func (r *retentionRunner) purgeAll() error {
+	var policies []models.RetentionPolicy
+	if err := database.DB.Where("enabled = ?", true).Order("id").Find(&policies).Error; err != nil {
+		return err
+	}
+
+	grouped := make(map[string][]uint)
+	for _, policy := range policies {
+		if policy.GroupID != nil {
+			grouped[policy.Target] = append(grouped[policy.Target], *policy.GroupID)
+		}
+	}
+	for i := range policies {
+		if _, ok := retentionTargets[policies[i].Target]; !ok && policies[i].Target != models.RetentionTargetDeleted {
+			continue
+		}
+		result := r.purgePolicy(&policies[i], grouped[policies[i].Target])
+		r.results = append(r.results, result)
+		r.run.Purged += result.Purged
+		r.run.Archived += result.Archived
+	}
+
+	database.DB.Model(&models.RetentionSettings{}).Where("id = ?", loadRetentionSettings().ID).
+		Update("last_purge_at", r.now.Unix())
+	return nil
+}
+
+// databaseSize 数据库文件大小(页数 × 页大小)
+func databaseSize() int64 {
+	var pageCount, pageSize int64
+	database.DB.Raw("PRAGMA page_count").Row().Scan(&pageCount)
+	database.DB.Raw("PRAGMA page_size").Row().Scan(&pageSize)
+	return pageCount * pageSize
+}
+
+// vacuumDatabase 合并全文索引并压缩数据库，VACUUM 期间数据库被独占锁定
+func (r *retentionRunner) vacuumDatabase() error {
+	r.run.SizeBefore = databaseSize()
+	if err := database.DB.Exec(`INSERT INTO alerts_fts(alerts_fts) VALUES ('optimize')`).Error; err != nil {
+		log.Printf("Failed to optimize alert search index: %v", err)
+	}
+	if err := database.DB.Exec("VACUUM").Error; err != nil {
+		return err
+	}
+	database.DB.Exec("PRAGMA optimize")
+	r.run.SizeAfter = databaseSize()
+	r.run.Vacuumed = true
+
+	database.DB.Model(&models.RetentionSettings{}).Where("id = ?", loadRetentionSettings().ID).
+		Update("last_vacuum_at", time.Now().Unix())
+	return nil
+}
+
+// execute 执行清理和压缩并保存结果，调用前须持有 retentionMu
+func (r *retentionRunner) execute() {
+	defer retentionMu.Unlock()
+
+	var err error
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+		r.finish(err)
+	}()
+
+	if r.purge {
+		err = r.purgeAll()
+	}
+	if err == nil && r.vacuum {
+		err = r.vacuumDatabase()
+	}
+}
+
+func (r *retentionRunner) finish(err error) {
+	results, _ := json.Marshal(r.results)
+	r.run.Results = string(results)
+	r.run.Status = models.RetentionRunStatusCompleted
+	if err != nil {
+		r.run.Status = models.RetentionRunStatusFailed
+		r.run.Message = truncateString(err.Error(), 250)
+		log.Printf("Retention run %d failed: %v", r.run.ID, err)
+	}
+	r.run.FinishedAt = time.Now().Unix()
+	if err := database.DB.Save(r.run).Error; err != nil {
+		log.Printf("Failed to save retention run %d: %v", r.run.ID, err)
+	}
+}
+
+// startRetentionRun 创建清理任务记录并加锁，已有任务在执行时返回 errRetentionRunning，
+// 调用方须随后调用 execute
+func startRetentionRun(trigger string, purge, vacuum bool) (*retentionRunner, error) {
+	if !retentionMu.TryLock() {
+		return nil, errRetentionRunning
+	}
+	now := time.Now()
+	run := &models.RetentionRun{Trigger: trigger, Status: models.RetentionRunStatusRunning, StartedAt: now.Unix()}
+	if err := database.DB.Create(run).Error; err != nil {
+		retentionMu.Unlock()
+		return nil, err
+	}
+	return &retentionRunner{run: run, now: now, purge: purge, vacuum: vacuum}, nil
+}
+
+// loadRetentionSettings 获取清理计划，不存在时按默认值创建: 每小时清理，每周压缩
+func loadRetentionSettings() models.RetentionSettings {
+	var settings models.RetentionSettings
+	// 以创建时间作为上次执行时间，避免部署后第一次检查就执行 VACUUM 锁住整个数据库
+	now := time.Now().Unix()
+	defaults := models.RetentionSettings{PurgeIntervalMinutes: 60, VacuumIntervalHours: 7 * 24, LastPurgeAt: now, LastVacuumAt: now}
+	if err := database.DB.Order("id").Attrs(defaults).FirstOrCreate(&settings).Error; err != nil {
+		log.Printf("Failed to load retention settings: %v", err)
+	}
+	return settings
+}
+
+// runScheduledRetention 按计划执行到期的清理和压缩
+func runScheduledRetention(now time.Time) {
+	settings := loadRetentionSettings()
+	purge := settings.PurgeIntervalMinutes > 0 && now.Unix()-settings.LastPurgeAt >= int64(settings.PurgeIntervalMinutes)*60
+	vacuum := settings.VacuumIntervalHours > 0 && now.Unix()-settings.LastVacuumAt >= int64(settings.VacuumIntervalHours)*3600
+	if !purge && !vacuum {
+		return
+	}
+	runner, err := startRetentionRun("schedule", purge, vacuum)
+	if err != nil {
+		if err != errRetentionRunning {
+			log.Printf("Failed to start retention run: %v", err)
+		}
+		return
+	}
+	runner.execute()
+}
+
+// StartRetentionScheduler 启动数据清理计划
+func StartRetentionScheduler() {
+	go func() {
+		ticker := time.NewTicker(retentionCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			runScheduledRetention(time.Now())
+		}
+	}()
+}
+
+// RecoverRetentionRuns 服务重启后将未完成的清理任务标记为失败
+func RecoverRetentionRuns() {
+	database.DB.Model(&models.RetentionRun{}).
+		Where("status = ?", models.RetentionRunStatusRunning).
+		Updates(map[string]interface{}{
+			"status":      models.RetentionRunStatusFailed,
+			"message":     "interrupted by server restart",
+			"finished_at": time.Now().Unix(),
+		})
+}
@@ -0,0 +1,215 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+// retentionPolicyInput 创建或修改保留策略的请求
+type retentionPolicyInput struct {
+	Target  string `json:"target" binding:"required"`
+	GroupID *uint  `json:"group_id"`
+	Days    int    `json:"days" binding:"required"`
+	Archive bool   `json:"archive"`
+	Enabled *bool  `json:"enabled"`
+}
+
+// validate 校验数据类型、保留天数和分组，同一数据类型和分组只能有一条策略
+func (input *retentionPolicyInput) validate(id uint) error {
+	target, ok := retentionTargets[input.Target]
+	if !ok && input.Target != models.RetentionTargetDeleted {
+		return fmt.Errorf("invalid target %q", input.Target)
+	}
+	if input.Days < 1 {
+		return errors.New("days must be at least 1")
+	}
+	if input.GroupID != nil && !target.grouped {
+		return fmt.Errorf("group_id is not supported for target %q", input.Target)
+	}
+	if err := checkDeviceGroup(input.GroupID); err != nil {
+		return err
+	}
+
+	query := database.DB.Model(&models.RetentionPolicy{}).Where("target = ? AND id <> ?", input.Target, id)
+	if input.GroupID != nil {
+		query = query.Where("group_id = ?", *input.GroupID)
+	} else {
+		query = query.Where("group_id IS NULL")
+	}
+	var count int64
+	query.Count(&count)
+	if count > 0 {
+		return errors.New("a retention policy for this target and group already exists")
+	}
+	return nil
+}
+
+// apply 将请求写入策略
+func (input *retentionPolicyInput) apply(policy *models.RetentionPolicy) {
+	policy.Target = input.Target
+	policy.GroupID = input.GroupID
+	policy.Days = input.Days
+	policy.Archive = input.Archive
+	if input.Enabled != nil {
+		policy.Enabled = *input.Enabled
+	}
+}
+
+// GetRetentionPolicies 获取保留策略列表
+func GetRetentionPolicies(c *gin.Context) {
+	var policies []models.RetentionPolicy
+	if err := database.DB.Order("target, id").Find(&policies).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get retention policies"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": policies})
+}
+
+// CreateRetentionPolicy 创建保留策略，默认启用
+func CreateRetentionPolicy(c *gin.Context) {
+	var input retentionPolicyInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := input.validate(0); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	policy := models.RetentionPolicy{Enabled: true}
+	input.apply(&policy)
+	if err := database.DB.Create(&policy).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create retention policy"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": policy})
+}
+
+// UpdateRetentionPolicy 修改保留策略
+func UpdateRetentionPolicy(c *gin.Context) {
+	var policy models.RetentionPolicy
+	if err := database.DB.First(&policy, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Retention policy not found"})
+		return
+	}
+
+	var input retentionPolicyInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := input.validate(policy.ID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	input.apply(&policy)
+	if err := database.DB.Save(&policy).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update retention policy"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": policy})
+}
+
+// DeleteRetentionPolicy 删除保留策略
+func DeleteRetentionPolicy(c *gin.Context) {
+	var policy models.RetentionPolicy
+	if err := database.DB.First(&policy, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Retention policy not found"})
+		return
+	}
+
+	if err := database.DB.Delete(&policy).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete retention policy"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Retention policy deleted successfully"})
+}
+
+// GetRetentionSettings 获取清理和压缩计划
+func GetRetentionSettings(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"data": loadRetentionSettings()})
+}
+
+// UpdateRetentionSettings 修改清理和压缩计划，间隔为 0 表示不自动执行
+func UpdateRetentionSettings(c *gin.Context) {
+	var input struct {
+		PurgeIntervalMinutes *int `json:"purge_interval_minutes"`
+		VacuumIntervalHours  *int `json:"vacuum_interval_hours"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	settings := loadRetentionSettings()
+	if input.PurgeIntervalMinutes != nil {
+		if *input.PurgeIntervalMinutes < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "purge_interval_minutes must not be negative"})
+			return
+		}
+		settings.PurgeIntervalMinutes = *input.PurgeIntervalMinutes
+	}
+	if input.VacuumIntervalHours != nil {
+		if *input.VacuumIntervalHours < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "vacuum_interval_hours must not be negative"})
+			return
+		}
+		settings.VacuumIntervalHours = *input.VacuumIntervalHours
+	}
+	if err := database.DB.Save(&settings).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update retention settings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": settings})
+}
+
+// RunRetention 立即在后台执行一次清理，vacuum=true 时清理后压缩数据库
+func RunRetention(c *gin.Context) {
+	runner, err := startRetentionRun("manual", true, c.Query("vacuum") == "true")
+	if err == errRetentionRunning {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start retention run"})
+		return
+	}
+
+	run := *runner.run
+	go runner.execute()
+	c.JSON(http.StatusOK, gin.H{"data": run})
+}
+
+// GetRetentionRuns 获取最近的清理任务
+func GetRetentionRuns(c *gin.Context) {
+	var runs []models.RetentionRun
+	if err := database.DB.Order("id DESC").Limit(50).Find(&runs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get retention runs"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": runs})
+}
+
+// GetRetentionRun 获取清理任务
+func GetRetentionRun(c *gin.Context) {
+	var run models.RetentionRun
+	if err := database.DB.First(&run, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Retention run not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": run})
+}
@@ -0,0 +1,211 @@
+package controllers
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+func TestRetentionRun(t *testing.T) {
+	useTestDatabase(t)
+	retentionArchiveDir = t.TempDir()
+	defer func() { retentionArchiveDir = "archives" }()
+
+	now := time.Now()
+	old := now.AddDate(0, 0, -40).Unix()
+	group := models.DeviceGroup{Name: "critical"}
+	database.DB.Create(&group)
+	kept := models.Device{Name: "kept", Topic: "kept", UserID: 1, GroupID: &group.ID}
+	pruned := models.Device{Name: "pruned", Topic: "pruned", UserID: 1}
+	database.DB.Create(&kept)
+	database.DB.Create(&pruned)
+
+	alerts := []models.Alert{
+		{DeviceID: pruned.ID, Type: "overheat", Level: "high", Message: "ancient", Timestamp: old, LastSeen: old},
+		{DeviceID: pruned.ID, Type: "overheat", Level: "high", Message: "ongoing", Timestamp: old, LastSeen: now.Unix()},
+		{DeviceID: kept.ID, Type: "overheat", Level: "high", Message: "grouped", Timestamp: old, LastSeen: old},
+	}
+	for i := range alerts {
+		database.DB.Create(&alerts[i])
+	}
+	database.DB.Create(&models.AlertComment{AlertID: alerts[0].ID, Body: "note"})
+	database.DB.Create(&models.Telemetry{DeviceID: pruned.ID, Timestamp: old})
+	database.DB.Create(&models.Telemetry{DeviceID: pruned.ID, Timestamp: now.Unix()})
+
+	// 已软删除的告警连同其评论永久删除，仍被引用的设备不永久删除
+	removed := models.Device{Name: "removed", Topic: "removed", UserID: 1}
+	database.DB.Create(&removed)
+	database.DB.Delete(&removed)
+	database.DB.Unscoped().Model(&removed).Update("deleted_at", now.AddDate(0, 0, -10))
+	dismissed := models.Alert{DeviceID: kept.ID, Type: "offline", Level: "low", Message: "dismissed", Timestamp: now.Unix(), LastSeen: now.Unix()}
+	database.DB.Create(&dismissed)
+	database.DB.Create(&models.AlertComment{AlertID: dismissed.ID, Body: "false alarm"})
+	database.DB.Delete(&dismissed)
+	database.DB.Unscoped().Model(&dismissed).Update("deleted_at", now.AddDate(0, 0, -10))
+
+	policies := []models.RetentionPolicy{
+		{Target: models.RetentionTargetAlerts, Days: 30, Archive: true, Enabled: true},
+		{Target: models.RetentionTargetAlerts, GroupID: &group.ID, Days: 90, Enabled: true},
+		{Target: models.RetentionTargetTelemetry, Days: 30, Enabled: true},
+		{Target: models.RetentionTargetDeleted, Days: 7, Enabled: true},
+	}
+	for i := range policies {
+		database.DB.Create(&policies[i])
+	}
+
+	runner, err := startRetentionRun("manual", true, true)
+	if err != nil {
+		t.Fatalf("Failed to start run: %v", err)
+	}
+	if _, err := startRetentionRun("manual", true, false); err != errRetentionRunning {
+		t.Errorf("Expected concurrent run to be rejected, got %v", err)
+	}
+	runner.execute()
+
+	var run models.RetentionRun
+	database.DB.First(&run, runner.run.ID)
+	if run.Status != models.RetentionRunStatusCompleted || !run.Vacuumed || run.SizeAfter == 0 {
+		t.Fatalf("Unexpected run %+v", run)
+	}
+	// 告警 1 条、遥测 1 条、软删除的告警 1 条
+	if run.Purged != 3 || run.Archived != 1 {
+		t.Errorf("Expected 3 purged and 1 archived, got %d and %d", run.Purged, run.Archived)
+	}
+
+	var remaining []models.Alert
+	database.DB.Unscoped().Order("id").Find(&remaining)
+	if len(remaining) != 2 || remaining[0].Message != "ongoing" || remaining[1].Message != "grouped" {
+		t.Errorf("Unexpected remaining alerts %+v", remaining)
+	}
+	var count int64
+	database.DB.Unscoped().Model(&models.AlertComment{}).Count(&count)
+	if count != 0 {
+		t.Errorf("Expected comments of purged alert to be removed, got %d", count)
+	}
+	database.DB.Raw("SELECT COUNT(*) FROM alerts_fts WHERE alerts_fts MATCH 'ancient'").Scan(&count)
+	if count != 0 {
+		t.Errorf("Expected purged alert to leave the search index")
+	}
+	database.DB.Model(&models.Telemetry{}).Count(&count)
+	if count != 1 {
+		t.Errorf("Expected 1 telemetry record, got %d", count)
+	}
+	database.DB.Unscoped().Model(&models.Alert{}).Where("id = ?", dismissed.ID).Count(&count)
+	if count != 0 {
+		t.Errorf("Expected soft-deleted alert to be purged")
+	}
+	database.DB.Unscoped().Model(&models.Device{}).Where("id = ?", removed.ID).Count(&count)
+	if count != 1 {
+		t.Errorf("Expected soft-deleted device to be kept")
+	}
+
+	var results []RetentionResult
+	json.Unmarshal([]byte(run.Results), &results)
+	if len(results) != 4 || len(results[0].Archives) != 1 {
+		t.Fatalf("Unexpected results %s", run.Results)
+	}
+	data, err := os.ReadFile(filepath.Join(retentionArchiveDir, results[0].Archives[0]))
+	if err != nil {
+		t.Fatalf("Archive not written: %v", err)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Invalid archive: %v", err)
+	}
+	var rows []map[string]interface{}
+	scanner := bufio.NewScanner(gz)
+	for scanner.Scan() {
+		var row map[string]interface{}
+		json.Unmarshal(scanner.Bytes(), &row)
+		rows = append(rows, row)
+	}
+	if len(rows) != 1 || rows[0]["message"] != "ancient" {
+		t.Errorf("Unexpected archived rows %v", rows)
+	}
+
+	settings := loadRetentionSettings()
+	if settings.LastPurgeAt == 0 || settings.LastVacuumAt == 0 {
+		t.Errorf("Expected schedule to record the run, got %+v", settings)
+	}
+}
+
+func TestScheduledRetentionFirstRun(t *testing.T) {
+	useTestDatabase(t)
+
+	now := time.Now()
+	settings := loadRetentionSettings()
+	if settings.LastPurgeAt == 0 || settings.LastVacuumAt == 0 {
+		t.Fatalf("Expected new settings to be seeded with the creation time, got %+v", settings)
+	}
+
+	// 部署后的第一次检查不执行清理或 VACUUM
+	runScheduledRetention(now.Add(time.Minute))
+	var count int64
+	database.DB.Model(&models.RetentionRun{}).Count(&count)
+	if count != 0 {
+		t.Fatalf("Expected no run right after deployment, got %d", count)
+	}
+
+	runScheduledRetention(now.Add(2 * time.Hour))
+	var run models.RetentionRun
+	if err := database.DB.First(&run).Error; err != nil {
+		t.Fatalf("Expected purge once the interval elapsed: %v", err)
+	}
+	if run.Vacuumed {
+		t.Error("Expected VACUUM to wait for its own interval")
+	}
+}
+
+func TestCreateRetentionPolicy(t *testing.T) {
+	useTestDatabase(t)
+	gin.SetMode(gin.TestMode)
+
+	group := models.DeviceGroup{Name: "plant"}
+	database.DB.Create(&group)
+
+	create := func(body string) int {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/api/retention/policies", bytes.NewBufferString(body))
+		c.Request.Header.Set("Content-Type", "application/json")
+		c.Set("userID", uint(1))
+		CreateRetentionPolicy(c)
+		return w.Code
+	}
+
+	if code := create(`{"target":"alerts","days":30}`); code != http.StatusOK {
+		t.Fatalf("Expected policy to be created, got %d", code)
+	}
+	var policy models.RetentionPolicy
+	database.DB.First(&policy)
+	if !policy.Enabled {
+		t.Error("Expected new policy to be enabled")
+	}
+	if code := create(`{"target":"alerts","days":60,"group_id":` + fmt.Sprint(group.ID) + `}`); code != http.StatusOK {
+		t.Errorf("Expected group policy to be created, got %d", code)
+	}
+
+	for _, body := range []string{
+		`{"target":"alerts","days":10}`,                               // 重复
+		`{"target":"logs","days":10}`,                                 // 不支持的数据类型
+		`{"target":"telemetry","days":0}`,                             // 天数无效
+		`{"target":"notification_deliveries","days":10,"group_id":1}`, // 不支持分组
+		`{"target":"telemetry","days":10,"group_id":999}`,             // 分组不存在
+	} {
+		if code := create(body); code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", body, code)
+		}
+	}
+}
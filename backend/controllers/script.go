@@ -0,0 +1,468 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"runtime/metrics"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+// PayloadKindScript 脚本负载，由 Format.Script 中的 JavaScript 函数解析，
+// 用于字段定义无法描述的厂商格式(异或混淆、私有压缩等)
+const PayloadKindScript = "script"
+
+// 脚本运行限制。脚本运行在独立的解释器中，只能访问传入的字节和 meta，
+// 没有 require、文件、网络或定时器等接口
+const (
+	scriptMaxSize      = 64 * 1024              // 脚本最大长度
+	scriptTimeout      = 100 * time.Millisecond // 单次调用(含脚本顶层代码)的最长执行时间
+	scriptMaxCallStack = 256                    // 最大调用栈深度，防止无限递归耗尽内存
+	scriptMaxLength    = 1 << 20                // 单次创建的字符串、数组、缓冲区的最大长度
+	scriptMaxMemory    = 64 << 20               // 单次调用期间最多分配的内存(字节)
+	scriptMaxLogs      = 50                     // 单次调用保留的 console.log 条数
+	scriptMaxSamples   = 100                    // 测试接口单次最多运行的样本数
+)
+
+var (
+	errScriptTimeout = fmt.Errorf("script exceeded the %v time limit", scriptTimeout)
+	errScriptMemory  = fmt.Errorf("script exceeded the %d MB memory limit", scriptMaxMemory>>20)
+)
+
+// scriptGuards 在脚本之前执行，限制一次调用就能分配大量内存的内置函数。
+// 这些函数在 Go 中一次完成分配，执行期间无法被中断
+var scriptGuards = goja.MustCompile("guards.js", fmt.Sprintf(`(function (max) {
+	function check(length) {
+		if (length > max) throw new RangeError("length " + length + " exceeds the limit of " + max);
+	}
+	function guard(proto, name, size) {
+		var original = proto[name];
+		Object.defineProperty(proto, name, {
+			value: function () {
+				check(size(this, arguments));
+				return original.apply(this, arguments);
+			},
+			writable: true,
+			configurable: true
+		});
+	}
+	function argLength(args) {
+		var arg = args[0];
+		if (typeof arg === "number") return arg;
+		if (arg !== null && typeof arg === "object") return arg.byteLength !== undefined ? arg.byteLength : arg.length;
+		return 0;
+	}
+	function guardConstructor(name) {
+		var target = globalThis[name];
+		var proxy = new Proxy(target, {
+			construct: function (t, args, newTarget) {
+				if (args.length === 1) check(argLength(args));
+				return Reflect.construct(t, args, newTarget);
+			},
+			apply: function (t, self, args) {
+				if (args.length === 1) check(argLength(args));
+				return Reflect.apply(t, self, args);
+			},
+			get: function (t, key) {
+				if (key === Symbol.hasInstance) return function (value) { return value instanceof t; };
+				return Reflect.get(t, key);
+			}
+		});
+		Object.defineProperty(target.prototype, "constructor", { value: proxy, writable: true, configurable: true });
+		globalThis[name] = proxy;
+	}
+
+	guard(String.prototype, "repeat", function (s, args) { return String(s).length * Number(args[0]); });
+	guard(String.prototype, "padStart", function (s, args) { return Number(args[0]); });
+	guard(String.prototype, "padEnd", function (s, args) { return Number(args[0]); });
+	guard(Array.prototype, "fill", function (a) { return a.length; });
+	guard(Array.prototype, "join", function (a) { return a.length; });
+	guard(Array, "from", function (a, args) { return argLength(args); });
+	guard(Object.getPrototypeOf(Uint8Array), "from", function (a, args) { return argLength(args); });
+	["Array", "ArrayBuffer", "Int8Array", "Uint8Array", "Uint8ClampedArray", "Int16Array", "Uint16Array",
+		"Int32Array", "Uint32Array", "Float32Array", "Float64Array"].forEach(guardConstructor);
+})(%d);`, scriptMaxLength), false)
+
+// messageScript 编译后的解码脚本。goja 运行时不能并发使用，
+// 每次调用从池中取出一个运行时，超时中断后的运行时直接丢弃
+type messageScript struct {
+	program   *goja.Program
+	hasEncode bool
+	pool      sync.Pool // *scriptRuntime
+}
+
+// scriptRuntime 已执行过脚本顶层代码的解释器
+type scriptRuntime struct {
+	vm     *goja.Runtime
+	decode goja.Callable
+	encode goja.Callable
+	logs   []string
+}
+
+// compileScript 编译脚本并执行一次顶层代码，确认定义了 decode 函数
+func compileScript(source string) (*messageScript, error) {
+	if strings.TrimSpace(source) == "" {
+		return nil, errors.New("script is empty")
+	}
+	if len(source) > scriptMaxSize {
+		return nil, fmt.Errorf("script exceeds %d bytes", scriptMaxSize)
+	}
+	program, err := goja.Compile("decoder.js", source, false)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &messageScript{program: program}
+	rt, err := s.newRuntime()
+	if err != nil {
+		return nil, err
+	}
+	s.hasEncode = rt.encode != nil
+	s.pool.Put(rt)
+	return s, nil
+}
+
+func (s *messageScript) newRuntime() (*scriptRuntime, error) {
+	vm := goja.New()
+	vm.SetMaxCallStackSize(scriptMaxCallStack)
+	rt := &scriptRuntime{vm: vm}
+
+	console := vm.NewObject()
+	console.Set("log", func(call goja.FunctionCall) goja.Value {
+		if len(rt.logs) < scriptMaxLogs {
+			parts := make([]string, len(call.Arguments))
+			for i, arg := range call.Arguments {
+				parts[i] = arg.String()
+			}
+			rt.logs = append(rt.logs, strings.Join(parts, " "))
+		}
+		return goja.Undefined()
+	})
+	vm.Set("console", console)
+
+	if _, err := vm.RunProgram(scriptGuards); err != nil {
+		return nil, err
+	}
+	if _, err := rt.call(func() (goja.Value, error) { return vm.RunProgram(s.program) }); err != nil {
+		return nil, err
+	}
+	decode, ok := goja.AssertFunction(vm.Get("decode"))
+	if !ok {
+		return nil, errors.New("script must define a decode(bytes, meta) function")
+	}
+	rt.decode = decode
+	rt.encode, _ = goja.AssertFunction(vm.Get("encode"))
+	rt.logs = nil
+	return rt, nil
+}
+
+// call 在时间和内存限制内执行脚本，超时由定时器中断解释器，
+// 分配内存超过限制时由 watchScriptMemory 中断
+func (rt *scriptRuntime) call(fn func() (goja.Value, error)) (value goja.Value, err error) {
+	timer := time.AfterFunc(scriptTimeout, func() { rt.vm.Interrupt(errScriptTimeout) })
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		watchScriptMemory(rt.vm, done)
+		close(stopped)
+	}()
+	defer func() {
+		timer.Stop()
+		close(done)
+		<-stopped
+		rt.vm.ClearInterrupt()
+		if r := recover(); r != nil {
+			err = fmt.Errorf("script panic: %v", r)
+		}
+	}()
+
+	value, err = fn()
+	var interrupted *goja.InterruptedError
+	if errors.As(err, &interrupted) {
+		if interrupted.Value() == errScriptMemory {
+			return nil, errScriptMemory
+		}
+		return nil, errScriptTimeout
+	}
+	var overflow *goja.StackOverflowError
+	if errors.As(err, &overflow) {
+		return nil, fmt.Errorf("script exceeded the maximum call stack depth of %d", scriptMaxCallStack)
+	}
+	return value, err
+}
+
+// watchScriptMemory 定期检查累计分配的堆内存，调用期间分配超过 scriptMaxMemory 时中断解释器。
+// 分配量是进程级的统计，限制留有余量以免其他请求的分配导致误判
+func watchScriptMemory(vm *goja.Runtime, done <-chan struct{}) {
+	sample := []metrics.Sample{{Name: "/gc/heap/allocs:bytes"}}
+	metrics.Read(sample)
+	baseline := sample[0].Value.Uint64()
+
+	ticker := time.NewTicker(5 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			metrics.Read(sample)
+			if sample[0].Value.Uint64() > baseline+scriptMaxMemory {
+				vm.Interrupt(errScriptMemory)
+				return
+			}
+		}
+	}
+}
+
+// invoke 取出运行时执行 decode 或 encode，返回脚本输出的日志
+func (s *messageScript) invoke(fn func(rt *scriptRuntime) (goja.Value, error)) (interface{}, []string, error) {
+	rt, _ := s.pool.Get().(*scriptRuntime)
+	if rt == nil {
+		var err error
+		if rt, err = s.newRuntime(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	value, err := rt.call(func() (goja.Value, error) { return fn(rt) })
+	logs := rt.logs
+	rt.logs = nil
+	if err == errScriptTimeout || err == errScriptMemory {
+		// 被中断的运行时状态不确定，不再复用
+		return nil, logs, err
+	}
+	s.pool.Put(rt)
+	if err != nil {
+		return nil, logs, err
+	}
+	if value == nil || goja.IsUndefined(value) || goja.IsNull(value) {
+		return nil, logs, nil
+	}
+	return value.Export(), logs, nil
+}
+
+// Decode 调用 decode(bytes, meta)，bytes 为 0-255 的数字数组，返回值必须是对象
+func (s *messageScript) Decode(data []byte, meta map[string]interface{}) (map[string]interface{}, []string, error) {
+	input := make([]interface{}, len(data))
+	for i, b := range data {
+		input[i] = int64(b)
+	}
+	if meta == nil {
+		meta = map[string]interface{}{}
+	}
+
+	exported, logs, err := s.invoke(func(rt *scriptRuntime) (goja.Value, error) {
+		return rt.decode(goja.Undefined(), rt.vm.NewArray(input...), rt.vm.ToValue(meta))
+	})
+	if err != nil {
+		return nil, logs, err
+	}
+	object, ok := exported.(map[string]interface{})
+	if !ok {
+		return nil, logs, fmt.Errorf("decode must return an object, got %T", exported)
+	}
+	fields, err := scriptValue("", object)
+	if err != nil {
+		return nil, logs, err
+	}
+	return fields.(map[string]interface{}), logs, nil
+}
+
+// Encode 调用 encode(fields, meta)，返回值必须是 0-255 的数字数组或 Uint8Array
+func (s *messageScript) Encode(fields, meta map[string]interface{}) ([]byte, []string, error) {
+	if !s.hasEncode {
+		return nil, nil, errors.New("script does not define an encode(fields, meta) function")
+	}
+	if meta == nil {
+		meta = map[string]interface{}{}
+	}
+
+	exported, logs, err := s.invoke(func(rt *scriptRuntime) (goja.Value, error) {
+		return rt.encode(goja.Undefined(), rt.vm.ToValue(fields), rt.vm.ToValue(meta))
+	})
+	if err != nil {
+		return nil, logs, err
+	}
+	switch v := exported.(type) {
+	case []byte:
+		return append([]byte(nil), v...), logs, nil
+	case []interface{}:
+		data := make([]byte, len(v))
+		for i, item := range v {
+			number, ok := numericFloat(item)
+			if !ok || number < 0 || number > 255 || number != math.Trunc(number) {
+				return nil, logs, fmt.Errorf("encode result[%d] is not a byte: %v", i, item)
+			}
+			data[i] = byte(number)
+		}
+		return data, logs, nil
+	default:
+		return nil, logs, fmt.Errorf("encode must return a byte array, got %T", exported)
+	}
+}
+
+// scriptValue 检查脚本返回值可以保存为 JSON，NaN 和 Infinity 转换为 null，path 用于错误信息
+func scriptValue(path string, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil, bool, string, int64:
+		return v, nil
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, nil
+		}
+		return v, nil
+	case []byte:
+		return append([]byte(nil), v...), nil
+	case []interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			converted, err := scriptValue(fmt.Sprintf("%s[%d]", path, i), item)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = converted
+		}
+		return items, nil
+	case map[string]interface{}:
+		object := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			converted, err := scriptValue(joinPath(path, key), item)
+			if err != nil {
+				return nil, err
+			}
+			object[key] = converted
+		}
+		return object, nil
+	default:
+		return nil, fmt.Errorf("decode result %s has unsupported type %T", path, value)
+	}
+}
+
+// scriptMeta 传给脚本的配置信息
+func scriptMeta(config models.MessageTypeConfig, encoding string) map[string]interface{} {
+	return map[string]interface{}{
+		"config_id":   config.ID,
+		"config_name": config.Name,
+		"protocol":    config.Protocol,
+		"f_port":      config.FPort,
+		"version":     config.Version,
+		"encoding":    encoding,
+	}
+}
+
+// ScriptSample 脚本测试样本: 提供 raw_data 时调用 decode，提供 fields 时调用 encode
+type ScriptSample struct {
+	Name     string                 `json:"name"`
+	RawData  string                 `json:"raw_data"`
+	Fields   map[string]interface{} `json:"fields"`
+	Meta     map[string]interface{} `json:"meta"`
+	Expected json.RawMessage        `json:"expected"` // 期望的解码字段或编码结果，为空时不比较
+}
+
+// ScriptSampleResult 单个样本的运行结果
+type ScriptSampleResult struct {
+	Name       string                 `json:"name"`
+	Direction  string                 `json:"direction"` // decode, encode
+	Success    bool                   `json:"success"`
+	Error      string                 `json:"error,omitempty"`
+	Fields     map[string]interface{} `json:"fields,omitempty"`
+	RawData    string                 `json:"raw_data,omitempty"`
+	Logs       []string               `json:"logs"`
+	DurationMs float64                `json:"duration_ms"`
+	Matched    *bool                  `json:"matched,omitempty"`
+}
+
+// runScriptSamples 依次运行测试样本，单个样本失败不影响其他样本
+func runScriptSamples(decoder *MessageDecoder, samples []ScriptSample) []ScriptSampleResult {
+	encoding := decoder.format.Encoding
+	results := make([]ScriptSampleResult, 0, len(samples))
+	for i, sample := range samples {
+		result := ScriptSampleResult{Name: sample.Name, Direction: "decode", Logs: []string{}}
+		if result.Name == "" {
+			result.Name = fmt.Sprintf("sample %d", i+1)
+		}
+		meta := sample.Meta
+		if meta == nil {
+			meta = map[string]interface{}{"encoding": encoding}
+		}
+
+		start := time.Now()
+		var logs []string
+		var err error
+		if sample.Fields != nil && sample.RawData == "" {
+			result.Direction = "encode"
+			var data []byte
+			if data, logs, err = decoder.script.Encode(sample.Fields, meta); err == nil {
+				result.RawData = encodePayload(encoding, data)
+			}
+		} else {
+			var data []byte
+			if data, err = decoder.decodePayload(sample.RawData, nil); err != nil {
+				err = fmt.Errorf("failed to decode data: %v", err)
+			} else {
+				result.Fields, logs, err = decoder.script.Decode(data, meta)
+			}
+		}
+		result.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+		if logs != nil {
+			result.Logs = logs
+		}
+		if err != nil {
+			result.Error = err.Error()
+			results = append(results, result)
+			continue
+		}
+		result.Success = true
+
+		if len(sample.Expected) > 0 {
+			var matched bool
+			if result.Direction == "encode" {
+				var expected string
+				json.Unmarshal(sample.Expected, &expected)
+				matched = strings.EqualFold(expected, result.RawData)
+			} else {
+				actual, _ := json.Marshal(result.Fields)
+				matched = jsonEqual(string(sample.Expected), string(actual))
+			}
+			result.Matched = &matched
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// TestMessageScript 在样本负载上运行脚本解码器，format 可以是未保存的格式(JSON 对象或字符串)
+func TestMessageScript(c *gin.Context) {
+	var input struct {
+		Format  json.RawMessage `json:"format" binding:"required"`
+		Samples []ScriptSample  `json:"samples" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(input.Samples) > scriptMaxSamples {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("at most %d samples are allowed", scriptMaxSamples)})
+		return
+	}
+
+	// 编辑中的脚本不放入解码器缓存
+	decoder := compileMessageDecoder(string(input.Format))
+	if decoder.errorMsg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": decoder.errorMsg})
+		return
+	}
+	if decoder.script == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format kind must be script"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": runScriptSamples(decoder, input.Samples)})
+}
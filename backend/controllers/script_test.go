@@ -0,0 +1,128 @@
+package controllers
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+// xorScript 厂商报文体按字节异或 0x5A 混淆
+const xorScript = `
+var KEY = 0x5A;
+function decode(bytes, meta) {
+	var plain = bytes.map(function (b) { return b ^ KEY; });
+	console.log("port", meta.f_port);
+	return {
+		temperature: ((plain[0] << 8) | plain[1]) / 10,
+		battery: plain[2],
+		flags: [plain[3] & 1, (plain[3] >> 1) & 1]
+	};
+}
+function encode(fields, meta) {
+	var t = Math.round(fields.temperature * 10);
+	return [t >> 8, t & 0xff, fields.battery, 0].map(function (b) { return b ^ KEY; });
+}
+`
+
+func scriptFormatJSON(t *testing.T, script string) string {
+	return mustFormatJSON(t, models.MessageFormat{Kind: PayloadKindScript, Encoding: "hex", Script: script})
+}
+
+func TestScriptDecoder(t *testing.T) {
+	config := models.MessageTypeConfig{Protocol: "mqtt", FPort: 2, Format: scriptFormatJSON(t, xorScript)}
+
+	// 0x00FA = 250 -> 25.0℃, battery 87, flags 0b10
+	result, err := parseWithConfig(config, "5aa00d58")
+	if err != nil || !result.Success {
+		t.Fatalf("Unexpected error: %v %s", err, result.Error)
+	}
+	if result.Fields["temperature"] != int64(25) || result.Fields["battery"] != int64(87) {
+		t.Errorf("Unexpected fields: %+v", result.Fields)
+	}
+	if flags, _ := json.Marshal(result.Fields["flags"]); string(flags) != "[0,1]" {
+		t.Errorf("Unexpected flags: %s", flags)
+	}
+
+	decoder := compileMessageDecoder(config.Format)
+	results := runScriptSamples(decoder, []ScriptSample{
+		{RawData: "5aa00d58", Meta: map[string]interface{}{"f_port": 2}, Expected: json.RawMessage(`{"temperature":25,"battery":87,"flags":[0,1]}`)},
+		{Name: "downlink", Fields: map[string]interface{}{"temperature": 25.0, "battery": 87.0}, Expected: json.RawMessage(`"5AA00D5A"`)},
+		{Name: "bad hex", RawData: "zz"},
+	})
+	if !results[0].Success || results[0].Matched == nil || !*results[0].Matched {
+		t.Errorf("Expected decode sample to match, got %+v", results[0])
+	}
+	if len(results[0].Logs) != 1 || results[0].Logs[0] != "port 2" {
+		t.Errorf("Unexpected logs: %v", results[0].Logs)
+	}
+	if results[1].Direction != "encode" || results[1].RawData != "5aa00d5a" || !*results[1].Matched {
+		t.Errorf("Unexpected encode result: %+v", results[1])
+	}
+	if results[2].Success || results[2].Error == "" {
+		t.Errorf("Expected invalid hex sample to fail, got %+v", results[2])
+	}
+}
+
+func TestScriptDecoderSandbox(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		errMsg string
+	}{
+		{"infinite loop", `function decode(bytes) { while (true) {} }`, "time limit"},
+		{"deep recursion", `function f(n) { return f(n + 1); } function decode() { return f(0); }`, "call stack"},
+		{"require", `function decode() { return { r: typeof require, f: typeof fetch }; }`, ""},
+		{"throw", `function decode() { throw new Error("bad frame"); }`, "bad frame"},
+		{"non object", `function decode() { return 42; }`, "must return an object"},
+		{"function value", `function decode() { return { f: function () {} }; }`, "unsupported type"},
+		{"repeat", `function decode() { return { s: "x".repeat(1e9) }; }`, "exceeds the limit"},
+		{"pad", `function decode() { return { s: "".padEnd(1e9) }; }`, "exceeds the limit"},
+		{"array fill", `function decode() { return { a: new Array(1e9).fill(0) }; }`, "exceeds the limit"},
+		{"array join", `function decode() { var a = []; a.length = 1e9; return { s: String(a) }; }`, "exceeds the limit"},
+		{"typed array", `function decode() { return { a: new Uint8Array(1e9) }; }`, "exceeds the limit"},
+		{"typed array constructor", `function decode() { return { a: new (new Uint8Array(1).constructor)(1e9) }; }`, "exceeds the limit"},
+		{"array from", `function decode() { return { a: Array.from({ length: 1e9 }) }; }`, "exceeds the limit"},
+		{"growing memory", `function decode() { var a = []; while (true) a.push(new Uint8Array(1 << 20)); }`, "memory limit"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			result, _ := parseMessageData(scriptFormatJSON(t, tt.script), "00")
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("Script was not stopped in time: %v", elapsed)
+			}
+			if tt.errMsg == "" {
+				if !result.Success || result.Fields["r"] != "undefined" || result.Fields["f"] != "undefined" {
+					t.Errorf("Expected no host access, got %+v %s", result.Fields, result.Error)
+				}
+				return
+			}
+			if result.Success || !strings.Contains(result.Error, tt.errMsg) {
+				t.Errorf("Expected error containing %q, got %q", tt.errMsg, result.Error)
+			}
+		})
+	}
+
+	// 受限的内置函数在限制内正常可用
+	guarded := `function decode(bytes) {
+		var data = new Uint8Array(bytes);
+		return { ok: data instanceof Uint8Array && new Array(2).fill(0).join("") === "00" && "7".padStart(3, "0") === "007" };
+	}`
+	if result, _ := parseMessageData(scriptFormatJSON(t, guarded), "0102"); !result.Success || result.Fields["ok"] != true {
+		t.Errorf("Expected guarded builtins to work, got %+v %s", result.Fields, result.Error)
+	}
+
+	// 顶层代码同样受时间限制，未定义 decode 的脚本无法保存
+	for _, script := range []string{`while (true) {}`, `function parse() {}`, `function decode( {`} {
+		if validateMessageFormat("mqtt", scriptFormatJSON(t, script)).Valid {
+			t.Errorf("Expected script %q to be invalid", script)
+		}
+	}
+	if !validateMessageFormat("mqtt", scriptFormatJSON(t, xorScript)).Valid {
+		t.Error("Expected xor script to be valid")
+	}
+}
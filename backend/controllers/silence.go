@@ -0,0 +1,271 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+// parseDailyTime 解析 HH:MM，返回当天的分钟数
+func parseDailyTime(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseWeekdays 解析逗号分隔的星期(0-6)，为空表示每天
+func parseWeekdays(s string) (map[time.Weekday]bool, error) {
+	days := make(map[time.Weekday]bool)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		day, err := strconv.Atoi(item)
+		if err != nil || day < 0 || day > 6 {
+			return nil, fmt.Errorf("invalid weekday %q", item)
+		}
+		days[time.Weekday(day)] = true
+	}
+	if len(days) == 0 {
+		for day := time.Sunday; day <= time.Saturday; day++ {
+			days[day] = true
+		}
+	}
+	return days, nil
+}
+
+// silenceActive 静默在 t 时刻是否生效
+func silenceActive(silence *models.Silence, t time.Time) bool {
+	unix := t.Unix()
+	if unix < silence.StartsAt || (silence.EndsAt != 0 && unix >= silence.EndsAt) {
+		return false
+	}
+	if silence.DailyStart == "" {
+		return true
+	}
+
+	start, err1 := parseDailyTime(silence.DailyStart)
+	end, err2 := parseDailyTime(silence.DailyEnd)
+	days, err3 := parseWeekdays(silence.Weekdays)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return false
+	}
+	if silence.Timezone != "" {
+		if loc, err := time.LoadLocation(silence.Timezone); err == nil {
+			t = t.In(loc)
+		}
+	}
+	minute := t.Hour()*60 + t.Minute()
+	if start < end {
+		return days[t.Weekday()] && minute >= start && minute < end
+	}
+	// 跨过零点的时间段属于开始的那一天
+	return (days[t.Weekday()] && minute >= start) || (days[t.AddDate(0, 0, -1).Weekday()] && minute < end)
+}
+
+// silenceMatches 静默的匹配条件是否匹配告警
+func silenceMatches(silence *models.Silence, alert *models.Alert, device *models.Device) bool {
+	if silence.DeviceID != nil && *silence.DeviceID != alert.DeviceID {
+		return false
+	}
+	if silence.GroupID != nil && (device.GroupID == nil || *device.GroupID != *silence.GroupID) {
+		return false
+	}
+	if silence.AlertType != "" && silence.AlertType != alert.Type {
+		return false
+	}
+	return levelListContains(silence.Levels, alert.Level)
+}
+
+// matchSilence 查找设备所有者当前生效且匹配告警的静默，没有时返回 nil
+func matchSilence(alert *models.Alert) *models.Silence {
+	var device models.Device
+	if err := database.DB.First(&device, alert.DeviceID).Error; err != nil {
+		return nil
+	}
+	now := time.Now()
+	var silences []models.Silence
+	if err := database.DB.Where("user_id = ? AND starts_at <= ? AND (ends_at = 0 OR ends_at > ?)", device.UserID, now.Unix(), now.Unix()).
+		Order("id").Find(&silences).Error; err != nil {
+		log.Printf("Failed to load silences for user %d: %v", device.UserID, err)
+		return nil
+	}
+	for i := range silences {
+		if silenceMatches(&silences[i], alert, &device) && silenceActive(&silences[i], now) {
+			return &silences[i]
+		}
+	}
+	return nil
+}
+
+// silenceInput 创建静默的请求
+type silenceInput struct {
+	Comment    string `json:"comment"`
+	DeviceID   *uint  `json:"device_id"`
+	GroupID    *uint  `json:"group_id"`
+	AlertType  string `json:"alert_type"`
+	Levels     string `json:"levels"`
+	StartsAt   int64  `json:"starts_at"`
+	EndsAt     int64  `json:"ends_at"`
+	Weekdays   string `json:"weekdays"`
+	DailyStart string `json:"daily_start"`
+	DailyEnd   string `json:"daily_end"`
+	Timezone   string `json:"timezone"`
+}
+
+// validate 校验静默请求，starts_at 为空时从当前时刻开始
+func (input *silenceInput) validate(userID uint) error {
+	if input.DeviceID == nil && input.GroupID == nil && input.AlertType == "" && strings.TrimSpace(input.Levels) == "" {
+		return errors.New("at least one of device_id, group_id, alert_type or levels is required")
+	}
+	if input.DeviceID != nil {
+		var device models.Device
+		if err := database.DB.Where("id = ? AND user_id = ?", *input.DeviceID, userID).First(&device).Error; err != nil {
+			return errors.New("Device not found")
+		}
+	}
+	if err := checkDeviceGroup(input.GroupID); err != nil {
+		return err
+	}
+	levels, err := normalizeLevels(input.Levels)
+	if err != nil {
+		return err
+	}
+	input.Levels = levels
+
+	if input.StartsAt == 0 {
+		input.StartsAt = time.Now().Unix()
+	}
+	if input.EndsAt != 0 && input.EndsAt <= input.StartsAt {
+		return errors.New("ends_at must be after starts_at")
+	}
+	if input.DailyStart == "" && input.DailyEnd == "" {
+		if input.EndsAt == 0 {
+			return errors.New("ends_at is required unless daily_start and daily_end are set")
+		}
+		if input.Weekdays != "" {
+			return errors.New("weekdays requires daily_start and daily_end")
+		}
+		return nil
+	}
+
+	start, err := parseDailyTime(input.DailyStart)
+	if err != nil {
+		return err
+	}
+	end, err := parseDailyTime(input.DailyEnd)
+	if err != nil {
+		return err
+	}
+	if start == end {
+		return errors.New("daily_start and daily_end must differ")
+	}
+	if _, err := parseWeekdays(input.Weekdays); err != nil {
+		return err
+	}
+	if input.Timezone != "" {
+		if _, err := time.LoadLocation(input.Timezone); err != nil {
+			return fmt.Errorf("invalid timezone %q", input.Timezone)
+		}
+	}
+	return nil
+}
+
+// GetSilences 获取静默列表，active=true 时只返回当前生效的静默，expired=false 时不返回已结束的静默
+func GetSilences(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	now := time.Now()
+
+	query := database.DB.Where("user_id = ?", userID)
+	if c.Query("expired") == "false" || c.Query("active") == "true" {
+		query = query.Where("ends_at = 0 OR ends_at > ?", now.Unix())
+	}
+	var silences []models.Silence
+	if err := query.Order("id DESC").Find(&silences).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get silences"})
+		return
+	}
+
+	result := make([]models.Silence, 0, len(silences))
+	for _, silence := range silences {
+		silence.Active = silenceActive(&silence, now)
+		if c.Query("active") == "true" && !silence.Active {
+			continue
+		}
+		result = append(result, silence)
+	}
+	c.JSON(http.StatusOK, gin.H{"data": result})
+}
+
+// CreateSilence 创建静默
+func CreateSilence(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	var input silenceInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := input.validate(userID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	silence := models.Silence{
+		UserID:     userID,
+		Comment:    input.Comment,
+		DeviceID:   input.DeviceID,
+		GroupID:    input.GroupID,
+		AlertType:  input.AlertType,
+		Levels:     input.Levels,
+		StartsAt:   input.StartsAt,
+		EndsAt:     input.EndsAt,
+		Weekdays:   input.Weekdays,
+		DailyStart: input.DailyStart,
+		DailyEnd:   input.DailyEnd,
+		Timezone:   input.Timezone,
+	}
+	if err := database.DB.Create(&silence).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create silence"})
+		return
+	}
+
+	silence.Active = silenceActive(&silence, time.Now())
+	c.JSON(http.StatusOK, gin.H{"data": silence})
+}
+
+// ExpireSilence 立即结束静默，已结束的静默保留用于查询
+func ExpireSilence(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	var silence models.Silence
+	if err := database.DB.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&silence).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Silence not found"})
+		return
+	}
+
+	now := time.Now().Unix()
+	if silence.EndsAt == 0 || silence.EndsAt > now {
+		silence.EndsAt = now
+		if silence.StartsAt > now {
+			silence.StartsAt = now
+		}
+		if err := database.DB.Save(&silence).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to expire silence"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": silence})
+}
@@ -0,0 +1,100 @@
+package controllers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+func TestSilenceActive(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	oneOff := &models.Silence{StartsAt: at("2024-03-04 08:00").Unix(), EndsAt: at("2024-03-04 12:00").Unix()}
+	// 每周一、周三 22:00 到次日 06:00
+	nightly := &models.Silence{StartsAt: at("2024-03-01 00:00").Unix(), Weekdays: "1,3", DailyStart: "22:00", DailyEnd: "06:00", Timezone: "UTC"}
+
+	cases := []struct {
+		silence *models.Silence
+		at      string
+		want    bool
+	}{
+		{oneOff, "2024-03-04 07:59", false},
+		{oneOff, "2024-03-04 08:00", true},
+		{oneOff, "2024-03-04 12:00", false},
+		{nightly, "2024-03-04 21:59", false}, // 周一
+		{nightly, "2024-03-04 22:00", true},
+		{nightly, "2024-03-05 05:59", true}, // 周一开始的时间段延续到周二
+		{nightly, "2024-03-05 06:00", false},
+		{nightly, "2024-03-05 23:00", false}, // 周二不生效
+		{nightly, "2024-03-06 23:00", true},
+		{nightly, "2024-02-26 23:00", false}, // 早于开始时间
+	}
+	for _, tc := range cases {
+		if got := silenceActive(tc.silence, at(tc.at)); got != tc.want {
+			t.Errorf("%+v at %s: got %v, want %v", tc.silence, tc.at, got, tc.want)
+		}
+	}
+}
+
+func TestSaveAlertSilenced(t *testing.T) {
+	useTestDatabase(t)
+	alertSaver.rates = make(map[uint]*alertRateState)
+
+	user := models.User{Username: "field", Password: "x"}
+	database.DB.Create(&user)
+	device := models.Device{Name: "station", Topic: "station/1", UserID: user.ID}
+	database.DB.Create(&device)
+	// 渠道停用，测试不实际发送通知，只检查是否开始升级
+	channel := models.NotificationChannel{UserID: user.ID, Name: "ops", Type: models.ChannelTypeWebhook, Config: `{"url":"http://127.0.0.1:1"}`}
+	database.DB.Create(&channel)
+	database.DB.Model(&channel).Update("enabled", false)
+	database.DB.Create(&models.EscalationPolicy{UserID: user.ID, Name: "all", Enabled: true,
+		Tiers: fmt.Sprintf(`[{"delay_minutes":5,"channel_ids":[%d]}]`, channel.ID)})
+
+	now := time.Now().Unix()
+	silence := models.Silence{UserID: user.ID, DeviceID: &device.ID, Levels: "low,medium", StartsAt: now - 60, EndsAt: now + 3600}
+	database.DB.Create(&silence)
+
+	newAlert := func(level string) *models.Alert {
+		return &models.Alert{DeviceID: device.ID, Type: "offline", Level: level}
+	}
+	silenced := newAlert("low")
+	if _, err := saveAlert(silenced); err != nil {
+		t.Fatalf("Failed to save alert: %v", err)
+	}
+	if !silenced.Silenced || silenced.SilenceID != silence.ID {
+		t.Errorf("Expected silenced alert, got %+v", silenced)
+	}
+	// 不匹配级别的告警照常处理
+	loud := newAlert("high")
+	saveAlert(loud)
+	if loud.Silenced {
+		t.Errorf("Expected high alert not to be silenced")
+	}
+
+	var escalations []models.AlertEscalation
+	database.DB.Find(&escalations)
+	if len(escalations) != 1 || escalations[0].AlertID != loud.ID {
+		t.Errorf("Expected escalation only for the unsilenced alert, got %+v", escalations)
+	}
+
+	// 静默结束后同一指纹的告警不合并到静默的告警
+	database.DB.Model(&silence).Update("ends_at", now-1)
+	after := newAlert("low")
+	if saved, _ := saveAlert(after); saved != alertCreated || after.Silenced || after.ID == silenced.ID {
+		t.Errorf("Expected a new unsilenced alert after the silence expired, got %v %+v", saved, after)
+	}
+	var count int64
+	database.DB.Model(&models.Alert{}).Where("silenced = ?", true).Count(&count)
+	if count != 1 {
+		t.Errorf("Expected one silenced alert, got %d", count)
+	}
+}
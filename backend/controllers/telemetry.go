@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+// recordTelemetry 保存设备遥测数据，fields 序列化为 JSON 存入 Data，保存后计算告警规则
+func recordTelemetry(telemetry *models.Telemetry, fields map[string]interface{}) error {
+	if fields != nil {
+		data, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		telemetry.Data = string(data)
+	}
+	if telemetry.Timestamp == 0 {
+		telemetry.Timestamp = time.Now().Unix()
+	}
+
+	if err := database.DB.Create(telemetry).Error; err != nil {
+		return err
+	}
+	evaluateAlertRules(telemetry, fields)
+	return nil
+}
+
+// upsertDeviceLocation 按 topic 查找设备并更新位置，设备不存在时自动创建
+func upsertDeviceLocation(topic string, timestamp int64, latitude, longitude float64) (*models.Device, error) {
+	var device models.Device
+	result := database.DB.Where("topic = ?", topic).First(&device)
+	if result.Error != nil {
+		// Device not found, create a new one
+		device = models.Device{
+			Name:      topic,
+			Topic:     topic,
+			UserID:    1, // Default user ID, adjust as needed
+			Longitude: longitude,
+			Latitude:  latitude,
+			Status:    "online",
+			LastSeen:  timestamp,
+		}
+		if err := database.DB.Create(&device).Error; err != nil {
+			return nil, err
+		}
+		return &device, nil
+	}
+
+	// Update existing device
+	device.Longitude = longitude
+	device.Latitude = latitude
+	device.Status = "online"
+	device.LastSeen = timestamp
+	if err := database.DB.Save(&device).Error; err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+// GetDeviceTelemetry 获取设备遥测数据，支持时间范围及分页
+func GetDeviceTelemetry(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	id := c.Param("id")
+
+	var device models.Device
+	if err := database.DB.Where("id = ? AND user_id = ?", id, userID).First(&device).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	query := database.DB.Model(&models.Telemetry{}).Where("device_id = ?", device.ID)
+	if start, err := strconv.ParseInt(c.Query("start"), 10, 64); err == nil {
+		query = query.Where("timestamp >= ?", start)
+	}
+	if end, err := strconv.ParseInt(c.Query("end"), 10, 64); err == nil {
+		query = query.Where("timestamp <= ?", end)
+	}
+	if source := c.Query("source"); source != "" {
+		query = query.Where("source = ?", source)
+	}
+
+	pageNum, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || pageNum < 1 {
+		pageNum = 1
+	}
+	pageSizeNum, err := strconv.Atoi(c.DefaultQuery("page_size", "100"))
+	if err != nil || pageSizeNum < 1 {
+		pageSizeNum = 100
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch telemetry"})
+		return
+	}
+
+	var telemetry []models.Telemetry
+	if err := query.Order("timestamp DESC").
+		Offset((pageNum - 1) * pageSizeNum).
+		Limit(pageSizeNum).
+		Find(&telemetry).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch telemetry"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": telemetry,
+		"pagination": gin.H{
+			"page":       pageNum,
+			"page_size":  pageSizeNum,
+			"total":      total,
+			"total_page": (total + int64(pageSizeNum) - 1) / int64(pageSizeNum),
+		},
+	})
+}
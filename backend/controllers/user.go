@@ -10,6 +10,19 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+// IsAdmin 判断当前登录用户是否为管理员
+func IsAdmin(c *gin.Context) bool {
+	userID, exists := c.Get("userID")
+	if !exists {
+		return false
+	}
+	var user models.User
+	if err := database.DB.Select("role").First(&user, userID).Error; err != nil {
+		return false
+	}
+	return user.Role == models.UserRoleAdmin
+}
+
 // GetUsers 获取所有用户
 func GetUsers(c *gin.Context) {
 	var users []models.User
@@ -54,6 +67,12 @@ func CreateUser(c *gin.Context) {
 		return
 	}
 
+	// 只有管理员可以分配管理员角色
+	if input.Role == models.UserRoleAdmin && !IsAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Admin privileges required"})
+		return
+	}
+
 	// 检查用户名是否已存在
 	var existingUser models.User
 	database.DB.Where("username = ?", input.Username).First(&existingUser)
@@ -121,6 +140,12 @@ func UpdateUser(c *gin.Context) {
 		return
 	}
 
+	// 只有管理员可以修改角色，防止普通用户给自己提权
+	if input.Role != user.Role && !IsAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Admin privileges required"})
+		return
+	}
+
 	// 检查用户名是否已被其他用户使用（如果用户名有变化）
 	if user.Username != input.Username {
 		var existingUser models.User
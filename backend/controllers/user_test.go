@@ -0,0 +1,61 @@
+package controllers
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liang/mqtt-app/backend/database"
+	"github.com/liang/mqtt-app/backend/models"
+)
+
+func TestUserRoleEscalation(t *testing.T) {
+	useTestDatabase(t)
+	gin.SetMode(gin.TestMode)
+
+	admin := models.User{Username: "admin", Password: "x", Role: models.UserRoleAdmin}
+	user := models.User{Username: "alice", Password: "x", Role: "user"}
+	database.DB.Create(&admin)
+	database.DB.Create(&user)
+
+	request := func(handler gin.HandlerFunc, method string, callerID, targetID uint, body string) int {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(method, "/api/users", bytes.NewBufferString(body))
+		c.Request.Header.Set("Content-Type", "application/json")
+		c.Params = gin.Params{{Key: "id", Value: fmt.Sprint(targetID)}}
+		c.Set("userID", callerID)
+		handler(c)
+		return w.Code
+	}
+
+	if code := request(UpdateUser, http.MethodPut, user.ID, user.ID, `{"username":"alice","role":"admin"}`); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for self escalation, got %d", code)
+	}
+	if code := request(CreateUser, http.MethodPost, user.ID, 0, `{"username":"mallory","password":"x","role":"admin"}`); code != http.StatusForbidden {
+		t.Errorf("Expected 403 when creating an admin, got %d", code)
+	}
+	var reloaded models.User
+	database.DB.First(&reloaded, user.ID)
+	if reloaded.Role != "user" {
+		t.Fatalf("Expected role to stay user, got %q", reloaded.Role)
+	}
+	if IsAdmin(&gin.Context{}) {
+		t.Error("Expected anonymous caller not to be admin")
+	}
+
+	// 不修改角色时普通用户仍可更新，管理员可以修改角色
+	if code := request(UpdateUser, http.MethodPut, user.ID, user.ID, `{"username":"alice2","role":"user"}`); code != http.StatusOK {
+		t.Errorf("Expected 200 without role change, got %d", code)
+	}
+	if code := request(UpdateUser, http.MethodPut, admin.ID, user.ID, `{"username":"alice2","role":"admin"}`); code != http.StatusOK {
+		t.Errorf("Expected 200 for admin, got %d", code)
+	}
+	database.DB.First(&reloaded, user.ID)
+	if reloaded.Role != models.UserRoleAdmin {
+		t.Errorf("Expected admin to grant role, got %q", reloaded.Role)
+	}
+}
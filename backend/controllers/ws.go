@@ -44,41 +44,52 @@ func WsHandler(c *gin.Context) {
 	}
 
 	// Channel to pass messages from MQTT to WebSocket
-	msgChan := make(chan []byte)
+	msgChan := make(chan []byte, 64)
 
 	// Define the message handler for this specific connection
 	messageHandler := func(client MQTT.Client, msg MQTT.Message) {
 		log.Printf("Forwarding message from topic %s to WebSocket", msg.Topic())
-		msgChan <- msg.Payload()
+		// 不阻塞其他订阅方(如数据接入)，连接处理不过来时丢弃消息
+		select {
+		case msgChan <- msg.Payload():
+		default:
+			log.Printf("WebSocket buffer full, dropping message from topic %s", msg.Topic())
+		}
 	}
 
 	// Subscribe to the topics
-	if token := mqtt.Client.SubscribeMultiple(topics, messageHandler); token.Wait() && token.Error() != nil {
-		log.Println("Failed to subscribe to topics:", token.Error())
-		return
+	var unsubscribes []func()
+	for topic := range topics {
+		unsubscribe, err := mqtt.Subscribe(topic, messageHandler)
+		if err != nil {
+			log.Println("Failed to subscribe to topic:", topic, err)
+			continue
+		}
+		unsubscribes = append(unsubscribes, unsubscribe)
 	}
 	log.Printf("Subscribed to topics for user %d", userID)
 
 	// Unsubscribe when the function returns
 	defer func() {
-		topicList := []string{}
-		for topic := range topics {
-			topicList = append(topicList, topic)
-		}
-		if len(topicList) > 0 {
-			if token := mqtt.Client.Unsubscribe(topicList...); token.Wait() && token.Error() != nil {
-				log.Println("Failed to unsubscribe from topics:", token.Error())
-			}
-			log.Printf("Unsubscribed from topics for user %d", userID)
+		for _, unsubscribe := range unsubscribes {
+			unsubscribe()
 		}
+		log.Printf("Unsubscribed from topics for user %d", userID)
 	}()
 
 	// Goroutine to write messages to WebSocket
+	done := make(chan struct{})
+	defer close(done)
 	go func() {
-		for msg := range msgChan {
-			if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
-				log.Println("Error writing to WebSocket:", err)
-				return // Exit goroutine on error
+		for {
+			select {
+			case msg := <-msgChan:
+				if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+					log.Println("Error writing to WebSocket:", err)
+					return // Exit goroutine on error
+				}
+			case <-done:
+				return
 			}
 		}
 	}()
@@ -87,7 +98,6 @@ func WsHandler(c *gin.Context) {
 	for {
 		if _, _, err := conn.ReadMessage(); err != nil {
 			log.Println("WebSocket read error (client disconnected?):", err)
-			close(msgChan) // Close channel to terminate writer goroutine
 			break
 		}
 	}
@@ -1,9 +1,11 @@
 package controllers
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"strconv"
@@ -96,6 +98,22 @@ func ProcessZYData(packet *ZYDataPacket) error {
 
 // processLocationData processes location data from ZY packet
 func processLocationData(deviceID string, timestamp uint32, data []byte) error {
+	// 设备显式绑定了解析配置时使用绑定的配置
+	if device, err := findDeviceByTopic(deviceID); err == nil {
+		if config, _ := boundMessageConfig(device, deviceID); config != nil {
+			telemetry := &models.Telemetry{Source: "zy", Timestamp: int64(timestamp)}
+			if _, err := ingestPayloadWithConfig(device, config, data, telemetry); err != nil {
+				return fmt.Errorf("failed to parse location data: %v", err)
+			}
+			return nil
+		}
+	}
+
+	// GNSS 终端直接转发的 NMEA 语句
+	if isNMEAPayload(data) {
+		return processNMEAData(deviceID, timestamp, string(data))
+	}
+
 	// Parse the hex-encoded content data
 	hexContent := hex.EncodeToString(data)
 	contentData, err := parseContentData(hexContent)
@@ -104,27 +122,22 @@ func processLocationData(deviceID string, timestamp uint32, data []byte) error {
 	}
 
 	// Find or create device
-	var device models.Device
-	result := database.DB.Where("topic = ?", deviceID).First(&device)
-	if result.Error != nil {
-		// Device not found, create a new one
-		device = models.Device{
-			Name:      deviceID,
-			Topic:     deviceID,
-			UserID:    1, // Default user ID, adjust as needed
-			Longitude: contentData.Longitude,
-			Latitude:  contentData.Latitude,
-			Status:    "online",
-			LastSeen:  int64(timestamp),
-		}
-		database.DB.Create(&device)
-	} else {
-		// Update existing device
-		device.Longitude = contentData.Longitude
-		device.Latitude = contentData.Latitude
-		device.Status = "online"
-		device.LastSeen = int64(timestamp)
-		database.DB.Save(&device)
+	device, err := upsertDeviceLocation(deviceID, int64(timestamp), contentData.Latitude, contentData.Longitude)
+	if err != nil {
+		return fmt.Errorf("failed to update device: %v", err)
+	}
+
+	telemetry := models.Telemetry{
+		DeviceID:  device.ID,
+		Source:    "zy",
+		Timestamp: int64(timestamp),
+		Latitude:  contentData.Latitude,
+		Longitude: contentData.Longitude,
+		Altitude:  float64(contentData.Altitude),
+		RawData:   hexContent,
+	}
+	if err := recordTelemetry(&telemetry, contentData.Fields()); err != nil {
+		return fmt.Errorf("failed to save telemetry: %v", err)
 	}
 
 	fmt.Printf("Updated device %s location: lat=%f, lng=%f\n", deviceID, contentData.Latitude, contentData.Longitude)
@@ -190,7 +203,9 @@ func processAlertData(deviceID string, timestamp uint32, data []byte) error {
 		RawData:   fmt.Sprintf("alert_type=%d,alert_level=%d", alertType, alertLevel),
 	}
 
-	database.DB.Create(&alert)
+	if _, err := saveAlert(&alert); err != nil {
+		return fmt.Errorf("failed to save alert: %v", err)
+	}
 
 	fmt.Printf("Created alert for device %s: %s\n", deviceID, alert.Message)
 	return nil
@@ -198,24 +213,42 @@ func processAlertData(deviceID string, timestamp uint32, data []byte) error {
 
 // HandleZyTCPData handles incoming TCP data for ZY protocol
 func HandleZyTCPData(data []byte, conn net.Conn) {
+	peer := conn.RemoteAddr().String()
 	packet, err := ParseZYDataPacket(data)
+	if err == nil {
+		if topic := strings.TrimSpace(string(packet.Msg_id)); topic != "" {
+			zyPeerTopics.Store(peer, topic)
+		}
+	}
+
+	// 设备处于抓包模式时记录收发的原始帧，无法解析的帧归属于该连接此前识别出的设备
+	var capture *activeCapture
+	if topic, ok := zyPeerTopics.Load(peer); ok {
+		capture = topicCapture(topic.(string))
+	}
+	reply := func(response []byte) {
+		conn.Write(response)
+		capture.record(models.CaptureTransportZyTCP, models.CaptureDirectionOut, peer, response, "")
+	}
+
 	if err != nil {
 		fmt.Printf("Error parsing ZY packet: %v\n", err)
-		conn.Write([]byte("ERROR: " + err.Error()))
+		capture.record(models.CaptureTransportZyTCP, models.CaptureDirectionIn, peer, data, errorNote(err))
+		reply([]byte("ERROR: " + err.Error()))
 		return
 	}
 
 	// Process the packet
 	err = ProcessZYData(packet)
+	capture.record(models.CaptureTransportZyTCP, models.CaptureDirectionIn, peer, data, errorNote(err))
 	if err != nil {
 		fmt.Printf("Error processing ZY data: %v\n", err)
-		conn.Write([]byte("ERROR: " + err.Error()))
+		reply([]byte("ERROR: " + err.Error()))
 		return
 	}
 
 	// Send success response
-	response := []byte("SUCCESS")
-	conn.Write(response)
+	reply([]byte("SUCCESS"))
 }
 
 // ZyForwardData and related functions remain for HTTP forwarding
@@ -250,6 +283,20 @@ type ContentData struct {
 	Voltage     float64 // 电压
 }
 
+// Fields 返回解析后的字段，字段名与告警的 ParsedData 保持一致
+func (d *ContentData) Fields() map[string]interface{} {
+	return map[string]interface{}{
+		"device_type": d.DeviceType,
+		"datetime":    d.DateTime,
+		"latitude":    d.Latitude,
+		"longitude":   d.Longitude,
+		"altitude":    d.Altitude,
+		"snr":         d.SNR,
+		"temperature": d.Temperature,
+		"voltage":     d.Voltage,
+	}
+}
+
 // parseContentData parses the hex-encoded content data
 func parseContentData(hexContent string) (*ContentData, error) {
 	// Decode hex string to bytes
@@ -315,6 +362,14 @@ func parseContentData(hexContent string) (*ContentData, error) {
 }
 
 func HandleZyForwardData(c *gin.Context) {
+	// 保留原始请求体用于抓包
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ZyForwardDataResponse{Result: err.Error()})
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
 	var data ZyForwardData
 	if err := c.ShouldBindJSON(&data); err != nil {
 		response := ZyForwardDataResponse{
@@ -337,7 +392,7 @@ func HandleZyForwardData(c *gin.Context) {
 		// Parse single content data
 		if data.Content != "" {
 
-			contentData, err := parseContentData(data.Content)
+			fields, config, err := decodeZyForwardContent(data, data.Content)
 			if err != nil {
 				response = ZyForwardDataResponse{
 					TotalLen: data.TotalLen,
@@ -346,10 +401,10 @@ func HandleZyForwardData(c *gin.Context) {
 				}
 			} else {
 				// Process the parsed data (save to database, etc.)
-				fmt.Printf("Parsed content data: %+v\n", contentData)
+				fmt.Printf("Parsed content data: %+v\n", fields)
 
 				// Create alert record with parsed content data
-				createZyDataAlert(data, contentData, data.Content)
+				createZyDataAlert(data, fields, config, data.Content)
 
 				response = ZyForwardDataResponse{
 					TotalLen: data.TotalLen,
@@ -370,13 +425,13 @@ func HandleZyForwardData(c *gin.Context) {
 		for i, content := range data.ContentList {
 			if content != "" {
 
-				contentData, err := parseContentData(content)
+				fields, config, err := decodeZyForwardContent(data, content)
 				if err != nil {
 					fmt.Printf("Error parsing content %d: %v\n", i, err)
 				} else {
-					fmt.Printf("Parsed content data %d: %+v\n", i, contentData)
+					fmt.Printf("Parsed content data %d: %+v\n", i, fields)
 					// Create alert record with parsed content data
-					createZyDataAlert(data, contentData, content)
+					createZyDataAlert(data, fields, config, content)
 					successCount++
 				}
 			}
@@ -388,23 +443,66 @@ func HandleZyForwardData(c *gin.Context) {
 		}
 	}
 
+	if capture := deviceCapture(zyForwardDeviceID(data)); capture != nil {
+		capture.record(models.CaptureTransportHTTPForward, models.CaptureDirectionIn, c.ClientIP(), body, response.Result)
+		if encoded, err := json.Marshal(response); err == nil {
+			capture.record(models.CaptureTransportHTTPForward, models.CaptureDirectionOut, c.ClientIP(), encoded, "")
+		}
+	}
+
 	c.JSON(http.StatusOK, response)
 }
 
-// createZyDataAlert creates an alert record for ZY data
-
-// createZyDataAlert creates an alert record for ZY data
-func createZyDataAlert(data ZyForwardData, contentData *ContentData, rawContent string) {
-	// 使用默认设备ID 1，因为DeviceType可能不是有效的设备ID
+// zyForwardDeviceID 从转发数据的 msgId(<设备ID>_xxx) 中取得设备ID，无法识别时返回 0
+func zyForwardDeviceID(data ZyForwardData) uint {
 	deviceID := strings.Split(data.MsgID, "_")[0]
 
 	// 将deviceID字符串转换为整数
 	deviceIDUint, err := strconv.ParseUint(deviceID, 10, 32)
 	if err != nil {
-		// 如果转换失败，使用默认设备ID 1
-		deviceIDUint = 0
-		fmt.Printf("Failed to convert deviceID '%s' to uint, using default ID 1\n", deviceID)
+		fmt.Printf("Failed to convert deviceID '%s' to uint, using default ID 0\n", deviceID)
+		return 0
 	}
+	return uint(deviceIDUint)
+}
+
+// decodeZyForwardContent 解析转发的十六进制内容: 设备显式绑定了解析配置时使用绑定的配置，
+// 否则按中移终端内容格式解析(返回的配置为 nil)
+func decodeZyForwardContent(data ZyForwardData, content string) (map[string]interface{}, *models.MessageTypeConfig, error) {
+	var device models.Device
+	if err := database.DB.First(&device, zyForwardDeviceID(data)).Error; err == nil {
+		if config, _ := boundMessageConfig(&device, device.Topic); config != nil {
+			// 告警记录解析所用的版本
+			if err := ensureConfigVersioned(config); err != nil {
+				return nil, nil, err
+			}
+			payload, err := hex.DecodeString(content)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to decode hex content: %v", err)
+			}
+			result, err := parseWithConfig(*config, encodePayloadForConfig(config, payload))
+			if err != nil {
+				return nil, nil, err
+			}
+			if !result.Success {
+				return nil, nil, fmt.Errorf("%s", result.Error)
+			}
+			return result.Fields, config, nil
+		}
+	}
+
+	contentData, err := parseContentData(content)
+	if err != nil {
+		return nil, nil, err
+	}
+	return contentData.Fields(), nil, nil
+}
+
+// createZyDataAlert creates an alert record for ZY data, config is the bound config used to decode (nil for built-in)
+func createZyDataAlert(data ZyForwardData, fields map[string]interface{}, config *models.MessageTypeConfig, rawContent string) {
+	deviceIDUint := zyForwardDeviceID(data)
+	latitude, _ := fieldFloat(fields, "latitude", "lat")
+	longitude, _ := fieldFloat(fields, "longitude", "lng", "lon")
 
 	// 检查device中有没有对应DeviceID的设备
 	var device models.Device
@@ -415,8 +513,8 @@ func createZyDataAlert(data ZyForwardData, contentData *ContentData, rawContent
 			Name:      fmt.Sprintf("设备_%d", deviceIDUint),
 			Topic:     fmt.Sprintf("device/%d", deviceIDUint),
 			UserID:    1, // 默认用户ID
-			Longitude: contentData.Longitude,
-			Latitude:  contentData.Latitude,
+			Longitude: longitude,
+			Latitude:  latitude,
 			Status:    "online",
 			LastSeen:  time.Now().Unix(),
 		}
@@ -431,8 +529,8 @@ func createZyDataAlert(data ZyForwardData, contentData *ContentData, rawContent
 	} else {
 		// 设备存在，更新坐标和时间
 		device.UpdatedAt = time.Now()
-		device.Longitude = contentData.Longitude
-		device.Latitude = contentData.Latitude
+		device.Longitude = longitude
+		device.Latitude = latitude
 		device.Status = "online"
 		device.LastSeen = time.Now().Unix()
 		if err := database.DB.Save(&device).Error; err != nil {
@@ -450,23 +548,45 @@ func createZyDataAlert(data ZyForwardData, contentData *ContentData, rawContent
 		return
 	}
 
+	parsedData, err := json.Marshal(fields)
+	if err != nil {
+		fmt.Printf("Failed to marshal parsed content data: %v\n", err)
+		return
+	}
+
 	alert := models.Alert{
-		DeviceID:  uint(deviceIDUint),
-		Type:      "99",
-		Message:   string(messageJSON), // Assign the JSON string here
-		Level:     "low",
-		Read:      false,
-		Timestamp: time.Now().Unix(),
-		RawData:   rawContent,
-		ParsedData: fmt.Sprintf(`{"device_type":%d,"datetime":"%s","latitude":%f,"longitude":%f,"altitude":%d,"snr":%d,"temperature":%d,"voltage":%.1f}`,
-			contentData.DeviceType, contentData.DateTime, contentData.Latitude, contentData.Longitude,
-			contentData.Altitude, contentData.SNR, contentData.Temperature, contentData.Voltage),
+		DeviceID:   uint(deviceIDUint),
+		Type:       "99",
+		Message:    string(messageJSON), // Assign the JSON string here
+		Level:      "low",
+		Read:       false,
+		Timestamp:  time.Now().Unix(),
+		RawData:    rawContent,
+		ParsedData: string(parsedData),
+	}
+	if config != nil {
+		alert.ConfigID = config.ID
+		alert.ConfigVersion = config.Version
 	}
 
-	result = database.DB.Create(&alert)
-	if result.Error != nil {
-		fmt.Printf("Failed to create alert: %v\n", result.Error)
-	} else {
-		fmt.Printf("Created ZY data alert for device type: %d, alert ID: %d\n", contentData.DeviceType, alert.ID)
+	// 同一设备重复的数据告警合并为一条，超出限流的告警被抑制
+	switch saved, err := saveAlert(&alert); {
+	case err != nil:
+		fmt.Printf("Failed to create alert: %v\n", err)
+	case saved == alertDeduplicated:
+		fmt.Printf("Merged ZY data alert for device: %d, alert ID: %d, occurrences: %d\n", deviceIDUint, alert.ID, alert.Occurrences)
+	case saved == alertSuppressed:
+		fmt.Printf("Suppressed ZY data alert for device: %d\n", deviceIDUint)
+	default:
+		fmt.Printf("Created ZY data alert for device: %d, alert ID: %d\n", deviceIDUint, alert.ID)
 	}
+
+	// 转发数据不保存遥测，直接计算告警规则
+	evaluateAlertRules(&models.Telemetry{
+		DeviceID:      device.ID,
+		Timestamp:     alert.Timestamp,
+		RawData:       rawContent,
+		ConfigID:      alert.ConfigID,
+		ConfigVersion: alert.ConfigVersion,
+	}, fields)
 }
@@ -9,16 +9,66 @@ import (
 var DB *gorm.DB
 
 func ConnectDatabase() {
-	database, err := gorm.Open(sqlite.Open("mqtt_app.db"), &gorm.Config{})
+	ConnectDatabaseAt("mqtt_app.db")
+}
+
+// ConnectDatabaseAt 连接指定路径的数据库，离线工具(如 replay)使用数据库副本
+func ConnectDatabaseAt(path string) {
+	database, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
 	if err != nil {
 		panic("Failed to connect to database!")
 	}
 
 	err = database.AutoMigrate(&models.User{}, &models.Device{}, &models.DeviceGroup{},
-		&models.Alert{}, &models.MessageType{}, &models.MessageTypeConfig{})
+		&models.Alert{}, &models.MessageType{}, &models.MessageTypeConfig{}, &models.Telemetry{},
+		&models.JT808Terminal{}, &models.LoRaWANDevice{}, &models.ModbusDevice{}, &models.TopicConfigBinding{}, &models.MessageTypeConfigVersion{},
+		&models.RedecodeJob{}, &models.CaptureSession{}, &models.CapturedFrame{},
+		&models.AlertRule{}, &models.AlertRuleState{}, &models.AlertEvent{}, &models.AlertComment{},
+		&models.NotificationChannel{}, &models.NotificationDelivery{},
+		&models.OnCallSchedule{}, &models.OnCallOverride{}, &models.EscalationPolicy{}, &models.AlertEscalation{},
+		&models.Silence{}, &models.ExportJob{},
+		&models.RetentionPolicy{}, &models.RetentionSettings{}, &models.RetentionRun{})
 	if err != nil {
 		panic("Failed to migrate database!")
 	}
+	if err := setupAlertSearch(database); err != nil {
+		panic("Failed to create alert search index: " + err.Error())
+	}
 
 	DB = database
 }
+
+// alertSearchTriggers 保持告警全文索引与 alerts 表同步，只在消息或解析数据变化时重建索引
+var alertSearchTriggers = []string{
+	`CREATE TRIGGER IF NOT EXISTS alerts_fts_ai AFTER INSERT ON alerts BEGIN
+		INSERT INTO alerts_fts(docid, message, parsed_data) VALUES (new.id, new.message, new.parsed_data);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS alerts_fts_bd BEFORE DELETE ON alerts BEGIN
+		DELETE FROM alerts_fts WHERE docid = old.id;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS alerts_fts_bu BEFORE UPDATE OF message, parsed_data ON alerts BEGIN
+		DELETE FROM alerts_fts WHERE docid = old.id;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS alerts_fts_au AFTER UPDATE OF message, parsed_data ON alerts BEGIN
+		INSERT INTO alerts_fts(docid, message, parsed_data) VALUES (new.id, new.message, new.parsed_data);
+	END`,
+}
+
+// setupAlertSearch 创建告警消息和解析数据的全文索引(FTS4，内容引用 alerts 表)，
+// 首次创建时为已有告警建立索引
+func setupAlertSearch(db *gorm.DB) error {
+	if db.Migrator().HasTable("alerts_fts") {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(`CREATE VIRTUAL TABLE alerts_fts USING fts4(content="alerts", message, parsed_data)`).Error; err != nil {
+			return err
+		}
+		for _, trigger := range alertSearchTriggers {
+			if err := tx.Exec(trigger).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Exec(`INSERT INTO alerts_fts(alerts_fts) VALUES ('rebuild')`).Error
+	})
+}
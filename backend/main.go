@@ -5,7 +5,9 @@ import (
 	"io/fs"
 	"net"
 	"net/http"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/liang/mqtt-app/backend/controllers"
@@ -18,6 +20,11 @@ import (
 var embeddedFrontend embed.FS
 
 func main() {
+	// Offline replay of captured frames: backend replay [-db file] [-format file] capture.jsonl
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(controllers.RunReplayCommand(os.Args[2:]))
+	}
+
 	r := gin.Default()
 
 	// Add CORS middleware
@@ -26,9 +33,39 @@ func main() {
 	// Connect to database
 	database.ConnectDatabase()
 
+	// Record an initial version for message type configs created before versioning
+	controllers.VersionLegacyConfigs()
+
+	// Mark redecode jobs interrupted by the last shutdown as failed
+	controllers.RecoverRedecodeJobs()
+
+	// Mark export jobs interrupted by the last shutdown as failed and remove expired export files
+	controllers.RecoverExportJobs()
+
+	// Mark retention runs interrupted by the last shutdown as failed
+	controllers.RecoverRetentionRuns()
+
+	// Resume frame capture sessions that have not expired
+	controllers.LoadCaptureSessions()
+
+	// Retry alert notifications that were pending at the last shutdown
+	controllers.ResumeNotificationDeliveries()
+
+	// Re-enqueue alert notifications whose retry time has come
+	controllers.StartNotificationScheduler()
+
+	// Continue alert escalations, including those that fell due while stopped
+	controllers.StartEscalationScheduler()
+
+	// Purge data past its retention period and compact the database on schedule
+	controllers.StartRetentionScheduler()
+
 	// Connect to MQTT broker
 	mqtt.Connect()
 
+	// Subscribe to topics bound to message type configs
+	controllers.StartMQTTIngestion()
+
 	// Static file service for uploaded icons
 	r.Static("/uploads", "./uploads")
 
@@ -42,6 +79,9 @@ func main() {
 		// 中移数据 data route
 		api.POST("/zy-forward-data", controllers.HandleZyForwardData)
 
+		// LoRaWAN 网络服务器(ChirpStack/TTN) HTTP 集成
+		api.POST("/lorawan/uplink", controllers.HandleLoRaWANUplink)
+
 		// Authenticated routes
 		auth := api.Group("/")
 		auth.Use(middleware.AuthMiddleware())
@@ -53,6 +93,23 @@ func main() {
 			auth.DELETE("/devices/:id", controllers.DeleteDevice)
 			auth.PUT("/devices/:id/location", controllers.UpdateDeviceLocation)
 			auth.PUT("/devices/:id/status", controllers.UpdateDeviceStatus)
+			auth.GET("/devices/:id/telemetry", controllers.GetDeviceTelemetry)
+			auth.GET("/devices/:id/message-config", controllers.GetDeviceMessageConfig)
+			auth.POST("/devices/:id/lorawan/downlink", controllers.SendLoRaWANDownlink)
+			auth.GET("/devices/:id/modbus", controllers.GetModbusConfig)
+			auth.PUT("/devices/:id/modbus", controllers.SaveModbusConfig)
+			auth.POST("/devices/:id/modbus/poll", controllers.PollModbusDevice)
+			auth.POST("/devices/:id/capture", controllers.StartDeviceCapture)
+			auth.DELETE("/devices/:id/capture", controllers.StopDeviceCapture)
+			auth.POST("/devices/:id/coap-token", controllers.EnableCoAPAccess)
+			auth.DELETE("/devices/:id/coap-token", controllers.DisableCoAPAccess)
+
+			// Raw frame capture routes
+			auth.GET("/captures", controllers.GetCaptureSessions)
+			auth.GET("/captures/:id/frames", controllers.GetCaptureFrames)
+			auth.GET("/captures/:id/export", controllers.ExportCapture)
+			auth.POST("/captures/:id/replay", controllers.ReplayCaptureSession)
+			auth.DELETE("/captures/:id", controllers.DeleteCaptureSession)
 
 			// Alert routes
 			auth.GET("/alerts", controllers.GetAlerts)
@@ -62,6 +119,70 @@ func main() {
 			auth.PUT("/alerts/read", controllers.MarkAlertsAsRead)
 			auth.PUT("/alerts/read-all", controllers.MarkAllAlertsAsRead)
 			auth.DELETE("/alerts/:id", controllers.DeleteAlert)
+			auth.POST("/alerts/:id/acknowledge", controllers.AcknowledgeAlert)
+			auth.POST("/alerts/:id/resolve", controllers.ResolveAlert)
+			auth.POST("/alerts/:id/reopen", controllers.ReopenAlert)
+			auth.PUT("/alerts/:id/assignee", controllers.AssignAlert)
+			auth.GET("/alerts/:id/comments", controllers.GetAlertComments)
+			auth.POST("/alerts/:id/comments", controllers.AddAlertComment)
+			auth.GET("/alerts/:id/events", controllers.GetAlertEvents)
+			auth.GET("/stats/alerts", controllers.GetAlertStats)
+
+			// Alert rule routes
+			auth.GET("/alert-rules", controllers.GetAlertRules)
+			auth.POST("/alert-rules", controllers.CreateAlertRule)
+			auth.POST("/alert-rules/test", controllers.TestAlertRule)
+			auth.PUT("/alert-rules/:id", controllers.UpdateAlertRule)
+			auth.DELETE("/alert-rules/:id", controllers.DeleteAlertRule)
+			auth.GET("/alert-rules/:id/states", controllers.GetAlertRuleStates)
+
+			// Notification channel routes
+			auth.GET("/notification-channels", controllers.GetNotificationChannels)
+			auth.POST("/notification-channels", controllers.CreateNotificationChannel)
+			auth.PUT("/notification-channels/:id", controllers.UpdateNotificationChannel)
+			auth.DELETE("/notification-channels/:id", controllers.DeleteNotificationChannel)
+			auth.POST("/notification-channels/:id/test", controllers.TestNotificationChannel)
+			auth.GET("/alerts/:id/deliveries", controllers.GetAlertDeliveries)
+
+			// On-call schedules and escalation policies
+			auth.GET("/oncall-schedules", controllers.GetOnCallSchedules)
+			auth.POST("/oncall-schedules", controllers.CreateOnCallSchedule)
+			auth.PUT("/oncall-schedules/:id", controllers.UpdateOnCallSchedule)
+			auth.DELETE("/oncall-schedules/:id", controllers.DeleteOnCallSchedule)
+			auth.GET("/oncall-schedules/:id/oncall", controllers.GetOnCall)
+			auth.POST("/oncall-schedules/:id/overrides", controllers.CreateOnCallOverride)
+			auth.DELETE("/oncall-schedules/:id/overrides/:overrideId", controllers.DeleteOnCallOverride)
+			auth.GET("/escalation-policies", controllers.GetEscalationPolicies)
+			auth.POST("/escalation-policies", controllers.CreateEscalationPolicy)
+			auth.PUT("/escalation-policies/:id", controllers.UpdateEscalationPolicy)
+			auth.DELETE("/escalation-policies/:id", controllers.DeleteEscalationPolicy)
+			auth.GET("/alerts/:id/escalation", controllers.GetAlertEscalation)
+
+			// Alert silences (maintenance windows)
+			auth.GET("/silences", controllers.GetSilences)
+			auth.POST("/silences", controllers.CreateSilence)
+			auth.POST("/silences/:id/expire", controllers.ExpireSilence)
+
+			// Data exports
+			auth.GET("/export/alerts", controllers.ExportAlerts)
+			auth.GET("/export/telemetry", controllers.ExportTelemetry)
+			auth.GET("/export-jobs", controllers.GetExportJobs)
+			auth.GET("/export-jobs/:id", controllers.GetExportJob)
+			auth.GET("/export-jobs/:id/download", controllers.DownloadExportJob)
+			auth.DELETE("/export-jobs/:id", controllers.DeleteExportJob)
+
+			// Data retention, admin only since policies apply to all users' data
+			retention := auth.Group("/retention")
+			retention.Use(middleware.AdminMiddleware())
+			retention.GET("/policies", controllers.GetRetentionPolicies)
+			retention.POST("/policies", controllers.CreateRetentionPolicy)
+			retention.PUT("/policies/:id", controllers.UpdateRetentionPolicy)
+			retention.DELETE("/policies/:id", controllers.DeleteRetentionPolicy)
+			retention.GET("/settings", controllers.GetRetentionSettings)
+			retention.PUT("/settings", controllers.UpdateRetentionSettings)
+			retention.POST("/run", controllers.RunRetention)
+			retention.GET("/runs", controllers.GetRetentionRuns)
+			retention.GET("/runs/:id", controllers.GetRetentionRun)
 
 			// Message type config routes
 			auth.GET("/message-types", controllers.GetMessageTypeConfigs)
@@ -71,8 +192,25 @@ func main() {
 			auth.PUT("/message-types/:id", controllers.UpdateMessageTypeConfig)
 			auth.DELETE("/message-types/:id", controllers.DeleteMessageTypeConfig)
 			auth.PUT("/message-types/:id/default", controllers.SetDefaultMessageTypeConfig)
+			auth.GET("/message-types/:id/versions", controllers.GetMessageTypeConfigVersions)
+			auth.GET("/message-types/:id/versions/:version", controllers.GetMessageTypeConfigVersion)
+			auth.GET("/message-types/:id/diff", controllers.DiffMessageTypeConfigVersions)
+			auth.POST("/message-types/:id/rollback", controllers.RollbackMessageTypeConfig)
+			auth.GET("/message-types/:id/redecode-jobs", controllers.GetRedecodeJobs)
+			auth.POST("/message-types/:id/redecode-jobs", controllers.CreateRedecodeJob)
+			auth.GET("/redecode-jobs/:id", controllers.GetRedecodeJob)
+			auth.POST("/redecode-jobs/:id/cancel", controllers.CancelRedecodeJob)
+			auth.GET("/message-types/topic-bindings", controllers.GetTopicConfigBindings)
+			auth.POST("/message-types/topic-bindings", controllers.CreateTopicConfigBinding)
+			auth.PUT("/message-types/topic-bindings/:id", controllers.UpdateTopicConfigBinding)
+			auth.DELETE("/message-types/topic-bindings/:id", controllers.DeleteTopicConfigBinding)
+			auth.GET("/message-types/export", controllers.ExportMessageTypeConfigs)
+			auth.POST("/message-types/import", controllers.ImportMessageTypeConfigs)
+			auth.POST("/message-types/field-table", controllers.ImportFieldTable)
 			auth.POST("/message-types/parse", controllers.ParseMessageData)
 			auth.POST("/message-types/test", controllers.TestMessageFormat)
+			auth.POST("/message-types/validate", controllers.ValidateMessageFormat)
+			auth.POST("/message-types/script/test", controllers.TestMessageScript)
 
 			auth.POST("/message-types/geo-test-data", controllers.GetGeoTestData)
 			auth.POST("/message-types/geo-config", controllers.CreateGeoConfig)
@@ -85,11 +223,13 @@ func main() {
 			// WebSocket route
 			auth.GET("/ws", controllers.WsHandler)
 
-			// User routes
-			auth.GET("/users", controllers.GetUsers)
-			auth.POST("/users", controllers.CreateUser)
-			auth.PUT("/users/:id", controllers.UpdateUser)
-			auth.DELETE("/users/:id", controllers.DeleteUser)
+			// User routes, admin only so users cannot grant themselves the admin role
+			users := auth.Group("/users")
+			users.Use(middleware.AdminMiddleware())
+			users.GET("", controllers.GetUsers)
+			users.POST("", controllers.CreateUser)
+			users.PUT("/:id", controllers.UpdateUser)
+			users.DELETE("/:id", controllers.DeleteUser)
 
 			// Device group routes
 			auth.GET("/device-groups", controllers.GetDeviceGroups)
@@ -125,6 +265,17 @@ func main() {
 	// Start TCP server for ZY data
 	go startZyTCPServer(":8081")
 
+	// Start TCP server for JT/T 808 vehicle terminals
+	go startJT808TCPServer(":8082")
+
+	// Start TCP server for Modbus DTU gateways (server-driven polling)
+	go startModbusTCPServer(":8084")
+
+	// Start UDP servers for NB-IoT devices (CoAP and raw UDP)
+	controllers.StartCoAPCleanup()
+	go startUDPServer(":5683", controllers.HandleCoAPPacket)
+	go startUDPServer(":8083", controllers.HandleUDPPacket)
+
 	// Keep main goroutine running
 	select {}
 }
@@ -153,6 +304,7 @@ func startZyTCPServer(address string) {
 // handleZyConnection handles individual TCP connections for ZY data
 func handleZyConnection(conn net.Conn) {
 	defer conn.Close()
+	defer controllers.ZyConnectionClosed(conn)
 
 	buffer := make([]byte, 1024)
 	for {
@@ -169,6 +321,101 @@ func handleZyConnection(conn net.Conn) {
 	}
 }
 
+// startJT808TCPServer starts a TCP server to handle JT/T 808 terminals
+func startJT808TCPServer(address string) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		panic("Failed to start JT808 TCP server: " + err.Error())
+	}
+	defer listener.Close()
+
+	println("JT808 TCP Server listening on " + address)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			println("Error accepting connection:", err.Error())
+			continue
+		}
+
+		go handleJT808Connection(conn)
+	}
+}
+
+// handleJT808Connection handles a JT/T 808 terminal connection, frames may span reads
+func handleJT808Connection(conn net.Conn) {
+	defer conn.Close()
+
+	session := controllers.NewJT808Session(conn)
+	buffer := make([]byte, 1024)
+	for {
+		conn.SetReadDeadline(time.Now().Add(controllers.JT808IdleTimeout))
+		n, err := conn.Read(buffer)
+		if err != nil {
+			println("Error reading from JT808 connection:", err.Error())
+			return
+		}
+
+		if n > 0 {
+			session.HandleData(buffer[:n])
+		}
+	}
+}
+
+// startModbusTCPServer starts a TCP server that Modbus DTU gateways connect to
+func startModbusTCPServer(address string) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		panic("Failed to start Modbus TCP server: " + err.Error())
+	}
+	defer listener.Close()
+
+	println("Modbus TCP Server listening on " + address)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			println("Error accepting connection:", err.Error())
+			continue
+		}
+
+		go handleModbusConnection(conn)
+	}
+}
+
+// handleModbusConnection identifies the gateway by its registration packet and polls it until disconnect
+func handleModbusConnection(conn net.Conn) {
+	defer conn.Close()
+
+	if err := controllers.ServeModbusConnection(conn); err != nil {
+		println("Error serving Modbus connection:", err.Error())
+	}
+}
+
+// startUDPServer starts a UDP server, each datagram is handled in its own goroutine
+func startUDPServer(address string, handler func(net.PacketConn, net.Addr, []byte)) {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		panic("Failed to start UDP server: " + err.Error())
+	}
+	defer conn.Close()
+
+	println("UDP Server listening on " + address)
+
+	buffer := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			println("Error reading UDP packet:", err.Error())
+			continue
+		}
+
+		packet := make([]byte, n)
+		copy(packet, buffer[:n])
+		go handler(conn, addr, packet)
+	}
+}
+
 // fileExists checks if a file exists in the embedded filesystem
 func fileExists(fs fs.FS, path string) bool {
 	if path == "" || path == "/" {
@@ -0,0 +1,46 @@
+package models
+
+import "gorm.io/gorm"
+
+// 告警处理状态
+const (
+	AlertStateOpen         = "open"
+	AlertStateAcknowledged = "acknowledged"
+	AlertStateResolved     = "resolved"
+	AlertStateCleared      = "cleared"
+)
+
+// AlertTypeStorm 设备告警超出限流时生成的汇总告警类型
+const AlertTypeStorm = "storm"
+
+// 告警处理记录的操作
+const (
+	AlertActionAcknowledge = "acknowledge"
+	AlertActionResolve     = "resolve"
+	AlertActionReopen      = "reopen"
+	AlertActionClear       = "clear"
+	AlertActionAssign      = "assign"
+	AlertActionComment     = "comment"
+	AlertActionEscalate    = "escalate" // 升级策略通知了一个层级
+)
+
+// AlertEvent 告警处理记录(审计)
+type AlertEvent struct {
+	gorm.Model
+	AlertID   uint   `json:"alert_id" gorm:"index"`
+	UserID    uint   `json:"user_id"`                  // 操作人，系统操作时为 0
+	Username  string `json:"username" gorm:"size:100"` // 操作人用户名
+	Action    string `json:"action" gorm:"size:20"`    // acknowledge, resolve, reopen, clear, assign, comment
+	FromState string `json:"from_state" gorm:"size:20"`
+	ToState   string `json:"to_state" gorm:"size:20"`
+	Detail    string `json:"detail" gorm:"size:255"`
+}
+
+// AlertComment 告警评论
+type AlertComment struct {
+	gorm.Model
+	AlertID  uint   `json:"alert_id" gorm:"index"`
+	UserID   uint   `json:"user_id"`
+	Username string `json:"username" gorm:"size:100"`
+	Body     string `json:"body" gorm:"type:text"`
+}
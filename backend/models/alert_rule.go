@@ -0,0 +1,44 @@
+package models
+
+import "gorm.io/gorm"
+
+// 告警规则级别，对应 Alert.Level
+const (
+	AlertLevelCritical = "critical"
+	AlertLevelHigh     = "high"
+	AlertLevelMedium   = "medium"
+	AlertLevelLow      = "low"
+)
+
+// AlertRule 告警规则，对设备每条解析后的消息计算条件表达式，条件成立时生成告警
+type AlertRule struct {
+	gorm.Model
+	UserID      uint   `json:"user_id" gorm:"index"`
+	Name        string `json:"name" gorm:"size:100"`
+	Description string `json:"description" gorm:"size:255"`
+	Enabled     bool   `json:"enabled"`
+	// 作用范围: 指定设备或设备组，都为空时作用于用户的全部设备
+	DeviceID *uint `json:"device_id" gorm:"index"`
+	GroupID  *uint `json:"group_id" gorm:"index"`
+	// 触发条件，如 temperature > 60 for 5m、voltage < 3.3、changed(status)，
+	// 末尾的 for <时长> 表示条件需持续成立该时长
+	Condition string `json:"condition" gorm:"type:text"`
+	// 恢复条件(迟滞)，如 temperature < 55，为空时触发条件不成立即恢复
+	ClearCondition string `json:"clear_condition" gorm:"type:text"`
+	Level          string `json:"level" gorm:"size:20"`    // 生成告警的级别: critical, high, medium, low
+	Message        string `json:"message" gorm:"size:255"` // 告警消息模板，{字段名} 替换为字段值，为空时使用默认消息
+}
+
+// AlertRuleState 规则在单个设备上的计算状态
+type AlertRuleState struct {
+	gorm.Model
+	RuleID            uint   `json:"rule_id" gorm:"uniqueIndex:idx_rule_device"`
+	DeviceID          uint   `json:"device_id" gorm:"uniqueIndex:idx_rule_device"`
+	Firing            bool   `json:"firing"`              // 已触发且未恢复
+	PendingSince      int64  `json:"pending_since"`       // 触发条件开始成立的时间(Unix 秒)，0 表示不成立
+	ClearPendingSince int64  `json:"clear_pending_since"` // 恢复条件开始成立的时间
+	AlertID           uint   `json:"alert_id"`            // 最近一次触发生成的告警
+	FiredAt           int64  `json:"fired_at"`
+	ClearedAt         int64  `json:"cleared_at"`
+	Previous          string `json:"previous" gorm:"type:text"` // 上一条消息中 changed/delta 引用字段的值(JSON)
+}
@@ -0,0 +1,55 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 抓包会话状态
+const (
+	CaptureStatusActive  = "active"
+	CaptureStatusStopped = "stopped"
+)
+
+// 抓包的接入方式
+const (
+	CaptureTransportZyTCP       = "zy_tcp"
+	CaptureTransportMQTT        = "mqtt"
+	CaptureTransportHTTPForward = "http_forward"
+)
+
+// 帧方向
+const (
+	CaptureDirectionIn  = "in"  // 设备上行
+	CaptureDirectionOut = "out" // 平台下发或应答
+)
+
+// CaptureSession 设备抓包会话，开启后记录该设备收发的原始帧，到期或达到帧数上限时自动停止
+type CaptureSession struct {
+	gorm.Model
+	UserID     uint       `json:"user_id" gorm:"index"`
+	DeviceID   uint       `json:"device_id" gorm:"index"`
+	Topic      string     `json:"topic" gorm:"size:255"`       // 开始抓包时的设备主题
+	Status     string     `json:"status" gorm:"size:20;index"` // active, stopped
+	StopReason string     `json:"stop_reason" gorm:"size:50"`  // manual, expired, max_frames
+	MaxFrames  int        `json:"max_frames"`                  // 最多记录的帧数
+	FrameCount int        `json:"frame_count"`                 // 已记录的帧数
+	ExpiresAt  time.Time  `json:"expires_at"`                  // 自动停止时间
+	StoppedAt  *time.Time `json:"stopped_at"`
+}
+
+// CapturedFrame 抓包记录的一帧原始数据
+type CapturedFrame struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	SessionID  uint      `json:"session_id" gorm:"index"`
+	DeviceID   uint      `json:"device_id" gorm:"index"`
+	Transport  string    `json:"transport" gorm:"size:20"` // zy_tcp, mqtt, http_forward
+	Direction  string    `json:"direction" gorm:"size:10"` // in, out
+	Peer       string    `json:"peer" gorm:"size:255"`     // 对端地址或 MQTT 主题
+	Payload    string    `json:"payload" gorm:"type:text"` // 原始字节(十六进制)
+	Size       int       `json:"size"`                     // 原始帧字节数
+	Truncated  bool      `json:"truncated"`                // 超过单帧上限时只保存前部
+	Note       string    `json:"note" gorm:"size:255"`     // 处理结果，如解析错误
+	CapturedAt time.Time `json:"captured_at" gorm:"index"`
+}
@@ -0,0 +1,12 @@
+package models
+
+import "gorm.io/gorm"
+
+// TopicConfigBinding 主题模式与消息类型配置的绑定
+type TopicConfigBinding struct {
+	gorm.Model
+	UserID   uint   `json:"user_id" gorm:"index"`
+	Pattern  string `json:"pattern" gorm:"size:255"` // MQTT 主题模式，支持 + 和 # 通配符
+	ConfigID uint   `json:"config_id"`               // 消息类型配置ID
+	Priority int    `json:"priority"`                // 优先级，多个模式匹配时取值大者
+}
@@ -12,32 +12,56 @@ type DeviceGroup struct {
 	Name        string `gorm:"not null" json:"name"`
 	Description string `json:"description"`
 	IconURL     string `json:"icon_url"` // SVG图标URL
+	// 组内设备默认使用的消息类型配置
+	MessageTypeConfigID *uint `json:"message_type_config_id"`
 }
 
 type Device struct {
 	gorm.Model
 	Name        string      `gorm:"not null" json:"name"`
 	Topic       string      `gorm:"uniqueIndex;not null" json:"topic"`
-	UserID      uint        `json:"user_id"`
-	GroupID     *uint       `json:"group_id"` // 可为空的设备组ID
+	UserID      uint        `json:"user_id" gorm:"index"`
+	GroupID     *uint       `json:"group_id" gorm:"index"` // 可为空的设备组ID
 	Longitude   float64     `json:"longitude"`
 	Latitude    float64     `json:"latitude"`
 	Address     string      `json:"address"`
 	Status      string      `gorm:"default:'offline'" json:"status"`
 	LastSeen    int64       `json:"last_seen"`
 	DeviceGroup DeviceGroup `gorm:"foreignKey:GroupID" json:"device_group,omitempty"`
+	// 设备绑定的消息类型配置，优先级最高
+	MessageTypeConfigID *uint `json:"message_type_config_id"`
+	// CoAP 读取凭证，为空时不允许通过 CoAP GET/Observe 读取设备数据
+	CoAPToken string `json:"-" gorm:"size:64"`
 }
 
 type Alert struct {
 	gorm.Model
-	DeviceID   uint   `json:"device_id"`
+	DeviceID   uint   `json:"device_id" gorm:"index:idx_alerts_device_timestamp,priority:1"`
 	Type       string `json:"type"` // emergency, warning, info
 	Message    string `json:"message"`
-	Level      string `json:"level"` // critical, high, medium, low
-	Read       bool   `gorm:"default:false" json:"read"`
-	Timestamp  int64  `json:"timestamp"`
+	Level      string `json:"level" gorm:"index"` // critical, high, medium, low
+	Read       bool   `gorm:"default:false;index" json:"read"`
+	Timestamp  int64  `json:"timestamp" gorm:"index;index:idx_alerts_device_timestamp,priority:2"`
 	RawData    string `json:"raw_data" gorm:"type:text"`    // 原始字节数据
 	ParsedData string `json:"parsed_data" gorm:"type:text"` // 解析后的数据
+	// 解析使用的配置及版本，用于之后重新解析
+	ConfigID      uint `json:"config_id"`
+	ConfigVersion int  `json:"config_version"`
+	RuleID        uint `json:"rule_id" gorm:"index"` // 生成告警的规则，0 表示非规则告警
+	// 处理状态: open, acknowledged, resolved, cleared(规则恢复后自动清除)
+	State          string `json:"state" gorm:"size:20;index;default:'open'"`
+	AssigneeID     *uint  `json:"assignee_id" gorm:"index"` // 处理人
+	AcknowledgedAt int64  `json:"acknowledged_at"`
+	AcknowledgedBy uint   `json:"acknowledged_by"`
+	ResolvedAt     int64  `json:"resolved_at"` // 解决或自动清除的时间
+	ResolvedBy     uint   `json:"resolved_by"` // 解决人，自动清除时为 0
+	// 去重: 相同指纹(设备+规则/类型+级别)的未处理告警只保留一条，重复发生时累加次数
+	Fingerprint string `json:"fingerprint" gorm:"size:40;index"`
+	Occurrences int    `json:"occurrences" gorm:"default:1"`
+	LastSeen    int64  `json:"last_seen"` // 最近一次发生的时间，Timestamp 为首次发生的时间
+	// 静默: 产生时匹配了生效的静默规则，照常保存但不发送通知、不升级
+	Silenced  bool `json:"silenced" gorm:"index"`
+	SilenceID uint `json:"silence_id"`
 }
 
 type MessageType struct {
@@ -56,18 +80,40 @@ type MessageTypeConfig struct {
 	Protocol    string `json:"protocol" gorm:"size:50"`     // 协议类型: tcp, udp, mqtt, etc.
 	Format      string `json:"format" gorm:"type:text"`     // 数据格式配置(JSON)
 	IsDefault   bool   `json:"is_default" gorm:"default:false"`
+	FPort       int    `json:"f_port" gorm:"default:0"` // LoRaWAN 端口号，0 表示不按端口选择
+	Version     int    `json:"version"`                 // 当前版本号，每次修改格式生成新版本
+}
+
+// MessageTypeConfigVersion 消息类型配置的不可变历史版本
+type MessageTypeConfigVersion struct {
+	gorm.Model
+	ConfigID    uint   `json:"config_id" gorm:"uniqueIndex:idx_config_version"`
+	Version     int    `json:"version" gorm:"uniqueIndex:idx_config_version"`
+	Name        string `json:"name" gorm:"size:100"`
+	Description string `json:"description" gorm:"size:255"`
+	Protocol    string `json:"protocol" gorm:"size:50"`
+	Format      string `json:"format" gorm:"type:text"`
+	FPort       int    `json:"f_port"`
+	AuthorID    uint   `json:"author_id"`               // 修改人
+	Author      string `json:"author" gorm:"size:100"`  // 修改人用户名
+	Comment     string `json:"comment" gorm:"size:255"` // 修改说明
+	RollbackOf  int    `json:"rollback_of"`             // 回滚来源版本，0 表示普通修改
 }
 
 // FieldDefinition 字段定义
 type FieldDefinition struct {
-	Name     string `json:"name"`     // 字段名称
-	Type     string `json:"type"`     // 字段类型: int8, uint8, int16, uint16, int32, uint32, float32, float64, string, bytes
-	Offset   int    `json:"offset"`   // 字节偏移量
-	Length   int    `json:"length"`   // 字段长度(字节数)
-	Endian   string `json:"endian"`   // 字节序: big, little
-	Signed   bool   `json:"signed"`   // 是否有符号
-	Decimals int    `json:"decimals"` // 小数位数(浮点数)
-	Unit     string `json:"unit"`     // 单位
+	Name     string  `json:"name"`            // 字段名称
+	Type     string  `json:"type"`            // 字段类型: int8, uint8, int16, uint16, int32, uint32, float32, float64, string, bytes
+	Offset   int     `json:"offset"`          // 字节偏移量
+	Length   int     `json:"length"`          // 字段长度(字节数)
+	Endian   string  `json:"endian"`          // 字节序: big, little
+	Signed   bool    `json:"signed"`          // 是否有符号
+	Decimals int     `json:"decimals"`        // 小数位数(浮点数)
+	Unit     string  `json:"unit"`            // 单位
+	Scale    float64 `json:"scale,omitempty"` // 缩放系数，解析值乘以该系数(如 0.1)，为 0 时不缩放
+	Path     string  `json:"path"`            // JSON路径(json负载), 如 data.items[0].value, 为空时使用字段名称
+	Index    int     `json:"index"`           // 列序号(分隔符负载), 从0开始
+	Key      string  `json:"key"`             // 键名(key=value负载), 为空时使用字段名称
 }
 
 // MessageFormat 消息格式配置
@@ -79,6 +125,10 @@ type MessageFormat struct {
 	Length    *FieldDefinition  `json:"length"`    // 长度字段
 	Delimiter string            `json:"delimiter"` // 分隔符
 	Encoding  string            `json:"encoding"`  // 编码: hex, base64, ascii
+	Kind      string            `json:"kind"`      // 负载类型: binary(默认), json, delimited, kv, script
+	Separator string            `json:"separator"` // 键值分隔符(kv负载), 默认为 =
+	// 自定义解码脚本(script负载), JavaScript，需定义 decode(bytes, meta) 函数，可选定义 encode(fields, meta)
+	Script string `json:"script,omitempty"`
 }
 
 // ParseResult 解析结果
@@ -0,0 +1,59 @@
+package models
+
+import "gorm.io/gorm"
+
+// 告警升级状态
+const (
+	EscalationStatusActive    = "active"    // 等待下一层级通知
+	EscalationStatusStopped   = "stopped"   // 告警已确认、解决或清除
+	EscalationStatusCompleted = "completed" // 所有层级及重复次数已通知完
+)
+
+// OnCallSchedule 值班表，成员按周轮换。成员为通知渠道(如个人邮箱、个人机器人)，
+// 第一个成员从 RotationStart 开始值班，此后每 7 天轮换到下一个成员
+type OnCallSchedule struct {
+	gorm.Model
+	UserID        uint             `json:"user_id" gorm:"index"`
+	Name          string           `json:"name" gorm:"size:100"`
+	Members       string           `json:"members" gorm:"size:255"` // 成员通知渠道ID，逗号分隔，按轮换顺序
+	RotationStart int64            `json:"rotation_start"`          // 轮换起点(交接时刻)，Unix 秒
+	Overrides     []OnCallOverride `json:"overrides,omitempty" gorm:"foreignKey:ScheduleID"`
+}
+
+// OnCallOverride 临时替班，时间段内由指定成员代替轮换成员值班
+type OnCallOverride struct {
+	gorm.Model
+	ScheduleID uint   `json:"schedule_id" gorm:"index"`
+	ChannelID  uint   `json:"channel_id"`
+	StartAt    int64  `json:"start_at"`
+	EndAt      int64  `json:"end_at"`
+	Note       string `json:"note" gorm:"size:255"`
+}
+
+// EscalationPolicy 告警升级策略: 依次通知各层级，某层级通知后在其等待时长内未确认则升级到下一层级，
+// 最后一个层级等待结束后从第一个层级重复
+type EscalationPolicy struct {
+	gorm.Model
+	UserID  uint   `json:"user_id" gorm:"index"`
+	Name    string `json:"name" gorm:"size:100"`
+	Enabled bool   `json:"enabled"`
+	// 适用的告警级别(逗号分隔)及设备组(为空表示全部)，创建时级别默认为 critical
+	Levels  string `json:"levels" gorm:"size:100"`
+	GroupID *uint  `json:"group_id"`
+	// 层级(JSON 数组): [{"delay_minutes":10,"schedule_ids":[1],"channel_ids":[2]}]，
+	// schedule_ids 通知值班表当前值班成员，channel_ids 直接通知渠道
+	Tiers  string `json:"tiers" gorm:"type:text"`
+	Repeat int    `json:"repeat"` // 全部层级通知完后重复的轮数
+}
+
+// AlertEscalation 告警的升级进度，由调度器按 NextAt 推进，重启后继续
+type AlertEscalation struct {
+	gorm.Model
+	AlertID  uint   `json:"alert_id" gorm:"uniqueIndex"`
+	PolicyID uint   `json:"policy_id" gorm:"index"`
+	Status   string `json:"status" gorm:"size:20;index"` // active, stopped, completed
+	Tier     int    `json:"tier"`                        // 下一次通知的层级(从 0 开始)
+	Round    int    `json:"round"`                       // 已完成的轮数
+	NextAt   int64  `json:"next_at" gorm:"index"`        // 下一次通知时间，Unix 秒
+	Notified int    `json:"notified"`                    // 已通知的层级次数
+}
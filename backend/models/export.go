@@ -0,0 +1,27 @@
+package models
+
+import "gorm.io/gorm"
+
+// 导出任务状态
+const (
+	ExportStatusPending   = "pending"
+	ExportStatusRunning   = "running"
+	ExportStatusCompleted = "completed"
+	ExportStatusFailed    = "failed"
+)
+
+// ExportJob 后台导出任务，导出文件保存在服务器上供下载，过期后删除
+type ExportJob struct {
+	gorm.Model
+	UserID     uint   `json:"user_id" gorm:"index"`
+	Target     string `json:"target" gorm:"size:20"`       // 导出对象: alerts, telemetry
+	Format     string `json:"format" gorm:"size:10"`       // csv, xlsx, jsonl
+	Query      string `json:"query" gorm:"type:text"`      // 过滤条件(请求的查询参数)
+	Status     string `json:"status" gorm:"size:20;index"` // pending, running, completed, failed
+	Rows       int    `json:"rows"`                        // 已导出行数
+	Size       int64  `json:"size"`                        // 导出文件大小(字节)
+	FilePath   string `json:"-" gorm:"size:255"`
+	Message    string `json:"message" gorm:"size:255"` // 任务失败原因
+	StartedAt  int64  `json:"started_at"`
+	FinishedAt int64  `json:"finished_at"`
+}
@@ -0,0 +1,22 @@
+package models
+
+import "gorm.io/gorm"
+
+// JT808Terminal JT/T 808 终端注册信息
+type JT808Terminal struct {
+	gorm.Model
+	Phone        string `json:"phone" gorm:"uniqueIndex;size:20"` // 终端手机号(BCD)
+	DeviceID     uint   `json:"device_id" gorm:"index"`
+	AuthCode     string `json:"-" gorm:"size:64"`             // 鉴权码
+	Version      int    `json:"version"`                      // 协议版本: 2013, 2019
+	ProvinceID   uint16 `json:"province_id"`                  // 省域ID
+	CityID       uint16 `json:"city_id"`                      // 市县域ID
+	Manufacturer string `json:"manufacturer" gorm:"size:32"`  // 制造商ID
+	TerminalType string `json:"terminal_type" gorm:"size:64"` // 终端型号
+	TerminalID   string `json:"terminal_id" gorm:"size:64"`   // 终端ID
+	PlateColor   uint8  `json:"plate_color"`                  // 车牌颜色
+	Plate        string `json:"plate" gorm:"size:32"`         // 车牌号
+	IMEI         string `json:"imei" gorm:"size:32"`          // 终端IMEI(2019)
+	Firmware     string `json:"firmware" gorm:"size:32"`      // 软件版本号(2019)
+	LastAuthAt   int64  `json:"last_auth_at"`                 // 最近一次鉴权时间
+}
@@ -0,0 +1,15 @@
+package models
+
+import "gorm.io/gorm"
+
+// LoRaWANDevice LoRaWAN 终端与平台设备的映射
+type LoRaWANDevice struct {
+	gorm.Model
+	DevEUI          string `json:"dev_eui" gorm:"uniqueIndex;size:16"` // 终端 DevEUI(小写十六进制)
+	DeviceID        uint   `json:"device_id" gorm:"index"`
+	Network         string `json:"network" gorm:"size:20"`           // 网络服务器类型: chirpstack, ttn
+	ApplicationID   string `json:"application_id" gorm:"size:64"`    // 网络服务器中的应用ID
+	NetworkDeviceID string `json:"network_device_id" gorm:"size:64"` // 网络服务器中的设备ID(TTN device_id)
+	DevAddr         string `json:"dev_addr" gorm:"size:8"`
+	LastFCnt        uint32 `json:"last_f_cnt"`
+}
@@ -0,0 +1,27 @@
+package models
+
+import "gorm.io/gorm"
+
+// ModbusDevice Modbus 轮询配置，设备通过 DTU 透传或 Modbus TCP 主动连接服务器
+type ModbusDevice struct {
+	gorm.Model
+	DeviceID       uint   `json:"device_id" gorm:"uniqueIndex"`
+	RegistrationID string `json:"registration_id" gorm:"uniqueIndex;size:64"` // DTU 注册包内容，用于识别连接
+	Heartbeat      string `json:"heartbeat" gorm:"size:64"`                   // DTU 心跳包内容，读取响应时跳过
+	Mode           string `json:"mode" gorm:"size:10"`                        // 帧格式: rtu(透传), tcp(MBAP)
+	SlaveID        uint8  `json:"slave_id"`                                   // 从站地址/单元标识
+	Interval       int    `json:"interval"`                                   // 轮询间隔(秒)
+	Timeout        int    `json:"timeout"`                                    // 响应超时(毫秒)
+	Blocks         string `json:"blocks" gorm:"type:text"`                    // 寄存器块配置(JSON)
+	Enabled        bool   `json:"enabled"`
+	LastPollAt     int64  `json:"last_poll_at"`
+	LastError      string `json:"last_error" gorm:"size:255"`
+}
+
+// ModbusRegisterBlock 一次读取的连续寄存器块
+type ModbusRegisterBlock struct {
+	Function uint8             `json:"function"` // 功能码: 3 读保持寄存器, 4 读输入寄存器
+	Address  uint16            `json:"address"`  // 起始寄存器地址
+	Quantity uint16            `json:"quantity"` // 寄存器数量(1-125)
+	Fields   []FieldDefinition `json:"fields"`   // 字段定义，偏移量为相对块起始地址的字节偏移(寄存器序号*2)
+}
@@ -0,0 +1,51 @@
+package models
+
+import "gorm.io/gorm"
+
+// 通知渠道类型
+const (
+	ChannelTypeWebhook  = "webhook"  // 通用 HTTP 回调，HMAC 签名
+	ChannelTypeEmail    = "email"    // SMTP 邮件
+	ChannelTypeWeCom    = "wecom"    // 企业微信群机器人
+	ChannelTypeDingTalk = "dingtalk" // 钉钉群机器人
+	ChannelTypeFeishu   = "feishu"   // 飞书群机器人
+)
+
+// 通知发送状态
+const (
+	DeliveryStatusPending = "pending"
+	DeliveryStatusSent    = "sent"
+	DeliveryStatusFailed  = "failed"
+)
+
+// NotificationChannel 告警通知渠道，用户设备产生的告警按级别和设备组路由到渠道
+type NotificationChannel struct {
+	gorm.Model
+	UserID  uint   `json:"user_id" gorm:"index"`
+	Name    string `json:"name" gorm:"size:100"`
+	Type    string `json:"type" gorm:"size:20"` // webhook, email, wecom, dingtalk, feishu
+	Enabled bool   `json:"enabled"`
+	// 渠道配置(JSON): url、secret、headers；邮件为 host、port、username、password、from、to、tls
+	Config string `json:"config" gorm:"type:text"`
+	// Markdown 消息模板(Go text/template)，为空时使用默认模板
+	Template string `json:"template" gorm:"type:text"`
+	// 路由条件: 告警级别(逗号分隔，为空表示全部)及设备组(为空表示全部)
+	Levels  string `json:"levels" gorm:"size:100"`
+	GroupID *uint  `json:"group_id"`
+}
+
+// NotificationDelivery 告警在渠道上的发送记录
+type NotificationDelivery struct {
+	gorm.Model
+	AlertID    uint   `json:"alert_id" gorm:"index"`
+	ChannelID  uint   `json:"channel_id" gorm:"index"`
+	Status     string `json:"status" gorm:"size:20;index"` // pending, sent, failed
+	Attempts   int    `json:"attempts"`
+	StatusCode int    `json:"status_code"` // 最后一次 HTTP 响应状态码
+	Error      string `json:"error" gorm:"size:255"`
+	SentAt     int64  `json:"sent_at"`
+	// 待发送记录下次尝试的时间(Unix 秒)，到期后由调度协程重新加入发送队列，0 表示已在发送队列中
+	NextAttemptAt int64 `json:"next_attempt_at" gorm:"index;default:0"`
+	// 升级层级(从 1 开始)，0 表示按渠道路由发送的通知
+	EscalationTier int `json:"escalation_tier"`
+}
@@ -0,0 +1,36 @@
+package models
+
+import "gorm.io/gorm"
+
+// 重新解析任务状态
+const (
+	RedecodeStatusPending   = "pending"
+	RedecodeStatusRunning   = "running"
+	RedecodeStatusCompleted = "completed"
+	RedecodeStatusFailed    = "failed"
+	RedecodeStatusCancelled = "cancelled"
+)
+
+// RedecodeJob 使用指定配置版本重新解析历史原始数据的后台任务
+type RedecodeJob struct {
+	gorm.Model
+	UserID        uint   `json:"user_id" gorm:"index"`
+	ConfigID      uint   `json:"config_id" gorm:"index"`
+	ConfigVersion int    `json:"config_version"`              // 用于重新解析的配置版本
+	DeviceIDs     string `json:"device_ids" gorm:"type:text"` // 设备ID列表(JSON)
+	StartTime     int64  `json:"start_time"`                  // 时间范围起点(Unix 秒)，0 表示不限
+	EndTime       int64  `json:"end_time"`                    // 时间范围终点(Unix 秒)，0 表示不限
+	Target        string `json:"target" gorm:"size:20"`       // 处理对象: alerts, telemetry, all
+	DryRun        bool   `json:"dry_run"`                     // 仅统计和预览，不写回数据
+	Status        string `json:"status" gorm:"size:20;index"` // pending, running, completed, failed, cancelled
+	Total         int    `json:"total"`                       // 待处理记录数
+	Processed     int    `json:"processed"`                   // 已处理记录数
+	Succeeded     int    `json:"succeeded"`                   // 解析成功数
+	Failed        int    `json:"failed"`                      // 解析失败数
+	Changed       int    `json:"changed"`                     // 解析结果发生变化的记录数
+	Errors        string `json:"errors" gorm:"type:text"`     // 解析错误明细(JSON)，最多保留前若干条
+	Samples       string `json:"samples" gorm:"type:text"`    // 解析前后对比样本(JSON)
+	Message       string `json:"message" gorm:"size:255"`     // 任务失败原因
+	StartedAt     int64  `json:"started_at"`
+	FinishedAt    int64  `json:"finished_at"`
+}
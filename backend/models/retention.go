@@ -0,0 +1,54 @@
+package models
+
+import "gorm.io/gorm"
+
+// 保留策略适用的数据类型
+const (
+	RetentionTargetAlerts     = "alerts"
+	RetentionTargetTelemetry  = "telemetry"
+	RetentionTargetDeliveries = "notification_deliveries"
+	RetentionTargetDeleted    = "deleted" // 各表中已软删除的记录
+)
+
+// 清理任务状态
+const (
+	RetentionRunStatusRunning   = "running"
+	RetentionRunStatusCompleted = "completed"
+	RetentionRunStatusFailed    = "failed"
+)
+
+// RetentionPolicy 数据保留策略: 超过保留天数的数据由清理任务永久删除
+type RetentionPolicy struct {
+	gorm.Model
+	Target string `json:"target" gorm:"size:30;index"` // alerts, telemetry, notification_deliveries, deleted
+	// 只适用于该分组设备的数据(仅 alerts、telemetry)，为空时适用于没有分组策略的设备
+	GroupID *uint `json:"group_id" gorm:"index"`
+	Days    int   `json:"days"`    // 保留天数
+	Archive bool  `json:"archive"` // 删除前将数据归档为压缩文件
+	Enabled bool  `json:"enabled"`
+}
+
+// RetentionSettings 清理和压缩数据库的计划，只有一条记录
+type RetentionSettings struct {
+	gorm.Model
+	PurgeIntervalMinutes int   `json:"purge_interval_minutes"` // 清理间隔(分钟)，0 表示不自动清理
+	VacuumIntervalHours  int   `json:"vacuum_interval_hours"`  // 压缩数据库(VACUUM)间隔(小时)，0 表示不自动压缩
+	LastPurgeAt          int64 `json:"last_purge_at"`
+	LastVacuumAt         int64 `json:"last_vacuum_at"`
+}
+
+// RetentionRun 一次清理任务的执行记录
+type RetentionRun struct {
+	gorm.Model
+	Trigger    string `json:"trigger" gorm:"size:20"`      // schedule, manual
+	Status     string `json:"status" gorm:"size:20;index"` // running, completed, failed
+	Purged     int    `json:"purged"`                      // 删除的记录数
+	Archived   int    `json:"archived"`                    // 归档的记录数
+	Results    string `json:"results" gorm:"type:text"`    // 各策略的清理结果(JSON)
+	Vacuumed   bool   `json:"vacuumed"`
+	SizeBefore int64  `json:"size_before"`             // 压缩前数据库大小(字节)
+	SizeAfter  int64  `json:"size_after"`              // 压缩后数据库大小(字节)
+	Message    string `json:"message" gorm:"size:255"` // 任务失败原因
+	StartedAt  int64  `json:"started_at"`
+	FinishedAt int64  `json:"finished_at"`
+}
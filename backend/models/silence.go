@@ -0,0 +1,27 @@
+package models
+
+import "gorm.io/gorm"
+
+// Silence 告警静默(维护窗口): 生效期间匹配的告警照常保存但标记为静默，不发送通知、不升级。
+// 匹配条件为空表示不限，多个条件同时满足才匹配
+type Silence struct {
+	gorm.Model
+	UserID  uint   `json:"user_id" gorm:"index"`
+	Comment string `json:"comment" gorm:"size:255"`
+	// 匹配条件
+	DeviceID  *uint  `json:"device_id"`
+	GroupID   *uint  `json:"group_id"`
+	AlertType string `json:"alert_type" gorm:"size:50"`
+	Levels    string `json:"levels" gorm:"size:100"` // 告警级别，逗号分隔
+	// 生效时间范围，Unix 秒，EndsAt 为 0 表示不结束(仅周期静默)，提前结束时设置为结束的时刻
+	StartsAt int64 `json:"starts_at"`
+	EndsAt   int64 `json:"ends_at" gorm:"index"`
+	// 周期静默: 在时间范围内，每周指定的星期(0-6，0 为周日，逗号分隔，为空表示每天)的每日时间段生效，
+	// 时间为 HH:MM，结束早于开始表示跨过零点；为空表示整个时间范围内生效
+	Weekdays   string `json:"weekdays" gorm:"size:20"`
+	DailyStart string `json:"daily_start" gorm:"size:5"`
+	DailyEnd   string `json:"daily_end" gorm:"size:5"`
+	Timezone   string `json:"timezone" gorm:"size:50"` // 周期静默的时区，为空时使用服务器时区
+	// Active 查询时计算的当前是否生效
+	Active bool `json:"active" gorm:"-"`
+}
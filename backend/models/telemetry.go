@@ -0,0 +1,24 @@
+package models
+
+import "gorm.io/gorm"
+
+// Telemetry 设备遥测数据(位置及解析后的字段)
+type Telemetry struct {
+	gorm.Model
+	DeviceID  uint    `json:"device_id" gorm:"index"`
+	Source    string  `json:"source" gorm:"size:50"` // 数据来源: zy, nmea, etc.
+	Timestamp int64   `json:"timestamp" gorm:"index"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Altitude  float64 `json:"altitude"`
+	Speed     float64 `json:"speed"`                     // 速度(km/h)
+	Course    float64 `json:"course"`                    // 方向(度)
+	RSSI      int     `json:"rssi"`                      // 接收信号强度(dBm)
+	SNR       float64 `json:"snr"`                       // 信噪比(dB)
+	Data      string  `json:"data" gorm:"type:text"`     // 解析后的字段(JSON)
+	Metadata  string  `json:"metadata" gorm:"type:text"` // 接入元数据(JSON)，如 LoRaWAN 网关、频率、扩频因子
+	RawData   string  `json:"raw_data" gorm:"type:text"` // 原始数据
+	// 解析使用的消息类型配置及版本，内置协议解析时为 0
+	ConfigID      uint `json:"config_id" gorm:"index"`
+	ConfigVersion int  `json:"config_version"`
+}
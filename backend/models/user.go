@@ -2,6 +2,9 @@ package models
 
 import "gorm.io/gorm"
 
+// UserRoleAdmin 管理员角色，可以管理作用于全部用户数据的设置(如数据保留策略)
+const UserRoleAdmin = "admin"
+
 type User struct {
 	gorm.Model
 	Username string `gorm:"uniqueIndex;not null" json:"username"`
@@ -1,19 +1,37 @@
 package mqtt
 
 import (
+	"errors"
 	"log"
+	"sync"
+	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 )
 
 var Client MQTT.Client
 
+// brokerTimeout 等待服务器订阅/取消订阅应答的最长时间，避免连接异常时一直持有 brokerMu
+const brokerTimeout = 10 * time.Second
+
+// errBrokerTimeout 等待服务器应答超时
+var errBrokerTimeout = errors.New("timed out waiting for broker")
+
+// waitToken 等待服务器应答，超时返回 errBrokerTimeout
+func waitToken(token MQTT.Token) error {
+	if !token.WaitTimeout(brokerTimeout) {
+		return errBrokerTimeout
+	}
+	return token.Error()
+}
+
 var messagePubHandler MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
 	log.Printf("Received message: %s from topic: %s\n", msg.Payload(), msg.Topic())
 }
 
 var connectHandler MQTT.OnConnectHandler = func(client MQTT.Client) {
 	log.Println("Connected to MQTT broker")
+	resubscribe(client)
 }
 
 var connectLostHandler MQTT.ConnectionLostHandler = func(client MQTT.Client, err error) {
@@ -42,3 +60,104 @@ func Publish(topic string, payload []byte) error {
 	log.Printf("Published message to topic: %s", topic)
 	return nil
 }
+
+// subscriptions 每个主题过滤器上注册的处理函数，同一主题可被多个使用方订阅
+var (
+	subscriptionsMu sync.Mutex
+	subscriptions   = make(map[string]map[int]MQTT.MessageHandler)
+	nextHandlerID   int
+)
+
+// brokerMu 串行化订阅表的变更及对应的服务器订阅/取消订阅，保证服务器上的订阅与订阅表一致；
+// 分发消息只使用 subscriptionsMu，等待服务器应答期间不阻塞消息处理
+var brokerMu sync.Mutex
+
+// dispatch 将主题过滤器上收到的消息分发给所有处理函数
+func dispatch(topic string) MQTT.MessageHandler {
+	return func(client MQTT.Client, msg MQTT.Message) {
+		subscriptionsMu.Lock()
+		handlers := make([]MQTT.MessageHandler, 0, len(subscriptions[topic]))
+		for _, handler := range subscriptions[topic] {
+			handlers = append(handlers, handler)
+		}
+		subscriptionsMu.Unlock()
+
+		for _, handler := range handlers {
+			handler(client, msg)
+		}
+	}
+}
+
+// resubscribe 重连后恢复所有订阅。等待应答期间不持有 subscriptionsMu，
+// 否则已恢复订阅的主题上收到的消息会阻塞在 dispatch，后续的订阅应答无法处理
+func resubscribe(client MQTT.Client) {
+	brokerMu.Lock()
+	defer brokerMu.Unlock()
+
+	subscriptionsMu.Lock()
+	topics := make([]string, 0, len(subscriptions))
+	for topic := range subscriptions {
+		topics = append(topics, topic)
+	}
+	subscriptionsMu.Unlock()
+
+	for _, topic := range topics {
+		if err := waitToken(client.Subscribe(topic, 0, dispatch(topic))); err != nil {
+			log.Printf("Failed to resubscribe to topic %s: %v", topic, err)
+		}
+	}
+}
+
+// Subscribe 订阅主题并注册处理函数，返回取消该处理函数的函数，
+// 主题上最后一个处理函数取消时才向服务器取消订阅
+func Subscribe(topic string, handler MQTT.MessageHandler) (func(), error) {
+	brokerMu.Lock()
+	defer brokerMu.Unlock()
+
+	subscriptionsMu.Lock()
+	handlers, subscribed := subscriptions[topic]
+	if !subscribed {
+		handlers = make(map[int]MQTT.MessageHandler)
+		subscriptions[topic] = handlers
+	}
+	nextHandlerID++
+	id := nextHandlerID
+	handlers[id] = handler
+	subscriptionsMu.Unlock()
+
+	if !subscribed {
+		if err := waitToken(Client.Subscribe(topic, 0, dispatch(topic))); err != nil {
+			subscriptionsMu.Lock()
+			delete(handlers, id)
+			if len(handlers) == 0 {
+				delete(subscriptions, topic)
+			}
+			subscriptionsMu.Unlock()
+			return nil, err
+		}
+	}
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			brokerMu.Lock()
+			defer brokerMu.Unlock()
+
+			subscriptionsMu.Lock()
+			delete(handlers, id)
+			current, ok := subscriptions[topic]
+			last := ok && len(current) == 0
+			if last {
+				delete(subscriptions, topic)
+			}
+			subscriptionsMu.Unlock()
+
+			if last {
+				if err := waitToken(Client.Unsubscribe(topic)); err != nil {
+					log.Printf("Failed to unsubscribe from topic %s: %v", topic, err)
+				}
+			}
+		})
+	}
+	return unsubscribe, nil
+}
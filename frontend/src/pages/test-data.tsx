@@ -117,7 +117,7 @@ export default function TestDataPage() {
           // 创建Alert数据
           const alertData = {
             device_id: device.ID,
-            type: '1', //对应message-type-config的id
+            type: '1', // 轨迹点，解析配置按设备绑定选择
             message: '轨迹点',
             raw_data: parsedData.data[i],
             level: 'low',
@@ -112,6 +112,7 @@ export const apiService = {
     message: string;
     level: string;
     raw_data: string;
+    config_id?: number;
   }) => api.post<ApiResponse<Alert>>('/alerts', alertData),
 
   markAlertAsRead: (id: number) => api.put<ApiResponse>(`/alerts/${id}/read`),